@@ -0,0 +1,591 @@
+package cli
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/export"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/ipfile"
+	"github.com/alexanderkarlis/sw-dnsbl/maillog"
+)
+
+// jobPollInterval is how often `job -wait` asks for the job's status
+const jobPollInterval = time.Second
+
+// errNoServer is returned by commands that need a running server
+var errNoServer = errors.New("needs a running server, set -server or SWDNSBL_SERVER")
+
+// commands are the subcommands Run knows, by name
+var commands = map[string]func(args []string, stdout io.Writer) error{
+	"login":   login,
+	"check":   check,
+	"enqueue": enqueue,
+	"job":     job,
+	"export":  exportZone,
+	"records": records,
+	"ingest":  ingest,
+	"migrate": migrate,
+	"backup":  backup,
+	"restore": restore,
+}
+
+// Run function runs the subcommand args[0] with the rest of args as its
+// arguments, writing its output to stdout. It returns false, and runs
+// nothing, when args[0] isn't a subcommand.
+func Run(args []string, stdout io.Writer) (bool, error) {
+	if len(args) == 0 {
+		return false, nil
+	}
+	cmd, ok := commands[args[0]]
+	if !ok {
+		return false, nil
+	}
+	return true, cmd(args[1:], stdout)
+}
+
+// options are the flags every subcommand shares
+type options struct {
+	server string
+	token  string
+	output string
+}
+
+func (o *options) register(flags *flag.FlagSet) {
+	flags.StringVar(&o.server, "server", os.Getenv("SWDNSBL_SERVER"), "url of a running sw-dnsbl, e.g. http://localhost:8080. Commands that can run locally do so when it's empty")
+	flags.StringVar(&o.token, "token", os.Getenv("SWDNSBL_TOKEN"), "bearer token, defaults to the one saved by login")
+}
+
+func (o *options) registerOutput(flags *flag.FlagSet) {
+	o.register(flags)
+	flags.StringVar(&o.output, "output", OutputTable, "output format: table, json or csv")
+}
+
+// client returns a client for the server, with the saved token unless one
+// was given
+func (o *options) client() (*Client, error) {
+	if o.server == "" {
+		return nil, errNoServer
+	}
+	token := o.token
+	if token == "" {
+		b, err := ioutil.ReadFile(tokenFile())
+		if err != nil {
+			return nil, fmt.Errorf("no token, run `sw-dnsbl login` first: %s", err)
+		}
+		token = strings.TrimSpace(string(b))
+	}
+	return NewClient(o.server, token), nil
+}
+
+// tokenFile is where login saves the token, SWDNSBL_TOKEN_FILE or
+// sw-dnsbl/token in the user's config dir
+func tokenFile() string {
+	if path := os.Getenv("SWDNSBL_TOKEN_FILE"); path != "" {
+		return path
+	}
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		dir = "."
+	}
+	return filepath.Join(dir, "sw-dnsbl", "token")
+}
+
+// login runs `sw-dnsbl login -server url -u user -p password`
+func login(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("login", flag.ContinueOnError)
+	o.register(flags)
+	username := flags.String("u", "", "username")
+	password := flags.String("p", "", "password")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if o.server == "" {
+		return errNoServer
+	}
+
+	token, err := NewClient(o.server, "").Login(*username, *password)
+	if err != nil {
+		return err
+	}
+	path := tokenFile()
+	if err = os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	if err = ioutil.WriteFile(path, []byte(token+"\n"), 0600); err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "token saved to %s\n", path)
+	return nil
+}
+
+// check runs `sw-dnsbl check [-f file] ip...`, against the server's checkIP
+// query or, without a server, the configured lists from here
+func check(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("check", flag.ContinueOnError)
+	o.registerOutput(flags)
+	file := flags.String("f", "", "file with one ip per line, - for stdin")
+	lists := flags.String("lists", "", "comma separated blocklists, default the configured ones")
+	timeout := flags.Duration("timeout", dnsbl.DefaultCheckTimeout, "deadline for the lookups of each ip")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ips, err := readIPs(flags.Args(), *file)
+	if err != nil {
+		return err
+	}
+	var listNames []string
+	if *lists != "" {
+		listNames = strings.Split(*lists, ",")
+	}
+
+	var results []*model.ListResult
+	if o.server == "" {
+		checker := dnsbl.NewConfiguredChecker(config.GetConfig())
+		if listNames != nil {
+			checker.Lists = listNames
+		}
+		for _, ip := range ips {
+			ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+			checked, err := checker.Check(ctx, []string{ip})
+			cancel()
+			if err != nil && err != context.DeadlineExceeded {
+				return err
+			}
+			results = append(results, checked[0].Results...)
+		}
+	} else {
+		client, err := o.client()
+		if err != nil {
+			return err
+		}
+		for _, ip := range ips {
+			checked, err := client.CheckIP(ip, listNames)
+			if err != nil {
+				return fmt.Errorf("%s: %s", ip, err)
+			}
+			results = append(results, checked...)
+		}
+	}
+	return resultsTable(results).write(stdout, o.output)
+}
+
+// enqueue runs `sw-dnsbl enqueue [-f file] ip...` on the server
+func enqueue(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("enqueue", flag.ContinueOnError)
+	o.registerOutput(flags)
+	file := flags.String("f", "", "file with one ip per line, - for stdin")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	ips, err := readIPs(flags.Args(), *file)
+	if err != nil {
+		return err
+	}
+	client, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	status, err := client.Enqueue(ips)
+	if err != nil {
+		return err
+	}
+	return jobTable(status).write(stdout, o.output)
+}
+
+// job runs `sw-dnsbl job [-wait] id` on the server
+func job(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("job", flag.ContinueOnError)
+	o.registerOutput(flags)
+	wait := flags.Bool("wait", false, "wait until the job is done")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sw-dnsbl job [-wait] <id>")
+	}
+	client, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	status, err := client.Job(flags.Arg(0))
+	for err == nil && *wait && status.State != dnsbl.JobDone {
+		time.Sleep(jobPollInterval)
+		status, err = client.Job(flags.Arg(0))
+	}
+	if err != nil {
+		return err
+	}
+	return jobTable(status).write(stdout, o.output)
+}
+
+// exportZone runs `sw-dnsbl export`, writing the current listings as an
+// rbldnsd or RPZ zone from the server's /export endpoint or, without a
+// server, straight from the database
+func exportZone(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("export", flag.ContinueOnError)
+	o.register(flags)
+	format := flags.String("format", export.FormatRbldnsd, "zone format, rbldnsd or rpz")
+	lists := flags.String("list", "", "comma separated blocklists to export, default all")
+	categories := flags.String("category", "", "comma separated categories to export, default all")
+	minScore := flags.Int("min-score", 0, "minimum score of an exported ip")
+	zone := flags.String("zone", "", "zone name written to the SOA, default DNSBL_ZONE")
+	ttl := flags.Int("ttl", -1, "record ttl in seconds, default DNS_SERVER_TTL")
+	out := flags.String("o", "-", "output file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	w, closeOutput, err := output(*out, stdout)
+	if err != nil {
+		return err
+	}
+	defer closeOutput()
+
+	if o.server != "" {
+		client, err := o.client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		setParam(query, "list", *lists)
+		setParam(query, "category", *categories)
+		setParam(query, "zone", *zone)
+		if *minScore != 0 {
+			query.Set("min_score", fmt.Sprint(*minScore))
+		}
+		if *ttl >= 0 {
+			query.Set("ttl", fmt.Sprint(*ttl))
+		}
+		return client.Export(*format, query, w)
+	}
+
+	config := config.GetConfig()
+	filter := export.Filter{MinScore: *minScore}
+	if *lists != "" {
+		filter.Lists = strings.Split(*lists, ",")
+	}
+	if *categories != "" {
+		filter.Categories = strings.Split(*categories, ",")
+	}
+	zoneOpts := export.Options{Zone: config.DNSBLZone, Serial: uint32(time.Now().Unix()), TTL: config.DNSServerTTL}
+	if *zone != "" {
+		zoneOpts.Zone = *zone
+	}
+	if *ttl >= 0 {
+		zoneOpts.TTL = *ttl
+	}
+
+	db, err := openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	listings, err := export.Listings(db, filter, config.ListWeights)
+	if err != nil {
+		return err
+	}
+	if err = export.Write(w, *format, listings, zoneOpts); err != nil {
+		return fmt.Errorf("%s: %s", *format, err)
+	}
+	return nil
+}
+
+// records runs `sw-dnsbl records`, writing the stored records as csv, json
+// or ndjson from the server's /export/records endpoint or, without a server,
+// straight from the database
+func records(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("records", flag.ContinueOnError)
+	o.register(flags)
+	format := flags.String("format", export.FormatCSV, "csv, json or ndjson")
+	listed := flags.Bool("listed", false, "only ips listed on a blocklist")
+	lists := flags.String("list", "", "comma separated blocklists the ips were checked against, or with -listed are listed on")
+	since := flags.String("since", "", "only records updated since, unix seconds, an RFC 3339 time or a date")
+	out := flags.String("o", "-", "output file, - for stdout")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	updatedSince, err := export.ParseSince(*since)
+	if err != nil {
+		return err
+	}
+
+	w, closeOutput, err := output(*out, stdout)
+	if err != nil {
+		return err
+	}
+	defer closeOutput()
+
+	if o.server != "" {
+		client, err := o.client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		setParam(query, "list", *lists)
+		setParam(query, "since", *since)
+		if *listed {
+			query.Set("listed", "true")
+		}
+		return client.Records(*format, query, w)
+	}
+
+	filter := database.RecordFilter{Listed: *listed, UpdatedSince: updatedSince}
+	if *lists != "" {
+		filter.Lists = strings.Split(*lists, ",")
+	}
+	db, err := openDb()
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if err = export.WriteRecords(w, *format, db, filter); err != nil {
+		return fmt.Errorf("%s: %s", *format, err)
+	}
+	return nil
+}
+
+// ingest runs `sw-dnsbl ingest file...`, following postfix or exim logs, or
+// stdin for -, and queuing the ips of connecting and rejected clients on the
+// server. It runs until interrupted, or stdin ends.
+func ingest(args []string, stdout io.Writer) error {
+	var o options
+	flags := flag.NewFlagSet("ingest", flag.ContinueOnError)
+	o.register(flags)
+	window := flags.Duration("window", time.Hour, "queue an ip at most once per window")
+	fromStart := flags.Bool("from-start", false, "read the files from their start instead of their end")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() == 0 {
+		return errors.New("usage: sw-dnsbl ingest [-window 1h] [-from-start] <file|->...")
+	}
+	client, err := o.client()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(signals)
+	go func() {
+		select {
+		case <-signals:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	ingester := maillog.NewIngester(func(ips []string) (string, error) {
+		status, err := client.Enqueue(ips)
+		return status.ID, err
+	}, *window)
+	flushed := make(chan struct{})
+	go func() {
+		ingester.Run(ctx)
+		close(flushed)
+	}()
+
+	errs := make(chan error, flags.NArg())
+	for _, path := range flags.Args() {
+		go func(path string) {
+			if err := ingester.Ingest(ctx, path, *fromStart); err != nil {
+				errs <- fmt.Errorf("%s: %s", path, err)
+				return
+			}
+			errs <- nil
+		}(path)
+	}
+	for range flags.Args() {
+		if e := <-errs; e != nil && err == nil {
+			err = e
+			cancel()
+		}
+	}
+	cancel()
+	<-flushed
+
+	fmt.Fprintf(stdout, "queued %d ips\n", ingester.Queued())
+	return err
+}
+
+// migrate runs `sw-dnsbl migrate`, bringing the configured database's schema
+// up to date, or with -status only showing its version
+func migrate(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	status := flags.Bool("status", false, "show the schema version without migrating")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	db, err := openSQL("migrate")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	if *status {
+		version, err := db.SchemaVersion()
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "schema at version %d (latest %d)\n", version, database.LatestSchemaVersion())
+		return nil
+	}
+	from, to, err := db.Migrate()
+	if err != nil {
+		return err
+	}
+	if from == to {
+		fmt.Fprintf(stdout, "schema already at version %d\n", to)
+		return nil
+	}
+	fmt.Fprintf(stdout, "migrated schema from version %d to %d\n", from, to)
+	return nil
+}
+
+// backup runs `sw-dnsbl backup [-gzip] path`, writing a consistent snapshot
+// of the sqlite3 database to path; the server can keep running meanwhile
+func backup(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("backup", flag.ContinueOnError)
+	compress := flags.Bool("gzip", false, "gzip the snapshot")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sw-dnsbl backup [-gzip] path")
+	}
+
+	db, err := openSQL("backup")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	info, err := db.Backup(flags.Arg(0), *compress)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "backed up schema version %d to %s, %d bytes\n", info.SchemaVersion, info.Path, info.Bytes)
+	return nil
+}
+
+// restore runs `sw-dnsbl restore path`, replacing the contents of the sqlite3
+// database with the snapshot in path once it checks out and is migrated
+func restore(args []string, stdout io.Writer) error {
+	flags := flag.NewFlagSet("restore", flag.ContinueOnError)
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: sw-dnsbl restore path")
+	}
+
+	db, err := openSQL("restore")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	from, to, err := db.Restore(flags.Arg(0))
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "restored schema version %d from %s\n", from, flags.Arg(0))
+	if from < to {
+		fmt.Fprintf(stdout, "migrated it to version %d\n", to)
+	}
+	return nil
+}
+
+// openSQL opens the configured database for cmd without touching its schema;
+// it is never wiped
+func openSQL(cmd string) (*database.Db, error) {
+	c := config.GetConfig()
+	if c.DbDriver == config.DbDriverMemory {
+		return nil, fmt.Errorf("%s needs a database, DB_DRIVER is %s", cmd, c.DbDriver)
+	}
+	c.PersistDb = true
+	return database.Open(c)
+}
+
+// output returns stdout for "-", else the created file path, and a func
+// closing it
+func output(path string, stdout io.Writer) (io.Writer, func() error, error) {
+	if path == "-" {
+		return stdout, func() error { return nil }, nil
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	return f, f.Close, nil
+}
+
+// openDb opens the configured database for reading; it is never wiped or
+// migrated, a schema behind this version is left to `sw-dnsbl migrate`
+func openDb() (database.Store, error) {
+	config := config.GetConfig()
+	config.PersistDb = true
+	config.SkipMigrate = true
+	return database.NewStore(config)
+}
+
+// readIPs returns args followed by the ips in file, a text, csv or ndjson file
+// as read by ipfile.Scan
+func readIPs(args []string, file string) ([]string, error) {
+	ips := append([]string{}, args...)
+	if file != "" {
+		var r io.Reader = os.Stdin
+		if file != "-" {
+			f, err := os.Open(file)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			r = f
+		}
+		err := ipfile.Scan(r, ipfile.Detect(file, ""), func(ip string) error {
+			ips = append(ips, ip)
+			return nil
+		})
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, errors.New("no ips given")
+	}
+	return ips, nil
+}
+
+func setParam(query url.Values, name, value string) {
+	if value != "" {
+		query.Set(name, value)
+	}
+}
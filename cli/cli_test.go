@@ -0,0 +1,270 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/export"
+	"github.com/alexanderkarlis/sw-dnsbl/graph"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/generated"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+	"github.com/alexanderkarlis/sw-dnsbl/rest"
+)
+
+func TestCommands(t *testing.T) {
+	dir, err := ioutil.TempDir("", "cli")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	zonePath := filepath.Join(dir, "internal.zone")
+	require.Equal(t, nil, ioutil.WriteFile(zonePath, []byte("127.0.0.5 :127.0.0.5:internal listing\n"), 0644))
+	ipsPath := filepath.Join(dir, "ips.txt")
+	require.Equal(t, nil, ioutil.WriteFile(ipsPath, []byte("# suspects\n127.0.0.5\n\n127.0.0.6 # maybe\n"), 0644))
+
+	os.Setenv("SWDNSBL_SERVER", "")
+	os.Setenv("SWDNSBL_TOKEN", "")
+	os.Setenv("SWDNSBL_TOKEN_FILE", filepath.Join(dir, "token"))
+	os.Setenv("DB_PATH", filepath.Join(dir, "swdnsbl.db"))
+	os.Setenv("PERSIST_DB", "true")
+	os.Setenv("DNS_BLOCKLIST", "")
+	os.Setenv("ZONE_FILES", "internal.bl:ip4set:"+zonePath)
+	defer os.Unsetenv("ZONE_FILES")
+
+	// a server without lists, so jobs finish without lookups, and with stored
+	// results for checkIP
+	conf := config.GetConfig()
+	db, err := database.NewDb(conf)
+	require.Equal(t, nil, err)
+	defer db.Close()
+	require.Equal(t, nil, db.UpsertListResult(&model.ListResult{
+		IPAddress:    "127.0.0.2",
+		Blocklist:    "zen.spamhaus.org",
+		Listed:       true,
+		ResponseCode: "127.0.0.2",
+		Category:     dnsbl.CategorySpam,
+		CheckedAt:    int(time.Now().Unix()),
+	}))
+	require.Equal(t, nil, db.UpsertRecord(&model.Record{
+		IPAddress:    "127.0.0.2",
+		UUID:         "uuid-2",
+		ResponseCode: "127.0.0.2",
+		CreatedAt:    100,
+		UpdatedAt:    200,
+	}))
+
+	consumer := dnsbl.NewConsumer(db, &config.APIConfig{WorkerPoolsize: 10, QueuePolicy: config.QueuePolicyReject})
+	resolver := graph.Resolver{Database: db, Consumer: consumer}
+	router := mux.NewRouter()
+	router.Use(middleware.Middleware())
+	router.Handle("/graphql", handler.NewDefaultServer(generated.NewExecutableSchema(generated.Config{Resolvers: &resolver})))
+	router.Handle("/export/{format}", middleware.RequireAuth(export.Handler(db, conf)))
+	router.Handle("/export/records/{format}", middleware.RequireAuth(export.RecordsHandler(db)))
+	(&rest.API{Database: db, Consumer: consumer}).Register(router)
+	server := httptest.NewServer(router)
+	defer server.Close()
+
+	run := func(args ...string) (string, error) {
+		var buf bytes.Buffer
+		ran, err := Run(args, &buf)
+		require.Equal(t, true, ran)
+		return buf.String(), err
+	}
+
+	t.Run("not_a_command", func(t *testing.T) {
+		ran, err := Run([]string{"serve"}, ioutil.Discard)
+		assert.Equal(t, false, ran)
+		assert.Equal(t, nil, err)
+		ran, _ = Run(nil, ioutil.Discard)
+		assert.Equal(t, false, ran)
+	})
+
+	t.Run("check_local", func(t *testing.T) {
+		out, err := run("check", "-output", "csv", "-f", ipsPath)
+		require.Equal(t, nil, err)
+		assert.Equal(t, ""+
+			"IP,LIST,LISTED,CODE,CATEGORY,REASON,ERROR\n"+
+			"127.0.0.5,internal.bl,true,127.0.0.5,local,internal listing,\n"+
+			"127.0.0.6,internal.bl,false,NXDOMAIN,,,\n", out)
+
+		_, err = run("check")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("needs_server_or_token", func(t *testing.T) {
+		_, err := run("enqueue", "127.0.0.2")
+		assert.Equal(t, errNoServer, err)
+		_, err = run("job", "-server", server.URL, "some-id")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("login", func(t *testing.T) {
+		_, err := run("login", "-server", server.URL, "-u", "secureworks", "-p", "nope")
+		assert.NotEqual(t, nil, err)
+
+		out, err := run("login", "-server", server.URL, "-u", "secureworks", "-p", "supersecret")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "token saved to "+filepath.Join(dir, "token")+"\n", out)
+		token, err := ioutil.ReadFile(filepath.Join(dir, "token"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, true, strings.HasPrefix(string(token), "Bearer "))
+	})
+
+	t.Run("check_remote", func(t *testing.T) {
+		out, err := run("check", "-server", server.URL, "-lists", "zen.spamhaus.org", "-output", "json", "127.0.0.2")
+		require.Equal(t, nil, err)
+		var results []model.ListResult
+		require.Equal(t, nil, json.Unmarshal([]byte(out), &results))
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, true, results[0].Listed)
+		assert.Equal(t, true, results[0].Cached)
+		assert.InDelta(t, time.Now().Unix(), results[0].CheckedAt, 60)
+
+		_, err = run("check", "-server", server.URL, "nope")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("enqueue_and_job", func(t *testing.T) {
+		out, err := run("enqueue", "-server", server.URL, "-output", "json", "-f", ipsPath)
+		require.Equal(t, nil, err)
+		var status dnsbl.JobStatus
+		require.Equal(t, nil, json.Unmarshal([]byte(out), &status))
+		assert.Equal(t, []string{"127.0.0.5", "127.0.0.6"}, status.IPs)
+
+		out, err = run("job", "-server", server.URL, "-wait", "-output", "csv", status.ID)
+		require.Equal(t, nil, err)
+		lines := strings.Split(strings.TrimSpace(out), "\n")
+		require.Equal(t, 2, len(lines))
+		assert.Equal(t, true, strings.HasPrefix(lines[1], status.ID+",done,2,2,"))
+	})
+
+	t.Run("export", func(t *testing.T) {
+		out, err := run("export", "-server", server.URL, "-format", "rpz", "-zone", "rpz.example.com", "-category", "spam")
+		require.Equal(t, nil, err)
+		assert.Contains(t, out, "$ORIGIN rpz.example.com.\n")
+		assert.Contains(t, out, "\n32.2.0.0.127.rpz-ip CNAME . ; zen.spamhaus.org\n")
+
+		zonePath := filepath.Join(dir, "export.zone")
+		_, err = run("export", "-ttl", "60", "-o", zonePath)
+		require.Equal(t, nil, err)
+		zone, err := ioutil.ReadFile(zonePath)
+		require.Equal(t, nil, err)
+		assert.Contains(t, string(zone), "$TTL 60\n127.0.0.2 :127.0.0.2:listed on zen.spamhaus.org (127.0.0.2)\n")
+	})
+
+	t.Run("records", func(t *testing.T) {
+		out, err := run("records", "-server", server.URL, "-listed", "-since", "150")
+		require.Equal(t, nil, err)
+		assert.Equal(t, ""+
+			"ip_address,uuid,created_at,updated_at,response_code,lists\n"+
+			"127.0.0.2,uuid-2,100,200,127.0.0.2,zen.spamhaus.org\n", out)
+
+		out, err = run("records", "-format", "ndjson", "-list", "zen.spamhaus.org")
+		require.Equal(t, nil, err)
+		assert.Equal(t, `{"uuid":"uuid-2","created_at":100,"updated_at":200,"response_code":"127.0.0.2","ip_address":"127.0.0.2","error":null,"lists":["zen.spamhaus.org"]}`+"\n", out)
+
+		_, err = run("records", "-since", "soon")
+		assert.NotEqual(t, nil, err)
+		_, err = run("records", "-format", "xml")
+		assert.NotEqual(t, nil, err)
+		// reading never migrates the database
+		os.Setenv("DB_PATH", filepath.Join(dir, "unmigrated.db"))
+		defer os.Setenv("DB_PATH", filepath.Join(dir, "swdnsbl.db"))
+		_, err = run("records")
+		assert.NotEqual(t, nil, err)
+		out, err = run("migrate", "-status")
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("schema at version 0 (latest %d)\n", database.LatestSchemaVersion()), out)
+	})
+
+	t.Run("ingest", func(t *testing.T) {
+		logPath := filepath.Join(dir, "mail.log")
+		require.Equal(t, nil, ioutil.WriteFile(logPath, []byte(""+
+			"Dec  1 10:00:00 mx1 postfix/smtpd[1]: connect from unknown[192.0.2.1]\n"+
+			"Dec  1 10:00:01 mx1 postfix/smtpd[1]: NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 blocked\n"+
+			"Dec  1 10:00:02 mx1 postfix/smtpd[2]: connect from unknown[192.0.2.2]\n"), 0644))
+		stdin, err := os.Open(logPath)
+		require.Equal(t, nil, err)
+		defer stdin.Close()
+		os.Stdin, stdin = stdin, os.Stdin
+		defer func() { os.Stdin = stdin }()
+
+		out, err := run("ingest", "-server", server.URL, "-")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "queued 2 ips\n", out)
+
+		_, err = run("ingest", "-server", server.URL)
+		assert.NotEqual(t, nil, err)
+		_, err = run("ingest", "-server", server.URL, filepath.Join(dir, "missing.log"))
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("migrate", func(t *testing.T) {
+		latest := database.LatestSchemaVersion()
+		out, err := run("migrate", "-status")
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("schema at version %d (latest %d)\n", latest, latest), out)
+		out, err = run("migrate")
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("schema already at version %d\n", latest), out)
+
+		os.Setenv("DB_PATH", filepath.Join(dir, "fresh.db"))
+		defer os.Setenv("DB_PATH", filepath.Join(dir, "swdnsbl.db"))
+		out, err = run("migrate", "-status")
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("schema at version 0 (latest %d)\n", latest), out)
+		out, err = run("migrate")
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("migrated schema from version 0 to %d\n", latest), out)
+
+		defer os.Setenv("DB_DRIVER", os.Getenv("DB_DRIVER"))
+		os.Setenv("DB_DRIVER", config.DbDriverMemory)
+		_, err = run("migrate")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("backup_restore", func(t *testing.T) {
+		latest := database.LatestSchemaVersion()
+		snapshot := filepath.Join(dir, "snapshot.db.gz")
+		out, err := run("backup", "-gzip", snapshot)
+		require.Equal(t, nil, err)
+		fi, err := os.Stat(snapshot)
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("backed up schema version %d to %s, %d bytes\n", latest, snapshot, fi.Size()), out)
+
+		os.Setenv("DB_PATH", filepath.Join(dir, "restored.db"))
+		defer os.Setenv("DB_PATH", filepath.Join(dir, "swdnsbl.db"))
+		out, err = run("restore", snapshot)
+		require.Equal(t, nil, err)
+		assert.Equal(t, fmt.Sprintf("restored schema version %d from %s\n", latest, snapshot), out)
+		restored, err := database.NewDb(config.GetConfig())
+		require.Equal(t, nil, err)
+		defer restored.Close()
+		r, err := restored.QueryRecord("127.0.0.2")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "uuid-2", r.UUID)
+
+		_, err = run("restore", ipsPath)
+		assert.NotEqual(t, nil, err)
+		_, err = run("backup")
+		assert.NotEqual(t, nil, err)
+		_, err = run("restore")
+		assert.NotEqual(t, nil, err)
+	})
+}
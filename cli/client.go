@@ -0,0 +1,206 @@
+package cli
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Client talks to a running sw-dnsbl server, over GraphQL where only GraphQL
+// has the operation and over the /v1 REST API otherwise
+type Client struct {
+	URL        string
+	Token      string
+	HTTPClient *http.Client
+}
+
+// NewClient function returns a client for the server at serverURL, e.g.
+// http://localhost:8080, authenticating with token
+func NewClient(serverURL, token string) *Client {
+	return &Client{
+		URL:        strings.TrimSuffix(serverURL, "/"),
+		Token:      token,
+		HTTPClient: &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// Login function signs in with the createToken mutation and returns the
+// bearer token
+func (c *Client) Login(username, password string) (string, error) {
+	var resp struct {
+		CreateToken model.Token `json:"createToken"`
+	}
+	err := c.graphql(
+		`mutation($username: String!, $password: String!) {
+			createToken(data: {username: $username, password: $password}) { bearer_token }
+		}`,
+		map[string]interface{}{"username": username, "password": password},
+		&resp,
+	)
+	if err != nil {
+		return "", err
+	}
+	return resp.CreateToken.BearerToken, nil
+}
+
+// CheckIP function runs the checkIP query for ip against lists, the server's
+// configured lists if empty
+func (c *Client) CheckIP(ip string, lists []string) ([]*model.ListResult, error) {
+	// checked_at comes as a DateTime, the model keeps unix time
+	var resp struct {
+		CheckIP []struct {
+			*model.ListResult
+			CheckedAt time.Time `json:"checked_at"`
+		} `json:"checkIP"`
+	}
+	vars := map[string]interface{}{"ip": ip}
+	if len(lists) > 0 {
+		vars["lists"] = lists
+	}
+	err := c.graphql(
+		`query($ip: String!, $lists: [String!]) {
+			checkIP(ip: $ip, lists: $lists) {
+				ip_address blocklist listed response_code reason category error cached checked_at
+			}
+		}`,
+		vars,
+		&resp,
+	)
+	results := make([]*model.ListResult, len(resp.CheckIP))
+	for i, r := range resp.CheckIP {
+		results[i] = r.ListResult
+		results[i].CheckedAt = int(r.CheckedAt.Unix())
+	}
+	return results, err
+}
+
+// Enqueue function queues ips with POST /v1/jobs
+func (c *Client) Enqueue(ips []string) (*dnsbl.JobStatus, error) {
+	var status dnsbl.JobStatus
+	err := c.rest(http.MethodPost, "/v1/jobs", map[string][]string{"ips": ips}, &status)
+	return &status, err
+}
+
+// Job function returns the status of job id from GET /v1/jobs/{id}
+func (c *Client) Job(id string) (*dnsbl.JobStatus, error) {
+	var status dnsbl.JobStatus
+	err := c.rest(http.MethodGet, "/v1/jobs/"+url.PathEscape(id), nil, &status)
+	return &status, err
+}
+
+// Export function copies the zone from GET /export/{format} to w
+func (c *Client) Export(format string, query url.Values, w io.Writer) error {
+	return c.download("/export/"+url.PathEscape(format)+"?"+query.Encode(), w)
+}
+
+// Records function copies the records from GET /export/records/{format} to w
+func (c *Client) Records(format string, query url.Values, w io.Writer) error {
+	return c.download("/export/records/"+url.PathEscape(format)+"?"+query.Encode(), w)
+}
+
+// download copies the body of GET path to w
+func (c *Client) download(path string, w io.Writer) error {
+	req, err := c.request(http.MethodGet, path, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return responseError(resp)
+	}
+	_, err = io.Copy(w, resp.Body)
+	return err
+}
+
+// graphql posts query to /graphql and decodes its data into out
+func (c *Client) graphql(query string, vars map[string]interface{}, out interface{}) error {
+	body := map[string]interface{}{"query": query, "variables": vars}
+	var resp struct {
+		Data   json.RawMessage `json:"data"`
+		Errors []struct {
+			Message string `json:"message"`
+		} `json:"errors"`
+	}
+	if err := c.rest(http.MethodPost, "/graphql", body, &resp); err != nil {
+		return err
+	}
+	if len(resp.Errors) > 0 {
+		var messages []string
+		for _, e := range resp.Errors {
+			messages = append(messages, e.Message)
+		}
+		return errors.New(strings.Join(messages, "; "))
+	}
+	return json.Unmarshal(resp.Data, out)
+}
+
+// rest sends body as json to path and decodes the json response into out
+func (c *Client) rest(method, path string, body, out interface{}) error {
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := c.request(method, path, r)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return responseError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// request returns a request to path carrying the bearer token
+func (c *Client) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.URL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	if c.Token != "" {
+		token := c.Token
+		if !strings.HasPrefix(token, "Bearer ") {
+			token = "Bearer " + token
+		}
+		req.Header.Set("Authorization", token)
+	}
+	return req, nil
+}
+
+// responseError turns a failed response into an error, using the message of
+// a REST error body when there is one
+func responseError(resp *http.Response) error {
+	b, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+	var apiErr struct {
+		Error string `json:"error"`
+	}
+	msg := strings.TrimSpace(string(b))
+	if json.Unmarshal(b, &apiErr) == nil && apiErr.Error != "" {
+		msg = apiErr.Error
+	}
+	return fmt.Errorf("%s: %s", resp.Status, msg)
+}
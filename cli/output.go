@@ -0,0 +1,98 @@
+package cli
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Output formats
+const (
+	OutputTable = "table"
+	OutputJSON  = "json"
+	OutputCSV   = "csv"
+)
+
+// table is command output that can be written in any of the output formats;
+// value is what the json output encodes
+type table struct {
+	header []string
+	rows   [][]string
+	value  interface{}
+}
+
+// write writes t to w in format
+func (t *table) write(w io.Writer, format string) error {
+	switch format {
+	case OutputJSON:
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(t.value)
+	case OutputCSV:
+		cw := csv.NewWriter(w)
+		cw.Write(t.header)
+		cw.WriteAll(t.rows)
+		return cw.Error()
+	case OutputTable:
+		tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(tw, strings.Join(t.header, "\t"))
+		for _, row := range t.rows {
+			fmt.Fprintln(tw, strings.Join(row, "\t"))
+		}
+		return tw.Flush()
+	}
+	return fmt.Errorf("unknown output format %s, use table, json or csv", format)
+}
+
+// resultsTable lists one row per ip and list
+func resultsTable(results []*model.ListResult) *table {
+	t := &table{
+		header: []string{"IP", "LIST", "LISTED", "CODE", "CATEGORY", "REASON", "ERROR"},
+		value:  results,
+	}
+	if results == nil {
+		t.value = []*model.ListResult{}
+	}
+	for _, r := range results {
+		t.rows = append(t.rows, []string{
+			r.IPAddress,
+			r.Blocklist,
+			strconv.FormatBool(r.Listed),
+			r.ResponseCode,
+			r.Category,
+			deref(r.Reason),
+			deref(r.Error),
+		})
+	}
+	return t
+}
+
+// jobTable lists a job on one row
+func jobTable(j *dnsbl.JobStatus) *table {
+	return &table{
+		header: []string{"ID", "STATE", "IPS", "CHECKED", "CREATED_AT", "FINISHED_AT"},
+		rows: [][]string{{
+			j.ID,
+			j.State,
+			strconv.Itoa(len(j.IPs)),
+			strconv.Itoa(j.Checked),
+			strconv.Itoa(j.CreatedAt),
+			strconv.Itoa(j.FinishedAt),
+		}},
+		value: j,
+	}
+}
+
+func deref(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
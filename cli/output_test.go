@@ -0,0 +1,53 @@
+package cli
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestOutput(t *testing.T) {
+	reason := "listed, for testing"
+	results := []*model.ListResult{
+		{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", Reason: &reason, Category: dnsbl.CategorySpam},
+		{IPAddress: "127.0.0.1", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN"},
+	}
+
+	t.Run("table", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, resultsTable(results).write(&buf, OutputTable))
+		assert.Equal(t, ""+
+			"IP         LIST              LISTED  CODE       CATEGORY  REASON               ERROR\n"+
+			"127.0.0.2  zen.spamhaus.org  true    127.0.0.2  spam      listed, for testing  \n"+
+			"127.0.0.1  zen.spamhaus.org  false   NXDOMAIN                                  \n", buf.String())
+	})
+
+	t.Run("csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, resultsTable(results).write(&buf, OutputCSV))
+		assert.Equal(t, ""+
+			"IP,LIST,LISTED,CODE,CATEGORY,REASON,ERROR\n"+
+			"127.0.0.2,zen.spamhaus.org,true,127.0.0.2,spam,\"listed, for testing\",\n"+
+			"127.0.0.1,zen.spamhaus.org,false,NXDOMAIN,,,\n", buf.String())
+	})
+
+	t.Run("json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, jobTable(&dnsbl.JobStatus{ID: "job", State: dnsbl.JobDone, IPs: []string{"127.0.0.2"}, Checked: 1}).write(&buf, OutputJSON))
+		assert.JSONEq(t, `{"id": "job", "state": "done", "ips": ["127.0.0.2"], "checked": 1, "created_at": 0}`, buf.String())
+
+		buf.Reset()
+		require.Equal(t, nil, resultsTable(nil).write(&buf, OutputJSON))
+		assert.Equal(t, "[]\n", buf.String())
+	})
+
+	t.Run("unknown_format", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.NotEqual(t, nil, resultsTable(results).write(&buf, "yaml"))
+	})
+}
@@ -7,13 +7,54 @@ import (
 	"strings"
 )
 
+// What the consumer does with a job when its queue is full, see QUEUE_FULL_POLICY
+const (
+	// QueuePolicyReject fails the enqueue straight away
+	QueuePolicyReject = "reject"
+	// QueuePolicyBlock waits up to QUEUE_TIMEOUT_MS for room in the queue
+	QueuePolicyBlock = "block"
+	// QueuePolicySpill writes the job to QUEUE_SPILL_DIR to be queued later
+	QueuePolicySpill = "spill"
+)
+
+// Database backends, see DB_DRIVER
+const (
+	// DbDriverSQLite keeps the database in the DB_PATH file
+	DbDriverSQLite = "sqlite3"
+	// DbDriverMySQL connects to MySQL (or MariaDB)
+	DbDriverMySQL = "mysql"
+	// DbDriverPostgres connects to PostgreSQL
+	DbDriverPostgres = "postgres"
+	// DbDriverMemory keeps everything in memory, lost when the process exits
+	DbDriverMemory = "memory"
+)
+
+// redactedValue stands in for the credentials when the config is logged
+const redactedValue = "REDACTED"
+
 // APIConfig is the overtall config read from env vars
 type APIConfig struct {
 	AppPort, DbPath, DbPort, DbName string
+	DbDriver, DbHost, DbDSN         string
 	DbUser, DbPassword, LogFile     string
-	WorkerPoolsize                  int
-	DNSBlockList                    []string
-	PersistDb                       bool
+	QueuePolicy, QueueSpillDir      string
+	DNSServerPort, DNSBLZone        string
+	PolicyServerPort, GRPCPort      string
+	SyslogPort, BackupDir           string
+	WorkerPoolsize, CacheTTL        int
+	QueueTimeout, DNSServerTTL      int
+	PolicyRejectScore, DbFlushSize  int
+	DbFlushInterval, LookupTimeout  int
+	PolicyDeferScore, MailLogWindow int
+	SyslogWindow, PruneInterval     int
+	RecordRetentionDays             int
+	HistoryRetentionDays            int
+	DailyIPsRetentionDays           int
+	DNSBlockList, ZoneFiles         []string
+	MailLogFiles, SyslogExtractors  []string
+	AdminUsers                      []string
+	ListWeights                     map[string]int
+	PersistDb, SkipMigrate          bool
 }
 
 // GetConfig function gets the configuration for the app and sets
@@ -27,6 +68,60 @@ func GetConfig() *APIConfig {
 		workersize = 100
 	}
 
+	cacheTTL := os.Getenv("CACHE_TTL")
+	cacheTTLSecs, err := strconv.Atoi(cacheTTL)
+	if err != nil {
+		log.Println("Could not convert CACHE_TTL to an `int`. Defaulting to `3600`.")
+		cacheTTLSecs = 3600
+	}
+
+	queuePolicy := os.Getenv("QUEUE_FULL_POLICY")
+	switch queuePolicy {
+	case QueuePolicyReject, QueuePolicyBlock, QueuePolicySpill:
+	default:
+		log.Println("Could not get a known QUEUE_FULL_POLICY. Defaulting to `reject`.")
+		queuePolicy = QueuePolicyReject
+	}
+
+	queueTimeout := os.Getenv("QUEUE_TIMEOUT_MS")
+	queueTimeoutMs, err := strconv.Atoi(queueTimeout)
+	if err != nil {
+		log.Println("Could not convert QUEUE_TIMEOUT_MS to an `int`. Defaulting to `1000`.")
+		queueTimeoutMs = 1000
+	}
+
+	lookupTimeout := os.Getenv("LOOKUP_TIMEOUT_MS")
+	lookupTimeoutMs, err := strconv.Atoi(lookupTimeout)
+	if err != nil {
+		log.Println("Could not convert LOOKUP_TIMEOUT_MS to an `int`. Defaulting to `2000`.")
+		lookupTimeoutMs = 2000
+	}
+
+	dbDriver := os.Getenv("DB_DRIVER")
+	switch dbDriver {
+	case DbDriverSQLite, DbDriverMySQL, DbDriverPostgres, DbDriverMemory:
+	default:
+		log.Println("Could not get a known DB_DRIVER. Defaulting to `sqlite3`.")
+		dbDriver = DbDriverSQLite
+	}
+
+	queueSpillDir := os.Getenv("QUEUE_SPILL_DIR")
+	if queueSpillDir == "" {
+		queueSpillDir = "./spill"
+	}
+
+	backupDir := os.Getenv("BACKUP_DIR")
+	if backupDir == "" {
+		backupDir = "./backups"
+	}
+
+	adminUsers := []string{"secureworks"}
+	if adminEnv := os.Getenv("ADMIN_USERS"); adminEnv != "" {
+		adminUsers = strings.Split(adminEnv, ",")
+	} else {
+		log.Println("Could not get ADMIN_USERS. Defaulting to `secureworks`.")
+	}
+
 	dnsEnv := os.Getenv("DNS_BLOCKLIST")
 	dnsList := strings.Split(dnsEnv, ",")
 	if len(dnsList) == 0 {
@@ -34,6 +129,121 @@ func GetConfig() *APIConfig {
 		dnsList = []string{"zen.spamhaus.org"}
 	}
 
+	var zoneFiles []string
+	if zoneEnv := os.Getenv("ZONE_FILES"); zoneEnv != "" {
+		zoneFiles = strings.Split(zoneEnv, ",")
+	}
+
+	listWeights := map[string]int{}
+	if weightsEnv := os.Getenv("LIST_WEIGHTS"); weightsEnv != "" {
+		for _, pair := range strings.Split(weightsEnv, ",") {
+			parts := strings.SplitN(pair, "=", 2)
+			if len(parts) != 2 {
+				log.Printf("Could not parse LIST_WEIGHTS entry `%s`. Ignoring it.\n", pair)
+				continue
+			}
+			weight, err := strconv.Atoi(parts[1])
+			if err != nil {
+				log.Printf("Could not convert LIST_WEIGHTS weight of `%s` to an `int`. Ignoring it.\n", parts[0])
+				continue
+			}
+			listWeights[parts[0]] = weight
+		}
+	}
+
+	dnsServerTTL := os.Getenv("DNS_SERVER_TTL")
+	dnsServerTTLSecs, err := strconv.Atoi(dnsServerTTL)
+	if err != nil {
+		log.Println("Could not convert DNS_SERVER_TTL to an `int`. Defaulting to `300`.")
+		dnsServerTTLSecs = 300
+	}
+
+	dnsblZone := os.Getenv("DNSBL_ZONE")
+	if dnsblZone == "" {
+		dnsblZone = "dnsbl.local"
+	}
+
+	policyRejectScore := os.Getenv("POLICY_REJECT_SCORE")
+	policyRejectScoreInt, err := strconv.Atoi(policyRejectScore)
+	if err != nil {
+		log.Println("Could not convert POLICY_REJECT_SCORE to an `int`. Defaulting to `1`.")
+		policyRejectScoreInt = 1
+	}
+
+	policyDeferScore := os.Getenv("POLICY_DEFER_SCORE")
+	policyDeferScoreInt, err := strconv.Atoi(policyDeferScore)
+	if err != nil {
+		log.Println("Could not convert POLICY_DEFER_SCORE to an `int`. Defaulting to `0`.")
+		policyDeferScoreInt = 0
+	}
+
+	var mailLogFiles []string
+	if mailLogEnv := os.Getenv("MAIL_LOG_FILES"); mailLogEnv != "" {
+		mailLogFiles = strings.Split(mailLogEnv, ",")
+	}
+
+	mailLogWindow := os.Getenv("MAIL_LOG_WINDOW")
+	mailLogWindowSecs, err := strconv.Atoi(mailLogWindow)
+	if err != nil {
+		log.Println("Could not convert MAIL_LOG_WINDOW to an `int`. Defaulting to `3600`.")
+		mailLogWindowSecs = 3600
+	}
+
+	// regexes may well contain commas, so extractors are split on semicolons
+	var syslogExtractors []string
+	if syslogEnv := os.Getenv("SYSLOG_EXTRACTORS"); syslogEnv != "" {
+		syslogExtractors = strings.Split(syslogEnv, ";")
+	}
+
+	syslogWindow := os.Getenv("SYSLOG_WINDOW")
+	syslogWindowSecs, err := strconv.Atoi(syslogWindow)
+	if err != nil {
+		log.Println("Could not convert SYSLOG_WINDOW to an `int`. Defaulting to `3600`.")
+		syslogWindowSecs = 3600
+	}
+
+	recordRetention := os.Getenv("RECORD_RETENTION_DAYS")
+	recordRetentionDays, err := strconv.Atoi(recordRetention)
+	if err != nil {
+		log.Println("Could not convert RECORD_RETENTION_DAYS to an `int`. Defaulting to `0`.")
+		recordRetentionDays = 0
+	}
+
+	historyRetention := os.Getenv("HISTORY_RETENTION_DAYS")
+	historyRetentionDays, err := strconv.Atoi(historyRetention)
+	if err != nil {
+		log.Println("Could not convert HISTORY_RETENTION_DAYS to an `int`. Defaulting to `30`.")
+		historyRetentionDays = 30
+	}
+
+	dailyIPsRetention := os.Getenv("DAILY_IPS_RETENTION_DAYS")
+	dailyIPsRetentionDays, err := strconv.Atoi(dailyIPsRetention)
+	if err != nil {
+		log.Println("Could not convert DAILY_IPS_RETENTION_DAYS to an `int`. Defaulting to `90`.")
+		dailyIPsRetentionDays = 90
+	}
+
+	pruneInterval := os.Getenv("PRUNE_INTERVAL")
+	pruneIntervalSecs, err := strconv.Atoi(pruneInterval)
+	if err != nil {
+		log.Println("Could not convert PRUNE_INTERVAL to an `int`. Defaulting to `3600`.")
+		pruneIntervalSecs = 3600
+	}
+
+	dbFlushSize := os.Getenv("DB_FLUSH_SIZE")
+	dbFlushSizeInt, err := strconv.Atoi(dbFlushSize)
+	if err != nil {
+		log.Println("Could not convert DB_FLUSH_SIZE to an `int`. Defaulting to `100`.")
+		dbFlushSizeInt = 100
+	}
+
+	dbFlushInterval := os.Getenv("DB_FLUSH_INTERVAL_MS")
+	dbFlushIntervalMs, err := strconv.Atoi(dbFlushInterval)
+	if err != nil {
+		log.Println("Could not convert DB_FLUSH_INTERVAL_MS to an `int`. Defaulting to `1000`.")
+		dbFlushIntervalMs = 1000
+	}
+
 	persistDb := os.Getenv("PERSIST_DB")
 	persistDbBool, err := strconv.ParseBool(persistDb)
 	if err != nil {
@@ -41,7 +251,17 @@ func GetConfig() *APIConfig {
 		persistDbBool = true
 	}
 
+	dbMigrate := os.Getenv("DB_MIGRATE")
+	dbMigrateBool, err := strconv.ParseBool(dbMigrate)
+	if err != nil {
+		log.Println("Could not convert DB_MIGRATE to a `bool`. Defaulting to `true`.")
+		dbMigrateBool = true
+	}
+
 	config.AppPort = os.Getenv("APP_PORT")
+	config.DbDriver = dbDriver
+	config.DbHost = os.Getenv("MYSQL_DATABASE_HOST")
+	config.DbDSN = os.Getenv("DB_DSN")
 	config.DbName = os.Getenv("MYSQL_DATABASE_NAME")
 	config.DbPath = os.Getenv("DB_PATH")
 	config.DbPort = os.Getenv("MYSQL_DATABASE_PORT")
@@ -49,9 +269,49 @@ func GetConfig() *APIConfig {
 	config.DbPassword = os.Getenv("MYSQL_PASSWORD")
 	config.LogFile = os.Getenv("LOG_FILE")
 	config.PersistDb = persistDbBool
+	config.SkipMigrate = !dbMigrateBool
+	config.DbFlushSize = dbFlushSizeInt
+	config.DbFlushInterval = dbFlushIntervalMs
 	config.DNSBlockList = dnsList
+	config.ZoneFiles = zoneFiles
+	config.ListWeights = listWeights
+	config.DNSServerPort = os.Getenv("DNS_SERVER_PORT")
+	config.DNSBLZone = dnsblZone
+	config.DNSServerTTL = dnsServerTTLSecs
+	config.PolicyServerPort = os.Getenv("POLICY_SERVER_PORT")
+	config.GRPCPort = os.Getenv("GRPC_PORT")
+	config.PolicyRejectScore = policyRejectScoreInt
+	config.PolicyDeferScore = policyDeferScoreInt
+	config.MailLogFiles = mailLogFiles
+	config.MailLogWindow = mailLogWindowSecs
+	config.SyslogPort = os.Getenv("SYSLOG_PORT")
+	config.SyslogExtractors = syslogExtractors
+	config.SyslogWindow = syslogWindowSecs
+	config.RecordRetentionDays = recordRetentionDays
+	config.HistoryRetentionDays = historyRetentionDays
+	config.DailyIPsRetentionDays = dailyIPsRetentionDays
+	config.PruneInterval = pruneIntervalSecs
 	config.WorkerPoolsize = workersize
+	config.CacheTTL = cacheTTLSecs
+	config.QueuePolicy = queuePolicy
+	config.QueueTimeout = queueTimeoutMs
+	config.LookupTimeout = lookupTimeoutMs
+	config.QueueSpillDir = queueSpillDir
+	config.BackupDir = backupDir
+	config.AdminUsers = adminUsers
 
-	log.Printf("CONFIG SETTINGS: %+v\n", config)
+	log.Printf("CONFIG SETTINGS: %+v\n", config.redacted())
 	return &config
 }
+
+// redacted returns c without the database password, for logging. The whole
+// DB_DSN goes, as its password can be anywhere in it.
+func (c APIConfig) redacted() APIConfig {
+	if c.DbPassword != "" {
+		c.DbPassword = redactedValue
+	}
+	if c.DbDSN != "" {
+		c.DbDSN = redactedValue
+	}
+	return c
+}
@@ -1,6 +1,8 @@
 package config
 
 import (
+	"bytes"
+	"log"
 	"os"
 	"testing"
 
@@ -19,16 +21,100 @@ func TestConfig(t *testing.T) {
 	os.Setenv("LOG_FILE", "app.log")
 	os.Setenv("PERSIST_DB", "true")
 	os.Setenv("DB_PATH", "./swdnsbl.db")
+	os.Setenv("DB_DRIVER", "postgres")
+	os.Setenv("DB_DSN", "postgres://db/sw_dnsbl")
+	os.Setenv("DB_MIGRATE", "false")
+	os.Setenv("CACHE_TTL", "600")
+	os.Setenv("QUEUE_FULL_POLICY", "block")
+	os.Setenv("QUEUE_TIMEOUT_MS", "250")
+	os.Setenv("QUEUE_SPILL_DIR", "/tmp/spill")
+	os.Setenv("LOOKUP_TIMEOUT_MS", "1500")
+	os.Setenv("BACKUP_DIR", "/var/backups/sw-dnsbl")
+	os.Setenv("ADMIN_USERS", "secureworks,ops")
+	os.Setenv("DNS_SERVER_PORT", "5353")
+	os.Setenv("DNSBL_ZONE", "bl.example.com")
+	os.Setenv("DNS_SERVER_TTL", "60")
+	os.Setenv("ZONE_FILES", "internal.bl:ip4set:/etc/rbldnsd/internal,hosts.bl:dnset:/etc/rbldnsd/hosts")
+	os.Setenv("POLICY_SERVER_PORT", "10040")
+	os.Setenv("GRPC_PORT", "9090")
+	os.Setenv("POLICY_REJECT_SCORE", "3")
+	os.Setenv("POLICY_DEFER_SCORE", "2")
+	os.Setenv("MAIL_LOG_FILES", "/var/log/mail.log,-")
+	os.Setenv("MAIL_LOG_WINDOW", "600")
+	os.Setenv("SYSLOG_PORT", "5514")
+	os.Setenv("SYSLOG_EXTRACTORS", "mail;fw=SRC=(\\d{1,3}(?:\\.\\d{1,3}){3})")
+	os.Setenv("SYSLOG_WINDOW", "300")
+	os.Setenv("DB_FLUSH_SIZE", "20")
+	os.Setenv("DB_FLUSH_INTERVAL_MS", "250")
+	os.Setenv("RECORD_RETENTION_DAYS", "90")
+	os.Setenv("HISTORY_RETENTION_DAYS", "7")
+	os.Setenv("DAILY_IPS_RETENTION_DAYS", "60")
+	os.Setenv("PRUNE_INTERVAL", "600")
+	os.Setenv("LIST_WEIGHTS", "zen.spamhaus.org=3,bl.spamcop.net=2,broken")
 
 	c := GetConfig()
 	assert.Equal(t, c.AppPort, "8080")
 	assert.Equal(t, c.DbName, "sw_dnsbl")
 	assert.Equal(t, c.DbPath, "./swdnsbl.db")
+	assert.Equal(t, c.DbDriver, DbDriverPostgres)
+	assert.Equal(t, c.DbHost, "0.0.0.0")
+	assert.Equal(t, c.DbDSN, "postgres://db/sw_dnsbl")
 	assert.Equal(t, c.PersistDb, true)
+	assert.Equal(t, c.SkipMigrate, true)
+	assert.Equal(t, c.DbFlushSize, 20)
+	assert.Equal(t, c.DbFlushInterval, 250)
 	assert.Equal(t, c.DbPort, "3306")
 	assert.Equal(t, c.DbUser, "mysql_admin")
 	assert.Equal(t, c.DbPassword, "password")
 	assert.Equal(t, c.WorkerPoolsize, 99)
 	assert.Equal(t, c.DNSBlockList, []string{"zen.spamhaus.org"})
 	assert.Equal(t, c.LogFile, "app.log")
+	assert.Equal(t, c.CacheTTL, 600)
+	assert.Equal(t, c.QueuePolicy, QueuePolicyBlock)
+	assert.Equal(t, c.QueueTimeout, 250)
+	assert.Equal(t, c.QueueSpillDir, "/tmp/spill")
+	assert.Equal(t, c.LookupTimeout, 1500)
+	assert.Equal(t, c.BackupDir, "/var/backups/sw-dnsbl")
+	assert.Equal(t, c.AdminUsers, []string{"secureworks", "ops"})
+	assert.Equal(t, c.DNSServerPort, "5353")
+	assert.Equal(t, c.DNSBLZone, "bl.example.com")
+	assert.Equal(t, c.DNSServerTTL, 60)
+	assert.Equal(t, c.ZoneFiles, []string{"internal.bl:ip4set:/etc/rbldnsd/internal", "hosts.bl:dnset:/etc/rbldnsd/hosts"})
+	assert.Equal(t, c.PolicyServerPort, "10040")
+	assert.Equal(t, c.GRPCPort, "9090")
+	assert.Equal(t, c.PolicyRejectScore, 3)
+	assert.Equal(t, c.PolicyDeferScore, 2)
+	assert.Equal(t, c.MailLogFiles, []string{"/var/log/mail.log", "-"})
+	assert.Equal(t, c.MailLogWindow, 600)
+	assert.Equal(t, c.SyslogPort, "5514")
+	assert.Equal(t, c.SyslogExtractors, []string{"mail", "fw=SRC=(\\d{1,3}(?:\\.\\d{1,3}){3})"})
+	assert.Equal(t, c.SyslogWindow, 300)
+	assert.Equal(t, c.RecordRetentionDays, 90)
+	assert.Equal(t, c.HistoryRetentionDays, 7)
+	assert.Equal(t, c.DailyIPsRetentionDays, 60)
+	assert.Equal(t, c.PruneInterval, 600)
+	assert.Equal(t, c.ListWeights, map[string]int{"zen.spamhaus.org": 3, "bl.spamcop.net": 2})
+
+	os.Setenv("QUEUE_FULL_POLICY", "drop")
+	os.Setenv("DB_DRIVER", "oracle")
+	os.Setenv("DB_MIGRATE", "maybe")
+	c = GetConfig()
+	assert.Equal(t, c.QueuePolicy, QueuePolicyReject)
+	assert.Equal(t, c.DbDriver, DbDriverSQLite)
+	assert.Equal(t, c.SkipMigrate, false)
+
+	os.Setenv("DB_DRIVER", "memory")
+	c = GetConfig()
+	assert.Equal(t, c.DbDriver, DbDriverMemory)
+
+	// the logged settings leave the credentials out
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	os.Setenv("DB_DSN", "postgres://sw:dsnsecret@db/sw_dnsbl")
+	c = GetConfig()
+	log.SetOutput(os.Stderr)
+	assert.Equal(t, c.DbDSN, "postgres://sw:dsnsecret@db/sw_dnsbl")
+	assert.NotContains(t, logged.String(), "dsnsecret")
+	assert.NotContains(t, logged.String(), "DbPassword:password")
+	assert.Contains(t, logged.String(), "DbPassword:REDACTED")
 }
@@ -0,0 +1,286 @@
+package database
+
+import (
+	"bufio"
+	"compress/gzip"
+	"database/sql"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/mattn/go-sqlite3"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+// gzipMagic starts every gzip file
+const gzipMagic = "\x1f\x8b"
+
+// Backuper is implemented by the stores that can take a snapshot of
+// themselves while in use
+type Backuper interface {
+	// Backup writes a consistent snapshot of the store to path, gzipped if
+	// compress
+	Backup(path string, compress bool) (*BackupInfo, error)
+}
+
+// BackupInfo describes a snapshot written by Backup
+type BackupInfo struct {
+	Path          string
+	Bytes         int64
+	Compressed    bool
+	SchemaVersion int
+}
+
+// Backup method writes a snapshot of the SQLite database to path, through
+// SQLite's online backup API so the workers can keep writing while it runs.
+// The snapshot is written next to path and linked into place, so path is
+// never a partial snapshot, and never one that was already there.
+func (db *Db) Backup(path string, compress bool) (*BackupInfo, error) {
+	if db.path == "" {
+		return nil, fmt.Errorf("backups need the %s driver, not %s", sqliteDialect.driver, db.sqlDialect().driver)
+	}
+	version, err := db.SchemaVersion()
+	if err != nil {
+		return nil, err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return nil, err
+	}
+	tmp.Close()
+	defer os.Remove(tmp.Name())
+
+	if err = copySQLite(sqliteDSN(db.path), tmp.Name()); err != nil {
+		return nil, err
+	}
+	// the copy is in WAL mode like the database; as a rollback journal
+	// database the snapshot is the one file, even where it can't be written
+	if err = setJournalMode(tmp.Name(), "DELETE"); err != nil {
+		return nil, err
+	}
+	if compress {
+		if err = gzipFile(tmp.Name()); err != nil {
+			return nil, err
+		}
+	}
+	// linked rather than renamed into place, so an existing file at path
+	// fails the backup instead of being replaced
+	if err = os.Link(tmp.Name(), path); err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("%s already exists", path)
+		}
+		return nil, err
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	return &BackupInfo{Path: path, Bytes: fi.Size(), Compressed: compress, SchemaVersion: version}, nil
+}
+
+// Restore method replaces the contents of the SQLite database with the
+// snapshot in path, gzipped or not, and returns the snapshot's schema version
+// and the one it was migrated to. The snapshot is copied next to the database
+// and checked, and an older one brought up to date, before anything is
+// replaced; one newer than this binary knows is refused. The final copy is
+// one transaction, so the database is never left half restored.
+func (db *Db) Restore(path string) (from, to int, err error) {
+	if db.path == "" {
+		return 0, 0, fmt.Errorf("restores need the %s driver, not %s", sqliteDialect.driver, db.sqlDialect().driver)
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(db.path), "restore.*.tmp")
+	if err != nil {
+		return 0, 0, err
+	}
+	tmp.Close()
+	defer func() {
+		os.Remove(tmp.Name())
+		os.Remove(tmp.Name() + "-wal")
+		os.Remove(tmp.Name() + "-shm")
+	}()
+	if err = copySnapshot(path, tmp.Name()); err != nil {
+		return 0, 0, err
+	}
+
+	from, err = snapshotVersion(tmp.Name())
+	if err != nil {
+		return 0, 0, err
+	}
+	to = from
+	if from < LatestSchemaVersion() {
+		snapshot, err := Open(&config.APIConfig{DbPath: tmp.Name(), PersistDb: true})
+		if err != nil {
+			return 0, 0, err
+		}
+		_, to, err = snapshot.Migrate()
+		snapshot.Close()
+		if err != nil {
+			return 0, 0, fmt.Errorf("migrating the snapshot: %s", err)
+		}
+		// and check it again as it is now
+		if to, err = snapshotVersion(tmp.Name()); err != nil {
+			return 0, 0, err
+		}
+	}
+	if to != LatestSchemaVersion() {
+		return 0, 0, fmt.Errorf("snapshot at schema version %d, not the %d this version needs", to, LatestSchemaVersion())
+	}
+
+	if err = copySQLite(tmp.Name(), sqliteDSN(db.path)); err != nil {
+		return 0, 0, err
+	}
+	return from, to, nil
+}
+
+// snapshotVersion returns the schema version of the snapshot in path, after
+// checking it is an intact sw-dnsbl database no newer than this binary
+func snapshotVersion(path string) (int, error) {
+	conn, err := sql.Open(sqliteDialect.driver, path)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	var check string
+	if err = conn.QueryRow("PRAGMA quick_check").Scan(&check); err != nil {
+		return 0, fmt.Errorf("%s is not a database: %s", path, err)
+	}
+	if check != "ok" {
+		return 0, fmt.Errorf("%s is damaged: %s", path, check)
+	}
+
+	var version int
+	err = conn.QueryRow(`SELECT version FROM schema_version ORDER BY version DESC LIMIT 1`).Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a sw-dnsbl snapshot: %s", path, err)
+	}
+	if version > LatestSchemaVersion() {
+		return 0, fmt.Errorf("snapshot at schema version %d, newer than the %d this version knows", version, LatestSchemaVersion())
+	}
+	return version, nil
+}
+
+// copySQLite copies the SQLite database at the data source name from over
+// the one at to with the backup API. It is done in a single step, which
+// reads from under one read transaction, so the copy is consistent.
+func copySQLite(from, to string) error {
+	d := &sqlite3.SQLiteDriver{}
+	src, err := d.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dest, err := d.Open(to)
+	if err != nil {
+		return err
+	}
+	defer dest.Close()
+
+	b, err := dest.(*sqlite3.SQLiteConn).Backup("main", src.(*sqlite3.SQLiteConn), "main")
+	if err != nil {
+		return err
+	}
+	if _, err = b.Step(-1); err != nil {
+		b.Finish()
+		return err
+	}
+	return b.Finish()
+}
+
+// setJournalMode sets the journal mode of the SQLite database in path
+func setJournalMode(path, mode string) error {
+	conn, err := sql.Open(sqliteDialect.driver, path)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Exec("PRAGMA journal_mode=" + mode)
+	return err
+}
+
+// isGzip returns whether the file in path is gzipped
+func isGzip(path string) (bool, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	magic := make([]byte, len(gzipMagic))
+	n, err := io.ReadFull(f, magic)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return false, err
+	}
+	return string(magic[:n]) == gzipMagic, nil
+}
+
+// gzipFile compresses the file in path in place
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	w := bufio.NewWriter(out)
+	zw := gzip.NewWriter(w)
+	if _, err = io.Copy(zw, in); err != nil {
+		return err
+	}
+	if err = zw.Close(); err != nil {
+		return err
+	}
+	if err = w.Flush(); err != nil {
+		return err
+	}
+	if err = out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(out.Name(), path)
+}
+
+// copySnapshot copies the snapshot in path over the file dest, decompressing
+// it if gzipped
+func copySnapshot(path, dest string) error {
+	compressed, err := isGzip(path)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	var r io.Reader = bufio.NewReader(in)
+	if compressed {
+		zr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		r = zr
+	}
+
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_TRUNC, 0)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err = io.Copy(out, r); err != nil {
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,188 @@
+package database
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backup")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	open := func(name string) *Db {
+		db, err := NewDb(&config.APIConfig{DbPath: filepath.Join(dir, name), PersistDb: true})
+		require.Equal(t, nil, err)
+		return db
+	}
+	db := open("swdnsbl.db")
+	defer db.Close()
+	require.Equal(t, nil, db.UpsertRecord(&model.Record{IPAddress: "127.0.0.2", UUID: "uuid-2", ResponseCode: "127.0.0.2", UpdatedAt: 100}))
+	require.Equal(t, nil, db.UpsertListResult(&model.ListResult{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, CheckedAt: 100}))
+
+	for _, compress := range []bool{false, true} {
+		name := "snapshot.db"
+		if compress {
+			name += ".gz"
+		}
+		t.Run("backup_and_restore_"+name, func(t *testing.T) {
+			path := filepath.Join(dir, name)
+			info, err := db.Backup(path, compress)
+			require.Equal(t, nil, err)
+			assert.Equal(t, path, info.Path)
+			assert.Equal(t, compress, info.Compressed)
+			assert.Equal(t, LatestSchemaVersion(), info.SchemaVersion)
+			fi, err := os.Stat(path)
+			require.Equal(t, nil, err)
+			assert.Equal(t, fi.Size(), info.Bytes)
+			gzipped, err := isGzip(path)
+			require.Equal(t, nil, err)
+			assert.Equal(t, compress, gzipped)
+			if !compress {
+				// a snapshot is the one file, not a WAL database
+				b, err := ioutil.ReadFile(path)
+				require.Equal(t, nil, err)
+				assert.Equal(t, []byte{1, 1}, b[18:20])
+			}
+
+			// restoring replaces whatever was there
+			restored := open("restored.db")
+			defer restored.Close()
+			require.Equal(t, nil, restored.UpsertRecord(&model.Record{IPAddress: "127.0.0.3", UUID: "uuid-3", UpdatedAt: 100}))
+			from, to, err := restored.Restore(path)
+			require.Equal(t, nil, err)
+			assert.Equal(t, LatestSchemaVersion(), from)
+			assert.Equal(t, LatestSchemaVersion(), to)
+
+			r, err := restored.QueryRecord("127.0.0.2")
+			require.Equal(t, nil, err)
+			assert.Equal(t, "uuid-2", r.UUID)
+			_, err = restored.QueryRecord("127.0.0.3")
+			assert.NotEqual(t, nil, err)
+			results, err := restored.QueryListResults("127.0.0.2")
+			require.Equal(t, nil, err)
+			assert.Equal(t, 1, len(results))
+			var mode string
+			require.Equal(t, nil, restored.Conn.QueryRow("PRAGMA journal_mode").Scan(&mode))
+			assert.Equal(t, "wal", mode)
+		})
+	}
+
+	t.Run("backup_existing_path", func(t *testing.T) {
+		path := filepath.Join(dir, "twice.db")
+		_, err := db.Backup(path, false)
+		require.Equal(t, nil, err)
+		before, err := ioutil.ReadFile(path)
+		require.Equal(t, nil, err)
+
+		_, err = db.Backup(path, true)
+		require.NotEqual(t, nil, err)
+		assert.Equal(t, path+" already exists", err.Error())
+		after, err := ioutil.ReadFile(path)
+		require.Equal(t, nil, err)
+		assert.Equal(t, before, after)
+		// nor is the temporary snapshot left behind
+		tmps, err := filepath.Glob(path + ".*.tmp")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, len(tmps))
+	})
+
+	t.Run("restore_not_a_snapshot", func(t *testing.T) {
+		restored := open("restored.db")
+		defer restored.Close()
+
+		garbage := filepath.Join(dir, "garbage.db")
+		require.Equal(t, nil, ioutil.WriteFile(garbage, []byte("not a database"), 0644))
+		_, _, err := restored.Restore(garbage)
+		assert.NotEqual(t, nil, err)
+
+		_, _, err = restored.Restore(filepath.Join(dir, "missing.db"))
+		assert.NotEqual(t, nil, err)
+
+		// a database, but not one of ours
+		other, err := Open(&config.APIConfig{DbPath: filepath.Join(dir, "other.db"), PersistDb: true})
+		require.Equal(t, nil, err)
+		_, err = other.Conn.Exec("CREATE TABLE things (id INTEGER)")
+		require.Equal(t, nil, err)
+		other.Close()
+		_, _, err = restored.Restore(filepath.Join(dir, "other.db"))
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("restore_newer_schema", func(t *testing.T) {
+		newer := open("newer.db")
+		_, err := newer.Conn.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", LatestSchemaVersion()+1, "from the future", 0)
+		require.Equal(t, nil, err)
+		_, err = newer.Backup(filepath.Join(dir, "newer-snapshot.db"), false)
+		require.Equal(t, nil, err)
+		newer.Close()
+
+		_, _, err = db.Restore(filepath.Join(dir, "newer-snapshot.db"))
+		assert.NotEqual(t, nil, err)
+		// and the database is left as it was
+		_, err = db.QueryRecord("127.0.0.2")
+		assert.Equal(t, nil, err)
+	})
+
+	t.Run("restore_older_schema", func(t *testing.T) {
+		// a snapshot taken before the later migrations
+		older, err := Open(&config.APIConfig{DbPath: filepath.Join(dir, "older.db"), PersistDb: true})
+		require.Equal(t, nil, err)
+		ctx := context.Background()
+		conn, err := older.Conn.Conn(ctx)
+		require.Equal(t, nil, err)
+		_, err = conn.ExecContext(ctx, createSchemaVersion)
+		require.Equal(t, nil, err)
+		for _, m := range migrations[:2] {
+			require.Equal(t, nil, applyMigration(ctx, conn, sqliteDialect, m))
+		}
+		_, err = conn.ExecContext(ctx, `INSERT INTO ip_details (ip_address, uuid, response_code, created_at, updated_at) VALUES ('127.0.0.5', 'uuid-5', 'NXDOMAIN', 100, 100)`)
+		require.Equal(t, nil, err)
+		conn.Close()
+		_, err = older.Backup(filepath.Join(dir, "older-snapshot.db"), false)
+		require.Equal(t, nil, err)
+		older.Close()
+
+		restored := open("restored.db")
+		defer restored.Close()
+		from, to, err := restored.Restore(filepath.Join(dir, "older-snapshot.db"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, from)
+		assert.Equal(t, LatestSchemaVersion(), to)
+
+		// the database is restored at the schema this version needs
+		version, err := restored.SchemaVersion()
+		require.Equal(t, nil, err)
+		assert.Equal(t, LatestSchemaVersion(), version)
+		r, err := restored.QueryRecord("127.0.0.5")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "uuid-5", r.UUID)
+		// while the snapshot is left as it was
+		version, err = snapshotVersion(filepath.Join(dir, "older-snapshot.db"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, version)
+		leftover, err := filepath.Glob(filepath.Join(dir, "restore.*"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, len(leftover))
+	})
+
+	t.Run("not_sqlite", func(t *testing.T) {
+		mysql, err := Open(&config.APIConfig{DbDriver: config.DbDriverMySQL, DbDSN: "root@tcp(127.0.0.1:1)/sw_dnsbl"})
+		require.Equal(t, nil, err)
+		defer mysql.Close()
+
+		_, err = mysql.Backup(filepath.Join(dir, "mysql.db"), false)
+		assert.NotEqual(t, nil, err)
+		_, _, err = mysql.Restore(filepath.Join(dir, "snapshot.db"))
+		assert.NotEqual(t, nil, err)
+	})
+}
@@ -2,14 +2,20 @@ package database
 
 import (
 	"database/sql"
+	"fmt"
 	"log"
 	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/alexanderkarlis/sw-dnsbl/config"
 	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
 
 	// in order to get around the go-lint; here's a comment
-	// _ "github.com/go-sql-driver/mysql"
+	_ "github.com/go-sql-driver/mysql"
+	_ "github.com/lib/pq"
 	_ "github.com/mattn/go-sqlite3" //Required for sql driver registration
 )
 
@@ -18,184 +24,493 @@ var (
 	err error
 )
 
-// Db is the type for MySql Connection
+// Db is the SQL Store, on whichever backend DB_DRIVER picks
 type Db struct {
-	Conn *sql.DB
-}
+	Conn    *sql.DB
+	dialect *dialect
+	// path is the file of a SQLite database
+	path string
 
-// Exists reports whether the named file or directory exists.
-func exists(name string) bool {
-	if _, err := os.Stat(name); err != nil {
-		if os.IsNotExist(err) {
-			return false
-		}
-	}
-	return true
+	// the write statements prepared so far, by query
+	stmtsMu sync.Mutex
+	stmts   map[string]*sql.Stmt
 }
 
-// NewDb method returns a new MySql instance
+// sqliteBusyTimeout is how long, in milliseconds, a SQLite write waits for
+// another connection's to finish before failing with "database is locked"
+const sqliteBusyTimeout = 5000
+
+// NewDb method returns a new Db on the configured DB_DRIVER with its schema
+// up to date. SQLite keeps the database in DB_PATH, which is removed first
+// unless PERSIST_DB; MySQL and PostgreSQL connect with DB_DSN or the MYSQL_*
+// settings and are never cleared. Unless DB_MIGRATE is false the pending
+// migrations are applied, else a schema behind this version is an error.
 func NewDb(c *config.APIConfig) (*Db, error) {
-	dbPath := "./swdnsbl.db"
+	d, err := Open(c)
+	if err != nil {
+		return nil, err
+	}
 
-	if c.DbPath != "" {
-		dbPath = c.DbPath
+	if !c.SkipMigrate {
+		_, _, err = d.Migrate()
+	} else {
+		var version int
+		version, err = d.SchemaVersion()
+		if err == nil && version < LatestSchemaVersion() {
+			err = fmt.Errorf("database schema at version %d, %d needed; run `sw-dnsbl migrate`", version, LatestSchemaVersion())
+		}
 	}
-	log.Println(dbPath)
-	if !c.PersistDb {
-		os.Remove(dbPath)
+	if err != nil {
+		d.Close()
+		return nil, err
 	}
 
-	db, err = sql.Open("sqlite3", dbPath)
+	log.Println("db connection started...")
+
+	return d, nil
+}
 
+// Open method connects to the configured DB_DRIVER like NewDb, leaving the
+// schema as it is
+func Open(c *config.APIConfig) (*Db, error) {
+	d, err := dialectFor(c.DbDriver)
 	if err != nil {
 		return nil, err
 	}
 
-	// read create table script sql
-	// content, err := ioutil.ReadFile("../scripts/ip/init.sql")
-	// if err != nil {
-	// 	panic(err)
-	// }
-
-	if !exists(dbPath) {
-		createTable := `
-			CREATE TABLE IF NOT EXISTS ip_details (
-				ip_address TEXT PRIMARY KEY NOT NULL, 
-				uuid TEXT NOT NULL, 
-				response_code text,
-				created_at TEXT, 
-				updated_at TEXT
-			);
-		`
-		_, err = db.Exec(createTable)
-		if err != nil {
-			log.Println(err)
-			log.Fatalf("create table sql statement FAILED: %s\n", createTable)
+	dsn, path := "", ""
+	if d == sqliteDialect {
+		dsn = "./swdnsbl.db"
+		if c.DbPath != "" {
+			dsn = c.DbPath
+		}
+		log.Println(dsn)
+		if !c.PersistDb {
+			os.Remove(dsn)
+			os.Remove(dsn + "-wal")
+			os.Remove(dsn + "-shm")
 		}
+		path = dsn
+		dsn = sqliteDSN(dsn)
+	} else {
+		dsn = d.dsn(c)
+		log.Printf("connecting to %s database %s on %s\n", d.driver, c.DbName, c.DbHost)
 	}
 
-	log.Println("db connection started...")
+	db, err = sql.Open(d.driver, dsn)
 
-	return &Db{db}, nil
+	if err != nil {
+		return nil, err
+	}
+
+	return &Db{Conn: db, dialect: d, path: path}, nil
+}
+
+// sqliteDSN returns the data source name of the SQLite database in path. WAL
+// lets the readers carry on while the workers write, and immediate
+// transactions wait for the write lock up front instead of failing when a
+// read turns into a write.
+func sqliteDSN(path string) string {
+	sep := "?"
+	if strings.Contains(path, "?") {
+		sep = "&"
+	}
+	return fmt.Sprintf("%s%s_journal_mode=WAL&_busy_timeout=%d&_txlock=immediate", path, sep, sqliteBusyTimeout)
+}
+
+// sqlDialect returns the dialect of db, SQLite unless it was opened otherwise
+func (db *Db) sqlDialect() *dialect {
+	if db.dialect == nil {
+		return sqliteDialect
+	}
+	return db.dialect
 }
 
 // UpsertRecord func inserts if not exists, else update record
 func (db *Db) UpsertRecord(r *model.Record) error {
-	if err != nil {
-		log.Println("this is the error:", err)
-		return err
-	}
+	return db.WriteBatch(&Batch{Records: []*model.Record{r}})
+}
 
-	log.Printf("%+v\n", r)
-	// upsertQuery := `
-	// INSERT INTO ip_details(uuid, created_at, updated_at, ip_address, response_code)
-	// VALUES (
-	// 	?,
-	// 	?,
-	// 	?,
-	// 	?,
-	// 	?
-	// ) ON DUPLICATE KEY
-	// UPDATE response_code = ?,
-	// 	updated_at = ?;
-	// `
+// QueryRecord func searches for a record
+func (db *Db) QueryRecord(ip string) (*model.Record, error) {
+	// TODO: add custom struct tags so that for easy unmarshalling
+
+	var r model.Record
 
-	upsertQuery := `
-		INSERT INTO ip_details( 
+	selectQuery := `
+		SELECT
 			ip_address,
 			uuid,
-			response_code,
 			created_at,
-			updated_at 
-		) VALUES( ?, ?, ?, ?, ? )
-		ON CONFLICT(ip_address) DO UPDATE SET
-			response_code = ?,
-			updated_at = ?
+			updated_at,
+			response_code,
+			lookup_error
+		FROM ip_details
+		WHERE ip_address = ?
 	`
+	// selectQuery := `
+	// 	select * from ip_details
+	// 	where ip_address = ?;
+	// `
+	selectQuery = db.sqlDialect().rebind(selectQuery)
 
-	upsertStmt, err := db.Conn.Prepare(upsertQuery)
+	err := db.Conn.QueryRow(selectQuery, ip).Scan(
+		&r.IPAddress,
+		&r.UUID,
+		unixTime{&r.CreatedAt},
+		unixTime{&r.UpdatedAt},
+		&r.ResponseCode,
+		&r.Error,
+	)
 
 	if err != nil {
-		log.Println(err)
-		log.Println("error on upsert preparation")
+		log.Println("Query Row Error", err)
+		return nil, err
+	}
+	return &r, nil
+}
+
+// UpsertListResult func stores the result of a single ip/blocklist lookup,
+// replacing any previous result for the pair unless the lookup failed, and
+// appends it to ip_history
+func (db *Db) UpsertListResult(r *model.ListResult) error {
+	return db.WriteBatch(&Batch{Results: []*model.ListResult{r}})
+}
+
+// Batch is the records and list results of lookups, stored together by
+// WriteBatch
+type Batch struct {
+	Records []*model.Record
+	Results []*model.ListResult
+}
+
+// Len method returns the number of records and results in b
+func (b *Batch) Len() int {
+	return len(b.Records) + len(b.Results)
+}
+
+// WriteBatch func upserts the records of b like UpsertRecord, then its list
+// results like UpsertListResult, in one transaction, so either all of b is
+// stored or none of it is
+func (db *Db) WriteBatch(b *Batch) error {
+	d := db.sqlDialect()
+	recordStmt, err := db.stmt(d.upsert(
+		"ip_details",
+		[]string{"ip_address", "uuid", "response_code", "created_at", "updated_at", "lookup_error", "ip_key"},
+		[]string{"ip_address"},
+		[]string{"response_code", "updated_at", "lookup_error"},
+	))
+	if err != nil {
 		return err
 	}
-	upsertResult, err := upsertStmt.Exec(
-		r.IPAddress,
-		r.UUID,
-		r.ResponseCode,
-		r.CreatedAt,
-		r.UpdatedAt,
-		r.ResponseCode,
-		r.UpdatedAt,
-	)
+	resultStmt, err := db.stmt(d.upsert(
+		"ip_results",
+		[]string{"ip_address", "blocklist", "listed", "response_code", "reason", "category", "updated_at"},
+		[]string{"ip_address", "blocklist"},
+		[]string{"listed", "response_code", "reason", "category", "updated_at"},
+	))
 	if err != nil {
-		log.Println(err)
-		log.Println("error on upsert")
 		return err
 	}
-	rowsAffected, err := upsertResult.RowsAffected()
+	historyStmt, err := db.stmt(`
+		INSERT INTO ip_history(ip_address, blocklist, listed, response_code, category, checked_at, lookup_error)
+		VALUES(?, ?, ?, ?, ?, ?, ?)
+	`)
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Conn.Begin()
 	if err != nil {
 		log.Println(err)
 		return err
 	}
-	if rowsAffected == 2 {
-		log.Printf("row data updated for ip address -> %s\n", r.IPAddress)
-	} else {
-		log.Printf("added new row: %s\n", r.IPAddress)
+	defer tx.Rollback()
+
+	upsertRecord := tx.Stmt(recordStmt)
+	for _, r := range b.Records {
+		_, err = upsertRecord.Exec(r.IPAddress, r.UUID, r.ResponseCode, timestamp(r.CreatedAt), timestamp(r.UpdatedAt), r.Error, ipKey(r.IPAddress))
+		if err != nil {
+			log.Println("error on upsert of", r.IPAddress, err)
+			return err
+		}
+	}
+
+	upsertResult := tx.Stmt(resultStmt)
+	insertHistory := tx.Stmt(historyStmt)
+	for _, r := range b.Results {
+		// stored as 0/1, which every backend takes for an INTEGER column
+		listed := 0
+		if r.Listed {
+			listed = 1
+		}
+		// a failed lookup says nothing about the listing, only the history
+		// keeps it
+		if r.Error == nil {
+			_, err = upsertResult.Exec(r.IPAddress, r.Blocklist, listed, r.ResponseCode, r.Reason, r.Category, timestamp(r.CheckedAt))
+		}
+		if err == nil {
+			_, err = insertHistory.Exec(r.IPAddress, r.Blocklist, listed, r.ResponseCode, r.Category, r.CheckedAt, r.Error)
+		}
+		if err != nil {
+			log.Println("error on list result upsert of", r.IPAddress, err)
+			return err
+		}
+	}
+
+	if err = tx.Commit(); err != nil {
+		log.Println(err)
+		return err
 	}
 	return nil
 }
 
-// QueryRecord func searches for a record
-func (db *Db) QueryRecord(ip string) (*model.Record, error) {
-	// TODO: add custom struct tags so that for easy unmarshalling
+// stmt returns query, rebound, as a statement prepared on first use
+func (db *Db) stmt(query string) (*sql.Stmt, error) {
+	db.stmtsMu.Lock()
+	defer db.stmtsMu.Unlock()
 
-	var r model.Record
+	if stmt, ok := db.stmts[query]; ok {
+		return stmt, nil
+	}
+	stmt, err := db.Conn.Prepare(db.sqlDialect().rebind(query))
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	if db.stmts == nil {
+		db.stmts = make(map[string]*sql.Stmt)
+	}
+	db.stmts[query] = stmt
+	return stmt, nil
+}
 
+// QueryListResults func returns every stored blocklist result for an ip
+func (db *Db) QueryListResults(ip string) ([]*model.ListResult, error) {
 	selectQuery := `
 		SELECT
 			ip_address,
-			uuid,
-			created_at,
-			updated_at,
-			response_code
-		FROM ip_details
+			blocklist,
+			listed,
+			response_code,
+			reason,
+			category,
+			updated_at
+		FROM ip_results
 		WHERE ip_address = ?
 	`
-	// selectQuery := `
-	// 	select * from ip_details
-	// 	where ip_address = ?;
-	// `
-	selectStmt, err := db.Conn.Prepare(selectQuery)
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), ip)
 	if err != nil {
 		log.Println(err)
 		return nil, err
 	}
-	defer selectStmt.Close()
-
-	// _, err = selectStmt.Exec(ip)
-	// if err != nil {
-	// 	log.Println("here", err)
-	// 	return nil, err
-	// }
+	return scanListResults(rows)
+}
 
-	err = db.Conn.QueryRow(selectQuery, ip).Scan(
-		&r.IPAddress,
-		&r.UUID,
-		&r.CreatedAt,
-		&r.UpdatedAt,
-		&r.ResponseCode,
-	)
+// QueryListedResults func returns every stored result that is a listing,
+// optionally only for the given blocklists and/or categories, ordered by ip
+func (db *Db) QueryListedResults(blocklists, categories []string) ([]*model.ListResult, error) {
+	selectQuery := `
+		SELECT
+			ip_address,
+			blocklist,
+			listed,
+			response_code,
+			reason,
+			category,
+			updated_at
+		FROM ip_results
+		WHERE listed = 1
+	`
+	var args []interface{}
+	if len(blocklists) > 0 {
+		selectQuery += " AND blocklist IN (" + placeholders(len(blocklists)) + ")"
+		for _, b := range blocklists {
+			args = append(args, b)
+		}
+	}
+	if len(categories) > 0 {
+		selectQuery += " AND category IN (" + placeholders(len(categories)) + ")"
+		for _, c := range categories {
+			args = append(args, c)
+		}
+	}
+	selectQuery += " ORDER BY ip_address, blocklist"
 
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), args...)
 	if err != nil {
-		log.Println("Query Row Error", err)
+		log.Println(err)
 		return nil, err
 	}
-	return &r, nil
+	return scanListResults(rows)
+}
+
+// RecordFilter picks the records EachRecord returns. Listed keeps the records
+// of ips with a listing, on one of Lists if given; without Listed, Lists keeps
+// the records of ips checked against one of them. UpdatedSince keeps records
+// updated at or after that unix time, if not 0.
+type RecordFilter struct {
+	Listed       bool
+	Lists        []string
+	UpdatedSince int
+}
+
+// EachRecord func calls fn with every ip_details record matching f, ordered
+// by ip, and the blocklists currently listing it. Rows are read one at a
+// time, so the whole table never has to fit in memory; an error from fn stops
+// the iteration and is returned.
+func (db *Db) EachRecord(f RecordFilter, fn func(r *model.Record, lists []string) error) error {
+	selectQuery := `
+		SELECT
+			d.ip_address,
+			d.uuid,
+			d.created_at,
+			d.updated_at,
+			d.response_code,
+			d.lookup_error,
+			(
+				SELECT ` + fmt.Sprintf(db.sqlDialect().groupConcat, "r.blocklist") + `
+				FROM ip_results r
+				WHERE r.ip_address = d.ip_address AND r.listed = 1
+			)
+		FROM ip_details d
+		WHERE 1 = 1
+	`
+	var args []interface{}
+	if f.Listed || len(f.Lists) > 0 {
+		selectQuery += " AND EXISTS (SELECT 1 FROM ip_results r WHERE r.ip_address = d.ip_address"
+		if f.Listed {
+			selectQuery += " AND r.listed = 1"
+		}
+		if len(f.Lists) > 0 {
+			selectQuery += " AND r.blocklist IN (" + placeholders(len(f.Lists)) + ")"
+			for _, l := range f.Lists {
+				args = append(args, l)
+			}
+		}
+		selectQuery += ")"
+	}
+	if f.UpdatedSince != 0 {
+		selectQuery += " AND d.updated_at >= ?"
+		args = append(args, timestamp(f.UpdatedSince))
+	}
+	selectQuery += " ORDER BY d.ip_address"
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), args...)
+	if err != nil {
+		log.Println(err)
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var r model.Record
+		var lists sql.NullString
+		err = rows.Scan(
+			&r.IPAddress,
+			&r.UUID,
+			unixTime{&r.CreatedAt},
+			unixTime{&r.UpdatedAt},
+			&r.ResponseCode,
+			&r.Error,
+			&lists,
+		)
+		if err != nil {
+			log.Println(err)
+			return err
+		}
+		var listNames []string
+		if lists.String != "" {
+			listNames = strings.Split(lists.String, ",")
+			sort.Strings(listNames)
+		}
+		if err = fn(&r, listNames); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
 }
 
-// Close the connection to Sqlite3
+// scanListResults reads ip_results rows selected in the column order of
+// QueryListResults and closes them
+func scanListResults(rows *sql.Rows) ([]*model.ListResult, error) {
+	defer rows.Close()
+
+	var results []*model.ListResult
+	for rows.Next() {
+		var r model.ListResult
+		err := rows.Scan(
+			&r.IPAddress,
+			&r.Blocklist,
+			&r.Listed,
+			&r.ResponseCode,
+			&r.Reason,
+			&r.Category,
+			unixTime{&r.CheckedAt},
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		r.Cached = true
+		results = append(results, &r)
+	}
+	return results, rows.Err()
+}
+
+// timestampFormats are the forms timestamps come back in when the driver
+// doesn't parse them itself: SQLite's for expressions, MySQL's without
+// parseTime
+var timestampFormats = []string{"2006-01-02 15:04:05.999999999-07:00", "2006-01-02 15:04:05.999999999", time.RFC3339Nano}
+
+// timestamp returns the value of a timestamp column for a Unix time
+func timestamp(unix int) time.Time {
+	return time.Unix(int64(unix), 0).UTC()
+}
+
+// unixTime scans a timestamp column into the Unix time it holds, 0 for NULL
+type unixTime struct {
+	unix *int
+}
+
+// Scan implements sql.Scanner
+func (u unixTime) Scan(value interface{}) error {
+	switch v := value.(type) {
+	case nil:
+		*u.unix = 0
+		return nil
+	case time.Time:
+		*u.unix = int(v.Unix())
+		return nil
+	case []byte:
+		value = string(v)
+	}
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("can't scan %T into a timestamp", value)
+	}
+	for _, f := range timestampFormats {
+		if t, err := time.ParseInLocation(f, s, time.UTC); err == nil {
+			*u.unix = int(t.Unix())
+			return nil
+		}
+	}
+	return fmt.Errorf("can't parse timestamp %q", s)
+}
+
+// placeholders returns n comma separated bind parameters
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?,", n), ",")
+}
+
+// Close the connection to the database
 func (db *Db) Close() error {
+	db.stmtsMu.Lock()
+	for query, stmt := range db.stmts {
+		stmt.Close()
+		delete(db.stmts, query)
+	}
+	db.stmtsMu.Unlock()
 	return db.Conn.Close()
 }
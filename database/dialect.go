@@ -0,0 +1,167 @@
+package database
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+// dialect holds what differs between the SQL backends. Queries are written
+// with `?` placeholders and rebound for the backends that number them.
+type dialect struct {
+	driver string
+	// groupConcat aggregates a column into a comma separated string
+	groupConcat string
+	// numbered placeholders, $1, $2...
+	numbered bool
+	// lock waits for, and unlock releases, the lock held while migrating
+	lock, unlock string
+	// catalog queries counting the tables named ?, the columns of table ?
+	// named ?, and the indexes of table ? named ?
+	hasTable, hasColumn, hasIndex string
+}
+
+var sqliteDialect = &dialect{
+	driver:      config.DbDriverSQLite,
+	groupConcat: "group_concat(%s)",
+	hasTable:    `SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = ?`,
+	hasColumn:   `SELECT COUNT(*) FROM pragma_table_info(?) WHERE name = ?`,
+	hasIndex:    `SELECT COUNT(*) FROM sqlite_master WHERE type = 'index' AND tbl_name = ? AND name = ?`,
+}
+
+var mysqlDialect = &dialect{
+	driver:      config.DbDriverMySQL,
+	groupConcat: "GROUP_CONCAT(%s)",
+	lock:        "SELECT GET_LOCK('sw_dnsbl_migrate', 60)",
+	unlock:      "SELECT RELEASE_LOCK('sw_dnsbl_migrate')",
+	hasTable:    `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = DATABASE() AND table_name = ?`,
+	hasColumn:   `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = DATABASE() AND table_name = ? AND column_name = ?`,
+	hasIndex:    `SELECT COUNT(*) FROM information_schema.statistics WHERE table_schema = DATABASE() AND table_name = ? AND index_name = ?`,
+}
+
+var postgresDialect = &dialect{
+	driver:      config.DbDriverPostgres,
+	groupConcat: "string_agg(%s, ',')",
+	numbered:    true,
+	lock:        "SELECT pg_advisory_lock(5377366)",
+	unlock:      "SELECT pg_advisory_unlock(5377366)",
+	hasTable:    `SELECT COUNT(*) FROM information_schema.tables WHERE table_schema = current_schema() AND table_name = ?`,
+	hasColumn:   `SELECT COUNT(*) FROM information_schema.columns WHERE table_schema = current_schema() AND table_name = ? AND column_name = ?`,
+	hasIndex:    `SELECT COUNT(*) FROM pg_indexes WHERE schemaname = current_schema() AND tablename = ? AND indexname = ?`,
+}
+
+// dialectFor returns the dialect of a DB_DRIVER
+func dialectFor(driver string) (*dialect, error) {
+	switch driver {
+	case "", config.DbDriverSQLite:
+		return sqliteDialect, nil
+	case config.DbDriverMySQL:
+		return mysqlDialect, nil
+	case config.DbDriverPostgres:
+		return postgresDialect, nil
+	}
+	return nil, fmt.Errorf("unknown database driver %s", driver)
+}
+
+// dsn returns the data source name for the networked backends, DB_DSN if set,
+// else one built from the MYSQL_* settings
+func (d *dialect) dsn(c *config.APIConfig) string {
+	if c.DbDSN != "" {
+		return c.DbDSN
+	}
+	host := c.DbHost
+	if host == "" {
+		host = "localhost"
+	}
+
+	if d.driver == config.DbDriverPostgres {
+		port := c.DbPort
+		if port == "" {
+			port = "5432"
+		}
+		// like MySQL, without TLS unless asked for with DB_DSN
+		u := url.URL{
+			Scheme:   "postgres",
+			User:     url.UserPassword(c.DbUser, c.DbPassword),
+			Host:     net.JoinHostPort(host, port),
+			Path:     "/" + c.DbName,
+			RawQuery: "sslmode=disable",
+		}
+		return u.String()
+	}
+
+	port := c.DbPort
+	if port == "" {
+		port = "3306"
+	}
+	mc := mysql.NewConfig()
+	mc.User = c.DbUser
+	mc.Passwd = c.DbPassword
+	mc.Net = "tcp"
+	mc.Addr = net.JoinHostPort(host, port)
+	mc.DBName = c.DbName
+	return mc.FormatDSN()
+}
+
+// rebind replaces the `?` placeholders of query with the dialect's own,
+// leaving the ones in quoted strings and identifiers alone
+func (d *dialect) rebind(query string) string {
+	if !d.numbered {
+		return query
+	}
+	var b strings.Builder
+	n := 0
+	// the quote the current quoted text ends with, 0 outside one; a doubled
+	// quote inside ends and restarts it, which comes out the same
+	var quote rune
+	for _, r := range query {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			}
+		case r == '\'' || r == '"':
+			quote = r
+		case r == '?':
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// upsert returns an insert of cols into table that updates the update
+// columns of the row already holding the key
+func (d *dialect) upsert(table string, cols, key, update []string) string {
+	sets := make([]string, len(update))
+	for i, col := range update {
+		sets[i] = col + " = " + d.excluded(col)
+	}
+	return d.upsertSet(table, cols, key, sets)
+}
+
+// upsertSet is upsert with the assignments of the update given as sets, which
+// can use excluded for the values being inserted
+func (d *dialect) upsertSet(table string, cols, key, sets []string) string {
+	query := "INSERT INTO " + table + "(" + strings.Join(cols, ", ") + ") VALUES(" + placeholders(len(cols)) + ")"
+	if d.driver == config.DbDriverMySQL {
+		return query + " ON DUPLICATE KEY UPDATE " + strings.Join(sets, ", ")
+	}
+	return query + " ON CONFLICT(" + strings.Join(key, ", ") + ") DO UPDATE SET " + strings.Join(sets, ", ")
+}
+
+// excluded returns the value an upsert tried to insert into col
+func (d *dialect) excluded(col string) string {
+	if d.driver == config.DbDriverMySQL {
+		return "VALUES(" + col + ")"
+	}
+	return "excluded." + col
+}
@@ -0,0 +1,82 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+func TestDialect(t *testing.T) {
+	t.Run("dialect_for", func(t *testing.T) {
+		for driver, want := range map[string]*dialect{
+			"":                      sqliteDialect,
+			config.DbDriverSQLite:   sqliteDialect,
+			config.DbDriverMySQL:    mysqlDialect,
+			config.DbDriverPostgres: postgresDialect,
+		} {
+			d, err := dialectFor(driver)
+			require.Equal(t, nil, err)
+			assert.Equal(t, want, d)
+		}
+		_, err := dialectFor("oracle")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("dsn", func(t *testing.T) {
+		c := &config.APIConfig{
+			DbHost:     "db",
+			DbName:     "sw_dnsbl",
+			DbUser:     "mysql_admin",
+			DbPassword: "p@ss word",
+		}
+		assert.Equal(t, "mysql_admin:p@ss word@tcp(db:3306)/sw_dnsbl", mysqlDialect.dsn(c))
+		assert.Equal(t, "postgres://mysql_admin:p%40ss%20word@db:5432/sw_dnsbl?sslmode=disable", postgresDialect.dsn(c))
+
+		c.DbPort = "6543"
+		c.DbHost = ""
+		assert.Equal(t, "mysql_admin:p@ss word@tcp(localhost:6543)/sw_dnsbl", mysqlDialect.dsn(c))
+
+		c.DbDSN = "postgres://db/other?sslmode=verify-full"
+		assert.Equal(t, c.DbDSN, postgresDialect.dsn(c))
+	})
+
+	t.Run("rebind", func(t *testing.T) {
+		query := "SELECT 1 FROM ip_results WHERE ip_address = ? AND blocklist IN (?,?)"
+		assert.Equal(t, query, sqliteDialect.rebind(query))
+		assert.Equal(t, query, mysqlDialect.rebind(query))
+		assert.Equal(t, "SELECT 1 FROM ip_results WHERE ip_address = $1 AND blocklist IN ($2,$3)", postgresDialect.rebind(query))
+
+		query = `SELECT 'why?', 'it''s ?', "odd?col" FROM ip_results WHERE ip_address = ?`
+		assert.Equal(t, `SELECT 'why?', 'it''s ?', "odd?col" FROM ip_results WHERE ip_address = $1`, postgresDialect.rebind(query))
+	})
+
+	t.Run("upsert", func(t *testing.T) {
+		cols := []string{"ip_address", "uuid", "response_code"}
+		key := []string{"ip_address"}
+		update := []string{"response_code"}
+		assert.Equal(t,
+			"INSERT INTO ip_details(ip_address, uuid, response_code) VALUES(?,?,?) ON CONFLICT(ip_address) DO UPDATE SET response_code = excluded.response_code",
+			sqliteDialect.upsert("ip_details", cols, key, update))
+		assert.Equal(t,
+			"INSERT INTO ip_details(ip_address, uuid, response_code) VALUES(?,?,?) ON DUPLICATE KEY UPDATE response_code = VALUES(response_code)",
+			mysqlDialect.upsert("ip_details", cols, key, update))
+		assert.Equal(t, sqliteDialect.upsert("ip_details", cols, key, update), postgresDialect.upsert("ip_details", cols, key, update))
+	})
+
+	t.Run("upsert_set", func(t *testing.T) {
+		cols := []string{"day", "lookups"}
+		key := []string{"day"}
+		for _, d := range []*dialect{sqliteDialect, mysqlDialect} {
+			sets := []string{"lookups = ip_history_daily.lookups + " + d.excluded("lookups")}
+			query := d.upsertSet("ip_history_daily", cols, key, sets)
+			if d == mysqlDialect {
+				assert.Equal(t, "INSERT INTO ip_history_daily(day, lookups) VALUES(?,?) ON DUPLICATE KEY UPDATE lookups = ip_history_daily.lookups + VALUES(lookups)", query)
+			} else {
+				assert.Equal(t, "INSERT INTO ip_history_daily(day, lookups) VALUES(?,?) ON CONFLICT(day) DO UPDATE SET lookups = ip_history_daily.lookups + excluded.lookups", query)
+			}
+		}
+	})
+}
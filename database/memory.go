@@ -0,0 +1,644 @@
+package database
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// ErrClosed is returned by a Memory store used after Close
+var ErrClosed = errors.New("store is closed")
+
+// Memory is the Store kept in maps, picked by DB_DRIVER=memory for tests and
+// ephemeral runs that shouldn't touch disk. It behaves like the SQL backends,
+// QueryRecord returning sql.ErrNoRows for an unknown ip included, but all of
+// it is gone once the process exits.
+type Memory struct {
+	mu      sync.RWMutex
+	closed  bool
+	records map[string]*model.Record
+	// results by ip, then blocklist
+	results map[string]map[string]*model.ListResult
+	history []*model.ListResult
+	daily   map[dailyKey]*DailySummary
+	// the ips of each compacted summary, and whether they were listed
+	dailyIPs map[dailyKey]map[string]bool
+}
+
+// dailyKey is what a DailySummary is grouped by
+type dailyKey struct {
+	day                               int
+	blocklist, responseCode, category string
+}
+
+// NewMemory function returns a new, empty Memory store
+func NewMemory() *Memory {
+	return &Memory{
+		records:  make(map[string]*model.Record),
+		results:  make(map[string]map[string]*model.ListResult),
+		daily:    make(map[dailyKey]*DailySummary),
+		dailyIPs: make(map[dailyKey]map[string]bool),
+	}
+}
+
+// UpsertRecord func inserts if not exists, else update record
+func (m *Memory) UpsertRecord(r *model.Record) error {
+	return m.WriteBatch(&Batch{Records: []*model.Record{r}})
+}
+
+// WriteBatch func stores the records of b like UpsertRecord, then its list
+// results like UpsertListResult
+func (m *Memory) WriteBatch(b *Batch) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return ErrClosed
+	}
+
+	for _, r := range b.Records {
+		if stored, ok := m.records[r.IPAddress]; ok {
+			stored.ResponseCode = r.ResponseCode
+			stored.UpdatedAt = r.UpdatedAt
+			stored.Error = copyString(r.Error)
+			continue
+		}
+		m.records[r.IPAddress] = copyRecord(r)
+	}
+	for _, r := range b.Results {
+		history := copyListResult(r)
+		history.Cached = true
+		history.Reason = nil
+		m.history = append(m.history, history)
+		// a failed lookup says nothing about the listing, only the history
+		// keeps it
+		if r.Error != nil {
+			continue
+		}
+
+		lists, ok := m.results[r.IPAddress]
+		if !ok {
+			lists = make(map[string]*model.ListResult)
+			m.results[r.IPAddress] = lists
+		}
+		stored := copyListResult(r)
+		stored.Cached = true
+		lists[r.Blocklist] = stored
+	}
+	return nil
+}
+
+// QueryRecord func searches for a record
+func (m *Memory) QueryRecord(ip string) (*model.Record, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	r, ok := m.records[ip]
+	if !ok {
+		return nil, sql.ErrNoRows
+	}
+	return copyRecord(r), nil
+}
+
+// UpsertListResult func stores the result of a single ip/blocklist lookup,
+// replacing any previous result for the pair unless the lookup failed, and
+// adds it to the history
+func (m *Memory) UpsertListResult(r *model.ListResult) error {
+	return m.WriteBatch(&Batch{Results: []*model.ListResult{r}})
+}
+
+// QueryListResults func returns every stored blocklist result for an ip,
+// ordered by blocklist
+func (m *Memory) QueryListResults(ip string) ([]*model.ListResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	var results []*model.ListResult
+	for _, r := range m.results[ip] {
+		results = append(results, copyListResult(r))
+	}
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Blocklist < results[j].Blocklist
+	})
+	return results, nil
+}
+
+// QueryListedResults func returns every stored result that is a listing,
+// optionally only for the given blocklists and/or categories, ordered by ip
+// and blocklist
+func (m *Memory) QueryListedResults(blocklists, categories []string) ([]*model.ListResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	var results []*model.ListResult
+	for _, lists := range m.results {
+		for _, r := range lists {
+			if !r.Listed {
+				continue
+			}
+			if len(blocklists) > 0 && !contains(blocklists, r.Blocklist) {
+				continue
+			}
+			if len(categories) > 0 && !contains(categories, r.Category) {
+				continue
+			}
+			results = append(results, copyListResult(r))
+		}
+	}
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].IPAddress != results[j].IPAddress {
+			return results[i].IPAddress < results[j].IPAddress
+		}
+		return results[i].Blocklist < results[j].Blocklist
+	})
+	return results, nil
+}
+
+// EachRecord func calls fn with every record matching f, ordered by ip, and
+// the blocklists currently listing it. The matching records are copied
+// first, so fn may use the store; an error from fn stops the iteration and is
+// returned.
+func (m *Memory) EachRecord(f RecordFilter, fn func(r *model.Record, lists []string) error) error {
+	type match struct {
+		record *model.Record
+		lists  []string
+	}
+
+	m.mu.RLock()
+	if m.closed {
+		m.mu.RUnlock()
+		return ErrClosed
+	}
+	var matches []match
+	for ip, r := range m.records {
+		if f.UpdatedSince != 0 && r.UpdatedAt < f.UpdatedSince {
+			continue
+		}
+		if f.Listed || len(f.Lists) > 0 {
+			if !m.hasResult(ip, func(lr *model.ListResult) bool {
+				return (!f.Listed || lr.Listed) && (len(f.Lists) == 0 || contains(f.Lists, lr.Blocklist))
+			}) {
+				continue
+			}
+		}
+		matches = append(matches, match{copyRecord(r), m.listedOn(ip)})
+	}
+	m.mu.RUnlock()
+
+	sort.Slice(matches, func(i, j int) bool {
+		return matches[i].record.IPAddress < matches[j].record.IPAddress
+	})
+	for _, mt := range matches {
+		if err := fn(mt.record, mt.lists); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// QueryRecords func returns a page of the records matching q, most recently
+// updated first, and whether more records follow it
+func (m *Memory) QueryRecords(q RecordQuery) ([]*model.Record, bool, error) {
+	if q.First <= 0 {
+		return nil, false, fmt.Errorf("page size must be greater than 0")
+	}
+	switch q.Status {
+	case "", StatusListed, StatusNotListed, StatusError:
+	default:
+		return nil, false, fmt.Errorf("unknown record status %s", q.Status)
+	}
+	afterUpdatedAt, afterIP := 0, ""
+	if q.After != "" {
+		var err error
+		afterUpdatedAt, afterIP, err = parseCursor(q.After)
+		if err != nil {
+			return nil, false, err
+		}
+	}
+
+	// the same ip_key range the SQL stores filter on
+	var networkFirst, networkLast []byte
+	if q.Network != nil {
+		networkFirst, networkLast = networkRange(q.Network)
+	}
+
+	onList := func(lr *model.ListResult) bool { return lr.Blocklist == q.Blocklist }
+	isListed := func(lr *model.ListResult) bool { return lr.Listed }
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, false, ErrClosed
+	}
+
+	var records []*model.Record
+	for ip, r := range m.records {
+		switch q.Status {
+		case "":
+			if q.Blocklist != "" && !m.hasResult(ip, onList) {
+				continue
+			}
+		case StatusListed, StatusNotListed:
+			listed := q.Status == StatusListed
+			if q.Blocklist != "" {
+				if !m.hasResult(ip, func(lr *model.ListResult) bool { return onList(lr) && lr.Listed == listed }) {
+					continue
+				}
+			} else if listed != m.hasResult(ip, isListed) {
+				continue
+			} else if !listed && r.Error != nil {
+				continue
+			}
+		case StatusError:
+			if r.Error == nil || (q.Blocklist != "" && !m.hasResult(ip, onList)) {
+				continue
+			}
+		}
+
+		if q.ResponseCode != "" && r.ResponseCode != q.ResponseCode {
+			continue
+		}
+		if q.UpdatedSince != 0 && r.UpdatedAt < q.UpdatedSince {
+			continue
+		}
+		if q.UpdatedUntil != 0 && r.UpdatedAt > q.UpdatedUntil {
+			continue
+		}
+		if q.Network != nil && !inRange(ipKey(ip), networkFirst, networkLast) {
+			continue
+		}
+		if q.After != "" && (r.UpdatedAt > afterUpdatedAt || (r.UpdatedAt == afterUpdatedAt && ip >= afterIP)) {
+			continue
+		}
+		records = append(records, r)
+	}
+
+	sort.Slice(records, func(i, j int) bool {
+		if records[i].UpdatedAt != records[j].UpdatedAt {
+			return records[i].UpdatedAt > records[j].UpdatedAt
+		}
+		return records[i].IPAddress > records[j].IPAddress
+	})
+	hasNext := len(records) > q.First
+	if hasNext {
+		records = records[:q.First]
+	}
+	page := make([]*model.Record, len(records))
+	for i, r := range records {
+		page[i] = copyRecord(r)
+	}
+	return page, hasNext, nil
+}
+
+// PruneRecords func deletes the records updated before the Unix time before
+// that are clean, i.e. listed nowhere and with a successful last lookup,
+// along with their list results, and returns how many records it deleted
+func (m *Memory) PruneRecords(before int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	removed := 0
+	for ip, r := range m.records {
+		if r.UpdatedAt >= before || r.Error != nil {
+			continue
+		}
+		if m.hasResult(ip, func(lr *model.ListResult) bool { return lr.Listed }) {
+			continue
+		}
+		delete(m.records, ip)
+		delete(m.results, ip)
+		removed++
+	}
+	return removed, nil
+}
+
+// CompactHistory func rolls the history of the days ending by the Unix time
+// before up into the daily summaries, adding to the ones already there, and
+// removes it. It returns how many lookups it removed.
+func (m *Memory) CompactHistory(before int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	// only whole days, so a day is never summarized from part of its lookups
+	before = dayStart(before)
+	summaries := make(map[dailyKey]*DailySummary)
+	ips := make(map[dailyKey]map[string]bool)
+	var kept []*model.ListResult
+	for _, r := range m.history {
+		if r.CheckedAt >= before {
+			kept = append(kept, r)
+			continue
+		}
+		key := dailyKey{dayStart(r.CheckedAt), r.Blocklist, r.ResponseCode, r.Category}
+		s, ok := summaries[key]
+		if !ok {
+			s = &DailySummary{Day: key.day, Blocklist: key.blocklist, ResponseCode: key.responseCode, Category: key.category}
+			summaries[key] = s
+			ips[key] = make(map[string]bool)
+		}
+		s.Lookups++
+		if r.Listed {
+			s.Listed++
+		}
+		if r.Error != nil {
+			s.Errors++
+		}
+		ips[key][r.IPAddress] = true
+		if m.dailyIPs[key] == nil {
+			m.dailyIPs[key] = make(map[string]bool)
+		}
+		m.dailyIPs[key][r.IPAddress] = m.dailyIPs[key][r.IPAddress] || r.Listed
+	}
+
+	for key, s := range summaries {
+		s.IPs = len(ips[key])
+		if stored, ok := m.daily[key]; ok {
+			stored.Lookups += s.Lookups
+			stored.Listed += s.Listed
+			stored.Errors += s.Errors
+			stored.IPs += s.IPs
+			continue
+		}
+		m.daily[key] = s
+	}
+	removed := len(m.history) - len(kept)
+	m.history = kept
+	return removed, nil
+}
+
+// PruneDailyIPs func deletes the ips kept for the compacted days ending by
+// the Unix time before, leaving their daily summaries, and returns how many it
+// deleted
+func (m *Memory) PruneDailyIPs(before int) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return 0, ErrClosed
+	}
+
+	before = dayStart(before)
+	removed := 0
+	for key, ips := range m.dailyIPs {
+		if key.day < before {
+			removed += len(ips)
+			delete(m.dailyIPs, key)
+		}
+	}
+	return removed, nil
+}
+
+// QueryHistory func returns the lookups of ip not compacted yet, failed ones
+// with their error, oldest first
+func (m *Memory) QueryHistory(ip string) ([]*model.ListResult, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	var history []*model.ListResult
+	for _, r := range m.history {
+		if r.IPAddress == ip {
+			history = append(history, copyListResult(r))
+		}
+	}
+	sort.SliceStable(history, func(i, j int) bool {
+		if history[i].CheckedAt != history[j].CheckedAt {
+			return history[i].CheckedAt < history[j].CheckedAt
+		}
+		return history[i].Blocklist < history[j].Blocklist
+	})
+	return history, nil
+}
+
+// QueryDailySummaries func returns the daily summaries of the days starting
+// from the Unix time from until to, both inclusive if not 0, ordered by day,
+// blocklist, response code and category
+func (m *Memory) QueryDailySummaries(from, to int) ([]*DailySummary, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	var summaries []*DailySummary
+	for _, s := range m.daily {
+		if (from != 0 && s.Day < from) || (to != 0 && s.Day > to) {
+			continue
+		}
+		copied := *s
+		summaries = append(summaries, &copied)
+	}
+	sort.Slice(summaries, func(i, j int) bool {
+		a, b := summaries[i], summaries[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Blocklist != b.Blocklist {
+			return a.Blocklist < b.Blocklist
+		}
+		if a.ResponseCode != b.ResponseCode {
+			return a.ResponseCode < b.ResponseCode
+		}
+		return a.Category < b.Category
+	})
+	return summaries, nil
+}
+
+// QueryStats func returns the counts of the lookups matching q, from the
+// history and the compacted days, ordered by group. Compacted days count when
+// they start from q.From until q.To. Without groups, it is a single Stats,
+// with counts of 0 if nothing matches.
+func (m *Memory) QueryStats(q StatsQuery) ([]*Stats, error) {
+	groups, err := q.groups()
+	if err != nil {
+		return nil, err
+	}
+	key := func(day int, blocklist, responseCode, category string) dailyKey {
+		var k dailyKey
+		for _, g := range groups {
+			switch g {
+			case StatsByDay:
+				k.day = day
+			case StatsByBlocklist:
+				k.blocklist = blocklist
+			case StatsByResponseCode:
+				k.responseCode = responseCode
+			case StatsByCategory:
+				k.category = category
+			}
+		}
+		return k
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	if m.closed {
+		return nil, ErrClosed
+	}
+
+	byKey := make(map[dailyKey]*Stats)
+	get := func(k dailyKey) *Stats {
+		s, ok := byKey[k]
+		if !ok {
+			s = &Stats{Day: k.day, Blocklist: k.blocklist, ResponseCode: k.responseCode, Category: k.category}
+			byKey[k] = s
+		}
+		return s
+	}
+	// the ips of each group, and whether they were listed
+	ips := make(map[dailyKey]map[string]bool)
+	addIP := func(k dailyKey, ip string, listed bool) {
+		if ips[k] == nil {
+			ips[k] = make(map[string]bool)
+		}
+		ips[k][ip] = ips[k][ip] || listed
+	}
+	for _, r := range m.history {
+		if (q.From != 0 && r.CheckedAt < q.From) || (q.To != 0 && r.CheckedAt > q.To) {
+			continue
+		}
+		k := key(dayStart(r.CheckedAt), r.Blocklist, r.ResponseCode, r.Category)
+		s := get(k)
+		s.Lookups++
+		if r.Listed {
+			s.Listed++
+		}
+		if r.Error != nil {
+			s.Errors++
+		}
+		addIP(k, r.IPAddress, r.Listed)
+	}
+	for _, d := range m.daily {
+		if (q.From != 0 && d.Day < q.From) || (q.To != 0 && d.Day > q.To) {
+			continue
+		}
+		k := key(d.Day, d.Blocklist, d.ResponseCode, d.Category)
+		s := get(k)
+		s.Lookups += d.Lookups
+		s.Listed += d.Listed
+		s.Errors += d.Errors
+		for ip, listed := range m.dailyIPs[dailyKey{d.Day, d.Blocklist, d.ResponseCode, d.Category}] {
+			addIP(k, ip, listed)
+		}
+	}
+	for k, set := range ips {
+		s := byKey[k]
+		s.IPs = len(set)
+		for _, listed := range set {
+			if listed {
+				s.ListedIPs++
+			}
+		}
+	}
+
+	stats := make([]*Stats, 0, len(byKey))
+	for _, s := range byKey {
+		stats = append(stats, s)
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		a, b := stats[i], stats[j]
+		if a.Day != b.Day {
+			return a.Day < b.Day
+		}
+		if a.Blocklist != b.Blocklist {
+			return a.Blocklist < b.Blocklist
+		}
+		if a.ResponseCode != b.ResponseCode {
+			return a.ResponseCode < b.ResponseCode
+		}
+		return a.Category < b.Category
+	})
+	if len(groups) == 0 && len(stats) == 0 {
+		stats = append(stats, &Stats{})
+	}
+	return stats, nil
+}
+
+// Close drops everything stored; the store can't be used afterwards
+func (m *Memory) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.closed = true
+	m.records = nil
+	m.results = nil
+	m.history = nil
+	m.daily = nil
+	m.dailyIPs = nil
+	return nil
+}
+
+// hasResult returns whether one of the list results of ip matches; m.mu must
+// be held
+func (m *Memory) hasResult(ip string, match func(lr *model.ListResult) bool) bool {
+	for _, lr := range m.results[ip] {
+		if match(lr) {
+			return true
+		}
+	}
+	return false
+}
+
+// listedOn returns the sorted blocklists listing ip; m.mu must be held
+func (m *Memory) listedOn(ip string) []string {
+	var lists []string
+	for _, lr := range m.results[ip] {
+		if lr.Listed {
+			lists = append(lists, lr.Blocklist)
+		}
+	}
+	sort.Strings(lists)
+	return lists
+}
+
+// contains returns whether s is one of values
+func contains(values []string, s string) bool {
+	for _, v := range values {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// copyRecord returns a copy of r sharing nothing with it
+func copyRecord(r *model.Record) *model.Record {
+	c := *r
+	c.Error = copyString(r.Error)
+	return &c
+}
+
+// copyListResult returns a copy of r sharing nothing with it
+func copyListResult(r *model.ListResult) *model.ListResult {
+	c := *r
+	c.Reason = copyString(r.Reason)
+	c.Error = copyString(r.Error)
+	return &c
+}
+
+// copyString returns a pointer to a copy of *s, or nil for nil
+func copyString(s *string) *string {
+	if s == nil {
+		return nil
+	}
+	c := *s
+	return &c
+}
@@ -0,0 +1,69 @@
+package database
+
+import (
+	"database/sql"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestMemory(t *testing.T) {
+	t.Run("new_store", func(t *testing.T) {
+		db, err := NewStore(&config.APIConfig{DbDriver: config.DbDriverMemory})
+		require.Equal(t, nil, err)
+		_, ok := db.(*Memory)
+		assert.Equal(t, true, ok)
+		assert.Equal(t, nil, db.Close())
+	})
+
+	t.Run("no_record", func(t *testing.T) {
+		db := NewMemory()
+		defer db.Close()
+
+		_, err := db.QueryRecord("127.0.0.1")
+		assert.Equal(t, sql.ErrNoRows, err)
+	})
+
+	t.Run("copies", func(t *testing.T) {
+		db := NewMemory()
+		defer db.Close()
+
+		// what is stored or returned can be changed without changing the store
+		record := &model.Record{IPAddress: "127.0.0.2", UUID: "uuid-2", ResponseCode: "127.0.0.2", UpdatedAt: 100}
+		require.Equal(t, nil, db.UpsertRecord(record))
+		record.ResponseCode = "NXDOMAIN"
+		r, err := db.QueryRecord("127.0.0.2")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "127.0.0.2", r.ResponseCode)
+		r.UpdatedAt = 200
+		r, err = db.QueryRecord("127.0.0.2")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 100, r.UpdatedAt)
+
+		reason := "listed for testing"
+		result := &model.ListResult{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, Reason: &reason}
+		require.Equal(t, nil, db.UpsertListResult(result))
+		reason = "changed"
+		results, err := db.QueryListResults("127.0.0.2")
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, "listed for testing", *results[0].Reason)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+		db := NewMemory()
+		require.Equal(t, nil, db.UpsertRecord(&model.Record{IPAddress: "127.0.0.2"}))
+		require.Equal(t, nil, db.Close())
+
+		_, err := db.QueryRecord("127.0.0.2")
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, ErrClosed, db.UpsertRecord(&model.Record{IPAddress: "127.0.0.3"}))
+		_, err = db.PruneRecords(100)
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, ErrClosed, db.EachRecord(RecordFilter{}, func(r *model.Record, lists []string) error { return nil }))
+	})
+}
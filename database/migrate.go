@@ -0,0 +1,621 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+// migration is a step of the schema, with the statements applying it on each
+// backend. Migrations are applied in version order, each recorded in the
+// schema_version table once applied.
+type migration struct {
+	version     int
+	description string
+	up          map[string][]string
+	// adds, if set, is the column or index each statement of up adds, in
+	// order. A statement is skipped when the catalog already has it, as in
+	// SQLite databases from before schema_version, or MySQL ones where a
+	// migration failed half way, MySQL having no transactional DDL.
+	adds []schemaObject
+	// fill, if set, runs after the statements, for data SQL can't compute
+	fill func(ctx context.Context, tx *sql.Tx, d *dialect) error
+}
+
+// schemaObject is a column, or with index set an index, of table
+type schemaObject struct {
+	table, column, index string
+}
+
+// exists reports whether the catalog has o
+func (o schemaObject) exists(ctx context.Context, q queryer, d *dialect) (bool, error) {
+	query, args := d.hasColumn, []interface{}{o.table, o.column}
+	if o.index != "" {
+		query, args = d.hasIndex, []interface{}{o.table, o.index}
+	}
+	var n int
+	err := q.QueryRowContext(ctx, d.rebind(query), args...).Scan(&n)
+	return n > 0, err
+}
+
+// migrations are the whole schema, oldest first. Add new ones at the end and
+// never change one that was released.
+var migrations = []migration{
+	{
+		version:     1,
+		description: "create ip_details",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE IF NOT EXISTS ip_details (
+					ip_address TEXT PRIMARY KEY NOT NULL,
+					uuid TEXT NOT NULL,
+					response_code text,
+					created_at TEXT,
+					updated_at TEXT
+				)
+			`},
+			// the networked backends keep ips and blocklists as byte strings
+			// so they sort the same as in SQLite
+			config.DbDriverMySQL: {`
+				CREATE TABLE IF NOT EXISTS ip_details (
+					ip_address VARCHAR(45) CHARACTER SET ascii COLLATE ascii_bin NOT NULL PRIMARY KEY,
+					uuid VARCHAR(36) NOT NULL,
+					response_code VARCHAR(255),
+					created_at BIGINT,
+					updated_at BIGINT
+				)
+			`},
+			config.DbDriverPostgres: {`
+				CREATE TABLE IF NOT EXISTS ip_details (
+					ip_address VARCHAR(45) COLLATE "C" PRIMARY KEY NOT NULL,
+					uuid VARCHAR(36) NOT NULL,
+					response_code VARCHAR(255),
+					created_at BIGINT,
+					updated_at BIGINT
+				)
+			`},
+		},
+	},
+	{
+		version:     2,
+		description: "create ip_results",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE IF NOT EXISTS ip_results (
+					ip_address TEXT NOT NULL,
+					blocklist TEXT NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code TEXT,
+					reason TEXT,
+					updated_at TEXT,
+					PRIMARY KEY (ip_address, blocklist)
+				)
+			`},
+			config.DbDriverMySQL: {`
+				CREATE TABLE IF NOT EXISTS ip_results (
+					ip_address VARCHAR(45) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					blocklist VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code VARCHAR(255),
+					reason TEXT,
+					category VARCHAR(32) NOT NULL DEFAULT '',
+					updated_at BIGINT,
+					PRIMARY KEY (ip_address, blocklist)
+				)
+			`},
+			config.DbDriverPostgres: {`
+				CREATE TABLE IF NOT EXISTS ip_results (
+					ip_address VARCHAR(45) COLLATE "C" NOT NULL,
+					blocklist VARCHAR(255) COLLATE "C" NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code VARCHAR(255),
+					reason TEXT,
+					category VARCHAR(32) NOT NULL DEFAULT '',
+					updated_at BIGINT,
+					PRIMARY KEY (ip_address, blocklist)
+				)
+			`},
+		},
+	},
+	{
+		// the networked backends had the category from the start
+		version:     3,
+		description: "add ip_results.category",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`ALTER TABLE ip_results ADD COLUMN category TEXT NOT NULL DEFAULT ''`},
+		},
+		adds: []schemaObject{{table: "ip_results", column: "category"}},
+	},
+	{
+		// SQLite can't change a column's type, so the tables are copied;
+		// the networked backends had BIGINT timestamps from the start
+		version:     4,
+		description: "store timestamps as integers",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE ip_details_typed (
+					ip_address TEXT PRIMARY KEY NOT NULL,
+					uuid TEXT NOT NULL,
+					response_code TEXT,
+					created_at INTEGER,
+					updated_at INTEGER
+				)
+			`, `
+				INSERT INTO ip_details_typed
+				SELECT ip_address, uuid, response_code, CAST(created_at AS INTEGER), CAST(updated_at AS INTEGER)
+				FROM ip_details
+			`,
+				`DROP TABLE ip_details`,
+				`ALTER TABLE ip_details_typed RENAME TO ip_details`,
+				`
+				CREATE TABLE ip_results_typed (
+					ip_address TEXT NOT NULL,
+					blocklist TEXT NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code TEXT,
+					reason TEXT,
+					category TEXT NOT NULL DEFAULT '',
+					updated_at INTEGER,
+					PRIMARY KEY (ip_address, blocklist)
+				)
+			`, `
+				INSERT INTO ip_results_typed
+				SELECT ip_address, blocklist, listed, response_code, reason, category, CAST(updated_at AS INTEGER)
+				FROM ip_results
+			`,
+				`DROP TABLE ip_results`,
+				`ALTER TABLE ip_results_typed RENAME TO ip_results`,
+			},
+		},
+	},
+	{
+		// for time ranges like everything listed in the last day, and lookups
+		// by response code
+		version:     5,
+		description: "index timestamps and response codes",
+		up: map[string][]string{
+			config.DbDriverSQLite: {
+				`CREATE INDEX IF NOT EXISTS ip_details_updated_at ON ip_details (updated_at)`,
+				`CREATE INDEX IF NOT EXISTS ip_details_response_code ON ip_details (response_code)`,
+				`CREATE INDEX IF NOT EXISTS ip_results_listed_updated_at ON ip_results (listed, updated_at)`,
+			},
+			config.DbDriverMySQL: {
+				`CREATE INDEX ip_details_updated_at ON ip_details (updated_at)`,
+				`CREATE INDEX ip_details_response_code ON ip_details (response_code)`,
+				`CREATE INDEX ip_results_listed_updated_at ON ip_results (listed, updated_at)`,
+			},
+			config.DbDriverPostgres: {
+				`CREATE INDEX IF NOT EXISTS ip_details_updated_at ON ip_details (updated_at)`,
+				`CREATE INDEX IF NOT EXISTS ip_details_response_code ON ip_details (response_code)`,
+				`CREATE INDEX IF NOT EXISTS ip_results_listed_updated_at ON ip_results (listed, updated_at)`,
+			},
+		},
+		// MySQL has no IF NOT EXISTS for indexes
+		adds: []schemaObject{
+			{table: "ip_details", index: "ip_details_updated_at"},
+			{table: "ip_details", index: "ip_details_response_code"},
+			{table: "ip_results", index: "ip_results_listed_updated_at"},
+		},
+	},
+	{
+		version:     6,
+		description: "add ip_details.lookup_error",
+		up: map[string][]string{
+			config.DbDriverSQLite:   {`ALTER TABLE ip_details ADD COLUMN lookup_error TEXT`},
+			config.DbDriverMySQL:    {`ALTER TABLE ip_details ADD COLUMN lookup_error TEXT`},
+			config.DbDriverPostgres: {`ALTER TABLE ip_details ADD COLUMN IF NOT EXISTS lookup_error TEXT`},
+		},
+		adds: []schemaObject{{table: "ip_details", column: "lookup_error"}},
+	},
+	{
+		// every lookup, until the pruner rolls it up into daily summaries
+		version:     7,
+		description: "create ip_history and ip_history_daily",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE IF NOT EXISTS ip_history (
+					ip_address TEXT NOT NULL,
+					blocklist TEXT NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code TEXT NOT NULL DEFAULT '',
+					category TEXT NOT NULL DEFAULT '',
+					checked_at INTEGER NOT NULL
+				)
+			`,
+				`CREATE INDEX IF NOT EXISTS ip_history_checked_at ON ip_history (checked_at)`,
+				`CREATE INDEX IF NOT EXISTS ip_history_ip_address ON ip_history (ip_address)`,
+				`
+				CREATE TABLE IF NOT EXISTS ip_history_daily (
+					day INTEGER NOT NULL,
+					blocklist TEXT NOT NULL,
+					response_code TEXT NOT NULL DEFAULT '',
+					category TEXT NOT NULL DEFAULT '',
+					lookups INTEGER NOT NULL DEFAULT 0,
+					listed INTEGER NOT NULL DEFAULT 0,
+					ips INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category)
+				)
+			`},
+			config.DbDriverMySQL: {`
+				CREATE TABLE IF NOT EXISTS ip_history (
+					ip_address VARCHAR(45) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					blocklist VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code VARCHAR(255) NOT NULL DEFAULT '',
+					category VARCHAR(32) NOT NULL DEFAULT '',
+					checked_at BIGINT NOT NULL,
+					INDEX ip_history_checked_at (checked_at),
+					INDEX ip_history_ip_address (ip_address)
+				)
+			`, `
+				CREATE TABLE IF NOT EXISTS ip_history_daily (
+					day BIGINT NOT NULL,
+					blocklist VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					response_code VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '',
+					category VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '',
+					lookups BIGINT NOT NULL DEFAULT 0,
+					listed BIGINT NOT NULL DEFAULT 0,
+					ips BIGINT NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category)
+				)
+			`},
+			config.DbDriverPostgres: {`
+				CREATE TABLE IF NOT EXISTS ip_history (
+					ip_address VARCHAR(45) COLLATE "C" NOT NULL,
+					blocklist VARCHAR(255) COLLATE "C" NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code VARCHAR(255) NOT NULL DEFAULT '',
+					category VARCHAR(32) NOT NULL DEFAULT '',
+					checked_at BIGINT NOT NULL
+				)
+			`,
+				`CREATE INDEX IF NOT EXISTS ip_history_checked_at ON ip_history (checked_at)`,
+				`CREATE INDEX IF NOT EXISTS ip_history_ip_address ON ip_history (ip_address)`,
+				`
+				CREATE TABLE IF NOT EXISTS ip_history_daily (
+					day BIGINT NOT NULL,
+					blocklist VARCHAR(255) COLLATE "C" NOT NULL,
+					response_code VARCHAR(255) COLLATE "C" NOT NULL DEFAULT '',
+					category VARCHAR(32) COLLATE "C" NOT NULL DEFAULT '',
+					lookups BIGINT NOT NULL DEFAULT 0,
+					listed BIGINT NOT NULL DEFAULT 0,
+					ips BIGINT NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category)
+				)
+			`},
+		},
+	},
+	{
+		// failed lookups too, so they can be counted
+		version:     8,
+		description: "add ip_history.lookup_error and ip_history_daily.errors",
+		up: map[string][]string{
+			config.DbDriverSQLite: {
+				`ALTER TABLE ip_history ADD COLUMN lookup_error TEXT`,
+				`ALTER TABLE ip_history_daily ADD COLUMN errors INTEGER NOT NULL DEFAULT 0`,
+			},
+			config.DbDriverMySQL: {
+				`ALTER TABLE ip_history ADD COLUMN lookup_error TEXT`,
+				`ALTER TABLE ip_history_daily ADD COLUMN errors INTEGER NOT NULL DEFAULT 0`,
+			},
+			config.DbDriverPostgres: {
+				`ALTER TABLE ip_history ADD COLUMN IF NOT EXISTS lookup_error TEXT`,
+				`ALTER TABLE ip_history_daily ADD COLUMN IF NOT EXISTS errors INTEGER NOT NULL DEFAULT 0`,
+			},
+		},
+		adds: []schemaObject{
+			{table: "ip_history", column: "lookup_error"},
+			{table: "ip_history_daily", column: "errors"},
+		},
+	},
+	{
+		// the Unix seconds of ip_details and ip_results become timestamps,
+		// in UTC; the history keeps them, its days being Unix time buckets.
+		// SQLite copies the tables again, in the text form the driver
+		// writes and reads times in. MySQL has no conversion from an integer
+		// column, so the values go through a new one.
+		version:     9,
+		description: "store ip_details and ip_results timestamps as timestamps",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE ip_details_typed (
+					ip_address TEXT PRIMARY KEY NOT NULL,
+					uuid TEXT NOT NULL,
+					response_code TEXT,
+					created_at DATETIME,
+					updated_at DATETIME,
+					lookup_error TEXT
+				)
+			`, `
+				INSERT INTO ip_details_typed
+				SELECT
+					ip_address, uuid, response_code,
+					strftime('%Y-%m-%d %H:%M:%S+00:00', created_at, 'unixepoch'),
+					strftime('%Y-%m-%d %H:%M:%S+00:00', updated_at, 'unixepoch'),
+					lookup_error
+				FROM ip_details
+			`,
+				`DROP TABLE ip_details`,
+				`ALTER TABLE ip_details_typed RENAME TO ip_details`,
+				`CREATE INDEX ip_details_updated_at ON ip_details (updated_at)`,
+				`CREATE INDEX ip_details_response_code ON ip_details (response_code)`,
+				`
+				CREATE TABLE ip_results_typed (
+					ip_address TEXT NOT NULL,
+					blocklist TEXT NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					response_code TEXT,
+					reason TEXT,
+					category TEXT NOT NULL DEFAULT '',
+					updated_at DATETIME,
+					PRIMARY KEY (ip_address, blocklist)
+				)
+			`, `
+				INSERT INTO ip_results_typed
+				SELECT
+					ip_address, blocklist, listed, response_code, reason, category,
+					strftime('%Y-%m-%d %H:%M:%S+00:00', updated_at, 'unixepoch')
+				FROM ip_results
+			`,
+				`DROP TABLE ip_results`,
+				`ALTER TABLE ip_results_typed RENAME TO ip_results`,
+				`CREATE INDEX ip_results_listed_updated_at ON ip_results (listed, updated_at)`,
+			},
+			config.DbDriverMySQL: {
+				`ALTER TABLE ip_details ADD COLUMN created_at_typed DATETIME NULL, ADD COLUMN updated_at_typed DATETIME NULL`,
+				`UPDATE ip_details SET
+					created_at_typed = DATE_ADD('1970-01-01 00:00:00', INTERVAL created_at SECOND),
+					updated_at_typed = DATE_ADD('1970-01-01 00:00:00', INTERVAL updated_at SECOND)`,
+				`ALTER TABLE ip_details DROP INDEX ip_details_updated_at, DROP COLUMN created_at, DROP COLUMN updated_at`,
+				`ALTER TABLE ip_details
+					CHANGE COLUMN created_at_typed created_at DATETIME NULL,
+					CHANGE COLUMN updated_at_typed updated_at DATETIME NULL`,
+				`CREATE INDEX ip_details_updated_at ON ip_details (updated_at)`,
+				`ALTER TABLE ip_results ADD COLUMN updated_at_typed DATETIME NULL`,
+				`UPDATE ip_results SET updated_at_typed = DATE_ADD('1970-01-01 00:00:00', INTERVAL updated_at SECOND)`,
+				`ALTER TABLE ip_results DROP INDEX ip_results_listed_updated_at, DROP COLUMN updated_at`,
+				`ALTER TABLE ip_results CHANGE COLUMN updated_at_typed updated_at DATETIME NULL`,
+				`CREATE INDEX ip_results_listed_updated_at ON ip_results (listed, updated_at)`,
+			},
+			config.DbDriverPostgres: {
+				`ALTER TABLE ip_details
+					ALTER COLUMN created_at TYPE TIMESTAMP WITH TIME ZONE USING to_timestamp(created_at),
+					ALTER COLUMN updated_at TYPE TIMESTAMP WITH TIME ZONE USING to_timestamp(updated_at)`,
+				`ALTER TABLE ip_results
+					ALTER COLUMN updated_at TYPE TIMESTAMP WITH TIME ZONE USING to_timestamp(updated_at)`,
+			},
+		},
+	},
+	{
+		// network filters are ranges of ip_key, the binary form of the ip
+		version:     10,
+		description: "add ip_details.ip_key",
+		up: map[string][]string{
+			config.DbDriverSQLite: {
+				`ALTER TABLE ip_details ADD COLUMN ip_key BLOB`,
+				`CREATE INDEX IF NOT EXISTS ip_details_ip_key ON ip_details (ip_key)`,
+			},
+			config.DbDriverMySQL: {
+				`ALTER TABLE ip_details ADD COLUMN ip_key VARBINARY(16)`,
+				`CREATE INDEX ip_details_ip_key ON ip_details (ip_key)`,
+			},
+			config.DbDriverPostgres: {
+				`ALTER TABLE ip_details ADD COLUMN IF NOT EXISTS ip_key BYTEA`,
+				`CREATE INDEX IF NOT EXISTS ip_details_ip_key ON ip_details (ip_key)`,
+			},
+		},
+		adds: []schemaObject{
+			{table: "ip_details", column: "ip_key"},
+			{table: "ip_details", index: "ip_details_ip_key"},
+		},
+		fill: fillIPKeys,
+	},
+	{
+		// the ips of each compacted day, so unique ips stay exact once their
+		// lookups are rolled up; the days compacted before it have none
+		version:     11,
+		description: "create ip_history_daily_ips",
+		up: map[string][]string{
+			config.DbDriverSQLite: {`
+				CREATE TABLE IF NOT EXISTS ip_history_daily_ips (
+					day INTEGER NOT NULL,
+					blocklist TEXT NOT NULL,
+					response_code TEXT NOT NULL DEFAULT '',
+					category TEXT NOT NULL DEFAULT '',
+					ip_address TEXT NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category, ip_address)
+				)
+			`},
+			config.DbDriverMySQL: {`
+				CREATE TABLE IF NOT EXISTS ip_history_daily_ips (
+					day BIGINT NOT NULL,
+					blocklist VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					response_code VARCHAR(255) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '',
+					category VARCHAR(32) CHARACTER SET ascii COLLATE ascii_bin NOT NULL DEFAULT '',
+					ip_address VARCHAR(45) CHARACTER SET ascii COLLATE ascii_bin NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category, ip_address)
+				)
+			`},
+			config.DbDriverPostgres: {`
+				CREATE TABLE IF NOT EXISTS ip_history_daily_ips (
+					day BIGINT NOT NULL,
+					blocklist VARCHAR(255) COLLATE "C" NOT NULL,
+					response_code VARCHAR(255) COLLATE "C" NOT NULL DEFAULT '',
+					category VARCHAR(32) COLLATE "C" NOT NULL DEFAULT '',
+					ip_address VARCHAR(45) COLLATE "C" NOT NULL,
+					listed INTEGER NOT NULL DEFAULT 0,
+					PRIMARY KEY (day, blocklist, response_code, category, ip_address)
+				)
+			`},
+		},
+	},
+}
+
+// fillIPKeys sets the ip_key of the records from before it
+func fillIPKeys(ctx context.Context, tx *sql.Tx, d *dialect) error {
+	rows, err := tx.QueryContext(ctx, `SELECT ip_address FROM ip_details WHERE ip_key IS NULL`)
+	if err != nil {
+		return err
+	}
+	var ips []string
+	for rows.Next() {
+		var ip string
+		if err = rows.Scan(&ip); err != nil {
+			rows.Close()
+			return err
+		}
+		ips = append(ips, ip)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	update, err := tx.PrepareContext(ctx, d.rebind(`UPDATE ip_details SET ip_key = ? WHERE ip_address = ?`))
+	if err != nil {
+		return err
+	}
+	defer update.Close()
+	for _, ip := range ips {
+		if _, err = update.ExecContext(ctx, ipKey(ip), ip); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// createSchemaVersion holds the versions applied so far
+const createSchemaVersion = `
+	CREATE TABLE IF NOT EXISTS schema_version (
+		version INTEGER PRIMARY KEY NOT NULL,
+		description VARCHAR(255) NOT NULL,
+		applied_at BIGINT NOT NULL
+	)
+`
+
+// migrateLockTimeout is how long Migrate waits for another replica migrating
+// the same database
+const migrateLockTimeout = time.Minute
+
+// LatestSchemaVersion function returns the version Migrate brings the schema
+// to
+func LatestSchemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// SchemaVersion method returns the latest migration applied to the database,
+// 0 if none is. It only reads, so a database never migrated is left without
+// a schema_version table.
+func (db *Db) SchemaVersion() (int, error) {
+	return schemaVersion(context.Background(), db.Conn, db.sqlDialect())
+}
+
+// queryer is a *sql.DB or *sql.Conn
+type queryer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func schemaVersion(ctx context.Context, q queryer, d *dialect) (int, error) {
+	var tables int
+	if err := q.QueryRowContext(ctx, d.rebind(d.hasTable), "schema_version").Scan(&tables); err != nil || tables == 0 {
+		return 0, err
+	}
+	var version int
+	err := q.QueryRowContext(ctx, `SELECT version FROM schema_version ORDER BY version DESC LIMIT 1`).Scan(&version)
+	if err == sql.ErrNoRows {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Migrate method applies the migrations the database doesn't have yet, each
+// in a transaction where the backend allows it, and returns the versions it
+// went from and to. On MySQL and PostgreSQL a lock keeps replicas starting
+// together from migrating at the same time.
+func (db *Db) Migrate() (from, to int, err error) {
+	ctx, cancel := context.WithTimeout(context.Background(), migrateLockTimeout)
+	defer cancel()
+
+	// the lock belongs to a connection, so everything happens on one
+	conn, err := db.Conn.Conn(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+
+	d := db.sqlDialect()
+	if d.lock != "" {
+		var locked sql.NullString
+		if err = conn.QueryRowContext(ctx, d.lock).Scan(&locked); err != nil {
+			return 0, 0, fmt.Errorf("locking the schema: %s", err)
+		}
+		// MySQL gives up after its timeout, PostgreSQL waits for the context
+		if locked.String == "0" {
+			return 0, 0, fmt.Errorf("locking the schema: another migration is running")
+		}
+		defer conn.ExecContext(context.Background(), d.unlock)
+	}
+
+	if _, err = conn.ExecContext(ctx, createSchemaVersion); err != nil {
+		return 0, 0, err
+	}
+	from, err = schemaVersion(ctx, conn, d)
+	if err != nil {
+		return 0, 0, err
+	}
+	to = from
+	for _, m := range migrations {
+		if m.version <= to {
+			continue
+		}
+		if err = applyMigration(ctx, conn, d, m); err != nil {
+			return from, to, fmt.Errorf("migration %d (%s): %s", m.version, m.description, err)
+		}
+		log.Printf("applied migration %d: %s\n", m.version, m.description)
+		to = m.version
+	}
+	return from, to, nil
+}
+
+func applyMigration(ctx context.Context, conn *sql.Conn, d *dialect, m migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for i, stmt := range m.up[d.driver] {
+		if i < len(m.adds) {
+			exists, err := m.adds[i].exists(ctx, tx, d)
+			if err != nil {
+				return err
+			}
+			if exists {
+				continue
+			}
+		}
+		if _, err := tx.ExecContext(ctx, stmt); err != nil {
+			return err
+		}
+	}
+	if m.fill != nil {
+		if err = m.fill(ctx, tx, d); err != nil {
+			return err
+		}
+	}
+	_, err = tx.ExecContext(ctx,
+		d.rebind(`INSERT INTO schema_version(version, description, applied_at) VALUES(?, ?, ?)`),
+		m.version, m.description, time.Now().Unix(),
+	)
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
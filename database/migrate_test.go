@@ -0,0 +1,185 @@
+package database
+
+import (
+	"context"
+	"database/sql"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+func TestMigrate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "migrate")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	conf := func(name string, migrate bool) *config.APIConfig {
+		return &config.APIConfig{DbPath: filepath.Join(dir, name), PersistDb: true, SkipMigrate: !migrate}
+	}
+
+	t.Run("fresh_database", func(t *testing.T) {
+		db, err := Open(conf("fresh.db", true))
+		require.Equal(t, nil, err)
+		defer db.Close()
+
+		version, err := db.SchemaVersion()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, version)
+
+		// reading the version leaves the database as it was
+		var tables int
+		require.Equal(t, nil, db.Conn.QueryRow(`SELECT COUNT(*) FROM sqlite_master`).Scan(&tables))
+		assert.Equal(t, 0, tables)
+
+		from, to, err := db.Migrate()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, from)
+		assert.Equal(t, LatestSchemaVersion(), to)
+
+		// once up to date there's nothing left to apply
+		from, to, err = db.Migrate()
+		require.Equal(t, nil, err)
+		assert.Equal(t, LatestSchemaVersion(), from)
+		assert.Equal(t, LatestSchemaVersion(), to)
+
+		var applied int
+		require.Equal(t, nil, db.Conn.QueryRow(`SELECT COUNT(*) FROM schema_version`).Scan(&applied))
+		assert.Equal(t, len(migrations), applied)
+	})
+
+	t.Run("legacy_database", func(t *testing.T) {
+		// tables made by NewDb before schema_version, with and without the
+		// category column
+		for name, createResults := range map[string]string{
+			"legacy.db": `CREATE TABLE ip_results (
+				ip_address TEXT NOT NULL, blocklist TEXT NOT NULL, listed INTEGER NOT NULL DEFAULT 0,
+				response_code TEXT, reason TEXT, updated_at TEXT, PRIMARY KEY (ip_address, blocklist))`,
+			"legacy_category.db": `CREATE TABLE ip_results (
+				ip_address TEXT NOT NULL, blocklist TEXT NOT NULL, listed INTEGER NOT NULL DEFAULT 0,
+				response_code TEXT, reason TEXT, category TEXT NOT NULL DEFAULT '', updated_at TEXT,
+				PRIMARY KEY (ip_address, blocklist))`,
+		} {
+			conn, err := sql.Open(config.DbDriverSQLite, filepath.Join(dir, name))
+			require.Equal(t, nil, err)
+			for _, stmt := range []string{
+				`CREATE TABLE ip_details (ip_address TEXT PRIMARY KEY NOT NULL, uuid TEXT NOT NULL,
+					response_code text, created_at TEXT, updated_at TEXT)`,
+				createResults,
+				`INSERT INTO ip_details VALUES ('127.0.0.2', 'uuid', '127.0.0.2', '1', '1')`,
+				`INSERT INTO ip_results(ip_address, blocklist, listed, response_code, reason, updated_at)
+					VALUES ('127.0.0.2', 'zen.spamhaus.org', 1, '127.0.0.2', 'spam', '1')`,
+			} {
+				_, err = conn.Exec(stmt)
+				require.Equal(t, nil, err)
+			}
+			conn.Close()
+
+			db, err := NewDb(conf(name, true))
+			require.Equal(t, nil, err, name)
+			version, err := db.SchemaVersion()
+			require.Equal(t, nil, err)
+			assert.Equal(t, LatestSchemaVersion(), version, name)
+
+			record, err := db.QueryRecord("127.0.0.2")
+			require.Equal(t, nil, err)
+			assert.Equal(t, "uuid", record.UUID, name)
+			// and can be found by network
+			records, _, err := db.QueryRecords(RecordQuery{Network: &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)}, First: 10})
+			require.Equal(t, nil, err)
+			require.Equal(t, 1, len(records), name)
+			assert.Equal(t, "127.0.0.2", records[0].IPAddress, name)
+			listed, err := db.QueryListResults("127.0.0.2")
+			require.Equal(t, nil, err)
+			require.Equal(t, 1, len(listed), name)
+			assert.Equal(t, "", listed[0].Category, name)
+			assert.Equal(t, 1, listed[0].CheckedAt, name)
+
+			// the text timestamps are now typed ones
+			for _, table := range []string{"ip_details", "ip_results"} {
+				var declared string
+				var updatedAt time.Time
+				require.Equal(t, nil, db.Conn.QueryRow(`SELECT type FROM pragma_table_info(?) WHERE name = 'updated_at'`, table).Scan(&declared))
+				require.Equal(t, nil, db.Conn.QueryRow(`SELECT updated_at FROM `+table).Scan(&updatedAt))
+				assert.Equal(t, "DATETIME", declared, name)
+				assert.Equal(t, time.Unix(1, 0).UTC(), updatedAt.UTC(), name)
+			}
+			db.Close()
+		}
+	})
+
+	t.Run("already_applied", func(t *testing.T) {
+		db, err := NewDb(conf("applied.db", true))
+		require.Equal(t, nil, err)
+		defer db.Close()
+
+		// as if the migrations adding columns and indexes hadn't been
+		// recorded; their statements would fail on what is already there
+		_, err = db.Conn.Exec(`DELETE FROM schema_version WHERE version >= 3`)
+		require.Equal(t, nil, err)
+		_, err = db.Conn.Exec(`DROP INDEX ip_details_response_code`)
+		require.Equal(t, nil, err)
+
+		from, to, err := db.Migrate()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, from)
+		assert.Equal(t, LatestSchemaVersion(), to)
+
+		d := db.sqlDialect()
+		for _, o := range []schemaObject{
+			{table: "ip_results", column: "category"},
+			{table: "ip_details", index: "ip_details_response_code"},
+		} {
+			exists, err := o.exists(context.Background(), db.Conn, d)
+			require.Equal(t, nil, err)
+			assert.Equal(t, true, exists, o)
+		}
+		exists, err := schemaObject{table: "ip_details", column: "category"}.exists(context.Background(), db.Conn, d)
+		require.Equal(t, nil, err)
+		assert.Equal(t, false, exists)
+	})
+
+	t.Run("indexes", func(t *testing.T) {
+		db, err := NewDb(conf("indexes.db", true))
+		require.Equal(t, nil, err)
+		defer db.Close()
+
+		for query, index := range map[string]string{
+			`SELECT ip_address FROM ip_results WHERE listed = 1 AND updated_at >= 0`: "ip_results_listed_updated_at",
+			`SELECT ip_address FROM ip_details WHERE updated_at >= 0`:                "ip_details_updated_at",
+			`SELECT ip_address FROM ip_details WHERE response_code = '127.0.0.2'`:    "ip_details_response_code",
+		} {
+			rows, err := db.Conn.Query(`EXPLAIN QUERY PLAN ` + query)
+			require.Equal(t, nil, err)
+			plan := ""
+			for rows.Next() {
+				var id, parent, notUsed int
+				var detail string
+				require.Equal(t, nil, rows.Scan(&id, &parent, &notUsed, &detail))
+				plan += detail
+			}
+			rows.Close()
+			assert.Contains(t, plan, index, query)
+		}
+	})
+
+	t.Run("migrate_disabled", func(t *testing.T) {
+		_, err := NewDb(conf("disabled.db", false))
+		assert.NotEqual(t, nil, err)
+
+		db, err := NewDb(conf("disabled.db", true))
+		require.Equal(t, nil, err)
+		db.Close()
+
+		db, err = NewDb(conf("disabled.db", false))
+		require.Equal(t, nil, err)
+		db.Close()
+	})
+}
@@ -0,0 +1,212 @@
+package database
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Record statuses of a RecordQuery
+const (
+	// StatusListed records are listed on a blocklist
+	StatusListed = "listed"
+	// StatusNotListed records are listed on no blocklist and their last
+	// lookup succeeded
+	StatusNotListed = "not_listed"
+	// StatusError records' last lookup failed
+	StatusError = "error"
+)
+
+// ErrInvalidCursor is returned for a cursor RecordCursor didn't make
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// RecordQuery picks a page of the records QueryRecords returns. Status is one
+// of the Status constants, or empty for any; with Blocklist, StatusListed and
+// StatusNotListed are about that blocklist only, else Blocklist keeps the
+// records of ips checked against it. UpdatedSince and UpdatedUntil bound
+// updated_at, both inclusive, if not 0, and Network keeps the ips it
+// contains. The page holds First records following the After cursor, from
+// the start if empty.
+type RecordQuery struct {
+	Status       string
+	Blocklist    string
+	ResponseCode string
+	UpdatedSince int
+	UpdatedUntil int
+	Network      *net.IPNet
+	After        string
+	First        int
+}
+
+// RecordCursor function returns the cursor of r, its place in the order of
+// QueryRecords
+func RecordCursor(r *model.Record) string {
+	return base64.RawURLEncoding.EncodeToString([]byte(strconv.Itoa(r.UpdatedAt) + "|" + r.IPAddress))
+}
+
+// parseCursor returns the updated_at and ip of a RecordCursor
+func parseCursor(cursor string) (int, string, error) {
+	b, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	parts := strings.SplitN(string(b), "|", 2)
+	if len(parts) != 2 {
+		return 0, "", ErrInvalidCursor
+	}
+	updatedAt, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, "", ErrInvalidCursor
+	}
+	return updatedAt, parts[1], nil
+}
+
+// QueryRecords func returns a page of the ip_details records matching q, most
+// recently updated first, and whether more records follow it. Pages are
+// keyed on (updated_at, ip_address), so records updated while paging don't
+// shift the pages after them.
+func (db *Db) QueryRecords(q RecordQuery) ([]*model.Record, bool, error) {
+	if q.First <= 0 {
+		return nil, false, fmt.Errorf("page size must be greater than 0")
+	}
+
+	selectQuery := `
+		SELECT
+			d.ip_address,
+			d.uuid,
+			d.created_at,
+			d.updated_at,
+			d.response_code,
+			d.lookup_error
+		FROM ip_details d
+		WHERE 1 = 1
+	`
+	var args []interface{}
+
+	const results = "(SELECT 1 FROM ip_results r WHERE r.ip_address = d.ip_address"
+	switch q.Status {
+	case "":
+		if q.Blocklist != "" {
+			selectQuery += " AND EXISTS " + results + " AND r.blocklist = ?)"
+			args = append(args, q.Blocklist)
+		}
+	case StatusListed, StatusNotListed:
+		listed := 1
+		if q.Status == StatusNotListed {
+			listed = 0
+		}
+		if q.Blocklist != "" {
+			selectQuery += " AND EXISTS " + results + " AND r.blocklist = ? AND r.listed = ?)"
+			args = append(args, q.Blocklist, listed)
+		} else if listed == 1 {
+			selectQuery += " AND EXISTS " + results + " AND r.listed = 1)"
+		} else {
+			selectQuery += " AND NOT EXISTS " + results + " AND r.listed = 1) AND d.lookup_error IS NULL"
+		}
+	case StatusError:
+		selectQuery += " AND d.lookup_error IS NOT NULL"
+		if q.Blocklist != "" {
+			selectQuery += " AND EXISTS " + results + " AND r.blocklist = ?)"
+			args = append(args, q.Blocklist)
+		}
+	default:
+		return nil, false, fmt.Errorf("unknown record status %s", q.Status)
+	}
+
+	if q.ResponseCode != "" {
+		selectQuery += " AND d.response_code = ?"
+		args = append(args, q.ResponseCode)
+	}
+	if q.UpdatedSince != 0 {
+		selectQuery += " AND d.updated_at >= ?"
+		args = append(args, timestamp(q.UpdatedSince))
+	}
+	if q.UpdatedUntil != 0 {
+		selectQuery += " AND d.updated_at <= ?"
+		args = append(args, timestamp(q.UpdatedUntil))
+	}
+
+	if q.Network != nil {
+		first, last := networkRange(q.Network)
+		selectQuery += " AND d.ip_key BETWEEN ? AND ?"
+		args = append(args, first, last)
+	}
+
+	if q.After != "" {
+		updatedAt, ip, err := parseCursor(q.After)
+		if err != nil {
+			return nil, false, err
+		}
+		selectQuery += " AND (d.updated_at < ? OR (d.updated_at = ? AND d.ip_address < ?))"
+		args = append(args, timestamp(updatedAt), timestamp(updatedAt), ip)
+	}
+	selectQuery += " ORDER BY d.updated_at DESC, d.ip_address DESC"
+	// one more than the page tells whether another follows
+	selectQuery += " LIMIT " + strconv.Itoa(q.First+1)
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), args...)
+	if err != nil {
+		log.Println(err)
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var records []*model.Record
+	for rows.Next() {
+		var r model.Record
+		err = rows.Scan(
+			&r.IPAddress,
+			&r.UUID,
+			unixTime{&r.CreatedAt},
+			unixTime{&r.UpdatedAt},
+			&r.ResponseCode,
+			&r.Error,
+		)
+		if err != nil {
+			log.Println(err)
+			return nil, false, err
+		}
+		if len(records) == q.First {
+			return records, true, nil
+		}
+		records = append(records, &r)
+	}
+	return records, false, rows.Err()
+}
+
+// ipKey returns the ip_key of ip, its 16 byte form, which sorts the way the
+// addresses do; nil if ip doesn't parse
+func ipKey(ip string) []byte {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return nil
+	}
+	return []byte(addr.To16())
+}
+
+// inRange reports whether key is between first and last, both inclusive
+func inRange(key, first, last []byte) bool {
+	return key != nil && bytes.Compare(first, key) <= 0 && bytes.Compare(key, last) <= 0
+}
+
+// networkRange returns the first and last ip_key of the addresses in n
+func networkRange(n *net.IPNet) ([]byte, []byte) {
+	first := n.IP.Mask(n.Mask).To16()
+	mask := n.Mask
+	if len(mask) == net.IPv4len {
+		// an ipv4 network is the ipv4-mapped part of the ipv6 space
+		mask = append(net.CIDRMask(96, 8*net.IPv6len)[:12], mask...)
+	}
+	last := make([]byte, net.IPv6len)
+	for i := range last {
+		last[i] = first[i] | ^mask[i]
+	}
+	return []byte(first), last
+}
@@ -0,0 +1,50 @@
+package database
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestRecords(t *testing.T) {
+	t.Run("cursor", func(t *testing.T) {
+		cursor := RecordCursor(&model.Record{IPAddress: "2001:db8::1", UpdatedAt: 1604581445})
+		updatedAt, ip, err := parseCursor(cursor)
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1604581445, updatedAt)
+		assert.Equal(t, "2001:db8::1", ip)
+
+		for _, bad := range []string{"nope!", "bm9wZQ", "eHwxMjcuMC4wLjE"} {
+			_, _, err = parseCursor(bad)
+			assert.Equal(t, ErrInvalidCursor, err, bad)
+		}
+	})
+
+	t.Run("network_range", func(t *testing.T) {
+		for cidr, want := range map[string][2]string{
+			"192.0.2.7/32":    {"192.0.2.7", "192.0.2.7"},
+			"192.0.2.0/24":    {"192.0.2.0", "192.0.2.255"},
+			"10.16.0.0/12":    {"10.16.0.0", "10.31.255.255"},
+			"0.0.0.0/0":       {"0.0.0.0", "255.255.255.255"},
+			"2001:db8::1/128": {"2001:db8::1", "2001:db8::1"},
+			"2001:db8::/32":   {"2001:db8::", "2001:db8:ffff:ffff:ffff:ffff:ffff:ffff"},
+			"::/0":            {"::", "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"},
+		} {
+			first, last := networkRange(network(t, cidr))
+			assert.Equal(t, ipKey(want[0]), first, cidr)
+			assert.Equal(t, ipKey(want[1]), last, cidr)
+		}
+	})
+
+	t.Run("ip_key", func(t *testing.T) {
+		// keys sort the way the addresses do
+		assert.Equal(t, -1, bytes.Compare(ipKey("9.255.255.255"), ipKey("10.0.0.0")))
+		assert.Equal(t, -1, bytes.Compare(ipKey("192.0.2.9"), ipKey("192.0.2.10")))
+		assert.Equal(t, 16, len(ipKey("127.0.0.1")))
+		assert.Equal(t, []byte(nil), ipKey("nope"))
+	})
+}
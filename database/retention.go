@@ -0,0 +1,425 @@
+package database
+
+import (
+	"database/sql"
+	"log"
+	"strconv"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// secondsPerDay is the length of the days of ip_history_daily, which start at
+// midnight UTC
+const secondsPerDay = 24 * 60 * 60
+
+// pruneBatch is the most records PruneRecords deletes in one transaction, so
+// a large prune doesn't hold the write lock for long
+const pruneBatch = 500
+
+// DailySummary is a day of ip_history rolled up by CompactHistory: the
+// lookups of one blocklist that gave one response code
+type DailySummary struct {
+	// Day is the Unix time of the start of the day
+	Day          int
+	Blocklist    string
+	ResponseCode string
+	Category     string
+	Lookups      int
+	Listed       int
+	Errors       int
+	// IPs is the number of different ips looked up, summed over the runs
+	// if the day was compacted more than once
+	IPs int
+}
+
+// dayStart returns the start of the day of a Unix time
+func dayStart(unix int) int {
+	return unix - unix%secondsPerDay
+}
+
+// PruneRecords func deletes the records updated before the Unix time before
+// that are clean, i.e. listed nowhere and with a successful last lookup,
+// along with their ip_results, and returns how many records it deleted
+func (db *Db) PruneRecords(before int) (int, error) {
+	selectQuery := `
+		SELECT d.ip_address FROM ip_details d
+		WHERE d.updated_at < ? AND d.lookup_error IS NULL
+		AND NOT EXISTS (SELECT 1 FROM ip_results r WHERE r.ip_address = d.ip_address AND r.listed = 1)
+		ORDER BY d.ip_address
+		LIMIT ` + strconv.Itoa(pruneBatch)
+
+	removed := 0
+	for {
+		ips, err := db.selectStrings(selectQuery, timestamp(before))
+		if err != nil {
+			return removed, err
+		}
+		if len(ips) == 0 {
+			return removed, nil
+		}
+
+		n, err := db.deleteRecords(ips, before)
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+		// the rest were updated since they were selected
+		if len(ips) < pruneBatch || n == 0 {
+			return removed, nil
+		}
+	}
+}
+
+// deleteRecords deletes the records of ips that are still clean and not
+// updated since before, and the ip_results of the ones it deleted, in a
+// transaction
+func (db *Db) deleteRecords(ips []string, before int) (int, error) {
+	in := "ip_address IN (" + placeholders(len(ips)) + ")"
+	var args []interface{}
+	for _, ip := range ips {
+		args = append(args, ip)
+	}
+	// the subqueries only look at ips, and aren't correlated, so MySQL
+	// allows them in a DELETE
+	detailsArgs := append(append([]interface{}{}, args...), timestamp(before))
+	detailsArgs = append(detailsArgs, args...)
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(
+		db.sqlDialect().rebind(`
+			DELETE FROM ip_details
+			WHERE `+in+` AND updated_at < ? AND lookup_error IS NULL
+			AND ip_address NOT IN (SELECT ip_address FROM ip_results WHERE `+in+` AND listed = 1)
+		`),
+		detailsArgs...,
+	)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	_, err = tx.Exec(
+		db.sqlDialect().rebind(`
+			DELETE FROM ip_results
+			WHERE `+in+`
+			AND ip_address NOT IN (SELECT ip_address FROM ip_details WHERE `+in+`)
+		`),
+		append(args, args...)...,
+	)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	if err = tx.Commit(); err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+// selectStrings returns the first column of the rows of query
+func (db *Db) selectStrings(query string, args ...interface{}) ([]string, error) {
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(query), args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var values []string
+	for rows.Next() {
+		var v string
+		if err = rows.Scan(&v); err != nil {
+			return nil, err
+		}
+		values = append(values, v)
+	}
+	return values, rows.Err()
+}
+
+// CompactHistory func rolls the ip_history of the days ending by the Unix
+// time before up into ip_history_daily, adding to the summaries already there,
+// and deletes it. Each day is compacted in its own transaction, so a large
+// backlog doesn't hold the write lock for long. It returns how many
+// ip_history rows it deleted.
+func (db *Db) CompactHistory(before int) (int, error) {
+	// only whole days, so a day is never summarized from part of its lookups
+	before = dayStart(before)
+	selectQuery := db.sqlDialect().rebind(`
+		SELECT checked_at FROM ip_history
+		WHERE checked_at < ?
+		ORDER BY checked_at
+		LIMIT 1
+	`)
+
+	removed := 0
+	for {
+		var oldest int
+		err := db.Conn.QueryRow(selectQuery, before).Scan(&oldest)
+		if err == sql.ErrNoRows {
+			return removed, nil
+		}
+		if err != nil {
+			log.Println(err)
+			return removed, err
+		}
+
+		n, err := db.compactDay(dayStart(oldest))
+		removed += n
+		if err != nil {
+			return removed, err
+		}
+	}
+}
+
+// compactDay rolls the ip_history of the day starting at the Unix time day up
+// into ip_history_daily and deletes it, in a transaction
+func (db *Db) compactDay(day int) (int, error) {
+	dayExpr := "checked_at - checked_at % " + strconv.Itoa(secondsPerDay)
+	selectQuery := `
+		SELECT
+			` + dayExpr + `,
+			blocklist,
+			response_code,
+			category,
+			COUNT(*),
+			SUM(listed),
+			COUNT(lookup_error),
+			COUNT(DISTINCT ip_address)
+		FROM ip_history
+		WHERE checked_at >= ? AND checked_at < ?
+		GROUP BY ` + dayExpr + `, blocklist, response_code, category
+	`
+	d := db.sqlDialect()
+	cols := []string{"day", "blocklist", "response_code", "category", "lookups", "listed", "errors", "ips"}
+	sets := make([]string, 4)
+	for i, col := range cols[4:] {
+		sets[i] = col + " = ip_history_daily." + col + " + " + d.excluded(col)
+	}
+	upsertQuery := d.upsertSet("ip_history_daily", cols, cols[:4], sets)
+	end := day + secondsPerDay
+
+	tx, err := db.Conn.Begin()
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(d.rebind(selectQuery), day, end)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	var summaries []DailySummary
+	for rows.Next() {
+		var s DailySummary
+		err = rows.Scan(&s.Day, &s.Blocklist, &s.ResponseCode, &s.Category, &s.Lookups, &s.Listed, &s.Errors, &s.IPs)
+		if err != nil {
+			rows.Close()
+			log.Println(err)
+			return 0, err
+		}
+		summaries = append(summaries, s)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return 0, err
+	}
+
+	for _, s := range summaries {
+		_, err = tx.Exec(d.rebind(upsertQuery), s.Day, s.Blocklist, s.ResponseCode, s.Category, s.Lookups, s.Listed, s.Errors, s.IPs)
+		if err != nil {
+			log.Println(err)
+			return 0, err
+		}
+	}
+	if err = compactDayIPs(tx, d, day, end); err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	res, err := tx.Exec(d.rebind(`DELETE FROM ip_history WHERE checked_at >= ? AND checked_at < ?`), day, end)
+	if err != nil {
+		log.Println(err)
+		return 0, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), tx.Commit()
+}
+
+// compactDayIPs keeps the different ips of the ip_history from the Unix time
+// day until end in ip_history_daily_ips, listed if any of their lookups was
+func compactDayIPs(tx *sql.Tx, d *dialect, day, end int) error {
+	dayExpr := "checked_at - checked_at % " + strconv.Itoa(secondsPerDay)
+	selectQuery := `
+		SELECT ` + dayExpr + `, blocklist, response_code, category, ip_address, MAX(listed)
+		FROM ip_history
+		WHERE checked_at >= ? AND checked_at < ?
+		GROUP BY ` + dayExpr + `, blocklist, response_code, category, ip_address
+	`
+	cols := []string{"day", "blocklist", "response_code", "category", "ip_address", "listed"}
+	listed := d.excluded("listed")
+	upsertQuery := d.upsertSet("ip_history_daily_ips", cols, cols[:5], []string{
+		"listed = CASE WHEN " + listed + " > ip_history_daily_ips.listed THEN " + listed + " ELSE ip_history_daily_ips.listed END",
+	})
+
+	rows, err := tx.Query(d.rebind(selectQuery), day, end)
+	if err != nil {
+		return err
+	}
+	var ips [][]interface{}
+	for rows.Next() {
+		var day, listed int
+		var blocklist, responseCode, category, ip string
+		if err = rows.Scan(&day, &blocklist, &responseCode, &category, &ip, &listed); err != nil {
+			rows.Close()
+			return err
+		}
+		ips = append(ips, []interface{}{day, blocklist, responseCode, category, ip, listed})
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	upsert, err := tx.Prepare(d.rebind(upsertQuery))
+	if err != nil {
+		return err
+	}
+	defer upsert.Close()
+	for _, args := range ips {
+		if _, err = upsert.Exec(args...); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// PruneDailyIPs func deletes the ip_history_daily_ips of the days ending by
+// the Unix time before, leaving their ip_history_daily summaries, and returns
+// how many rows it deleted. Each day is deleted in its own statement, like
+// CompactHistory compacts them.
+func (db *Db) PruneDailyIPs(before int) (int, error) {
+	before = dayStart(before)
+	d := db.sqlDialect()
+	selectQuery := d.rebind(`
+		SELECT day FROM ip_history_daily_ips
+		WHERE day < ?
+		ORDER BY day
+		LIMIT 1
+	`)
+	deleteQuery := d.rebind(`DELETE FROM ip_history_daily_ips WHERE day = ?`)
+
+	removed := 0
+	for {
+		var day int
+		err := db.Conn.QueryRow(selectQuery, before).Scan(&day)
+		if err == sql.ErrNoRows {
+			return removed, nil
+		}
+		if err != nil {
+			log.Println(err)
+			return removed, err
+		}
+
+		res, err := db.Conn.Exec(deleteQuery, day)
+		if err != nil {
+			log.Println(err)
+			return removed, err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return removed, err
+		}
+		removed += int(n)
+	}
+}
+
+// QueryHistory func returns the lookups of ip still in ip_history, failed ones
+// with their error, oldest first
+func (db *Db) QueryHistory(ip string) ([]*model.ListResult, error) {
+	selectQuery := `
+		SELECT
+			ip_address,
+			blocklist,
+			listed,
+			response_code,
+			category,
+			checked_at,
+			lookup_error
+		FROM ip_history
+		WHERE ip_address = ?
+		ORDER BY checked_at, blocklist
+	`
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), ip)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var history []*model.ListResult
+	for rows.Next() {
+		var r model.ListResult
+		err = rows.Scan(&r.IPAddress, &r.Blocklist, &r.Listed, &r.ResponseCode, &r.Category, &r.CheckedAt, &r.Error)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		r.Cached = true
+		history = append(history, &r)
+	}
+	return history, rows.Err()
+}
+
+// QueryDailySummaries func returns the ip_history_daily summaries of the days
+// starting from the Unix time from until to, both inclusive if not 0, ordered
+// by day, blocklist, response code and category
+func (db *Db) QueryDailySummaries(from, to int) ([]*DailySummary, error) {
+	selectQuery := `
+		SELECT day, blocklist, response_code, category, lookups, listed, errors, ips
+		FROM ip_history_daily
+		WHERE 1 = 1
+	`
+	var args []interface{}
+	if from != 0 {
+		selectQuery += " AND day >= ?"
+		args = append(args, from)
+	}
+	if to != 0 {
+		selectQuery += " AND day <= ?"
+		args = append(args, to)
+	}
+	selectQuery += " ORDER BY day, blocklist, response_code, category"
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var summaries []*DailySummary
+	for rows.Next() {
+		var s DailySummary
+		err = rows.Scan(&s.Day, &s.Blocklist, &s.ResponseCode, &s.Category, &s.Lookups, &s.Listed, &s.Errors, &s.IPs)
+		if err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		summaries = append(summaries, &s)
+	}
+	return summaries, rows.Err()
+}
@@ -0,0 +1,16 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRetention(t *testing.T) {
+	t.Run("day_start", func(t *testing.T) {
+		// 2020-11-05T13:04:05Z
+		assert.Equal(t, 1604534400, dayStart(1604581445))
+		assert.Equal(t, 1604534400, dayStart(1604534400))
+		assert.Equal(t, 0, dayStart(secondsPerDay-1))
+	})
+}
@@ -0,0 +1,183 @@
+package database
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// Groups of a StatsQuery
+const (
+	// StatsByDay groups by the day, starting at midnight UTC, of the lookups
+	StatsByDay = "day"
+	// StatsByBlocklist groups by blocklist
+	StatsByBlocklist = "blocklist"
+	// StatsByResponseCode groups by the response code of the lookups
+	StatsByResponseCode = "response_code"
+	// StatsByCategory groups by the category of the blocklists
+	StatsByCategory = "category"
+)
+
+// statsGroups are the groups of a StatsQuery in the order the stats are
+// sorted by
+var statsGroups = []string{StatsByDay, StatsByBlocklist, StatsByResponseCode, StatsByCategory}
+
+// StatsQuery picks the lookups QueryStats counts: the ones checked from the
+// Unix time From until To, both inclusive if not 0, grouped by the GroupBy
+// constants, or all together if none
+type StatsQuery struct {
+	From    int
+	To      int
+	GroupBy []string
+}
+
+// Stats are the counts of one group of lookups. The fields of the groups
+// not asked for are left empty.
+type Stats struct {
+	Day          int
+	Blocklist    string
+	ResponseCode string
+	Category     string
+	Lookups      int
+	// Listed is the number of lookups that found their ip listed
+	Listed int
+	Errors int
+	// IPs is the number of different ips looked up, counted once however
+	// many lookups, lists and days they had. Days compacted before schema
+	// version 11, or whose ips PruneDailyIPs deleted, add nothing to it.
+	IPs int
+	// ListedIPs is the number of different ips found listed at least once
+	ListedIPs int
+}
+
+// groups returns the groups of q in the order of statsGroups, or an error for
+// an unknown one
+func (q StatsQuery) groups() ([]string, error) {
+	for _, g := range q.GroupBy {
+		if !contains(statsGroups, g) {
+			return nil, fmt.Errorf("unknown stats group %s", g)
+		}
+	}
+	var groups []string
+	for _, g := range statsGroups {
+		if contains(q.GroupBy, g) {
+			groups = append(groups, g)
+		}
+	}
+	return groups, nil
+}
+
+// QueryStats func returns the counts of the lookups matching q, from
+// ip_history and the days ip_history_daily and ip_history_daily_ips
+// compacted, ordered by group. Compacted days count when they start from
+// q.From until q.To. Without groups, it is a single Stats, with counts of 0
+// if nothing matches.
+func (db *Db) QueryStats(q StatsQuery) ([]*Stats, error) {
+	groups, err := q.groups()
+	if err != nil {
+		return nil, err
+	}
+
+	// every part selects the four groups, the counts it adds and the ips it
+	// adds, under the same names, so the ips are distinct over all of them
+	historyQuery := `
+		SELECT
+			checked_at - checked_at % ` + strconv.Itoa(secondsPerDay) + ` AS day,
+			blocklist,
+			response_code,
+			category,
+			1 AS lookups,
+			listed,
+			CASE WHEN lookup_error IS NULL THEN 0 ELSE 1 END AS errors,
+			ip_address,
+			listed AS ip_listed
+		FROM ip_history
+		WHERE 1 = 1`
+	dailyQuery := `
+		SELECT day, blocklist, response_code, category, lookups, listed, errors, NULL, 0
+		FROM ip_history_daily
+		WHERE 1 = 1`
+	dailyIPsQuery := `
+		SELECT day, blocklist, response_code, category, 0, 0, 0, ip_address, listed
+		FROM ip_history_daily_ips
+		WHERE 1 = 1`
+	var args []interface{}
+	if q.From != 0 {
+		historyQuery += " AND checked_at >= ?"
+		args = append(args, q.From)
+	}
+	if q.To != 0 {
+		historyQuery += " AND checked_at <= ?"
+		args = append(args, q.To)
+	}
+	for _, query := range []*string{&dailyQuery, &dailyIPsQuery} {
+		if q.From != 0 {
+			*query += " AND day >= ?"
+			args = append(args, q.From)
+		}
+		if q.To != 0 {
+			*query += " AND day <= ?"
+			args = append(args, q.To)
+		}
+	}
+
+	selectQuery := `
+		SELECT ` + strings.Join(append(append([]string{}, groups...), `
+			COALESCE(SUM(lookups), 0),
+			COALESCE(SUM(listed), 0),
+			COALESCE(SUM(errors), 0),
+			COUNT(DISTINCT ip_address),
+			COUNT(DISTINCT CASE WHEN ip_listed = 1 THEN ip_address END)`), ", ") + `
+		FROM (` + historyQuery + `
+		UNION ALL` + dailyQuery + `
+		UNION ALL` + dailyIPsQuery + `
+		) s`
+	if len(groups) > 0 {
+		selectQuery += " GROUP BY " + strings.Join(groups, ", ") + " ORDER BY " + strings.Join(groups, ", ")
+	}
+
+	rows, err := db.Conn.Query(db.sqlDialect().rebind(selectQuery), args...)
+	if err != nil {
+		log.Println(err)
+		return nil, err
+	}
+	defer rows.Close()
+
+	var stats []*Stats
+	for rows.Next() {
+		var s Stats
+		dest := make([]interface{}, 0, len(groups)+5)
+		for _, g := range groups {
+			dest = append(dest, s.group(g))
+		}
+		dest = append(dest, &s.Lookups, &s.Listed, &s.Errors, &s.IPs, &s.ListedIPs)
+		if err = rows.Scan(dest...); err != nil {
+			log.Println(err)
+			return nil, err
+		}
+		stats = append(stats, &s)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	// some databases have no row for an aggregate of no rows
+	if len(groups) == 0 && len(stats) == 0 {
+		stats = append(stats, &Stats{})
+	}
+	return stats, nil
+}
+
+// group returns the field of s for the group g
+func (s *Stats) group(g string) interface{} {
+	switch g {
+	case StatsByDay:
+		return &s.Day
+	case StatsByBlocklist:
+		return &s.Blocklist
+	case StatsByResponseCode:
+		return &s.ResponseCode
+	default:
+		return &s.Category
+	}
+}
@@ -0,0 +1,23 @@
+package database
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("groups", func(t *testing.T) {
+		groups, err := StatsQuery{GroupBy: []string{StatsByCategory, StatsByDay, StatsByCategory}}.groups()
+		require.Equal(t, nil, err)
+		assert.Equal(t, []string{StatsByDay, StatsByCategory}, groups)
+
+		groups, err = StatsQuery{}.groups()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, len(groups))
+
+		_, err = StatsQuery{GroupBy: []string{StatsByBlocklist, "ip_address"}}.groups()
+		assert.NotEqual(t, nil, err)
+	})
+}
@@ -0,0 +1,70 @@
+package database
+
+import (
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Store is what the rest of the service needs from storage. Db implements it
+// on SQLite, MySQL and PostgreSQL, and Memory without a database, picked by
+// DB_DRIVER; the networked backends can be shared by several replicas.
+type Store interface {
+	// UpsertRecord inserts the record of an ip, or updates its response code,
+	// error and updated_at if there already is one
+	UpsertRecord(r *model.Record) error
+	// WriteBatch stores the records and list results of b like UpsertRecord
+	// and UpsertListResult, all or none of them
+	WriteBatch(b *Batch) error
+	// QueryRecord returns the record of ip, or an error if there is none
+	QueryRecord(ip string) (*model.Record, error)
+	// UpsertListResult stores the result of a single ip/blocklist lookup,
+	// replacing any previous result for the pair unless the lookup failed, and
+	// adds it to the history
+	UpsertListResult(r *model.ListResult) error
+	// QueryListResults returns every stored blocklist result for an ip
+	QueryListResults(ip string) ([]*model.ListResult, error)
+	// QueryListedResults returns every stored result that is a listing,
+	// optionally only for the given blocklists and/or categories, ordered by
+	// ip and blocklist
+	QueryListedResults(blocklists, categories []string) ([]*model.ListResult, error)
+	// EachRecord calls fn with every record matching f, ordered by ip, and the
+	// blocklists currently listing it
+	EachRecord(f RecordFilter, fn func(r *model.Record, lists []string) error) error
+	// QueryRecords returns a page of the records matching q, most recently
+	// updated first, and whether more follow
+	QueryRecords(q RecordQuery) ([]*model.Record, bool, error)
+	// PruneRecords deletes the clean records, listed nowhere and with a
+	// successful last lookup, not updated since the Unix time before, and
+	// returns how many it deleted
+	PruneRecords(before int) (int, error)
+	// CompactHistory rolls the history of the days ending by the Unix time
+	// before up into daily summaries, and returns how many lookups it removed
+	CompactHistory(before int) (int, error)
+	// PruneDailyIPs deletes the ips kept for the compacted days ending by the
+	// Unix time before, and returns how many it deleted
+	PruneDailyIPs(before int) (int, error)
+	// QueryHistory returns the lookups of ip not compacted yet, failed ones
+	// with their error, oldest first
+	QueryHistory(ip string) ([]*model.ListResult, error)
+	// QueryDailySummaries returns the daily summaries of the days starting
+	// from the Unix time from until to, both inclusive if not 0
+	QueryDailySummaries(from, to int) ([]*DailySummary, error)
+	// QueryStats returns the counts of lookups, listings, errors and ips of
+	// the history and the compacted days matching q, ordered by group
+	QueryStats(q StatsQuery) ([]*Stats, error)
+	// Close releases the connection to the storage
+	Close() error
+}
+
+// NewStore function returns the Store of the configured DB_DRIVER: a new
+// Memory for memory, else the Db of NewDb
+func NewStore(c *config.APIConfig) (Store, error) {
+	if c.DbDriver == config.DbDriverMemory {
+		return NewMemory(), nil
+	}
+	db, err := NewDb(c)
+	if err != nil {
+		return nil, err
+	}
+	return db, nil
+}
@@ -0,0 +1,82 @@
+package dnsbl
+
+import (
+	"log"
+	"sync"
+
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// batcher buffers the records and list results of the worker's lookups, and
+// writes them to the store in one transaction once size of them are pending
+// or when flushed
+type batcher struct {
+	db   database.Store
+	size int
+
+	// writing keeps batches written in the order they were taken, mu only
+	// guards pending so adding never waits on the store
+	writing sync.Mutex
+	mu      sync.Mutex
+	pending database.Batch
+}
+
+// newBatcher returns a batcher writing to db in batches of size, at least 1
+func newBatcher(db database.Store, size int) *batcher {
+	if size < 1 {
+		size = 1
+	}
+	return &batcher{db: db, size: size}
+}
+
+// add queues the record of a looked up ip and its list results, writing the
+// batch if that fills it
+func (b *batcher) add(r *model.Record, results []*model.ListResult) {
+	b.mu.Lock()
+	b.pending.Records = append(b.pending.Records, r)
+	b.pending.Results = append(b.pending.Results, results...)
+	full := b.pending.Len() >= b.size
+	b.mu.Unlock()
+
+	if full {
+		b.flush()
+	}
+}
+
+// flush writes whatever is pending
+func (b *batcher) flush() {
+	b.writing.Lock()
+	defer b.writing.Unlock()
+
+	b.mu.Lock()
+	batch := b.pending
+	b.pending = database.Batch{}
+	b.mu.Unlock()
+
+	b.write(&batch)
+}
+
+// write stores batch; b.writing must be held. If the batch fails as a whole
+// its rows are written one by one, so one bad row doesn't lose the rest.
+func (b *batcher) write(batch *database.Batch) {
+	if batch.Len() == 0 {
+		return
+	}
+
+	err := b.db.WriteBatch(batch)
+	if err == nil {
+		return
+	}
+	log.Printf("writing batch of %d failed, retrying one by one: %s\n", batch.Len(), err)
+	for _, r := range batch.Records {
+		if err := b.db.UpsertRecord(r); err != nil {
+			log.Println("inserting record failed!", err)
+		}
+	}
+	for _, r := range batch.Results {
+		if err := b.db.UpsertListResult(r); err != nil {
+			log.Println("inserting list result failed!", err)
+		}
+	}
+}
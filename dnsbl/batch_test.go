@@ -0,0 +1,107 @@
+package dnsbl
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// failingBatches is a store whose batches all fail
+type failingBatches struct {
+	database.Store
+}
+
+func (failingBatches) WriteBatch(b *database.Batch) error {
+	return errors.New("batch failed")
+}
+
+// blockingBatches is a store whose batches wait for written to be closed
+type blockingBatches struct {
+	database.Store
+	started, written chan struct{}
+}
+
+func (b blockingBatches) WriteBatch(batch *database.Batch) error {
+	close(b.started)
+	<-b.written
+	return b.Store.WriteBatch(batch)
+}
+
+func TestBatcher(t *testing.T) {
+	db := database.NewMemory()
+	defer db.Close()
+
+	lookup := func(ip string) (*model.Record, []*model.ListResult) {
+		return &model.Record{IPAddress: ip, UUID: ip, ResponseCode: "NXDOMAIN", CreatedAt: 100, UpdatedAt: 100},
+			[]*model.ListResult{
+				{IPAddress: ip, Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN", CheckedAt: 100},
+				{IPAddress: ip, Blocklist: "bl.spamcop.net", ResponseCode: "NXDOMAIN", CheckedAt: 100},
+			}
+	}
+	stored := func(ip string) bool {
+		_, err := db.QueryRecord(ip)
+		return err == nil
+	}
+
+	t.Run("write_when_full", func(t *testing.T) {
+		b := newBatcher(db, 7)
+		b.add(lookup("127.0.0.1"))
+		b.add(lookup("127.0.0.2"))
+		assert.Equal(t, false, stored("127.0.0.1"))
+
+		// the third record fills the batch
+		r, _ := lookup("127.0.0.3")
+		b.add(r, nil)
+		assert.Equal(t, true, stored("127.0.0.1"))
+		assert.Equal(t, true, stored("127.0.0.3"))
+		results, err := db.QueryListResults("127.0.0.3")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, len(results))
+	})
+
+	t.Run("flush", func(t *testing.T) {
+		b := newBatcher(db, 100)
+		b.add(lookup("127.0.0.4"))
+		assert.Equal(t, false, stored("127.0.0.4"))
+		b.flush()
+		assert.Equal(t, true, stored("127.0.0.4"))
+		results, err := db.QueryListResults("127.0.0.4")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, len(results))
+
+		// nothing pending is nothing to write
+		b.flush()
+	})
+
+	t.Run("failed_batch_one_by_one", func(t *testing.T) {
+		b := newBatcher(failingBatches{db}, 0)
+		b.add(lookup("127.0.0.5"))
+		assert.Equal(t, true, stored("127.0.0.5"))
+		results, err := db.QueryListResults("127.0.0.5")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, len(results))
+	})
+	t.Run("add_while_writing", func(t *testing.T) {
+		store := blockingBatches{db, make(chan struct{}), make(chan struct{})}
+		b := newBatcher(store, 100)
+		b.add(lookup("127.0.0.6"))
+		done := make(chan struct{})
+		go func() {
+			b.flush()
+			close(done)
+		}()
+		<-store.started
+
+		// the pending batch was taken, so adding doesn't wait for the write
+		b.add(lookup("127.0.0.7"))
+		close(store.written)
+		<-done
+		assert.Equal(t, true, stored("127.0.0.6"))
+		assert.Equal(t, false, stored("127.0.0.7"))
+	})
+}
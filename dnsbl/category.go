@@ -0,0 +1,114 @@
+package dnsbl
+
+import (
+	"strings"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Listing categories. A list's return codes are mapped onto these so listings
+// from different lists can be filtered and counted together.
+const (
+	CategorySpam    = "spam"
+	CategoryExploit = "exploit"
+	CategoryProxy   = "proxy"
+	CategoryPolicy  = "policy"
+	CategoryLocal   = "local"
+	CategoryOther   = "other"
+)
+
+// spamhausCategories covers zen and the sbl/xbl/pbl lists it combines,
+// see https://www.spamhaus.org/faq/section/DNSBL%20Usage#200
+var spamhausCategories = map[string]string{
+	"127.0.0.2":  CategorySpam,
+	"127.0.0.3":  CategorySpam,
+	"127.0.0.4":  CategoryExploit,
+	"127.0.0.5":  CategoryExploit,
+	"127.0.0.6":  CategoryExploit,
+	"127.0.0.7":  CategoryExploit,
+	"127.0.0.9":  CategorySpam,
+	"127.0.0.10": CategoryPolicy,
+	"127.0.0.11": CategoryPolicy,
+}
+
+// sorbsCategories covers the sorbs aggregate and sub lists
+var sorbsCategories = map[string]string{
+	"127.0.0.2":  CategoryProxy,
+	"127.0.0.3":  CategoryProxy,
+	"127.0.0.4":  CategoryProxy,
+	"127.0.0.5":  CategoryProxy,
+	"127.0.0.6":  CategorySpam,
+	"127.0.0.7":  CategoryExploit,
+	"127.0.0.8":  CategoryPolicy,
+	"127.0.0.9":  CategoryExploit,
+	"127.0.0.10": CategoryPolicy,
+	"127.0.0.11": CategoryPolicy,
+	"127.0.0.12": CategoryPolicy,
+	"127.0.0.14": CategoryPolicy,
+}
+
+// listCategories maps a blocklist domain suffix to its return code table
+var listCategories = map[string]map[string]string{
+	"spamhaus.org":    spamhausCategories,
+	"dnsbl.sorbs.net": sorbsCategories,
+}
+
+// singleCategoryLists are lists where every listing means the same thing
+var singleCategoryLists = map[string]string{
+	"bl.spamcop.net":         CategorySpam,
+	"b.barracudacentral.org": CategorySpam,
+	"cbl.abuseat.org":        CategoryExploit,
+	"psbl.surriel.com":       CategorySpam,
+}
+
+// Category function returns the category of a listing by list with the given
+// return code, CategoryOther for lists or codes it doesn't know
+func Category(list, code string) string {
+	list = strings.ToLower(list)
+	if category, ok := singleCategoryLists[list]; ok {
+		return category
+	}
+	for suffix, codes := range listCategories {
+		if list != suffix && !strings.HasSuffix(list, "."+suffix) {
+			continue
+		}
+		if category, ok := codes[code]; ok {
+			return category
+		}
+	}
+	return CategoryOther
+}
+
+// categorySeverity ranks the categories, most severe first: a compromised or
+// proxying host is worse than a spam source, which is worse than an address
+// only listed for its network's policy
+var categorySeverity = []string{CategoryExploit, CategoryProxy, CategorySpam, CategoryLocal, CategoryOther, CategoryPolicy}
+
+// severity returns the rank of a listing's category, lower is more severe
+func severity(r *model.ListResult) int {
+	category := r.Category
+	if category == "" {
+		category = Category(r.Blocklist, r.ResponseCode)
+	}
+	for i, c := range categorySeverity {
+		if c == category {
+			return i
+		}
+	}
+	return len(categorySeverity)
+}
+
+// MostSevere function returns the listing in results with the most severe
+// category, the first of them on a tie, or nil if nothing is listed
+func MostSevere(results []*model.ListResult) *model.ListResult {
+	var worst *model.ListResult
+	for _, r := range results {
+		if r == nil || !r.Listed {
+			continue
+		}
+		if worst == nil || severity(r) < severity(worst) {
+			worst = r
+		}
+	}
+	return worst
+}
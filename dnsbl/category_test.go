@@ -0,0 +1,42 @@
+package dnsbl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestCategory(t *testing.T) {
+	cases := []struct {
+		list, code, category string
+	}{
+		{"zen.spamhaus.org", "127.0.0.2", CategorySpam},
+		{"zen.spamhaus.org", "127.0.0.4", CategoryExploit},
+		{"ZEN.Spamhaus.org", "127.0.0.11", CategoryPolicy},
+		{"xbl.spamhaus.org", "127.0.0.4", CategoryExploit},
+		{"zen.spamhaus.org", "127.0.0.200", CategoryOther},
+		{"dnsbl.sorbs.net", "127.0.0.3", CategoryProxy},
+		{"spam.dnsbl.sorbs.net", "127.0.0.6", CategorySpam},
+		{"bl.spamcop.net", "127.0.0.2", CategorySpam},
+		{"notspamhaus.org", "127.0.0.2", CategoryOther},
+		{"internal.bl", "127.0.0.2", CategoryOther},
+	}
+	for _, c := range cases {
+		assert.Equal(t, c.category, Category(c.list, c.code), c.list+" "+c.code)
+	}
+}
+
+func TestMostSevere(t *testing.T) {
+	policy := &model.ListResult{Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.10", Category: CategoryPolicy}
+	spam := &model.ListResult{Blocklist: "bl.spamcop.net", Listed: true, ResponseCode: "127.0.0.2"}
+	exploit := &model.ListResult{Blocklist: "cbl.abuseat.org", Listed: true, ResponseCode: "127.0.0.2"}
+	clean := &model.ListResult{Blocklist: "psbl.surriel.com", ResponseCode: "NXDOMAIN"}
+
+	assert.Equal(t, exploit, MostSevere([]*model.ListResult{policy, spam, exploit, clean}))
+	assert.Equal(t, spam, MostSevere([]*model.ListResult{clean, policy, spam, nil}))
+	// the first of equally severe listings
+	assert.Equal(t, spam, MostSevere([]*model.ListResult{spam, {Blocklist: "psbl.surriel.com", Listed: true, ResponseCode: "127.0.0.2"}}))
+	assert.Equal(t, (*model.ListResult)(nil), MostSevere([]*model.ListResult{clean}))
+}
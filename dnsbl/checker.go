@@ -0,0 +1,245 @@
+package dnsbl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexanderkarlis/godnsbl"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// DefaultConcurrency is the number of lookups a Checker runs at once when
+// Concurrency isn't set
+const DefaultConcurrency = 64
+
+// Checker looks IP addresses up against a set of blocklist domains. It can be
+// used on its own, without the server or a database, and is safe for
+// concurrent use as long as its fields aren't changed after the first Check.
+type Checker struct {
+	// Lists are the blocklist domains to check against
+	Lists []string
+	// Concurrency caps the number of lookups in flight. 0 means DefaultConcurrency
+	Concurrency int
+	// Resolver is used for the lookups. nil means net.DefaultResolver
+	Resolver *net.Resolver
+	// Zones answer the lists they are named after from memory instead of DNS
+	Zones map[string]*Zone
+}
+
+// IPResult is the result of checking a single IP address against every list
+// of a Checker
+type IPResult struct {
+	// IP is the IP address that was checked
+	IP string
+	// Listed is true if any of the lists listed the IP
+	Listed bool
+	// Results holds one result per list, in the order of Checker.Lists
+	Results []*model.ListResult
+}
+
+// NewChecker function returns a Checker for lists with the default settings
+func NewChecker(lists []string) *Checker {
+	return &Checker{Lists: lists}
+}
+
+// NewConfiguredChecker function returns a Checker for the configured
+// DNS_BLOCKLIST and ZONE_FILES. Zones are checked like any other list, under
+// their zone name.
+func NewConfiguredChecker(c *config.APIConfig) *Checker {
+	zones := LoadZones(c.ZoneFiles)
+	var zoneNames []string
+	for name := range zones {
+		zoneNames = append(zoneNames, name)
+	}
+	sort.Strings(zoneNames)
+
+	var lists []string
+	for _, domain := range append(c.DNSBlockList, zoneNames...) {
+		if domain != "" {
+			lists = append(lists, domain)
+		}
+	}
+	return &Checker{Lists: lists, Zones: zones}
+}
+
+// Check function looks every ip up against every list concurrently and returns
+// one IPResult per ip, in order. A lookup that fails has its error set on the
+// ListResult rather than failing the whole check. If ctx is done before all
+// lookups finished, the unfinished ones are abandoned, reported with an error,
+// and ctx.Err() is returned alongside the results.
+func (ch *Checker) Check(ctx context.Context, ips []string) ([]IPResult, error) {
+	for _, ip := range ips {
+		if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+			return nil, fmt.Errorf("%s is %w", ip, ErrInvalidIP)
+		}
+	}
+
+	concurrency := ch.Concurrency
+	if concurrency <= 0 {
+		concurrency = DefaultConcurrency
+	}
+
+	// a lookup to run: list j of results[i]
+	type lookupTask struct {
+		i, j int
+	}
+	tasks := make(chan lookupTask)
+
+	results := make([]IPResult, len(ips))
+	for i, ip := range ips {
+		results[i] = IPResult{
+			IP:      ip,
+			Results: make([]*model.ListResult, len(ch.Lists)),
+		}
+	}
+	if n := len(ips) * len(ch.Lists); n < concurrency {
+		concurrency = n
+	}
+
+	// a fixed pool, so a large check doesn't start a goroutine per lookup.
+	// Once ctx is done the lookups left are reported failed straight away.
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for t := range tasks {
+				r := &results[t.i]
+				r.Results[t.j] = ch.lookup(ctx, ch.Lists[t.j], r.IP)
+			}
+		}()
+	}
+	for i := range ips {
+		for j := range ch.Lists {
+			tasks <- lookupTask{i, j}
+		}
+	}
+	close(tasks)
+	wg.Wait()
+
+	for i := range results {
+		for _, r := range results[i].Results {
+			if r.Listed {
+				results[i].Listed = true
+			}
+		}
+	}
+	return results, ctxErr(ctx)
+}
+
+// lookup checks a single ip against a single blocklist domain
+func (ch *Checker) lookup(ctx context.Context, list, ip string) *model.ListResult {
+	result := &model.ListResult{
+		IPAddress:    ip,
+		Blocklist:    list,
+		ResponseCode: "NXDOMAIN",
+		CheckedAt:    int(time.Now().Unix()),
+	}
+
+	if ctx.Err() != nil {
+		errString := ctx.Err().Error()
+		result.Error = &errString
+		return result
+	}
+
+	resolver := ch.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	if z, ok := ch.Zones[list]; ok {
+		return z.check(ctx, resolver, ip, result)
+	}
+
+	query := fmt.Sprintf("%s.%s", godnsbl.Reverse(net.ParseIP(ip)), list)
+	answers, err := resolver.LookupHost(ctx, query)
+	if err != nil {
+		if isNotFound(err) {
+			return result
+		}
+		errString := err.Error()
+		if ctxErr(ctx) != nil {
+			errString = ctxErr(ctx).Error()
+		}
+		result.Error = &errString
+		return result
+	}
+
+	if len(answers) > 0 {
+		result.ResponseCode = answers[0]
+	}
+	for _, answer := range answers {
+		if strings.HasPrefix(answer, "127.") {
+			result.Listed = true
+		}
+	}
+
+	if result.Listed {
+		result.Category = Category(list, result.ResponseCode)
+		txt, err := resolver.LookupTXT(ctx, query)
+		if err == nil && len(txt) > 0 {
+			result.Reason = &txt[0]
+		}
+	}
+	return result
+}
+
+// ctxErr is ctx.Err(), except that a deadline which has passed counts even if
+// ctx hasn't noticed yet. The resolver gives up right on the deadline, which
+// can be a moment before ctx is marked done.
+func ctxErr(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return nil
+}
+
+// isNotFound reports whether err is the NXDOMAIN a blocklist answers with
+// for an ip it doesn't list
+func isNotFound(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && dnsErr.IsNotFound
+}
+
+// ProcessIps function takes in a array of sources and IPs to check,
+// and returns one godnsbl.Result per ip per source, grouped by ip.
+//
+// Deprecated: use Checker.Check, which takes a context and returns errors.
+func ProcessIps(sources, ips []string) *[]godnsbl.Result {
+	checked, err := NewChecker(sources).Check(context.Background(), ips)
+	if err != nil {
+		return &[]godnsbl.Result{}
+	}
+
+	results := make([]godnsbl.Result, 0, len(ips)*len(sources))
+	for _, ipResult := range checked {
+		for _, r := range ipResult.Results {
+			result := godnsbl.Result{
+				Rbl:     r.Blocklist,
+				Address: r.IPAddress,
+				Listed:  r.Listed,
+				Code:    r.ResponseCode,
+			}
+			if r.Reason != nil {
+				result.Text = *r.Reason
+			}
+			if r.Error != nil {
+				result.Error = true
+				result.ErrorType = errors.New(*r.Error)
+			}
+			results = append(results, result)
+		}
+	}
+	return &results
+}
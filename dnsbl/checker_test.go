@@ -0,0 +1,178 @@
+package dnsbl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+)
+
+// testListings are the A records served by the fake blocklist test.bl;
+// anything else under test.bl is NXDOMAIN and slow.bl never answers
+var testListings = map[string]string{
+	"2.0.0.127.test.bl.": "127.0.0.2",
+	"3.0.0.127.test.bl.": "127.0.0.3",
+}
+
+// newTestResolver starts a fake blocklist dns server and returns a resolver
+// that sends every query to it
+func newTestResolver(t *testing.T) *net.Resolver {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Equal(t, nil, err)
+
+	mux := dns.NewServeMux()
+	mux.HandleFunc("test.bl.", func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		q := req.Question[0]
+		code, ok := testListings[strings.ToLower(q.Name)]
+		switch {
+		case !ok:
+			m.Rcode = dns.RcodeNameError
+		case q.Qtype == dns.TypeA:
+			rr, _ := dns.NewRR(q.Name + " 60 IN A " + code)
+			m.Answer = append(m.Answer, rr)
+		case q.Qtype == dns.TypeTXT:
+			rr, _ := dns.NewRR(q.Name + ` 60 IN TXT "listed for testing"`)
+			m.Answer = append(m.Answer, rr)
+		}
+		w.WriteMsg(m)
+	})
+	mux.HandleFunc("slow.bl.", func(w dns.ResponseWriter, req *dns.Msg) {})
+
+	server := &dns.Server{PacketConn: pc, Handler: mux}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	addr := pc.LocalAddr().String()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "udp", addr)
+		},
+	}
+}
+
+func TestChecker(t *testing.T) {
+	resolver := newTestResolver(t)
+
+	t.Run("check_multiple_ips", func(t *testing.T) {
+		checker := &Checker{
+			Lists:    []string{"test.bl"},
+			Resolver: resolver,
+		}
+
+		results, err := checker.Check(context.Background(), []string{"127.0.0.2", "127.0.0.3", "127.0.0.80"})
+		require.Equal(t, nil, err)
+		require.Equal(t, 3, len(results))
+
+		assert.Equal(t, "127.0.0.2", results[0].IP)
+		assert.Equal(t, true, results[0].Listed)
+		assert.Equal(t, "127.0.0.2", results[0].Results[0].ResponseCode)
+		require.NotEqual(t, (*string)(nil), results[0].Results[0].Reason)
+		assert.Equal(t, "listed for testing", *results[0].Results[0].Reason)
+		assert.Equal(t, CategoryOther, results[0].Results[0].Category)
+
+		assert.Equal(t, true, results[1].Listed)
+		assert.Equal(t, "127.0.0.3", results[1].Results[0].ResponseCode)
+
+		assert.Equal(t, false, results[2].Listed)
+		assert.Equal(t, "NXDOMAIN", results[2].Results[0].ResponseCode)
+		assert.Equal(t, (*string)(nil), results[2].Results[0].Error)
+	})
+
+	t.Run("check_deadline", func(t *testing.T) {
+		checker := &Checker{
+			Lists:    []string{"test.bl", "slow.bl"},
+			Resolver: resolver,
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		results, err := checker.Check(ctx, []string{"127.0.0.2"})
+		assert.Equal(t, context.DeadlineExceeded, err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, true, results[0].Results[0].Listed)
+		require.NotEqual(t, (*string)(nil), results[0].Results[1].Error)
+	})
+
+	t.Run("check_invalid_ip", func(t *testing.T) {
+		_, err := NewChecker([]string{"test.bl"}).Check(context.Background(), []string{"127.0.0.2", "nope"})
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("configured_checker", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "checker")
+		require.Equal(t, nil, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "internal.zone")
+		require.Equal(t, nil, ioutil.WriteFile(path, []byte("127.0.0.5\n"), 0644))
+
+		checker := NewConfiguredChecker(&config.APIConfig{
+			DNSBlockList: []string{"zen.spamhaus.org", ""},
+			ZoneFiles:    []string{"internal.bl:ip4set:" + path},
+		})
+		assert.Equal(t, []string{"zen.spamhaus.org", "internal.bl"}, checker.Lists)
+		require.NotEqual(t, (*Zone)(nil), checker.Zones["internal.bl"])
+	})
+
+	t.Run("check_concurrent_use", func(t *testing.T) {
+		checker := &Checker{
+			Lists:       []string{"test.bl"},
+			Concurrency: 2,
+			Resolver:    resolver,
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				results, err := checker.Check(context.Background(), []string{"127.0.0.2", "127.0.0.3"})
+				assert.Equal(t, nil, err)
+				assert.Equal(t, 2, len(results))
+			}()
+		}
+		wg.Wait()
+	})
+	t.Run("check_bounded_goroutines", func(t *testing.T) {
+		checker := &Checker{
+			Lists:       []string{"slow.bl"},
+			Concurrency: 2,
+			Resolver:    resolver,
+		}
+		ips := make([]string, 500)
+		for i := range ips {
+			ips[i] = "127.0.0.2"
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+		defer cancel()
+
+		before := runtime.NumGoroutine()
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			results, _ := checker.Check(ctx, ips)
+			assert.Equal(t, len(ips), len(results))
+		}()
+		// the lookups wait for the pool, not in a goroutine each
+		time.Sleep(100 * time.Millisecond)
+		assert.Less(t, runtime.NumGoroutine()-before, 50)
+		<-done
+	})
+}
@@ -1,8 +1,13 @@
 package dnsbl
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log"
+	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/alexanderkarlis/godnsbl"
@@ -13,31 +18,96 @@ import (
 	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
 )
 
+// DefaultCheckTimeout is the deadline used by CheckIP callers that don't set one
+const DefaultCheckTimeout = 2 * time.Second
+
+// spillInterval is how often spilled jobs are moved back into the queue
+const spillInterval = 500 * time.Millisecond
+
+// ErrQueueFull is returned by QueueJob when the job didn't fit in the queue
+var ErrQueueFull = errors.New("queue is full")
+
+// ErrInvalidIP is wrapped in the error of a check given something other than
+// an IPv4 address
+var ErrInvalidIP = errors.New("not an IPv4 address")
+
 // Consumer type
 type Consumer struct {
 	wg        sync.WaitGroup
-	db        *database.Db
+	db        database.Store
 	inputChan chan int
-	jobsChan  chan []string
+	jobsChan  chan job
 	blDomains []string
+	checker   *Checker
+	cacheTTL  time.Duration
+	writes    *batcher
 	quitChan  chan struct{}
+	updates   updates
+	jobs      jobTracker
+
+	policy        string
+	queueTimeout  time.Duration
+	lookupTimeout time.Duration
+	flushInterval time.Duration
+	spill         *spill
+	// moving average of how long a job takes, in nanoseconds; atomic
+	avgJobNanos int64
+}
+
+// job is a batch of ips queued together
+type job struct {
+	id     string
+	ips    []string
+	source string
 }
 
 // ResultSet from godnsbl.Lookup()
 type ResultSet []godnsbl.RBLResults
 
 // NewConsumer function returns a consumer to be run for the alotted job queue.
-func NewConsumer(db *database.Db, c *config.APIConfig) *Consumer {
+func NewConsumer(db database.Store, c *config.APIConfig) *Consumer {
 	poolsize := c.WorkerPoolsize
-	blDomains := c.DNSBlockList
+	checker := NewConfiguredChecker(c)
 
 	consumer := Consumer{
 		wg:        sync.WaitGroup{},
 		db:        db,
 		inputChan: make(chan int, 1),
-		jobsChan:  make(chan []string, poolsize),
+		jobsChan:  make(chan job, poolsize),
 		quitChan:  make(chan struct{}),
-		blDomains: blDomains,
+		blDomains: checker.Lists,
+		checker:   checker,
+		cacheTTL:  time.Duration(c.CacheTTL) * time.Second,
+		writes:    newBatcher(db, c.DbFlushSize),
+
+		policy:        c.QueuePolicy,
+		queueTimeout:  time.Duration(c.QueueTimeout) * time.Millisecond,
+		lookupTimeout: time.Duration(c.LookupTimeout) * time.Millisecond,
+		flushInterval: time.Duration(c.DbFlushInterval) * time.Millisecond,
+	}
+	if consumer.lookupTimeout <= 0 {
+		consumer.lookupTimeout = DefaultCheckTimeout
+	}
+
+	if consumer.policy == config.QueuePolicySpill {
+		s, err := newSpill(c.QueueSpillDir)
+		if err != nil {
+			log.Printf("could not open spill dir %s, rejecting jobs when the queue is full: %s\n", c.QueueSpillDir, err)
+			consumer.policy = config.QueuePolicyReject
+		} else {
+			consumer.spill = s
+			consumer.wg.Add(1)
+			go consumer.drainSpill()
+		}
+	}
+
+	for _, z := range checker.Zones {
+		go z.Watch(consumer.quitChan, ZoneReloadInterval)
+	}
+
+	if consumer.flushInterval > 0 {
+		consumer.wg.Add(1)
+		go consumer.flushWrites()
 	}
 
 	consumer.wg.Add(1)
@@ -48,82 +118,294 @@ func NewConsumer(db *database.Db, c *config.APIConfig) *Consumer {
 
 // Queue function
 func (c *Consumer) Queue(ips []string) bool {
+	_, err := c.QueueJob(ips)
+	return err == nil
+}
+
+// QueueJob function queues ips like Queue, and also returns the id of the job
+// they were queued under. What happens when the queue is full depends on the
+// QUEUE_FULL_POLICY; ErrQueueFull is returned if the job was dropped.
+func (c *Consumer) QueueJob(ips []string) (string, error) {
+	return c.QueueJobFrom("", ips)
+}
+
+// QueueJobFrom function queues ips like QueueJob, tagging the job with the
+// source that submitted them, e.g. `syslog/mail`
+func (c *Consumer) QueueJobFrom(source string, ips []string) (string, error) {
+	j := job{
+		id:     uuid.New().String(),
+		ips:    ips,
+		source: source,
+	}
+	// the log is where the source is kept, job statuses are forgotten
+	from := ""
+	if source != "" {
+		from = " from " + source
+	}
+
+	if c.policy == config.QueuePolicySpill {
+		// once jobs are spilled, new ones queue up behind them to keep the order
+		spilled, err := c.spill.sendOrWrite(j, time.Now().UnixNano(), c.trySend)
+		if err != nil {
+			log.Println("spilling job failed!", err)
+			return "", err
+		}
+		if spilled {
+			c.jobs.add(j, JobSpilled)
+			log.Printf("queue is full, spilled %d ips%s as job %s\n", len(ips), from, j.id)
+			return j.id, nil
+		}
+		c.jobs.add(j, JobQueued)
+		log.Printf("added %d ips%s to check against blist as job %s\n", len(ips), from, j.id)
+		return j.id, nil
+	}
+
+	if c.trySend(j) {
+		c.jobs.add(j, JobQueued)
+		log.Printf("added %d ips%s to check against blist as job %s\n", len(ips), from, j.id)
+		return j.id, nil
+	}
+	if c.policy == config.QueuePolicyBlock {
+		timer := time.NewTimer(c.queueTimeout)
+		defer timer.Stop()
+		select {
+		case c.jobsChan <- j:
+			c.jobs.add(j, JobQueued)
+			log.Printf("added %d ips%s to check against blist as job %s\n", len(ips), from, j.id)
+			return j.id, nil
+		case <-timer.C:
+		}
+	}
+
+	log.Printf("queue is full, dropped %d ips%s\n", len(ips), from)
+	return "", ErrQueueFull
+}
+
+// trySend queues j if there is room, without waiting
+func (c *Consumer) trySend(j job) bool {
 	select {
-	case c.jobsChan <- ips:
-		log.Printf("added %d ips to check against blist\n", len(ips))
+	case c.jobsChan <- j:
 		return true
 	default: // buffer is full
-		log.Printf("queue is full\n")
 		return false
 	}
 }
 
-// worker function that takes in a array of sources and IPs to check,
-// and runs the godnsbl.Lookup function
+// QueueStatus function returns how full the queue is
+func (c *Consumer) QueueStatus() *model.QueueStatus {
+	status := &model.QueueStatus{
+		Depth:             len(c.jobsChan),
+		Capacity:          cap(c.jobsChan),
+		Policy:            c.policy,
+		RetryAfterSeconds: int(c.RetryAfter() / time.Second),
+	}
+	if c.spill != nil {
+		status.Spilled = c.spill.len()
+	}
+	return status
+}
+
+// RetryAfter function estimates how long until there is room in a full queue,
+// which is about as long as the worker takes for a job
+func (c *Consumer) RetryAfter() time.Duration {
+	avg := time.Duration(atomic.LoadInt64(&c.avgJobNanos))
+	if avg < time.Second {
+		return time.Second
+	}
+	return avg.Round(time.Second)
+}
+
+// drainSpill moves spilled jobs back into the queue as room frees up
+func (c *Consumer) drainSpill() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(spillInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quitChan:
+			return
+		case <-ticker.C:
+			err := c.spill.drain(func(j job) bool {
+				if !c.trySend(j) {
+					return false
+				}
+				log.Printf("moved spilled job %s to the queue\n", j.id)
+				return true
+			})
+			if err != nil {
+				log.Println("draining spilled jobs failed!", err)
+			}
+		}
+	}
+}
+
+// Lists returns the blocklist domains the consumer checks against
+func (c *Consumer) Lists() []string {
+	return c.blDomains
+}
+
+// CheckIP function checks a single ip against lists (the configured blocklists
+// if empty) and returns one result per list, in order. Stored results younger
+// than the cache ttl are reused; the rest are looked up live, concurrently,
+// until ctx is done, and stored for next time.
+func (c *Consumer) CheckIP(ctx context.Context, ip string, lists []string) ([]*model.ListResult, error) {
+	if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+		return nil, fmt.Errorf("%s is %w", ip, ErrInvalidIP)
+	}
+	if len(lists) == 0 {
+		lists = c.blDomains
+	}
+
+	stored, err := c.db.QueryListResults(ip)
+	if err != nil {
+		return nil, err
+	}
+	cutoff := int(time.Now().Add(-c.cacheTTL).Unix())
+	fresh := make(map[string]*model.ListResult)
+	for _, r := range stored {
+		if r.CheckedAt >= cutoff {
+			fresh[r.Blocklist] = r
+		}
+	}
+
+	var missing []string
+	for _, list := range lists {
+		if _, ok := fresh[list]; !ok {
+			missing = append(missing, list)
+		}
+	}
+
+	// a done ctx is reported per list, so the error can be ignored here
+	checker := &Checker{Lists: missing, Zones: c.checker.Zones}
+	checked, _ := checker.Check(ctx, []string{ip})
+	var batch database.Batch
+	for _, r := range checked[0].Results {
+		fresh[r.Blocklist] = r
+		batch.Results = append(batch.Results, r)
+	}
+	if batch.Len() > 0 {
+		if err := c.db.WriteBatch(&batch); err != nil {
+			log.Println("inserting list results failed!", err)
+		}
+	}
+
+	results := make([]*model.ListResult, len(lists))
+	for i, list := range lists {
+		results[i] = fresh[list]
+	}
+	return results, nil
+}
+
+// flushWrites writes the worker's pending results every flushInterval, so a
+// long job's results don't wait for a full batch
+func (c *Consumer) flushWrites() {
+	defer c.wg.Done()
+	ticker := time.NewTicker(c.flushInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.quitChan:
+			c.writes.flush()
+			return
+		case <-ticker.C:
+			c.writes.flush()
+		}
+	}
+}
+
+// worker function that takes jobs of IPs off the jobs channel, checks each
+// IP against the blocklists, and stores and publishes the results
 func (c *Consumer) worker() {
 	defer c.wg.Done()
 	for {
 		select {
 		case <-c.quitChan:
 			log.Println("Stop chan received. Exiting function")
+			c.writes.flush()
 			return
-		case ips := <-c.jobsChan:
-			log.Printf("in jobs chan, received %+v\n", ips)
-
-			sources := c.blDomains
-			results := make([]godnsbl.Result, len(sources))
+		case j := <-c.jobsChan:
+			log.Printf("in jobs chan, received job %s %+v\n", j.id, j.ips)
+			start := time.Now()
+			c.jobs.update(j, func(s *JobStatus) { s.State = JobRunning })
 
-			for _, ip := range ips {
+			for _, ip := range j.ips {
 				log.Printf("looking up %s", ip)
-				for _, source := range sources {
-					rbl := godnsbl.Lookup(source, ip)
-
-					timeNow := time.Now().Unix()
-					respCode := "NXDOMAIN"
-
-					if !rbl.Results[0].Error {
-						respCode = rbl.Results[0].Code
-					}
-
-					record := &model.Record{
-						UUID:         uuid.New().String(),
-						CreatedAt:    int(timeNow),
-						UpdatedAt:    int(timeNow),
-						IPAddress:    ip,
-						ResponseCode: respCode,
-					}
-
-					err := c.db.UpsertRecord(record)
-					if err != nil {
-						log.Println("inserting record failed!", err)
-					}
-
-					// TODO: for debugging purposes
-					if len(rbl.Results) == 0 {
-						results = append(results, godnsbl.Result{})
-					} else {
-						results = append(results, rbl.Results[0])
-					}
+				ctx, cancel := context.WithTimeout(context.Background(), c.lookupTimeout)
+				checked, err := c.checker.Check(ctx, []string{ip})
+				cancel()
+				c.jobs.update(j, func(s *JobStatus) { s.Checked++ })
+				// the lists the deadline cut short come back failed, so
+				// only an invalid ip has nothing to store
+				if checked == nil {
+					log.Println("lookup failed!", err)
+					continue
+				}
+
+				// the store keeps only definite answers for checkIP,
+				// failed lookups go to the history for the stats
+				record := newRecord(checked[0])
+				c.writes.add(record, checked[0].Results)
+				for _, listResult := range checked[0].Results {
+					c.publish(&model.RecordUpdate{
+						JobID:  j.id,
+						Record: record,
+						Result: listResult,
+					})
 				}
 			}
+			// store what is pending, so a done job's results can be read
+			// straight away
+			c.writes.flush()
+			c.jobs.update(j, func(s *JobStatus) {
+				s.State = JobDone
+				s.FinishedAt = int(time.Now().Unix())
+			})
+			c.recordJobDuration(time.Since(start))
 		}
 	}
 }
 
-// ProcessIps function takes in a array of sources and IPs to check,
-// and runs the godnsbl.Lookup function
-func ProcessIps(sources, ips []string) *[]godnsbl.Result {
-	results := make([]godnsbl.Result, len(sources))
-	for _, ip := range ips {
-		log.Printf("running for %s", ip)
-		for i, source := range sources {
-			rbl := godnsbl.Lookup(source, ip)
-			if len(rbl.Results) == 0 {
-				results[i] = godnsbl.Result{}
-			} else {
-				results[i] = rbl.Results[0]
-			}
+// newRecord returns the ip_details record of a checked ip, merged over its
+// lists: the response code of its most severe listing, NXDOMAIN if none lists
+// it, and an error only if every list failed
+func newRecord(checked IPResult) *model.Record {
+	record := &model.Record{
+		UUID:         uuid.New().String(),
+		IPAddress:    checked.IP,
+		ResponseCode: "NXDOMAIN",
+	}
+	failed := 0
+	for _, r := range checked.Results {
+		if r.CheckedAt > record.UpdatedAt {
+			record.UpdatedAt = r.CheckedAt
 		}
+		if r.Error != nil {
+			failed++
+		}
+	}
+	if record.UpdatedAt == 0 {
+		record.UpdatedAt = int(time.Now().Unix())
+	}
+	record.CreatedAt = record.UpdatedAt
+
+	if worst := MostSevere(checked.Results); worst != nil {
+		record.ResponseCode = worst.ResponseCode
+	}
+	if failed > 0 && failed == len(checked.Results) {
+		record.Error = checked.Results[0].Error
+	}
+	return record
+}
+
+// recordJobDuration folds d into the moving average used by RetryAfter
+func (c *Consumer) recordJobDuration(d time.Duration) {
+	avg := atomic.LoadInt64(&c.avgJobNanos)
+	if avg == 0 {
+		avg = int64(d)
+	} else {
+		avg = (avg*7 + int64(d)) / 8
 	}
-	return &results
+	atomic.StoreInt64(&c.avgJobNanos, avg)
 }
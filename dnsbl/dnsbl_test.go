@@ -1,12 +1,16 @@
 package dnsbl
 
 import (
+	"context"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/alexanderkarlis/sw-dnsbl/config"
 	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestConsumer(t *testing.T) {
@@ -18,15 +22,15 @@ func TestConsumer(t *testing.T) {
 	os.Setenv("WORKER_POOL_SIZE", "99")
 	os.Setenv("DNS_BLOCKLIST", "zen.spamhaus.org")
 	os.Setenv("LOG_FILE", "app.log")
+	defer os.Setenv("DB_DRIVER", os.Getenv("DB_DRIVER"))
+	os.Setenv("DB_DRIVER", config.DbDriverMemory)
 
 	c := config.GetConfig()
-	db, err := database.NewDb(c)
-	defer os.Remove(c.DbPath)
-
-	defer db.Close()
+	db, err := database.NewStore(c)
 	if err != nil {
-		t.Error(err)
+		t.Fatal(err)
 	}
+	defer db.Close()
 	t.Run("new_consumer_success", func(t *testing.T) {
 		consumer := NewConsumer(db, c)
 		assert.NotEqual(t, nil, consumer)
@@ -52,4 +56,109 @@ func TestConsumer(t *testing.T) {
 		}
 		assert.Equal(t, false, addedToQueue)
 	})
+
+	t.Run("queue_full_reject", func(t *testing.T) {
+		consumer := &Consumer{
+			jobsChan: make(chan job, 1),
+			policy:   config.QueuePolicyReject,
+		}
+		_, err := consumer.QueueJob([]string{"127.0.0.1"})
+		require.Equal(t, nil, err)
+		_, err = consumer.QueueJob([]string{"127.0.0.2"})
+		assert.Equal(t, ErrQueueFull, err)
+
+		status := consumer.QueueStatus()
+		assert.Equal(t, 1, status.Depth)
+		assert.Equal(t, 1, status.Capacity)
+		assert.Equal(t, 1, status.RetryAfterSeconds)
+	})
+
+	t.Run("queue_full_block", func(t *testing.T) {
+		consumer := &Consumer{
+			jobsChan:     make(chan job, 1),
+			policy:       config.QueuePolicyBlock,
+			queueTimeout: 50 * time.Millisecond,
+		}
+		_, err := consumer.QueueJob([]string{"127.0.0.1"})
+		require.Equal(t, nil, err)
+
+		start := time.Now()
+		_, err = consumer.QueueJob([]string{"127.0.0.2"})
+		assert.Equal(t, ErrQueueFull, err)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+
+		// room frees up while waiting
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			<-consumer.jobsChan
+		}()
+		_, err = consumer.QueueJob([]string{"127.0.0.3"})
+		assert.Equal(t, nil, err)
+	})
+
+	t.Run("check_ip_cached", func(t *testing.T) {
+		consumer := NewConsumer(db, c)
+		err := db.UpsertListResult(&model.ListResult{
+			IPAddress:    "127.0.0.2",
+			Blocklist:    "zen.spamhaus.org",
+			Listed:       true,
+			ResponseCode: "127.0.0.2",
+			CheckedAt:    int(time.Now().Unix()),
+		})
+		require.Equal(t, nil, err)
+
+		results, err := consumer.CheckIP(context.Background(), "127.0.0.2", []string{"zen.spamhaus.org"})
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(results))
+		assert.Equal(t, true, results[0].Cached)
+		assert.Equal(t, true, results[0].Listed)
+		assert.Equal(t, "127.0.0.2", results[0].ResponseCode)
+	})
+
+	t.Run("check_ip_deadline", func(t *testing.T) {
+		consumer := NewConsumer(db, c)
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+		defer cancel()
+
+		lists := []string{"deadline.invalid", "other.deadline.invalid"}
+		start := time.Now()
+		results, err := consumer.CheckIP(ctx, "127.0.0.80", lists)
+		require.Equal(t, nil, err)
+		assert.Less(t, int64(time.Since(start)), int64(time.Second))
+		require.Equal(t, 2, len(results))
+		for i, r := range results {
+			assert.Equal(t, lists[i], r.Blocklist)
+			assert.Equal(t, false, r.Cached)
+		}
+	})
+
+	t.Run("new_record", func(t *testing.T) {
+		timeout := "i/o timeout"
+		listed := &model.ListResult{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.4", CheckedAt: 100}
+		clean := &model.ListResult{IPAddress: "127.0.0.2", Blocklist: "bl.spamcop.net", ResponseCode: "NXDOMAIN", CheckedAt: 101}
+		failed := &model.ListResult{IPAddress: "127.0.0.2", Blocklist: "psbl.surriel.com", ResponseCode: "NXDOMAIN", Error: &timeout, CheckedAt: 102}
+
+		// the last list doesn't decide, a listing does
+		r := newRecord(IPResult{IP: "127.0.0.2", Results: []*model.ListResult{listed, clean, failed}})
+		assert.Equal(t, "127.0.0.2", r.IPAddress)
+		assert.Equal(t, "127.0.0.4", r.ResponseCode)
+		assert.Equal(t, (*string)(nil), r.Error)
+		assert.Equal(t, 102, r.UpdatedAt)
+		assert.Equal(t, 102, r.CreatedAt)
+
+		r = newRecord(IPResult{IP: "127.0.0.2", Results: []*model.ListResult{clean, failed}})
+		assert.Equal(t, "NXDOMAIN", r.ResponseCode)
+		assert.Equal(t, (*string)(nil), r.Error)
+
+		r = newRecord(IPResult{IP: "127.0.0.2", Results: []*model.ListResult{failed, failed}})
+		assert.Equal(t, "NXDOMAIN", r.ResponseCode)
+		require.NotEqual(t, (*string)(nil), r.Error)
+		assert.Equal(t, timeout, *r.Error)
+	})
+
+	t.Run("check_ip_invalid", func(t *testing.T) {
+		consumer := NewConsumer(db, c)
+		_, err := consumer.CheckIP(context.Background(), "not-an-ip", nil)
+		assert.NotEqual(t, nil, err)
+	})
 }
@@ -0,0 +1,100 @@
+package dnsbl
+
+import (
+	"sync"
+	"time"
+)
+
+// maxTrackedJobs is how many jobs keep their status, the oldest are
+// forgotten first
+const maxTrackedJobs = 10000
+
+// Job states
+const (
+	JobQueued  = "queued"
+	JobSpilled = "spilled"
+	JobRunning = "running"
+	JobDone    = "done"
+)
+
+// JobStatus is the progress of a queued job
+type JobStatus struct {
+	ID         string   `json:"id"`
+	State      string   `json:"state"`
+	IPs        []string `json:"ips"`
+	Source     string   `json:"source,omitempty"`
+	Checked    int      `json:"checked"`
+	CreatedAt  int      `json:"created_at"`
+	FinishedAt int      `json:"finished_at,omitempty"`
+}
+
+// jobTracker keeps the status of the most recent jobs in memory, so it is lost
+// on restart
+type jobTracker struct {
+	mu   sync.Mutex
+	jobs map[string]*JobStatus
+	// ring of the tracked job ids, once full next is the oldest
+	order []string
+	next  int
+}
+
+// add starts tracking j in state, unless the worker got to it first
+func (t *jobTracker) add(j job, state string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.jobs[j.id]; !ok {
+		t.addLocked(j, state)
+	}
+}
+
+func (t *jobTracker) addLocked(j job, state string) *JobStatus {
+	if t.jobs == nil {
+		t.jobs = make(map[string]*JobStatus)
+	}
+	status := &JobStatus{
+		ID:        j.id,
+		State:     state,
+		IPs:       j.ips,
+		Source:    j.source,
+		CreatedAt: int(time.Now().Unix()),
+	}
+	t.jobs[j.id] = status
+	if len(t.order) < maxTrackedJobs {
+		t.order = append(t.order, j.id)
+		return status
+	}
+	delete(t.jobs, t.order[t.next])
+	t.order[t.next] = j.id
+	t.next = (t.next + 1) % maxTrackedJobs
+	return status
+}
+
+// update applies f to the status of j, tracking it first if it isn't yet
+// (jobs spilled before a restart)
+func (t *jobTracker) update(j job, f func(*JobStatus)) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, ok := t.jobs[j.id]
+	if !ok {
+		status = t.addLocked(j, JobQueued)
+	}
+	f(status)
+}
+
+// get returns a copy of the status of job id
+func (t *jobTracker) get(id string) (*JobStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	status, ok := t.jobs[id]
+	if !ok {
+		return nil, false
+	}
+	copied := *status
+	return &copied, true
+}
+
+// Job function returns the status of a job queued with QueueJob, false if the
+// job is unknown or too old to still be tracked
+func (c *Consumer) Job(id string) (*JobStatus, bool) {
+	return c.jobs.get(id)
+}
@@ -0,0 +1,62 @@
+package dnsbl
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestJobTracker(t *testing.T) {
+	t.Run("job_lifecycle", func(t *testing.T) {
+		var tracker jobTracker
+		j := job{id: "job-1", ips: []string{"127.0.0.2", "127.0.0.3"}, source: "syslog/mail"}
+
+		_, ok := tracker.get(j.id)
+		assert.Equal(t, false, ok)
+
+		tracker.add(j, JobQueued)
+		status, ok := tracker.get(j.id)
+		require.Equal(t, true, ok)
+		assert.Equal(t, JobQueued, status.State)
+		assert.Equal(t, j.ips, status.IPs)
+		assert.Equal(t, "syslog/mail", status.Source)
+
+		tracker.update(j, func(s *JobStatus) { s.State = JobRunning })
+		tracker.update(j, func(s *JobStatus) { s.Checked++ })
+		status, _ = tracker.get(j.id)
+		assert.Equal(t, JobRunning, status.State)
+		assert.Equal(t, 1, status.Checked)
+
+		// the worker can pick a job up before QueueJob tracks it
+		tracker.add(j, JobQueued)
+		status, _ = tracker.get(j.id)
+		assert.Equal(t, JobRunning, status.State)
+	})
+
+	t.Run("untracked_job_update", func(t *testing.T) {
+		var tracker jobTracker
+		tracker.update(job{id: "spilled"}, func(s *JobStatus) { s.State = JobDone })
+		status, ok := tracker.get("spilled")
+		require.Equal(t, true, ok)
+		assert.Equal(t, JobDone, status.State)
+	})
+
+	t.Run("oldest_jobs_forgotten", func(t *testing.T) {
+		var tracker jobTracker
+		for i := 0; i < maxTrackedJobs+2; i++ {
+			tracker.add(job{id: fmt.Sprint(i)}, JobQueued)
+		}
+		_, ok := tracker.get("0")
+		assert.Equal(t, false, ok)
+		_, ok = tracker.get("1")
+		assert.Equal(t, false, ok)
+		_, ok = tracker.get("2")
+		assert.Equal(t, true, ok)
+		_, ok = tracker.get(fmt.Sprint(maxTrackedJobs + 1))
+		assert.Equal(t, true, ok)
+		assert.Equal(t, maxTrackedJobs, len(tracker.jobs))
+		assert.Equal(t, maxTrackedJobs, len(tracker.order))
+	})
+}
@@ -0,0 +1,23 @@
+package dnsbl
+
+import "github.com/alexanderkarlis/sw-dnsbl/graph/model"
+
+// DefaultListWeight is the weight of a list missing from LIST_WEIGHTS
+const DefaultListWeight = 1
+
+// Score function returns the sum of the weights of the lists listing an ip
+// in results, lists missing from weights weigh DefaultListWeight
+func Score(results []*model.ListResult, weights map[string]int) int {
+	score := 0
+	for _, r := range results {
+		if r == nil || !r.Listed {
+			continue
+		}
+		if weight, ok := weights[r.Blocklist]; ok {
+			score += weight
+		} else {
+			score += DefaultListWeight
+		}
+	}
+	return score
+}
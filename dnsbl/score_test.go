@@ -0,0 +1,27 @@
+package dnsbl
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestScore(t *testing.T) {
+	results := []*model.ListResult{
+		{Blocklist: "zen.spamhaus.org", Listed: true},
+		{Blocklist: "bl.spamcop.net", Listed: true},
+		{Blocklist: "psbl.surriel.com"},
+		nil,
+	}
+
+	t.Run("default_weights", func(t *testing.T) {
+		assert.Equal(t, 2, Score(results, nil))
+	})
+
+	t.Run("configured_weights", func(t *testing.T) {
+		weights := map[string]int{"zen.spamhaus.org": 3, "psbl.surriel.com": 5}
+		assert.Equal(t, 4, Score(results, weights))
+	})
+}
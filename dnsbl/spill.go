@@ -0,0 +1,142 @@
+package dnsbl
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// spill keeps jobs that didn't fit in the queue on disk, one json file per
+// job, until there's room for them again. File names start with the time the
+// job was spilled so they sort in queue order.
+type spill struct {
+	dir   string
+	mu    sync.Mutex
+	count int
+}
+
+// spilledJob is the on-disk form of a job
+type spilledJob struct {
+	ID     string   `json:"id"`
+	IPs    []string `json:"ips"`
+	Source string   `json:"source,omitempty"`
+}
+
+// newSpill opens dir as a spill directory, picking up jobs left there by a
+// previous run
+func newSpill(dir string) (*spill, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	s := &spill{dir: dir}
+	files, err := s.files()
+	if err != nil {
+		return nil, err
+	}
+	s.count = len(files)
+	return s, nil
+}
+
+// files returns the spilled job files, oldest first
+func (s *spill) files() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var files []string
+	for _, e := range entries {
+		if !e.IsDir() && strings.HasSuffix(e.Name(), ".json") {
+			files = append(files, e.Name())
+		}
+	}
+	sort.Strings(files)
+	return files, nil
+}
+
+// len returns the number of spilled jobs
+func (s *spill) len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.count
+}
+
+// write spills j to disk
+func (s *spill) write(j job, spilledAt int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.writeLocked(j, spilledAt)
+}
+
+// sendOrWrite hands j to send if nothing is spilled, else or if send reports
+// the queue is full spills it to disk, and returns whether it was spilled.
+// Both happen under the lock drain holds, so j can't overtake jobs spilled
+// before it.
+func (s *spill) sendOrWrite(j job, spilledAt int64, send func(job) bool) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.count == 0 && send(j) {
+		return false, nil
+	}
+	return true, s.writeLocked(j, spilledAt)
+}
+
+// writeLocked spills j to disk; s.mu must be held
+func (s *spill) writeLocked(j job, spilledAt int64) error {
+	data, err := json.Marshal(spilledJob{ID: j.id, IPs: j.ips, Source: j.source})
+	if err != nil {
+		return err
+	}
+
+	// write then rename, so a half written job is never picked up
+	name := filepath.Join(s.dir, fmt.Sprintf("%020d-%s.json", spilledAt, j.id))
+	if err := ioutil.WriteFile(name+".tmp", data, 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(name+".tmp", name); err != nil {
+		return err
+	}
+	s.count++
+	return nil
+}
+
+// drain hands the spilled jobs to send, oldest first, until send reports the
+// queue is full again. Jobs are removed from disk once sent.
+func (s *spill) drain(send func(job) bool) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	files, err := s.files()
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		path := filepath.Join(s.dir, name)
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		var sj spilledJob
+		if err := json.Unmarshal(data, &sj); err != nil {
+			// nothing we can do with it, don't let it block the rest
+			os.Remove(path)
+			s.count--
+			continue
+		}
+
+		if !send(job{id: sj.ID, ips: sj.IPs, source: sj.Source}) {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		s.count--
+	}
+	return nil
+}
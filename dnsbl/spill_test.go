@@ -0,0 +1,101 @@
+package dnsbl
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSpill(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spill")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	s, err := newSpill(dir)
+	require.Equal(t, nil, err)
+	consumer := &Consumer{
+		jobsChan: make(chan job, 1),
+		policy:   config.QueuePolicySpill,
+		spill:    s,
+	}
+
+	t.Run("spill_when_full", func(t *testing.T) {
+		first, err := consumer.QueueJob([]string{"127.0.0.1"})
+		require.Equal(t, nil, err)
+		second, err := consumer.QueueJob([]string{"127.0.0.2"})
+		require.Equal(t, nil, err)
+		third, err := consumer.QueueJobFrom("syslog/mail", []string{"127.0.0.3"})
+		require.Equal(t, nil, err)
+
+		status := consumer.QueueStatus()
+		assert.Equal(t, 1, status.Depth)
+		assert.Equal(t, 2, status.Spilled)
+
+		// spilled jobs are queued in order as room frees up
+		assert.Equal(t, first, (<-consumer.jobsChan).id)
+		err = s.drain(func(j job) bool {
+			select {
+			case consumer.jobsChan <- j:
+				return true
+			default:
+				return false
+			}
+		})
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, s.len())
+		assert.Equal(t, second, (<-consumer.jobsChan).id)
+
+		// spilled jobs survive a restart
+		reopened, err := newSpill(dir)
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, reopened.len())
+		var drained []job
+		err = reopened.drain(func(j job) bool {
+			drained = append(drained, j)
+			return true
+		})
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(drained))
+		assert.Equal(t, third, drained[0].id)
+		assert.Equal(t, []string{"127.0.0.3"}, drained[0].ips)
+		assert.Equal(t, "syslog/mail", drained[0].source)
+	})
+
+	t.Run("queue_behind_spilled", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "spill")
+		require.Equal(t, nil, err)
+		defer os.RemoveAll(dir)
+
+		s, err := newSpill(dir)
+		require.Equal(t, nil, err)
+		consumer := &Consumer{
+			jobsChan: make(chan job, 1),
+			policy:   config.QueuePolicySpill,
+			spill:    s,
+		}
+
+		first, err := consumer.QueueJob([]string{"127.0.0.4"})
+		require.Equal(t, nil, err)
+		second, err := consumer.QueueJob([]string{"127.0.0.5"})
+		require.Equal(t, nil, err)
+		assert.Equal(t, first, (<-consumer.jobsChan).id)
+
+		// there is room again, but the job still goes after the spilled one
+		third, err := consumer.QueueJob([]string{"127.0.0.6"})
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, len(consumer.jobsChan))
+		assert.Equal(t, 2, s.len())
+
+		var drained []string
+		err = s.drain(func(j job) bool {
+			drained = append(drained, j.id)
+			return true
+		})
+		require.Equal(t, nil, err)
+		assert.Equal(t, []string{second, third}, drained)
+	})
+}
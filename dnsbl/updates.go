@@ -0,0 +1,86 @@
+package dnsbl
+
+import (
+	"context"
+	"log"
+	"sync"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// updateBuffer is how many updates a subscriber can fall behind before
+// further updates to it are dropped
+const updateBuffer = 64
+
+// subscriber is a single recordUpdated subscription
+type subscriber struct {
+	ips     map[string]bool
+	jobID   string
+	updates chan *model.RecordUpdate
+}
+
+// updates fans record updates out to subscribers
+type updates struct {
+	mu          sync.Mutex
+	subscribers map[*subscriber]struct{}
+}
+
+// wants reports whether the update matches the subscriber's filters
+func (s *subscriber) wants(u *model.RecordUpdate) bool {
+	if s.jobID != "" && s.jobID != u.JobID {
+		return false
+	}
+	if len(s.ips) > 0 && !s.ips[u.Record.IPAddress] {
+		return false
+	}
+	return true
+}
+
+// Subscribe function returns a channel of updates for finished lookups,
+// optionally only for the given ips and/or job id. The channel is closed once
+// ctx is done.
+func (c *Consumer) Subscribe(ctx context.Context, ips []string, jobID string) <-chan *model.RecordUpdate {
+	s := &subscriber{
+		ips:     make(map[string]bool),
+		jobID:   jobID,
+		updates: make(chan *model.RecordUpdate, updateBuffer),
+	}
+	for _, ip := range ips {
+		s.ips[ip] = true
+	}
+
+	c.updates.mu.Lock()
+	if c.updates.subscribers == nil {
+		c.updates.subscribers = make(map[*subscriber]struct{})
+	}
+	c.updates.subscribers[s] = struct{}{}
+	c.updates.mu.Unlock()
+
+	go func() {
+		<-ctx.Done()
+		c.updates.mu.Lock()
+		delete(c.updates.subscribers, s)
+		close(s.updates)
+		c.updates.mu.Unlock()
+	}()
+
+	return s.updates
+}
+
+// publish sends u to every subscriber that wants it, without blocking the
+// worker on slow subscribers
+func (c *Consumer) publish(u *model.RecordUpdate) {
+	c.updates.mu.Lock()
+	defer c.updates.mu.Unlock()
+
+	for s := range c.updates.subscribers {
+		if !s.wants(u) {
+			continue
+		}
+		select {
+		case s.updates <- u:
+		default:
+			log.Printf("subscriber is behind, dropped update for %s\n", u.Record.IPAddress)
+		}
+	}
+}
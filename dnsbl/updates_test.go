@@ -0,0 +1,69 @@
+package dnsbl
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newUpdate(jobID, ip string) *model.RecordUpdate {
+	return &model.RecordUpdate{
+		JobID:  jobID,
+		Record: &model.Record{IPAddress: ip, ResponseCode: "NXDOMAIN"},
+		Result: &model.ListResult{IPAddress: ip, Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN"},
+	}
+}
+
+func TestSubscribe(t *testing.T) {
+	t.Run("filter_by_job_and_ip", func(t *testing.T) {
+		c := &Consumer{}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		all := c.Subscribe(ctx, nil, "")
+		byJob := c.Subscribe(ctx, nil, "job-1")
+		byIP := c.Subscribe(ctx, []string{"127.0.0.2"}, "")
+
+		c.publish(newUpdate("job-1", "127.0.0.1"))
+		c.publish(newUpdate("job-2", "127.0.0.2"))
+
+		assert.Equal(t, 2, len(all))
+		require.Equal(t, 1, len(byJob))
+		assert.Equal(t, "127.0.0.1", (<-byJob).Record.IPAddress)
+		require.Equal(t, 1, len(byIP))
+		assert.Equal(t, "job-2", (<-byIP).JobID)
+	})
+
+	t.Run("closed_on_cancel", func(t *testing.T) {
+		c := &Consumer{}
+		ctx, cancel := context.WithCancel(context.Background())
+		updates := c.Subscribe(ctx, nil, "")
+		cancel()
+
+		select {
+		case _, ok := <-updates:
+			assert.Equal(t, false, ok)
+		case <-time.After(time.Second):
+			t.Error("subscription was not closed")
+		}
+
+		// publishing after the subscriber left must not panic
+		c.publish(newUpdate("job-1", "127.0.0.1"))
+	})
+
+	t.Run("slow_subscriber_drops", func(t *testing.T) {
+		c := &Consumer{}
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		updates := c.Subscribe(ctx, nil, "")
+		for i := 0; i < updateBuffer+10; i++ {
+			c.publish(newUpdate("job-1", "127.0.0.1"))
+		}
+		assert.Equal(t, updateBuffer, len(updates))
+	})
+}
@@ -0,0 +1,483 @@
+package dnsbl
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// rbldnsd dataset types a Zone can be loaded from
+const (
+	// ZoneIP4Set is a set of IPv4 addresses, CIDRs and ranges with per-entry values
+	ZoneIP4Set = "ip4set"
+	// ZoneIP4TSet is a set of single IPv4 addresses sharing one value
+	ZoneIP4TSet = "ip4tset"
+	// ZoneDNSet is a set of domain names
+	ZoneDNSet = "dnset"
+)
+
+// ZoneReloadInterval is how often zone files are checked for changes
+const ZoneReloadInterval = 10 * time.Second
+
+// defaultZoneCode is the A record rbldnsd answers with when a zone doesn't set one
+const defaultZoneCode = "127.0.0.2"
+
+// Zone is an rbldnsd zone file loaded into memory, so it can be used as a
+// blocklist without going through DNS
+type Zone struct {
+	// Name is the list name results are stored under
+	Name string
+	// Type is one of ZoneIP4Set, ZoneIP4TSet or ZoneDNSet
+	Type string
+	// Path is the zone file on disk
+	Path string
+
+	mu      sync.RWMutex
+	data    *zoneData
+	modTime time.Time
+	size    int64
+}
+
+// zoneValue is the A record and TXT template of an entry
+type zoneValue struct {
+	code string
+	text string
+}
+
+// ipRange is an ip4set entry covering more than one address
+type ipRange struct {
+	first, last uint32
+	value       *zoneValue
+	excluded    bool
+}
+
+type zoneData struct {
+	ips      map[uint32]*zoneValue
+	excluded map[uint32]bool
+	// ranges are sorted smallest first, so the first match is the most specific
+	ranges []ipRange
+
+	// names are exact domain matches, suffixes match anything below them
+	names    map[string]*zoneValue
+	suffixes map[string]*zoneValue
+	// the exclusion counterparts of names and suffixes
+	excludedNames    map[string]bool
+	excludedSuffixes map[string]bool
+}
+
+// ParseZoneSpec function splits a ZONE_FILES entry of the form
+// name:type:path, the same form rbldnsd takes on its command line
+func ParseZoneSpec(spec string) (*Zone, error) {
+	parts := strings.SplitN(strings.TrimSpace(spec), ":", 3)
+	if len(parts) != 3 || parts[0] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("zone %q is not of the form name:type:path", spec)
+	}
+	switch parts[1] {
+	case ZoneIP4Set, ZoneIP4TSet, ZoneDNSet:
+	default:
+		return nil, fmt.Errorf("zone %q has unsupported type %q", spec, parts[1])
+	}
+	return &Zone{Name: parts[0], Type: parts[1], Path: parts[2]}, nil
+}
+
+// LoadZones function loads every ZONE_FILES entry. Zones that fail to load are
+// logged and left out, so one bad file doesn't take the others down.
+func LoadZones(specs []string) map[string]*Zone {
+	zones := make(map[string]*Zone)
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		z, err := ParseZoneSpec(spec)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if _, err := z.Reload(); err != nil {
+			log.Printf("could not load zone %s: %s\n", z.Name, err)
+			continue
+		}
+		zones[z.Name] = z
+	}
+	return zones
+}
+
+// Reload function re-reads the zone file if it changed since the last load,
+// and reports whether it did. On error the previously loaded data is kept.
+func (z *Zone) Reload() (bool, error) {
+	info, err := os.Stat(z.Path)
+	if err != nil {
+		return false, err
+	}
+
+	z.mu.RLock()
+	unchanged := z.data != nil && info.ModTime().Equal(z.modTime) && info.Size() == z.size
+	z.mu.RUnlock()
+	if unchanged {
+		return false, nil
+	}
+
+	f, err := os.Open(z.Path)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+
+	data, err := parseZone(z.Type, f)
+	if err != nil {
+		return false, err
+	}
+
+	z.mu.Lock()
+	z.data = data
+	z.modTime = info.ModTime()
+	z.size = info.Size()
+	z.mu.Unlock()
+
+	log.Printf("loaded zone %s from %s\n", z.Name, z.Path)
+	return true, nil
+}
+
+// Watch function reloads the zone whenever its file changes, until quit is closed
+func (z *Zone) Watch(quit <-chan struct{}, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if _, err := z.Reload(); err != nil {
+				log.Printf("could not reload zone %s: %s\n", z.Name, err)
+			}
+		}
+	}
+}
+
+// LookupIP function returns the A record and TXT reason of ip, and whether the
+// zone lists it. Always false for dnset zones.
+func (z *Zone) LookupIP(ip net.IP) (string, string, bool) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return "", "", false
+	}
+	n := binary.BigEndian.Uint32(ip4)
+
+	z.mu.RLock()
+	data := z.data
+	z.mu.RUnlock()
+	if data == nil {
+		return "", "", false
+	}
+
+	if data.excluded[n] {
+		return "", "", false
+	}
+	if v, ok := data.ips[n]; ok {
+		return v.code, v.expand(ip4.String()), true
+	}
+	for _, r := range data.ranges {
+		if n < r.first || n > r.last {
+			continue
+		}
+		if r.excluded {
+			return "", "", false
+		}
+		return r.value.code, r.value.expand(ip4.String()), true
+	}
+	return "", "", false
+}
+
+// LookupDomain function returns the A record and TXT reason of name, and
+// whether the zone lists it. Always false for ip4 zones.
+func (z *Zone) LookupDomain(name string) (string, string, bool) {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+
+	z.mu.RLock()
+	data := z.data
+	z.mu.RUnlock()
+	if data == nil {
+		return "", "", false
+	}
+
+	if data.excludedNames[name] {
+		return "", "", false
+	}
+	if v, ok := data.names[name]; ok {
+		return v.code, v.expand(name), true
+	}
+	// walk up the labels, most specific parent first
+	for parent := name; strings.Contains(parent, "."); {
+		parent = parent[strings.Index(parent, ".")+1:]
+		if data.excludedSuffixes[parent] {
+			return "", "", false
+		}
+		if v, ok := data.suffixes[parent]; ok {
+			return v.code, v.expand(name), true
+		}
+	}
+	return "", "", false
+}
+
+// check answers a Checker lookup from the zone. dnset zones are matched
+// against the reverse DNS names of ip.
+func (z *Zone) check(ctx context.Context, resolver *net.Resolver, ip string, result *model.ListResult) *model.ListResult {
+	var code, text string
+	var listed bool
+
+	if z.Type == ZoneDNSet {
+		names, err := resolver.LookupAddr(ctx, ip)
+		if err != nil && !isNotFound(err) {
+			errString := err.Error()
+			result.Error = &errString
+			return result
+		}
+		for _, name := range names {
+			if code, text, listed = z.LookupDomain(name); listed {
+				break
+			}
+		}
+	} else {
+		code, text, listed = z.LookupIP(net.ParseIP(ip))
+	}
+
+	if listed {
+		result.Listed = true
+		result.ResponseCode = code
+		result.Category = CategoryLocal
+		if text != "" {
+			result.Reason = &text
+		}
+	}
+	return result
+}
+
+// expand substitutes $ in the TXT template with the listed address or name
+func (v *zoneValue) expand(subject string) string {
+	return strings.Replace(v.text, "$", subject, -1)
+}
+
+// parseValue parses the value part of an entry: either ":A:TXT", where A may
+// be a full address or the last octet of 127.0.0.x, or just a TXT
+func parseValue(s string, def *zoneValue) *zoneValue {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return def
+	}
+	if !strings.HasPrefix(s, ":") {
+		return &zoneValue{code: def.code, text: s}
+	}
+
+	v := &zoneValue{code: def.code, text: def.text}
+	parts := strings.SplitN(s[1:], ":", 2)
+	if a := strings.TrimSpace(parts[0]); a != "" {
+		if n, err := strconv.Atoi(a); err == nil && n >= 0 && n <= 255 {
+			v.code = fmt.Sprintf("127.0.0.%d", n)
+		} else if ip := net.ParseIP(a); ip != nil && ip.To4() != nil {
+			v.code = ip.To4().String()
+		}
+	}
+	if len(parts) == 2 {
+		v.text = strings.TrimSpace(parts[1])
+	}
+	return v
+}
+
+// parseZone reads an rbldnsd dataset of type t. Comments, $ directives and
+// blank lines are skipped; a line starting with ':' sets the default value of
+// the entries after it.
+func parseZone(t string, r io.Reader) (*zoneData, error) {
+	data := &zoneData{
+		ips:              make(map[uint32]*zoneValue),
+		excluded:         make(map[uint32]bool),
+		names:            make(map[string]*zoneValue),
+		suffixes:         make(map[string]*zoneValue),
+		excludedNames:    make(map[string]bool),
+		excludedSuffixes: make(map[string]bool),
+	}
+	def := &zoneValue{code: defaultZoneCode}
+
+	scanner := bufio.NewScanner(r)
+	lineNo := 0
+	for scanner.Scan() {
+		lineNo++
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' || line[0] == '$' {
+			continue
+		}
+		if line[0] == ':' {
+			def = parseValue(line, &zoneValue{code: defaultZoneCode})
+			continue
+		}
+
+		entry, value := line, ""
+		if i := strings.IndexAny(line, " \t:"); i >= 0 {
+			entry, value = line[:i], line[i:]
+		}
+		excluded := strings.HasPrefix(entry, "!")
+		entry = strings.TrimPrefix(entry, "!")
+
+		v := def
+		if t != ZoneIP4TSet {
+			v = parseValue(value, def)
+		}
+
+		var err error
+		if t == ZoneDNSet {
+			err = data.addDomain(entry, v, excluded)
+		} else {
+			err = data.addIP(t, entry, v, excluded)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", lineNo, err)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(data.ranges, func(i, j int) bool {
+		return data.ranges[i].last-data.ranges[i].first < data.ranges[j].last-data.ranges[j].first
+	})
+	return data, nil
+}
+
+// addIP adds an ip4set entry: a.b.c.d, a.b.c.d/len, a.b.c (a /24 and so on),
+// a.b.c.d-e.f.g.h or a.b.c.d-h. ip4tset only takes single addresses.
+func (data *zoneData) addIP(t, entry string, v *zoneValue, excluded bool) error {
+	first, last, err := parseIPEntry(entry)
+	if err != nil {
+		return err
+	}
+	if t == ZoneIP4TSet && first != last {
+		return fmt.Errorf("%s: ip4tset only takes single addresses", entry)
+	}
+
+	if first == last {
+		if excluded {
+			data.excluded[first] = true
+		} else {
+			data.ips[first] = v
+		}
+		return nil
+	}
+	data.ranges = append(data.ranges, ipRange{first: first, last: last, value: v, excluded: excluded})
+	return nil
+}
+
+// addDomain adds a dnset entry: example.com matches only itself, .example.com
+// matches itself and everything below it, *.example.com only what's below it
+func (data *zoneData) addDomain(entry string, v *zoneValue, excluded bool) error {
+	entry = strings.ToLower(strings.TrimSuffix(entry, "."))
+	switch {
+	case strings.HasPrefix(entry, "*."):
+		entry = entry[2:]
+		if excluded {
+			data.excludedSuffixes[entry] = true
+		} else {
+			data.suffixes[entry] = v
+		}
+	case strings.HasPrefix(entry, "."):
+		entry = entry[1:]
+		if excluded {
+			data.excludedNames[entry] = true
+			data.excludedSuffixes[entry] = true
+		} else {
+			data.names[entry] = v
+			data.suffixes[entry] = v
+		}
+	default:
+		if excluded {
+			data.excludedNames[entry] = true
+		} else {
+			data.names[entry] = v
+		}
+	}
+	if entry == "" {
+		return fmt.Errorf("empty domain")
+	}
+	return nil
+}
+
+// parseIPEntry returns the first and last address covered by an ip4set entry
+func parseIPEntry(entry string) (uint32, uint32, error) {
+	if i := strings.Index(entry, "-"); i >= 0 {
+		first, err := parseIPv4(entry[:i])
+		if err != nil {
+			return 0, 0, err
+		}
+		end := entry[i+1:]
+		var last uint32
+		if strings.Contains(end, ".") {
+			last, err = parseIPv4(end)
+		} else {
+			// a.b.c.d-h only replaces the last octet
+			var octet int
+			octet, err = strconv.Atoi(end)
+			if err == nil && (octet < 0 || octet > 255) {
+				err = fmt.Errorf("%s: bad range", entry)
+			}
+			last = first&0xffffff00 | uint32(octet)
+		}
+		if err != nil {
+			return 0, 0, err
+		}
+		if last < first {
+			return 0, 0, fmt.Errorf("%s: bad range", entry)
+		}
+		return first, last, nil
+	}
+
+	prefix := -1
+	if i := strings.Index(entry, "/"); i >= 0 {
+		var err error
+		prefix, err = strconv.Atoi(entry[i+1:])
+		if err != nil || prefix < 0 || prefix > 32 {
+			return 0, 0, fmt.Errorf("%s: bad prefix length", entry)
+		}
+		entry = entry[:i]
+	}
+
+	// a.b.c is short for a.b.c.0/24
+	octets := strings.Split(entry, ".")
+	if len(octets) > 4 {
+		return 0, 0, fmt.Errorf("%s: not an IPv4 address", entry)
+	}
+	if prefix < 0 {
+		prefix = 8 * len(octets)
+	}
+	for len(octets) < 4 {
+		octets = append(octets, "0")
+	}
+	first, err := parseIPv4(strings.Join(octets, "."))
+	if err != nil {
+		return 0, 0, err
+	}
+
+	mask := uint32(0)
+	if prefix > 0 {
+		mask = ^uint32(0) << uint(32-prefix)
+	}
+	first &= mask
+	return first, first | ^mask, nil
+}
+
+func parseIPv4(s string) (uint32, error) {
+	ip := net.ParseIP(s)
+	if ip == nil || ip.To4() == nil {
+		return 0, fmt.Errorf("%s: not an IPv4 address", s)
+	}
+	return binary.BigEndian.Uint32(ip.To4()), nil
+}
@@ -0,0 +1,184 @@
+package dnsbl
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testIP4Set = `# internal blocklist
+$TTL 300
+:127.0.0.2:Listed in internal.bl, see https://example.com/lookup?ip=$
+10.0.0.1
+10.0.1.0/24 :3:Whole /24 is bad
+!10.0.1.7
+192.168.5
+172.16.0.10-20
+172.16.1.1-172.16.1.3 Spam source $
+`
+
+const testDNSet = `:127.0.0.2:Host $ is listed
+.bad.example
+*.dyn.example :4:Dynamic pool
+only.example
+!good.bad.example
+`
+
+func writeZone(t *testing.T, dir, name, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0644)
+	require.Equal(t, nil, err)
+	return path
+}
+
+func TestZone(t *testing.T) {
+	dir, err := ioutil.TempDir("", "zones")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	ip4setPath := writeZone(t, dir, "internal.zone", testIP4Set)
+	dnsetPath := writeZone(t, dir, "hosts.zone", testDNSet)
+	tsetPath := writeZone(t, dir, "trivial.zone", ":127.0.0.5:trivially listed\n10.9.9.9\n10.9.9.10\n")
+
+	t.Run("parse_spec", func(t *testing.T) {
+		z, err := ParseZoneSpec("internal.bl:ip4set:/etc/rbldnsd/internal.zone")
+		require.Equal(t, nil, err)
+		assert.Equal(t, "internal.bl", z.Name)
+		assert.Equal(t, ZoneIP4Set, z.Type)
+		assert.Equal(t, "/etc/rbldnsd/internal.zone", z.Path)
+
+		_, err = ParseZoneSpec("internal.bl:/etc/rbldnsd/internal.zone")
+		assert.NotEqual(t, nil, err)
+		_, err = ParseZoneSpec("internal.bl:combined:/etc/rbldnsd/internal.zone")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("ip4set_lookup", func(t *testing.T) {
+		zones := LoadZones([]string{"internal.bl:ip4set:" + ip4setPath})
+		z := zones["internal.bl"]
+		require.NotEqual(t, (*Zone)(nil), z)
+
+		cases := []struct {
+			ip     string
+			listed bool
+			code   string
+			text   string
+		}{
+			{"10.0.0.1", true, "127.0.0.2", "Listed in internal.bl, see https://example.com/lookup?ip=10.0.0.1"},
+			{"10.0.0.2", false, "", ""},
+			{"10.0.1.200", true, "127.0.0.3", "Whole /24 is bad"},
+			{"10.0.1.7", false, "", ""},
+			{"192.168.5.77", true, "127.0.0.2", "Listed in internal.bl, see https://example.com/lookup?ip=192.168.5.77"},
+			{"172.16.0.15", true, "127.0.0.2", "Listed in internal.bl, see https://example.com/lookup?ip=172.16.0.15"},
+			{"172.16.0.21", false, "", ""},
+			{"172.16.1.2", true, "127.0.0.2", "Spam source 172.16.1.2"},
+		}
+		for _, c := range cases {
+			code, text, listed := z.LookupIP(net.ParseIP(c.ip))
+			assert.Equal(t, c.listed, listed, c.ip)
+			assert.Equal(t, c.code, code, c.ip)
+			assert.Equal(t, c.text, text, c.ip)
+		}
+	})
+
+	t.Run("ip4tset_lookup", func(t *testing.T) {
+		z := LoadZones([]string{"trivial.bl:ip4tset:" + tsetPath})["trivial.bl"]
+		require.NotEqual(t, (*Zone)(nil), z)
+
+		code, text, listed := z.LookupIP(net.ParseIP("10.9.9.10"))
+		assert.Equal(t, true, listed)
+		assert.Equal(t, "127.0.0.5", code)
+		assert.Equal(t, "trivially listed", text)
+
+		_, _, listed = z.LookupIP(net.ParseIP("10.9.9.11"))
+		assert.Equal(t, false, listed)
+
+		_, err := parseZone(ZoneIP4TSet, strings.NewReader("10.0.0.0/24\n"))
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("dnset_lookup", func(t *testing.T) {
+		z := LoadZones([]string{"hosts.bl:dnset:" + dnsetPath})["hosts.bl"]
+		require.NotEqual(t, (*Zone)(nil), z)
+
+		cases := []struct {
+			name   string
+			listed bool
+			code   string
+		}{
+			{"bad.example", true, "127.0.0.2"},
+			{"mx.bad.example.", true, "127.0.0.2"},
+			{"good.bad.example", false, ""},
+			{"dyn.example", false, ""},
+			{"1-2-3-4.dyn.example", true, "127.0.0.4"},
+			{"only.example", true, "127.0.0.2"},
+			{"sub.only.example", false, ""},
+		}
+		for _, c := range cases {
+			code, _, listed := z.LookupDomain(c.name)
+			assert.Equal(t, c.listed, listed, c.name)
+			assert.Equal(t, c.code, code, c.name)
+		}
+
+		_, text, _ := z.LookupDomain("MX.Bad.Example")
+		assert.Equal(t, "Host mx.bad.example is listed", text)
+	})
+
+	t.Run("reload_on_change", func(t *testing.T) {
+		path := writeZone(t, dir, "reload.zone", "10.0.0.1\n")
+		z := LoadZones([]string{"reload.bl:ip4set:" + path})["reload.bl"]
+		require.NotEqual(t, (*Zone)(nil), z)
+
+		reloaded, err := z.Reload()
+		require.Equal(t, nil, err)
+		assert.Equal(t, false, reloaded)
+
+		writeZone(t, dir, "reload.zone", "10.0.0.2\n10.0.0.3\n")
+		later := time.Now().Add(time.Second)
+		os.Chtimes(path, later, later)
+
+		quit := make(chan struct{})
+		defer close(quit)
+		go z.Watch(quit, 10*time.Millisecond)
+
+		assert.Eventually(t, func() bool {
+			_, _, listed := z.LookupIP(net.ParseIP("10.0.0.2"))
+			return listed
+		}, time.Second, 10*time.Millisecond)
+		_, _, listed := z.LookupIP(net.ParseIP("10.0.0.1"))
+		assert.Equal(t, false, listed)
+	})
+
+	t.Run("bad_zone_keeps_others", func(t *testing.T) {
+		bad := writeZone(t, dir, "bad.zone", "10.0.0.300\n")
+		zones := LoadZones([]string{
+			"bad.bl:ip4set:" + bad,
+			"missing.bl:ip4set:" + filepath.Join(dir, "missing.zone"),
+			"internal.bl:ip4set:" + ip4setPath,
+		})
+		assert.Equal(t, 1, len(zones))
+	})
+
+	t.Run("checker_uses_zone", func(t *testing.T) {
+		checker := &Checker{
+			Lists: []string{"internal.bl"},
+			Zones: LoadZones([]string{"internal.bl:ip4set:" + ip4setPath}),
+		}
+		results, err := checker.Check(context.Background(), []string{"10.0.1.1", "10.0.2.1"})
+		require.Equal(t, nil, err)
+		assert.Equal(t, true, results[0].Listed)
+		assert.Equal(t, "127.0.0.3", results[0].Results[0].ResponseCode)
+		assert.Equal(t, "Whole /24 is bad", *results[0].Results[0].Reason)
+		assert.Equal(t, CategoryLocal, results[0].Results[0].Category)
+		assert.Equal(t, false, results[1].Listed)
+		assert.Equal(t, "NXDOMAIN", results[1].Results[0].ResponseCode)
+	})
+}
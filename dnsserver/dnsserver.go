@@ -0,0 +1,213 @@
+package dnsserver
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+)
+
+// testEntry is the address every DNSBL must list, see RFC 5782 section 5
+const testEntry = "127.0.0.2"
+
+// Server answers standard DNSBL queries (d.c.b.a.zone) for its zone from the
+// results stored in the database, so mail servers can use the service like any
+// other blocklist
+type Server struct {
+	zone string
+	ttl  uint32
+	db   database.Store
+}
+
+// NewServer function returns a DNSBL server for the configured DNSBL_ZONE
+func NewServer(db database.Store, c *config.APIConfig) *Server {
+	return &Server{
+		zone: dns.Fqdn(strings.ToLower(c.DNSBLZone)),
+		ttl:  uint32(c.DNSServerTTL),
+		db:   db,
+	}
+}
+
+// ListenAndServe function serves the zone on addr over both UDP and TCP until
+// ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	errChan := make(chan error, 2)
+	servers := []*dns.Server{
+		{Addr: addr, Net: "udp", Handler: s},
+		{Addr: addr, Net: "tcp", Handler: s},
+	}
+	for _, srv := range servers {
+		go func(srv *dns.Server) {
+			errChan <- srv.ListenAndServe()
+		}(srv)
+	}
+	log.Printf("serving DNSBL zone %s on %s\n", s.zone, addr)
+
+	var err error
+	select {
+	case <-ctx.Done():
+	case err = <-errChan:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, srv := range servers {
+		srv.ShutdownContext(shutdownCtx)
+	}
+	return err
+}
+
+// ServeDNS answers a single query
+func (s *Server) ServeDNS(w dns.ResponseWriter, req *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.Authoritative = true
+
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		w.WriteMsg(m)
+		return
+	}
+	q := req.Question[0]
+	name := strings.ToLower(q.Name)
+
+	if !dns.IsSubDomain(s.zone, name) {
+		m.Authoritative = false
+		m.Rcode = dns.RcodeRefused
+		w.WriteMsg(m)
+		return
+	}
+
+	if name == s.zone {
+		if q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, s.soa())
+		} else {
+			m.Ns = append(m.Ns, s.soa())
+		}
+		w.WriteMsg(m)
+		return
+	}
+
+	ip := reverseIP(strings.TrimSuffix(name, "."+s.zone))
+	code, reason, listed, err := s.lookup(ip)
+	if err != nil {
+		log.Printf("dns lookup of %s failed: %s\n", ip, err)
+		m.Rcode = dns.RcodeServerFailure
+		w.WriteMsg(m)
+		return
+	}
+	if !listed {
+		m.Rcode = dns.RcodeNameError
+		m.Ns = append(m.Ns, s.soa())
+		w.WriteMsg(m)
+		return
+	}
+
+	hdr := dns.RR_Header{Name: q.Name, Class: dns.ClassINET, Ttl: s.ttl}
+	if q.Qtype == dns.TypeA || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeA
+		m.Answer = append(m.Answer, &dns.A{Hdr: hdr, A: net.ParseIP(code).To4()})
+	}
+	if q.Qtype == dns.TypeTXT || q.Qtype == dns.TypeANY {
+		hdr.Rrtype = dns.TypeTXT
+		m.Answer = append(m.Answer, &dns.TXT{Hdr: hdr, Txt: splitTXT(reason)})
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, s.soa())
+	}
+	w.WriteMsg(m)
+}
+
+// lookup returns the return code and TXT reason of a listed ip. The code is
+// the stored ip_details response_code when that is a listing, otherwise the
+// code of the first list that lists the ip.
+func (s *Server) lookup(ip string) (string, string, bool, error) {
+	if ip == "" {
+		return "", "", false, nil
+	}
+	if ip == testEntry {
+		return testEntry, "test entry, see RFC 5782", true, nil
+	}
+
+	results, err := s.db.QueryListResults(ip)
+	if err != nil {
+		return "", "", false, err
+	}
+
+	var code string
+	var reasons []string
+	for _, r := range results {
+		if !r.Listed {
+			continue
+		}
+		if code == "" {
+			code = r.ResponseCode
+		}
+		reason := fmt.Sprintf("listed on %s (%s)", r.Blocklist, r.ResponseCode)
+		if r.Reason != nil && *r.Reason != "" {
+			reason = fmt.Sprintf("%s: %s", reason, *r.Reason)
+		}
+		reasons = append(reasons, reason)
+	}
+	if code == "" {
+		return "", "", false, nil
+	}
+
+	record, err := s.db.QueryRecord(ip)
+	if err != nil && err != sql.ErrNoRows {
+		return "", "", false, err
+	}
+	if record != nil && strings.HasPrefix(record.ResponseCode, "127.") {
+		code = record.ResponseCode
+	}
+	return code, strings.Join(reasons, "; "), true, nil
+}
+
+// soa is the zone's SOA, also used as the negative caching ttl
+func (s *Server) soa() dns.RR {
+	return &dns.SOA{
+		Hdr:     dns.RR_Header{Name: s.zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: s.ttl},
+		Ns:      s.zone,
+		Mbox:    "hostmaster." + s.zone,
+		Serial:  uint32(time.Now().Unix()),
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  86400,
+		Minttl:  s.ttl,
+	}
+}
+
+// reverseIP turns the d.c.b.a labels of a query back into a.b.c.d, or
+// returns "" if they aren't an IPv4 address
+func reverseIP(labels string) string {
+	octets := strings.Split(labels, ".")
+	if len(octets) != 4 {
+		return ""
+	}
+	for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+		octets[i], octets[j] = octets[j], octets[i]
+	}
+	ip := net.ParseIP(strings.Join(octets, "."))
+	if ip == nil || ip.To4() == nil {
+		return ""
+	}
+	return ip.To4().String()
+}
+
+// splitTXT splits s into the 255 byte strings a TXT record is made of
+func splitTXT(s string) []string {
+	var parts []string
+	for len(s) > 255 {
+		parts = append(parts, s[:255])
+		s = s[255:]
+	}
+	return append(parts, s)
+}
@@ -0,0 +1,120 @@
+package dnsserver
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestDNSServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dnsserver")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	conf := &config.APIConfig{
+		DbPath:       filepath.Join(dir, "swdnsbl.db"),
+		PersistDb:    true,
+		DNSBLZone:    "bl.example.com",
+		DNSServerTTL: 60,
+	}
+	db, err := database.NewDb(conf)
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	now := int(time.Now().Unix())
+	reason := "https://www.spamhaus.org/query/ip/127.0.0.4"
+	require.Equal(t, nil, db.UpsertRecord(&model.Record{
+		UUID:         uuid.New().String(),
+		IPAddress:    "127.0.0.4",
+		ResponseCode: "127.0.0.4",
+		CreatedAt:    now,
+		UpdatedAt:    now,
+	}))
+	require.Equal(t, nil, db.UpsertListResult(&model.ListResult{
+		IPAddress:    "127.0.0.4",
+		Blocklist:    "zen.spamhaus.org",
+		Listed:       true,
+		ResponseCode: "127.0.0.4",
+		Reason:       &reason,
+		CheckedAt:    now,
+	}))
+	require.Equal(t, nil, db.UpsertListResult(&model.ListResult{
+		IPAddress:    "127.0.0.5",
+		Blocklist:    "zen.spamhaus.org",
+		ResponseCode: "NXDOMAIN",
+		CheckedAt:    now,
+	}))
+
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.Equal(t, nil, err)
+	server := &dns.Server{PacketConn: pc, Handler: NewServer(db, conf)}
+	go server.ActivateAndServe()
+	defer server.Shutdown()
+	addr := pc.LocalAddr().String()
+
+	query := func(name string, qtype uint16) *dns.Msg {
+		m := new(dns.Msg)
+		m.SetQuestion(name, qtype)
+		resp, err := dns.Exchange(m, addr)
+		require.Equal(t, nil, err)
+		return resp
+	}
+
+	t.Run("listed_a", func(t *testing.T) {
+		resp := query("4.0.0.127.bl.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeSuccess, resp.Rcode)
+		assert.Equal(t, true, resp.Authoritative)
+		require.Equal(t, 1, len(resp.Answer))
+		assert.Equal(t, "127.0.0.4", resp.Answer[0].(*dns.A).A.String())
+		assert.Equal(t, uint32(60), resp.Answer[0].Header().Ttl)
+	})
+
+	t.Run("listed_txt", func(t *testing.T) {
+		resp := query("4.0.0.127.bl.example.com.", dns.TypeTXT)
+		require.Equal(t, 1, len(resp.Answer))
+		assert.Equal(t, []string{"listed on zen.spamhaus.org (127.0.0.4): " + reason}, resp.Answer[0].(*dns.TXT).Txt)
+	})
+
+	t.Run("not_listed", func(t *testing.T) {
+		resp := query("5.0.0.127.bl.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+		require.Equal(t, 1, len(resp.Ns))
+		assert.Equal(t, dns.TypeSOA, resp.Ns[0].Header().Rrtype)
+
+		resp = query("9.9.9.10.bl.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("rfc5782_test_entries", func(t *testing.T) {
+		resp := query("2.0.0.127.bl.example.com.", dns.TypeA)
+		require.Equal(t, 1, len(resp.Answer))
+		assert.Equal(t, "127.0.0.2", resp.Answer[0].(*dns.A).A.String())
+
+		resp = query("1.0.0.127.bl.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+	})
+
+	t.Run("apex_and_other_zones", func(t *testing.T) {
+		resp := query("bl.example.com.", dns.TypeSOA)
+		require.Equal(t, 1, len(resp.Answer))
+		assert.Equal(t, dns.TypeSOA, resp.Answer[0].Header().Rrtype)
+
+		resp = query("not-an-ip.bl.example.com.", dns.TypeA)
+		assert.Equal(t, dns.RcodeNameError, resp.Rcode)
+
+		resp = query("4.0.0.127.zen.spamhaus.org.", dns.TypeA)
+		assert.Equal(t, dns.RcodeRefused, resp.Rcode)
+	})
+}
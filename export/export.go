@@ -0,0 +1,244 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Export formats
+const (
+	// FormatRbldnsd is rbldnsd ip4set data
+	FormatRbldnsd = "rbldnsd"
+	// FormatRPZ is a BIND response policy zone
+	FormatRPZ = "rpz"
+)
+
+// ErrUnknownFormat is returned by Write for formats other than FormatRbldnsd
+// and FormatRPZ
+var ErrUnknownFormat = errors.New("unknown export format")
+
+// Filter picks which listings are exported. Empty Lists or Categories match
+// every list or category.
+type Filter struct {
+	Lists      []string
+	Categories []string
+	MinScore   int
+}
+
+// Listing is one listed ip, merged over every list that lists it
+type Listing struct {
+	IP      string
+	Code    string
+	Lists   []string
+	Reasons []string
+	Score   int
+}
+
+// Options are the zone settings written to the SOA
+type Options struct {
+	Zone   string
+	Serial uint32
+	TTL    int
+}
+
+// Listings function returns the ips currently listed in the database that
+// match f, ordered by ip. An ip's score is the sum of the weights of the lists
+// listing it, see dnsbl.Score, its code the one of its most severe listing.
+func Listings(db database.Store, f Filter, weights map[string]int) ([]*Listing, error) {
+	results, err := db.QueryListedResults(f.Lists, f.Categories)
+	if err != nil {
+		return nil, err
+	}
+
+	byIP := map[string]*Listing{}
+	listed := map[string][]*model.ListResult{}
+	for _, r := range results {
+		l, ok := byIP[r.IPAddress]
+		if !ok {
+			l = &Listing{IP: r.IPAddress}
+			byIP[r.IPAddress] = l
+		}
+		listed[r.IPAddress] = append(listed[r.IPAddress], r)
+		l.Lists = append(l.Lists, r.Blocklist)
+		reason := fmt.Sprintf("listed on %s (%s)", r.Blocklist, r.ResponseCode)
+		if r.Reason != nil && *r.Reason != "" {
+			reason = fmt.Sprintf("%s: %s", reason, *r.Reason)
+		}
+		l.Reasons = append(l.Reasons, reason)
+	}
+	for ip, l := range byIP {
+		l.Code = dnsbl.MostSevere(listed[ip]).ResponseCode
+		l.Score = dnsbl.Score(listed[ip], weights)
+	}
+
+	var listings []*Listing
+	for _, l := range byIP {
+		if l.Score >= f.MinScore {
+			listings = append(listings, l)
+		}
+	}
+	sort.Slice(listings, func(i, j int) bool {
+		return compareIP(listings[i].IP, listings[j].IP)
+	})
+	return listings, nil
+}
+
+// Write function renders listings in format to w
+func Write(w io.Writer, format string, listings []*Listing, o Options) error {
+	switch format {
+	case FormatRbldnsd:
+		return WriteRbldnsd(w, listings, o)
+	case FormatRPZ:
+		return WriteRPZ(w, listings, o)
+	}
+	return ErrUnknownFormat
+}
+
+// WriteRbldnsd function writes listings as an rbldnsd ip4set, one
+// `ip :code:reason` entry per listed ip
+func WriteRbldnsd(w io.Writer, listings []*Listing, o Options) error {
+	zone := fqdn(o.Zone)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$SOA %d %s hostmaster.%s %d 3600 600 86400 %d\n", o.TTL, zone, zone, o.Serial, o.TTL)
+	fmt.Fprintf(bw, "$TTL %d\n", o.TTL)
+	for _, l := range listings {
+		// rbldnsd replaces $ in the TXT with the queried ip
+		reason := strings.Replace(strings.Join(l.Reasons, "; "), "$", "", -1)
+		fmt.Fprintf(bw, "%s :%s:%s\n", l.IP, l.Code, reason)
+	}
+	return bw.Flush()
+}
+
+// WriteRPZ function writes listings as a BIND response policy zone. Each ip
+// becomes an rpz-ip trigger with the NXDOMAIN action, so answers resolving to
+// a listed address are blocked.
+func WriteRPZ(w io.Writer, listings []*Listing, o Options) error {
+	zone := fqdn(o.Zone)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "$ORIGIN %s\n", zone)
+	fmt.Fprintf(bw, "$TTL %d\n", o.TTL)
+	fmt.Fprintf(bw, "@ IN SOA localhost. hostmaster.%s %d 3600 600 86400 %d\n", zone, o.Serial, o.TTL)
+	fmt.Fprintf(bw, "@ IN NS localhost.\n")
+	for _, l := range listings {
+		fmt.Fprintf(bw, "32.%s.rpz-ip CNAME . ; %s\n", reverse(l.IP), strings.Join(l.Lists, ","))
+	}
+	return bw.Flush()
+}
+
+// fqdn returns zone with a trailing dot
+func fqdn(zone string) string {
+	return strings.TrimSuffix(zone, ".") + "."
+}
+
+// reverse turns a.b.c.d into d.c.b.a
+func reverse(ip string) string {
+	octets := strings.Split(ip, ".")
+	for i, j := 0, len(octets)-1; i < j; i, j = i+1, j-1 {
+		octets[i], octets[j] = octets[j], octets[i]
+	}
+	return strings.Join(octets, ".")
+}
+
+// compareIP orders ips numerically, falling back to string order for
+// anything that doesn't parse
+func compareIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a).To4(), net.ParseIP(b).To4()
+	if ipA == nil || ipB == nil {
+		return a < b
+	}
+	for i := range ipA {
+		if ipA[i] != ipB[i] {
+			return ipA[i] < ipB[i]
+		}
+	}
+	return false
+}
+
+// Handler function serves /export/{format}. The list and category query
+// parameters take comma separated values, min_score, ttl and zone override
+// the defaults of no minimum, DNS_SERVER_TTL and DNSBL_ZONE.
+func Handler(db database.Store, c *config.APIConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		o := Options{
+			Zone:   c.DNSBLZone,
+			Serial: uint32(time.Now().Unix()),
+			TTL:    c.DNSServerTTL,
+		}
+		if zone := query.Get("zone"); zone != "" {
+			o.Zone = zone
+		}
+		if ttl := query.Get("ttl"); ttl != "" {
+			if o.TTL, err = strconv.Atoi(ttl); err != nil || o.TTL < 0 {
+				http.Error(w, "ttl must be a positive int", http.StatusBadRequest)
+				return
+			}
+		}
+
+		listings, err := Listings(db, filter, c.ListWeights)
+		if err != nil {
+			log.Printf("export query failed: %s\n", err)
+			http.Error(w, "could not read listings", http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err = Write(&buf, mux.Vars(r)["format"], listings, o); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		buf.WriteTo(w)
+	}
+}
+
+// parseFilter reads the list, category and min_score query parameters
+func parseFilter(query url.Values) (Filter, error) {
+	filter := Filter{
+		Lists:      splitParam(query["list"]),
+		Categories: splitParam(query["category"]),
+	}
+	if minScore := query.Get("min_score"); minScore != "" {
+		var err error
+		if filter.MinScore, err = strconv.Atoi(minScore); err != nil {
+			return filter, errors.New("min_score must be an int")
+		}
+	}
+	return filter, nil
+}
+
+// splitParam flattens repeated and comma separated query values
+func splitParam(values []string) []string {
+	var out []string
+	for _, v := range values {
+		for _, s := range strings.Split(v, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
@@ -0,0 +1,104 @@
+package export
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestExport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	db, err := database.NewDb(&config.APIConfig{DbPath: filepath.Join(dir, "swdnsbl.db"), PersistDb: true})
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	now := int(time.Now().Unix())
+	reason := "https://www.spamhaus.org/query/ip/127.0.0.4"
+	for _, r := range []*model.ListResult{
+		{IPAddress: "127.0.0.4", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.4", Reason: &reason, Category: dnsbl.CategoryExploit},
+		{IPAddress: "127.0.0.4", Blocklist: "bl.spamcop.net", Listed: true, ResponseCode: "127.0.0.2", Category: dnsbl.CategorySpam},
+		{IPAddress: "127.0.0.10", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.10", Category: dnsbl.CategoryPolicy},
+		{IPAddress: "127.0.0.5", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN"},
+	} {
+		r.CheckedAt = now
+		require.Equal(t, nil, db.UpsertListResult(r))
+	}
+	weights := map[string]int{"zen.spamhaus.org": 3}
+
+	t.Run("listings_all", func(t *testing.T) {
+		listings, err := Listings(db, Filter{}, weights)
+		require.Equal(t, nil, err)
+		require.Equal(t, 2, len(listings))
+		assert.Equal(t, "127.0.0.4", listings[0].IP)
+		assert.Equal(t, 4, listings[0].Score)
+		// the exploit listing is worse than the spam one it is listed after
+		assert.Equal(t, "127.0.0.4", listings[0].Code)
+		assert.Equal(t, []string{"bl.spamcop.net", "zen.spamhaus.org"}, listings[0].Lists)
+		assert.Equal(t, "127.0.0.10", listings[1].IP)
+		assert.Equal(t, 3, listings[1].Score)
+	})
+
+	t.Run("listings_filtered", func(t *testing.T) {
+		listings, err := Listings(db, Filter{MinScore: 4}, weights)
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(listings))
+		assert.Equal(t, "127.0.0.4", listings[0].IP)
+
+		listings, err = Listings(db, Filter{Categories: []string{dnsbl.CategoryPolicy}}, weights)
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(listings))
+		assert.Equal(t, "127.0.0.10", listings[0].IP)
+
+		listings, err = Listings(db, Filter{Lists: []string{"bl.spamcop.net"}}, weights)
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(listings))
+		assert.Equal(t, 1, listings[0].Score)
+	})
+
+	t.Run("write_rbldnsd", func(t *testing.T) {
+		listings, err := Listings(db, Filter{Lists: []string{"zen.spamhaus.org"}}, weights)
+		require.Equal(t, nil, err)
+
+		var buf bytes.Buffer
+		err = Write(&buf, FormatRbldnsd, listings, Options{Zone: "bl.example.com", Serial: 42, TTL: 60})
+		require.Equal(t, nil, err)
+		assert.Equal(t, "$SOA 60 bl.example.com. hostmaster.bl.example.com. 42 3600 600 86400 60\n"+
+			"$TTL 60\n"+
+			"127.0.0.4 :127.0.0.4:listed on zen.spamhaus.org (127.0.0.4): "+reason+"\n"+
+			"127.0.0.10 :127.0.0.10:listed on zen.spamhaus.org (127.0.0.10)\n", buf.String())
+	})
+
+	t.Run("write_rpz", func(t *testing.T) {
+		listings, err := Listings(db, Filter{}, weights)
+		require.Equal(t, nil, err)
+
+		var buf bytes.Buffer
+		err = Write(&buf, FormatRPZ, listings, Options{Zone: "rpz.example.com.", Serial: 42, TTL: 60})
+		require.Equal(t, nil, err)
+		assert.Equal(t, "$ORIGIN rpz.example.com.\n"+
+			"$TTL 60\n"+
+			"@ IN SOA localhost. hostmaster.rpz.example.com. 42 3600 600 86400 60\n"+
+			"@ IN NS localhost.\n"+
+			"32.4.0.0.127.rpz-ip CNAME . ; bl.spamcop.net,zen.spamhaus.org\n"+
+			"32.10.0.0.127.rpz-ip CNAME . ; zen.spamhaus.org\n", buf.String())
+	})
+
+	t.Run("write_unknown_format", func(t *testing.T) {
+		var buf bytes.Buffer
+		assert.Equal(t, ErrUnknownFormat, Write(&buf, "hosts", nil, Options{}))
+	})
+}
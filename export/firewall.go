@@ -0,0 +1,163 @@
+package export
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+)
+
+// Firewall formats
+const (
+	// FormatIPSet is an `ipset restore` file
+	FormatIPSet = "ipset"
+	// FormatNftables is an `nft -f` file
+	FormatNftables = "nftables"
+	// FormatIptables is an `iptables-restore --noflush` file
+	FormatIptables = "iptables"
+)
+
+// DefaultSetName names the ipset, nftables table and set, and iptables chain
+// (upper cased) unless another name is given
+const DefaultSetName = "swdnsbl"
+
+// minMaxElem is the smallest maxelem given to an ipset, so it has room to
+// grow between pulls
+const minMaxElem = 65536
+
+// validSetName matches names every firewall accepts; iptables chains allow 28
+// characters at most, and the temporary ipset adds two to the 31 ipset allows
+var validSetName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_-]{0,27}$`)
+
+// tmpSetSuffix names the ipset WriteIPSet fills before swapping it in
+const tmpSetSuffix = "-t"
+
+// WriteFirewall function renders the ips of listings in format to w, under
+// set, chain or table name
+func WriteFirewall(w io.Writer, format string, listings []*Listing, name string) error {
+	switch format {
+	case FormatIPSet:
+		return WriteIPSet(w, listings, name)
+	case FormatNftables:
+		return WriteNftables(w, listings, name)
+	case FormatIptables:
+		return WriteIptables(w, listings, name)
+	}
+	return ErrUnknownFormat
+}
+
+// WriteIPSet function writes listings as a hash:ip set for `ipset restore`.
+// The ips are added to a temporary set that is then swapped with the set,
+// created if missing, so reloading replaces it without ever leaving it
+// empty; match it with e.g.
+// `iptables -I INPUT -m set --match-set swdnsbl src -j DROP`.
+func WriteIPSet(w io.Writer, listings []*Listing, name string) error {
+	maxElem := minMaxElem
+	for maxElem < len(listings) {
+		maxElem *= 2
+	}
+	tmp := name + tmpSetSuffix
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "create %s hash:ip family inet hashsize 1024 maxelem %d -exist\n", name, maxElem)
+	// left over if a previous restore failed half way
+	fmt.Fprintf(bw, "create %s hash:ip family inet hashsize 1024 maxelem %d -exist\n", tmp, maxElem)
+	fmt.Fprintf(bw, "flush %s\n", tmp)
+	for _, l := range listings {
+		fmt.Fprintf(bw, "add %s %s\n", tmp, l.IP)
+	}
+	fmt.Fprintf(bw, "swap %s %s\n", tmp, name)
+	fmt.Fprintf(bw, "destroy %s\n", tmp)
+	return bw.Flush()
+}
+
+// WriteNftables function writes listings as the ipv4_addr set name of the
+// inet table name, with an input chain dropping traffic from it. Only the
+// set and the chain are flushed, so reloading with `nft -f` keeps the rest
+// of the ruleset.
+func WriteNftables(w io.Writer, listings []*Listing, name string) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "add table inet %s\n", name)
+	fmt.Fprintf(bw, "add set inet %s %s { type ipv4_addr; }\n", name, name)
+	fmt.Fprintf(bw, "flush set inet %s %s\n", name, name)
+	if len(listings) > 0 {
+		ips := make([]string, len(listings))
+		for i, l := range listings {
+			ips[i] = l.IP
+		}
+		fmt.Fprintf(bw, "add element inet %s %s { %s }\n", name, name, strings.Join(ips, ", "))
+	}
+	fmt.Fprintf(bw, "add chain inet %s input { type filter hook input priority -10; policy accept; }\n", name)
+	fmt.Fprintf(bw, "flush chain inet %s input\n", name)
+	fmt.Fprintf(bw, "add rule inet %s input ip saddr @%s drop\n", name, name)
+	return bw.Flush()
+}
+
+// WriteIptables function writes listings as a filter table chain dropping
+// each ip, for `iptables-restore --noflush`. Only the chain is replaced; jump
+// to it with e.g. `iptables -I INPUT -j SWDNSBL`.
+func WriteIptables(w io.Writer, listings []*Listing, name string) error {
+	chain := strings.ToUpper(name)
+	bw := bufio.NewWriter(w)
+	fmt.Fprintf(bw, "*filter\n")
+	fmt.Fprintf(bw, ":%s - [0:0]\n", chain)
+	fmt.Fprintf(bw, "-F %s\n", chain)
+	for _, l := range listings {
+		fmt.Fprintf(bw, "-A %s -s %s/32 -j DROP\n", chain, l.IP)
+	}
+	fmt.Fprintf(bw, "COMMIT\n")
+	return bw.Flush()
+}
+
+// FirewallHandler function serves /export/firewall/{format}. It takes the
+// list, category and min_score query parameters of Handler, and name for the
+// set or chain. Responses carry an ETag of their content, so pulls with a
+// matching If-None-Match get a 304 until the listings change.
+func FirewallHandler(db database.Store, c *config.APIConfig) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		filter, err := parseFilter(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		name := DefaultSetName
+		if n := query.Get("name"); n != "" {
+			if !validSetName.MatchString(n) {
+				http.Error(w, "name must be a letter followed by at most 27 letters, digits, - or _", http.StatusBadRequest)
+				return
+			}
+			name = n
+		}
+
+		listings, err := Listings(db, filter, c.ListWeights)
+		if err != nil {
+			log.Printf("firewall export query failed: %s\n", err)
+			http.Error(w, "could not read listings", http.StatusInternalServerError)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err = WriteFirewall(&buf, mux.Vars(r)["format"], listings, name); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		sum := sha256.Sum256(buf.Bytes())
+		w.Header().Set("ETag", `"`+hex.EncodeToString(sum[:16])+`"`)
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		// ServeContent answers If-None-Match with 304 Not Modified
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(buf.Bytes()))
+	}
+}
@@ -0,0 +1,117 @@
+package export
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestFirewall(t *testing.T) {
+	listings := []*Listing{{IP: "127.0.0.4"}, {IP: "127.0.0.10"}}
+
+	t.Run("write_ipset", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteFirewall(&buf, FormatIPSet, listings, "blocked"))
+		assert.Equal(t, ""+
+			"create blocked hash:ip family inet hashsize 1024 maxelem 65536 -exist\n"+
+			"create blocked-t hash:ip family inet hashsize 1024 maxelem 65536 -exist\n"+
+			"flush blocked-t\n"+
+			"add blocked-t 127.0.0.4\n"+
+			"add blocked-t 127.0.0.10\n"+
+			"swap blocked-t blocked\n"+
+			"destroy blocked-t\n", buf.String())
+	})
+
+	t.Run("write_nftables", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteFirewall(&buf, FormatNftables, listings, DefaultSetName))
+		assert.Equal(t, ""+
+			"add table inet swdnsbl\n"+
+			"add set inet swdnsbl swdnsbl { type ipv4_addr; }\n"+
+			"flush set inet swdnsbl swdnsbl\n"+
+			"add element inet swdnsbl swdnsbl { 127.0.0.4, 127.0.0.10 }\n"+
+			"add chain inet swdnsbl input { type filter hook input priority -10; policy accept; }\n"+
+			"flush chain inet swdnsbl input\n"+
+			"add rule inet swdnsbl input ip saddr @swdnsbl drop\n", buf.String())
+
+		buf.Reset()
+		require.Equal(t, nil, WriteNftables(&buf, nil, DefaultSetName))
+		assert.NotContains(t, buf.String(), "add element")
+	})
+
+	t.Run("write_iptables", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteFirewall(&buf, FormatIptables, listings, DefaultSetName))
+		assert.Equal(t, ""+
+			"*filter\n"+
+			":SWDNSBL - [0:0]\n"+
+			"-F SWDNSBL\n"+
+			"-A SWDNSBL -s 127.0.0.4/32 -j DROP\n"+
+			"-A SWDNSBL -s 127.0.0.10/32 -j DROP\n"+
+			"COMMIT\n", buf.String())
+
+		assert.Equal(t, ErrUnknownFormat, WriteFirewall(&buf, "pf", listings, DefaultSetName))
+	})
+
+	t.Run("handler_etag", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "firewall")
+		require.Equal(t, nil, err)
+		defer os.RemoveAll(dir)
+
+		c := &config.APIConfig{DbPath: filepath.Join(dir, "swdnsbl.db"), PersistDb: true}
+		db, err := database.NewDb(c)
+		require.Equal(t, nil, err)
+		defer db.Close()
+		listed := &model.ListResult{IPAddress: "127.0.0.4", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.4", Category: dnsbl.CategoryExploit}
+		require.Equal(t, nil, db.UpsertListResult(listed))
+
+		router := mux.NewRouter()
+		router.Handle("/export/firewall/{format}", FirewallHandler(db, c))
+		get := func(url, etag string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest("GET", url, nil)
+			if etag != "" {
+				req.Header.Set("If-None-Match", etag)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+
+		rec := get("/export/firewall/ipset?category=exploit&name=edge", "")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "add edge-t 127.0.0.4\n")
+		etag := rec.Header().Get("ETag")
+		require.NotEqual(t, "", etag)
+
+		rec = get("/export/firewall/ipset?category=exploit&name=edge", etag)
+		assert.Equal(t, http.StatusNotModified, rec.Code)
+		assert.Equal(t, "", rec.Body.String())
+
+		// a new listing changes the content and so the etag
+		require.Equal(t, nil, db.UpsertListResult(&model.ListResult{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.4", Category: dnsbl.CategoryExploit}))
+		rec = get("/export/firewall/ipset?category=exploit&name=edge", etag)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.NotEqual(t, etag, rec.Header().Get("ETag"))
+
+		assert.Equal(t, http.StatusNotFound, get("/export/firewall/pf", "").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/export/firewall/ipset?name=bad%20name", "").Code)
+		// one more than the 28 characters of an iptables chain
+		assert.Equal(t, http.StatusBadRequest, get("/export/firewall/ipset?name=a"+strings.Repeat("b", 28), "").Code)
+		assert.Equal(t, http.StatusOK, get("/export/firewall/ipset?name=a"+strings.Repeat("b", 27), "").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/export/firewall/ipset?min_score=high", "").Code)
+	})
+}
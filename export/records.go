@@ -0,0 +1,155 @@
+package export
+
+import (
+	"bufio"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+// Record export formats
+const (
+	// FormatCSV is a csv file with a header row
+	FormatCSV = "csv"
+	// FormatJSON is a json array of records
+	FormatJSON = "json"
+	// FormatNDJSON is one json record per line
+	FormatNDJSON = "ndjson"
+)
+
+// recordsHeader is the header row of FormatCSV
+var recordsHeader = []string{"ip_address", "uuid", "created_at", "updated_at", "response_code", "lists"}
+
+// Record is an exported ip_details record and the lists currently listing it
+type Record struct {
+	*model.Record
+	Lists []string `json:"lists"`
+}
+
+// contentTypes of the record export formats
+var contentTypes = map[string]string{
+	FormatCSV:    "text/csv; charset=utf-8",
+	FormatJSON:   "application/json",
+	FormatNDJSON: "application/x-ndjson",
+}
+
+// WriteRecords function streams the records matching f to w in format, row
+// by row as they are read from the database
+func WriteRecords(w io.Writer, format string, db database.Store, f database.RecordFilter) error {
+	bw := bufio.NewWriter(w)
+	var err error
+	switch format {
+	case FormatCSV:
+		cw := csv.NewWriter(bw)
+		cw.Write(recordsHeader)
+		err = db.EachRecord(f, func(r *model.Record, lists []string) error {
+			return cw.Write([]string{
+				r.IPAddress,
+				r.UUID,
+				strconv.Itoa(r.CreatedAt),
+				strconv.Itoa(r.UpdatedAt),
+				r.ResponseCode,
+				strings.Join(lists, ","),
+			})
+		})
+		cw.Flush()
+		if err == nil {
+			err = cw.Error()
+		}
+	case FormatJSON:
+		sep := "\n"
+		bw.WriteString("[")
+		err = db.EachRecord(f, func(r *model.Record, lists []string) error {
+			b, err := json.Marshal(newRecord(r, lists))
+			if err != nil {
+				return err
+			}
+			bw.WriteString(sep)
+			bw.Write(b)
+			sep = ",\n"
+			return nil
+		})
+		bw.WriteString("\n]\n")
+	case FormatNDJSON:
+		enc := json.NewEncoder(bw)
+		err = db.EachRecord(f, func(r *model.Record, lists []string) error {
+			return enc.Encode(newRecord(r, lists))
+		})
+	default:
+		return ErrUnknownFormat
+	}
+	if err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+func newRecord(r *model.Record, lists []string) *Record {
+	if lists == nil {
+		lists = []string{}
+	}
+	return &Record{Record: r, Lists: lists}
+}
+
+// ParseSince function parses an updated since time, given as unix seconds,
+// an RFC 3339 time or a 2006-01-02 date, into unix seconds
+func ParseSince(since string) (int, error) {
+	if since == "" {
+		return 0, nil
+	}
+	if unix, err := strconv.Atoi(since); err == nil {
+		return unix, nil
+	}
+	for _, layout := range []string{time.RFC3339, "2006-01-02"} {
+		if t, err := time.Parse(layout, since); err == nil {
+			return int(t.Unix()), nil
+		}
+	}
+	return 0, fmt.Errorf("since must be unix seconds, an RFC 3339 time or a date, not %s", since)
+}
+
+// RecordsHandler function serves /export/records/{format}, every ip_details
+// record as csv, json or ndjson. listed=true keeps the listed ips only, list
+// takes comma separated blocklists and since keeps the records updated since
+// then, see ParseSince.
+func RecordsHandler(db database.Store) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		format := mux.Vars(r)["format"]
+		contentType, ok := contentTypes[format]
+		if !ok {
+			http.Error(w, ErrUnknownFormat.Error(), http.StatusNotFound)
+			return
+		}
+
+		query := r.URL.Query()
+		filter := database.RecordFilter{Lists: splitParam(query["list"])}
+		var err error
+		if listed := query.Get("listed"); listed != "" {
+			if filter.Listed, err = strconv.ParseBool(listed); err != nil {
+				http.Error(w, "listed must be true or false", http.StatusBadRequest)
+				return
+			}
+		}
+		if filter.UpdatedSince, err = ParseSince(query.Get("since")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		// the body streams, so a failure half way can only be logged
+		w.Header().Set("Content-Type", contentType)
+		if err = WriteRecords(w, format, db, filter); err != nil {
+			log.Printf("records export failed: %s\n", err)
+		}
+	}
+}
@@ -0,0 +1,119 @@
+package export
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestRecords(t *testing.T) {
+	dir, err := ioutil.TempDir("", "records")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	db, err := database.NewDb(&config.APIConfig{DbPath: filepath.Join(dir, "swdnsbl.db"), PersistDb: true})
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	for _, r := range []*model.Record{
+		{IPAddress: "127.0.0.4", UUID: "uuid-4", ResponseCode: "127.0.0.4", CreatedAt: 100, UpdatedAt: 200},
+		{IPAddress: "127.0.0.5", UUID: "uuid-5", ResponseCode: "NXDOMAIN", CreatedAt: 100, UpdatedAt: 100},
+	} {
+		require.Equal(t, nil, db.UpsertRecord(r))
+	}
+	for _, r := range []*model.ListResult{
+		{IPAddress: "127.0.0.4", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.4"},
+		{IPAddress: "127.0.0.4", Blocklist: "bl.spamcop.net", Listed: true, ResponseCode: "127.0.0.2"},
+		{IPAddress: "127.0.0.5", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN"},
+	} {
+		require.Equal(t, nil, db.UpsertListResult(r))
+	}
+
+	t.Run("write_csv", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteRecords(&buf, FormatCSV, db, database.RecordFilter{}))
+		assert.Equal(t, ""+
+			"ip_address,uuid,created_at,updated_at,response_code,lists\n"+
+			"127.0.0.4,uuid-4,100,200,127.0.0.4,\"bl.spamcop.net,zen.spamhaus.org\"\n"+
+			"127.0.0.5,uuid-5,100,100,NXDOMAIN,\n", buf.String())
+	})
+
+	t.Run("write_json", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteRecords(&buf, FormatJSON, db, database.RecordFilter{}))
+		assert.JSONEq(t, `[
+			{"ip_address": "127.0.0.4", "uuid": "uuid-4", "created_at": 100, "updated_at": 200, "response_code": "127.0.0.4", "error": null, "lists": ["bl.spamcop.net", "zen.spamhaus.org"]},
+			{"ip_address": "127.0.0.5", "uuid": "uuid-5", "created_at": 100, "updated_at": 100, "response_code": "NXDOMAIN", "error": null, "lists": []}
+		]`, buf.String())
+
+		buf.Reset()
+		require.Equal(t, nil, WriteRecords(&buf, FormatJSON, db, database.RecordFilter{UpdatedSince: 1000}))
+		assert.Equal(t, "[\n]\n", buf.String())
+	})
+
+	t.Run("write_ndjson", func(t *testing.T) {
+		var buf bytes.Buffer
+		require.Equal(t, nil, WriteRecords(&buf, FormatNDJSON, db, database.RecordFilter{Listed: true}))
+		assert.Equal(t, `{"uuid":"uuid-4","created_at":100,"updated_at":200,"response_code":"127.0.0.4","ip_address":"127.0.0.4","error":null,"lists":["bl.spamcop.net","zen.spamhaus.org"]}`+"\n", buf.String())
+
+		assert.Equal(t, ErrUnknownFormat, WriteRecords(&buf, "xml", db, database.RecordFilter{}))
+	})
+
+	t.Run("parse_since", func(t *testing.T) {
+		since, err := ParseSince("1607000000")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1607000000, since)
+
+		since, err = ParseSince("2020-12-01")
+		require.Equal(t, nil, err)
+		assert.Equal(t, int(time.Date(2020, 12, 1, 0, 0, 0, 0, time.UTC).Unix()), since)
+
+		since, err = ParseSince("2020-12-01T10:00:00+01:00")
+		require.Equal(t, nil, err)
+		assert.Equal(t, int(time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC).Unix()), since)
+
+		_, err = ParseSince("last week")
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("handler", func(t *testing.T) {
+		router := mux.NewRouter()
+		router.Handle("/export/records/{format}", RecordsHandler(db))
+		get := func(url string) *httptest.ResponseRecorder {
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, httptest.NewRequest("GET", url, nil))
+			return rec
+		}
+
+		rec := get("/export/records/ndjson?listed=true&list=zen.spamhaus.org&since=150")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "application/x-ndjson", rec.Header().Get("Content-Type"))
+		var record Record
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &record))
+		assert.Equal(t, "127.0.0.4", record.IPAddress)
+
+		rec = get("/export/records/csv?list=bl.spamcop.net,spam.dnsbl.sorbs.net")
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, "text/csv; charset=utf-8", rec.Header().Get("Content-Type"))
+		assert.Contains(t, rec.Body.String(), "\n127.0.0.4,")
+		assert.NotContains(t, rec.Body.String(), "127.0.0.5")
+
+		assert.Equal(t, http.StatusNotFound, get("/export/records/xml").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/export/records/csv?listed=maybe").Code)
+		assert.Equal(t, http.StatusBadRequest, get("/export/records/csv?since=yesterday").Code)
+	})
+}
@@ -7,9 +7,16 @@ require (
 	github.com/DATA-DOG/go-sqlmock v1.5.0
 	github.com/alexanderkarlis/godnsbl v1.0.2
 	github.com/dgrijalva/jwt-go v3.2.0+incompatible
+	github.com/go-sql-driver/mysql v1.5.0
+	github.com/golang/protobuf v1.4.2
 	github.com/google/uuid v1.1.2
 	github.com/gorilla/mux v1.8.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/lib/pq v1.9.0
 	github.com/mattn/go-sqlite3 v1.14.5
+	github.com/miekg/dns v1.1.35
 	github.com/stretchr/testify v1.6.1
 	github.com/vektah/gqlparser/v2 v2.1.0
+	google.golang.org/grpc v1.34.0
+	google.golang.org/protobuf v1.25.0
 )
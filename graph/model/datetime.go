@@ -0,0 +1,35 @@
+package model
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/99designs/gqlgen/graphql"
+)
+
+// MarshalDateTime function writes the Unix time t as an RFC 3339 DateTime in
+// UTC. The models keep Unix times, as stored and served by the REST API.
+func MarshalDateTime(t int) graphql.Marshaler {
+	return graphql.WriterFunc(func(w io.Writer) {
+		io.WriteString(w, strconv.Quote(time.Unix(int64(t), 0).UTC().Format(time.RFC3339)))
+	})
+}
+
+// UnmarshalDateTime function reads an RFC 3339 DateTime, or a Unix time, into
+// a Unix time
+func UnmarshalDateTime(v interface{}) (int, error) {
+	switch v := v.(type) {
+	case string:
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return 0, fmt.Errorf("%s is not an RFC 3339 DateTime", v)
+		}
+		return int(t.Unix()), nil
+	case int, int64, json.Number:
+		return graphql.UnmarshalInt(v)
+	}
+	return 0, fmt.Errorf("%T is not a DateTime", v)
+}
@@ -0,0 +1,37 @@
+package model
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDateTime(t *testing.T) {
+	t.Run("marshal", func(t *testing.T) {
+		var buf bytes.Buffer
+		MarshalDateTime(1604581445).MarshalGQL(&buf)
+		assert.Equal(t, `"2020-11-05T13:04:05Z"`, buf.String())
+	})
+
+	t.Run("unmarshal", func(t *testing.T) {
+		for _, v := range []interface{}{
+			"2020-11-05T13:04:05Z",
+			"2020-11-05T14:04:05+01:00",
+			1604581445,
+			int64(1604581445),
+			json.Number("1604581445"),
+		} {
+			unix, err := UnmarshalDateTime(v)
+			require.Equal(t, nil, err, v)
+			assert.Equal(t, 1604581445, unix, v)
+		}
+
+		_, err := UnmarshalDateTime("yesterday")
+		assert.NotEqual(t, nil, err)
+		_, err = UnmarshalDateTime(true)
+		assert.NotEqual(t, nil, err)
+	})
+}
@@ -2,19 +2,137 @@
 
 package model
 
+import (
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// Backup is a snapshot of the sqlite3 database written by the backup mutation.
+type Backup struct {
+	// path is where the snapshot was written, in BACKUP_DIR.
+	Path string `json:"path"`
+	// bytes is the size of the snapshot file.
+	Bytes int `json:"bytes"`
+	// compressed is true if the snapshot is gzipped.
+	Compressed bool `json:"compressed"`
+	// schema_version is the schema version of the snapshot, checked by
+	// `sw-dnsbl restore`.
+	SchemaVersion int `json:"schema_version"`
+	// created_at is the time the snapshot was started.
+	CreatedAt int `json:"created_at"`
+	// duration_ms is how long the snapshot took, in milliseconds.
+	DurationMs int `json:"duration_ms"`
+}
+
+// ListResult is the outcome of checking a single IP address against a single
+// blocklist domain. Stored in the ip_results table.
+type ListResult struct {
+	// ip_address is the IP Address that was checked.
+	IPAddress string `json:"ip_address"`
+	// blocklist is the Blocklist domain the IP Address was checked against.
+	Blocklist string `json:"blocklist"`
+	// listed is true if the blocklist returned a 127.0.0.0/8 answer.
+	Listed bool `json:"listed"`
+	// response_code is NXDOMAIN if the IP Address is not listed, else the
+	// returned A record.
+	ResponseCode string `json:"response_code"`
+	// reason is the TXT record published by the blocklist for a listed IP Address.
+	Reason *string `json:"reason"`
+	// category is the kind of listing the response_code stands for, e.g. spam,
+	// exploit or policy. Empty if the IP Address is not listed.
+	Category string `json:"category"`
+	// error is set if the lookup failed or did not finish within the deadline.
+	Error *string `json:"error"`
+	// cached is true if the result came from the database instead of a live lookup.
+	Cached bool `json:"cached"`
+	// checked_at is the time the lookup happened.
+	CheckedAt int `json:"checked_at"`
+}
+
+// PageInfo tells whether a connection has more pages.
+type PageInfo struct {
+	// has_next_page is true if more records follow end_cursor.
+	HasNextPage bool `json:"has_next_page"`
+	// end_cursor is the cursor of the last edge, null if there are none.
+	EndCursor *string `json:"end_cursor"`
+}
+
+// PruneResult is what a run of the pruner removed.
+type PruneResult struct {
+	// records_removed is the number of clean records deleted, i.e. listed on no
+	// blocklist, with a successful last lookup and not rechecked within
+	// RECORD_RETENTION_DAYS.
+	RecordsRemoved int `json:"records_removed"`
+	// history_compacted is the number of lookups older than
+	// HISTORY_RETENTION_DAYS rolled up into daily summaries.
+	HistoryCompacted int `json:"history_compacted"`
+	// daily_ips_removed is the number of ips deleted from the summaries of the
+	// days older than DAILY_IPS_RETENTION_DAYS.
+	DailyIpsRemoved int `json:"daily_ips_removed"`
+	// started_at is the time the run started.
+	StartedAt int `json:"started_at"`
+	// duration_ms is how long the run took, in milliseconds.
+	DurationMs int `json:"duration_ms"`
+}
+
+// PruneStatus describes the pruner's runs since the server started.
+type PruneStatus struct {
+	// runs is the number of finished runs, failed ones included.
+	Runs int `json:"runs"`
+	// records_removed is the number of records deleted by all runs.
+	RecordsRemoved int `json:"records_removed"`
+	// history_compacted is the number of lookups compacted by all runs.
+	HistoryCompacted int `json:"history_compacted"`
+	// daily_ips_removed is the number of summary ips deleted by all runs.
+	DailyIpsRemoved int `json:"daily_ips_removed"`
+	// last_run is the latest successful run, null if there was none.
+	LastRun *PruneResult `json:"last_run"`
+	// last_error is the error of the latest run, null if it succeeded.
+	LastError *string `json:"last_error"`
+	// record_retention_days is the RECORD_RETENTION_DAYS, 0 if records are
+	// kept forever.
+	RecordRetentionDays int `json:"record_retention_days"`
+	// history_retention_days is the HISTORY_RETENTION_DAYS, 0 if lookups are
+	// never compacted.
+	HistoryRetentionDays int `json:"history_retention_days"`
+	// daily_ips_retention_days is the DAILY_IPS_RETENTION_DAYS, 0 if the ips of
+	// the summaries are kept forever.
+	DailyIpsRetentionDays int `json:"daily_ips_retention_days"`
+	// interval_seconds is the PRUNE_INTERVAL, 0 if the pruner only runs on
+	// demand.
+	IntervalSeconds int `json:"interval_seconds"`
+}
+
+// QueueStatus describes how full the consumer's job queue is.
+type QueueStatus struct {
+	// depth is the number of jobs waiting in the queue.
+	Depth int `json:"depth"`
+	// capacity is the number of jobs the queue holds (WORKER_POOL_SIZE).
+	Capacity int `json:"capacity"`
+	// spilled is the number of jobs written to disk waiting for room in the
+	// queue. Always 0 unless QUEUE_FULL_POLICY is spill.
+	Spilled int `json:"spilled"`
+	// policy is the QUEUE_FULL_POLICY: reject, block or spill.
+	Policy string `json:"policy"`
+	// retry_after_seconds is the estimated time until a full queue has room again.
+	RetryAfterSeconds int `json:"retry_after_seconds"`
+}
+
 // Record is the type that is the db schema for ip_details
 //
-// @uuid VARCHAR(255) NOT NULL,
-// @created_at VARCHAR(255  ),
-// @updated_at​ VARCHAR(255),
-// @response_code​ VARCHAR(255),
-// @ip_address​ VARCHAR(255)
+// @uuid VARCHAR(36) NOT NULL,
+// @created_at INTEGER (Unix time),
+// @updated_at INTEGER (Unix time), indexed,
+// @response_code VARCHAR(255), indexed,
+// @ip_address VARCHAR(45) PRIMARY KEY,
+// @lookup_error TEXT
 type Record struct {
 	// uuid for each record
 	UUID string `json:"uuid"`
-	// time record was created. Unix time.
+	// time record was created.
 	CreatedAt int `json:"created_at"`
-	// time record was updated. Unix time.
+	// time record was updated.
 	UpdatedAt int `json:"updated_at"`
 	// response_code is NXDOMAIN is response from `godnsbl.Lookup` is nil, else
 	// the response_code is the returned string.
@@ -22,6 +140,79 @@ type Record struct {
 	// ip_address is the IP Address used for searching against the Blocklist domain. Used
 	// in `godnsbl.Lookup`.
 	IPAddress string `json:"ip_address"`
+	// error is set if the last lookup of the IP Address failed or did not
+	// finish, in which case response_code is NXDOMAIN.
+	Error *string `json:"error"`
+}
+
+// RecordConnection is a page of records, most recently updated first.
+type RecordConnection struct {
+	// edges are the records of the page.
+	Edges []*RecordEdge `json:"edges"`
+	// page_info tells how to get the next page.
+	PageInfo *PageInfo `json:"page_info"`
+}
+
+// RecordEdge is a record and the cursor to page on from it.
+type RecordEdge struct {
+	// cursor to pass as `after` for the records following this one.
+	Cursor string `json:"cursor"`
+	// node is the record.
+	Node *Record `json:"node"`
+}
+
+// RecordFilter narrows the records query. Every field is optional and the
+// ones given must all match.
+type RecordFilter struct {
+	// status of the record. With blocklist, LISTED and NOT_LISTED are about
+	// that blocklist only.
+	Status *RecordStatus `json:"status"`
+	// blocklist the IP Address was checked against.
+	Blocklist *string `json:"blocklist"`
+	// response_code of the record, e.g. 127.0.0.2 or NXDOMAIN.
+	ResponseCode *string `json:"response_code"`
+	// updated_since keeps the records updated at or after this time.
+	UpdatedSince *int `json:"updated_since"`
+	// updated_until keeps the records updated at or before this time.
+	UpdatedUntil *int `json:"updated_until"`
+	// cidr keeps the records whose IP Address is in this network, e.g.
+	// 192.0.2.0/24. A bare IP Address matches only itself.
+	Cidr *string `json:"cidr"`
+}
+
+// RecordUpdate is pushed to recordUpdated subscribers every time a worker
+// finishes looking up an IP address against a blocklist.
+type RecordUpdate struct {
+	// job_id is the id of the job the IP Address was queued under.
+	JobID string `json:"job_id"`
+	// record is the ip_details data written by the update.
+	Record *Record `json:"record"`
+	// result is the blocklist result that caused the update.
+	Result *ListResult `json:"result"`
+}
+
+// StatsBucket counts one group of lookups. The fields of the groups not asked
+// for are null.
+type StatsBucket struct {
+	Blocklist    *string `json:"blocklist"`
+	ResponseCode *string `json:"response_code"`
+	Category     *string `json:"category"`
+	// day is the start of the day, at midnight UTC.
+	Day *int `json:"day"`
+	// lookups is the number of lookups, failed ones included.
+	Lookups int `json:"lookups"`
+	// listed is the number of lookups that found the IP Address listed.
+	Listed int `json:"listed"`
+	// errors is the number of lookups that failed or did not finish.
+	Errors int `json:"errors"`
+	// unique_ips is the number of different IP Addresses looked up, each
+	// counted once however many lookups, blocklists and days it had. Days
+	// compacted before schema version 11, or over DAILY_IPS_RETENTION_DAYS
+	// ago, add nothing to it, nor to listed_ips.
+	UniqueIps int `json:"unique_ips"`
+	// listed_ips is the number of different IP Addresses found listed at least
+	// once.
+	ListedIps int `json:"listed_ips"`
 }
 
 // Required Token for running any other queries
@@ -38,3 +229,101 @@ type UserAuth struct {
 	// password
 	Password string `json:"password"`
 }
+
+// RecordStatus is the outcome of the lookups of a record's IP Address.
+type RecordStatus string
+
+const (
+	// LISTED records are listed on at least one blocklist.
+	RecordStatusListed RecordStatus = "LISTED"
+	// NOT_LISTED records are listed on no blocklist, and their last lookup
+	// succeeded.
+	RecordStatusNotListed RecordStatus = "NOT_LISTED"
+	// ERROR records' last lookup failed.
+	RecordStatusError RecordStatus = "ERROR"
+)
+
+var AllRecordStatus = []RecordStatus{
+	RecordStatusListed,
+	RecordStatusNotListed,
+	RecordStatusError,
+}
+
+func (e RecordStatus) IsValid() bool {
+	switch e {
+	case RecordStatusListed, RecordStatusNotListed, RecordStatusError:
+		return true
+	}
+	return false
+}
+
+func (e RecordStatus) String() string {
+	return string(e)
+}
+
+func (e *RecordStatus) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = RecordStatus(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid RecordStatus", str)
+	}
+	return nil
+}
+
+func (e RecordStatus) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
+
+// StatsGroup is what the stats query groups lookups by.
+type StatsGroup string
+
+const (
+	// BLOCKLIST groups by blocklist domain.
+	StatsGroupBlocklist StatsGroup = "BLOCKLIST"
+	// RESPONSE_CODE groups by the response code of the lookups.
+	StatsGroupResponseCode StatsGroup = "RESPONSE_CODE"
+	// CATEGORY groups by the category of the blocklists.
+	StatsGroupCategory StatsGroup = "CATEGORY"
+	// DAY groups by the day of the lookups, starting at midnight UTC.
+	StatsGroupDay StatsGroup = "DAY"
+)
+
+var AllStatsGroup = []StatsGroup{
+	StatsGroupBlocklist,
+	StatsGroupResponseCode,
+	StatsGroupCategory,
+	StatsGroupDay,
+}
+
+func (e StatsGroup) IsValid() bool {
+	switch e {
+	case StatsGroupBlocklist, StatsGroupResponseCode, StatsGroupCategory, StatsGroupDay:
+		return true
+	}
+	return false
+}
+
+func (e StatsGroup) String() string {
+	return string(e)
+}
+
+func (e *StatsGroup) UnmarshalGQL(v interface{}) error {
+	str, ok := v.(string)
+	if !ok {
+		return fmt.Errorf("enums must be strings")
+	}
+
+	*e = StatsGroup(str)
+	if !e.IsValid() {
+		return fmt.Errorf("%s is not a valid StatsGroup", str)
+	}
+	return nil
+}
+
+func (e StatsGroup) MarshalGQL(w io.Writer) {
+	fmt.Fprint(w, strconv.Quote(e.String()))
+}
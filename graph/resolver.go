@@ -1,12 +1,218 @@
 package graph
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/auth"
 	"github.com/alexanderkarlis/sw-dnsbl/database"
 	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+	"github.com/alexanderkarlis/sw-dnsbl/retention"
+	"github.com/vektah/gqlparser/v2/gqlerror"
 )
 
 // Resolver is the dep injection of other reqs
 type Resolver struct {
-	Database *database.Db
+	Database database.Store
 	Consumer *dnsbl.Consumer
+	Pruner   *retention.Pruner
+	// BackupDir is where the backup mutation writes, the BACKUP_DIR
+	BackupDir string
+	// AdminUsers may run the admin mutations, the ADMIN_USERS
+	AdminUsers []string
+}
+
+// authorize checks the token the middleware put on the request context
+func authorize(ctx context.Context) error {
+	_, err := validToken(ctx)
+	return err
+}
+
+// authorizeAdmin checks the token like authorize, and that it was granted to
+// one of the AdminUsers
+func (r *Resolver) authorizeAdmin(ctx context.Context) error {
+	claims, err := validToken(ctx)
+	if err != nil {
+		return err
+	}
+	for _, user := range r.AdminUsers {
+		if claims.Username == user {
+			return nil
+		}
+	}
+	return gqlerror.Errorf("not an admin token")
+}
+
+// validToken returns the claims of the token on the request context
+func validToken(ctx context.Context) (*auth.CustomAuthClaims, error) {
+	token := middleware.GetTokenFromContext(ctx)
+	if token == "" {
+		return nil, gqlerror.Errorf("missing auth token")
+	}
+
+	claims, err := auth.ValidateToken(strings.TrimPrefix(token, "Bearer "))
+	if err != nil {
+		return nil, gqlerror.Errorf("not an authorized token")
+	}
+	return claims, nil
+}
+
+// queueError turns a Consumer.QueueJob error into a graphql error. A full queue
+// gets a code and a hint for when to retry, so clients can back off.
+func (r *Resolver) queueError(err error) error {
+	if err != dnsbl.ErrQueueFull {
+		return gqlerror.Errorf("could not queue job: %s", err)
+	}
+	return &gqlerror.Error{
+		Message: "queue is full",
+		Extensions: map[string]interface{}{
+			"code":       "QUEUE_FULL",
+			"retryAfter": int(r.Consumer.RetryAfter() / time.Second),
+		},
+	}
+}
+
+// backupPath returns the path in BackupDir of the snapshot called name, by
+// default named after the time it starts, creating the directory if needed.
+// Only a plain file name is taken, so a snapshot can't land outside it, and
+// one that exists already is never overwritten.
+func (r *Resolver) backupPath(name *string, compress bool, start time.Time) (string, error) {
+	file := "swdnsbl-" + start.UTC().Format("20060102T150405Z") + ".db"
+	if compress {
+		file += ".gz"
+	}
+	if name != nil {
+		file = *name
+	}
+	if file == "" || file == "." || file == ".." || strings.ContainsAny(file, `/\`) {
+		return "", gqlerror.Errorf("name must be a file name, written to BACKUP_DIR")
+	}
+	dir := r.BackupDir
+	if dir == "" {
+		dir = "."
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", gqlerror.Errorf("backup failed: %s", err)
+	}
+	path := filepath.Join(dir, file)
+	if _, err := os.Stat(path); err == nil {
+		return "", gqlerror.Errorf("%s already exists in BACKUP_DIR", file)
+	} else if !os.IsNotExist(err) {
+		return "", gqlerror.Errorf("backup failed: %s", err)
+	}
+	return path, nil
+}
+
+// the page sizes of the records query
+const (
+	defaultRecordsPage = 50
+	maxRecordsPage     = 500
+)
+
+// recordStatuses are the database statuses of the RecordStatus values
+var recordStatuses = map[model.RecordStatus]string{
+	model.RecordStatusListed:    database.StatusListed,
+	model.RecordStatusNotListed: database.StatusNotListed,
+	model.RecordStatusError:     database.StatusError,
+}
+
+// recordQuery turns the arguments of the records query into the query for
+// the database
+func recordQuery(filter *model.RecordFilter, first *int, after *string) (database.RecordQuery, error) {
+	q := database.RecordQuery{First: defaultRecordsPage}
+	if first != nil {
+		if *first <= 0 || *first > maxRecordsPage {
+			return q, fmt.Errorf("first must be between 1 and %d", maxRecordsPage)
+		}
+		q.First = *first
+	}
+	if after != nil {
+		q.After = *after
+	}
+	if filter == nil {
+		return q, nil
+	}
+
+	if filter.Status != nil {
+		q.Status = recordStatuses[*filter.Status]
+	}
+	if filter.Blocklist != nil {
+		q.Blocklist = *filter.Blocklist
+	}
+	if filter.ResponseCode != nil {
+		q.ResponseCode = *filter.ResponseCode
+	}
+	if filter.UpdatedSince != nil {
+		q.UpdatedSince = *filter.UpdatedSince
+	}
+	if filter.UpdatedUntil != nil {
+		q.UpdatedUntil = *filter.UpdatedUntil
+	}
+	if filter.Cidr != nil {
+		cidr := *filter.Cidr
+		// a bare ip is the network of just itself
+		if ip := net.ParseIP(cidr); ip != nil {
+			if ip.To4() != nil {
+				cidr += "/32"
+			} else {
+				cidr += "/128"
+			}
+		}
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return q, fmt.Errorf("invalid cidr %s", *filter.Cidr)
+		}
+		q.Network = network
+	}
+	return q, nil
+}
+
+// statsGroups are the database groups of the StatsGroup values
+var statsGroups = map[model.StatsGroup]string{
+	model.StatsGroupBlocklist:    database.StatsByBlocklist,
+	model.StatsGroupResponseCode: database.StatsByResponseCode,
+	model.StatsGroupCategory:     database.StatsByCategory,
+	model.StatsGroupDay:          database.StatsByDay,
+}
+
+// statsQuery turns the arguments of the stats query into the query for the
+// database
+func statsQuery(from, to *int, groupBy []model.StatsGroup) database.StatsQuery {
+	var q database.StatsQuery
+	if from != nil {
+		q.From = *from
+	}
+	if to != nil {
+		q.To = *to
+	}
+	for _, g := range groupBy {
+		q.GroupBy = append(q.GroupBy, statsGroups[g])
+	}
+	return q
+}
+
+// statsBucket returns s as a StatsBucket, with the fields of the groups of q
+// only
+func statsBucket(s *database.Stats, q database.StatsQuery) *model.StatsBucket {
+	b := &model.StatsBucket{Lookups: s.Lookups, Listed: s.Listed, Errors: s.Errors, UniqueIps: s.IPs, ListedIps: s.ListedIPs}
+	for _, g := range q.GroupBy {
+		switch g {
+		case database.StatsByBlocklist:
+			b.Blocklist = &s.Blocklist
+		case database.StatsByResponseCode:
+			b.ResponseCode = &s.ResponseCode
+		case database.StatsByCategory:
+			b.Category = &s.Category
+		case database.StatsByDay:
+			b.Day = &s.Day
+		}
+	}
+	return b
 }
@@ -8,10 +8,15 @@ import (
 	"fmt"
 	"log"
 	"strings"
+	"time"
 
+	"github.com/99designs/gqlgen/graphql"
 	"github.com/alexanderkarlis/sw-dnsbl/auth"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
 	"github.com/alexanderkarlis/sw-dnsbl/graph/generated"
 	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/ipfile"
 	"github.com/alexanderkarlis/sw-dnsbl/middleware"
 	"github.com/vektah/gqlparser/v2/gqlerror"
 )
@@ -39,18 +44,90 @@ func (r *mutationResolver) Enqueue(ctx context.Context, ips []string) (*bool, er
 	if err != nil {
 		return nil, gqlerror.Errorf("not an authorized token")
 	}
-	isQueueOk := r.Consumer.Queue(ips)
+	_, err = r.Consumer.QueueJob(ips)
+	isQueueOk := err == nil
 
 	if !isQueueOk {
-		return &isQueueOk, gqlerror.Errorf("queue not started")
+		return &isQueueOk, r.queueError(err)
 	}
 	return &isQueueOk, nil
 }
 
+func (r *mutationResolver) EnqueueJob(ctx context.Context, ips []string) (*string, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	jobID, err := r.Consumer.QueueJob(ips)
+	if err != nil {
+		return nil, r.queueError(err)
+	}
+	return &jobID, nil
+}
+
+func (r *mutationResolver) EnqueueFile(ctx context.Context, file graphql.Upload) (*string, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	ips, err := ipfile.Read(file.File, ipfile.Detect(file.Filename, file.ContentType))
+	if err != nil {
+		return nil, gqlerror.Errorf("%s: %s", file.Filename, err)
+	}
+	jobID, err := r.Consumer.QueueJob(ips)
+	if err != nil {
+		return nil, r.queueError(err)
+	}
+	return &jobID, nil
+}
+
 func (r *mutationResolver) SetWorkerPoolSize(ctx context.Context, size int) (*bool, error) {
 	panic(fmt.Errorf("not implemented"))
 }
 
+func (r *mutationResolver) Prune(ctx context.Context) (*model.PruneResult, error) {
+	if err := r.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	result, err := r.Pruner.Prune()
+	if err != nil {
+		return nil, gqlerror.Errorf("pruning failed: %s", err)
+	}
+	return result, nil
+}
+
+func (r *mutationResolver) Backup(ctx context.Context, name *string, gzip *bool) (*model.Backup, error) {
+	if err := r.authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	db, ok := r.Database.(database.Backuper)
+	if !ok {
+		return nil, gqlerror.Errorf("this database can't be backed up")
+	}
+	compress := gzip != nil && *gzip
+	start := time.Now()
+	path, err := r.backupPath(name, compress, start)
+	if err != nil {
+		return nil, err
+	}
+	info, err := db.Backup(path, compress)
+	if err != nil {
+		return nil, gqlerror.Errorf("backup failed: %s", err)
+	}
+	log.Printf("backed up the database to %s, %d bytes\n", info.Path, info.Bytes)
+
+	return &model.Backup{
+		Path:          info.Path,
+		Bytes:         int(info.Bytes),
+		Compressed:    info.Compressed,
+		SchemaVersion: info.SchemaVersion,
+		CreatedAt:     int(start.Unix()),
+		DurationMs:    int(time.Since(start) / time.Millisecond),
+	}, nil
+}
+
 func (r *queryResolver) GetIPDetails(ctx context.Context, ip string) (*model.Record, error) {
 	token := middleware.GetTokenFromContext(ctx)
 	if token == "" {
@@ -66,14 +143,113 @@ func (r *queryResolver) GetIPDetails(ctx context.Context, ip string) (*model.Rec
 	return record, err
 }
 
+func (r *queryResolver) CheckIP(ctx context.Context, ip string, lists []string, timeoutMs *int) ([]*model.ListResult, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	timeout := dnsbl.DefaultCheckTimeout
+	if timeoutMs != nil {
+		if *timeoutMs <= 0 {
+			return nil, gqlerror.Errorf("timeoutMs must be greater than 0")
+		}
+		timeout = time.Duration(*timeoutMs) * time.Millisecond
+	}
+
+	// the request context is cancelled if the client goes away, which in turn
+	// cancels any lookups still in flight
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	results, err := r.Consumer.CheckIP(ctx, ip, lists)
+	if err != nil {
+		return nil, gqlerror.Errorf("%s", err)
+	}
+	return results, nil
+}
+
+func (r *queryResolver) QueueStatus(ctx context.Context) (*model.QueueStatus, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+	return r.Consumer.QueueStatus(), nil
+}
+
+func (r *queryResolver) Records(ctx context.Context, filter *model.RecordFilter, first *int, after *string) (*model.RecordConnection, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	q, err := recordQuery(filter, first, after)
+	if err != nil {
+		return nil, gqlerror.Errorf("%s", err)
+	}
+	records, hasNext, err := r.Database.QueryRecords(q)
+	if err != nil {
+		return nil, gqlerror.Errorf("%s", err)
+	}
+
+	conn := &model.RecordConnection{
+		Edges:    make([]*model.RecordEdge, len(records)),
+		PageInfo: &model.PageInfo{HasNextPage: hasNext},
+	}
+	for i, record := range records {
+		conn.Edges[i] = &model.RecordEdge{Cursor: database.RecordCursor(record), Node: record}
+	}
+	if len(records) > 0 {
+		conn.PageInfo.EndCursor = &conn.Edges[len(records)-1].Cursor
+	}
+	return conn, nil
+}
+
+func (r *queryResolver) PruneStatus(ctx context.Context) (*model.PruneStatus, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+	return r.Pruner.Status(), nil
+}
+
+func (r *queryResolver) Stats(ctx context.Context, from *int, to *int, groupBy []model.StatsGroup) ([]*model.StatsBucket, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	q := statsQuery(from, to, groupBy)
+	stats, err := r.Database.QueryStats(q)
+	if err != nil {
+		return nil, gqlerror.Errorf("%s", err)
+	}
+	buckets := make([]*model.StatsBucket, len(stats))
+	for i, s := range stats {
+		buckets[i] = statsBucket(s, q)
+	}
+	return buckets, nil
+}
+
+func (r *subscriptionResolver) RecordUpdated(ctx context.Context, ips []string, jobID *string) (<-chan *model.RecordUpdate, error) {
+	if err := authorize(ctx); err != nil {
+		return nil, err
+	}
+
+	id := ""
+	if jobID != nil {
+		id = *jobID
+	}
+	return r.Consumer.Subscribe(ctx, ips, id), nil
+}
+
 // Mutation returns generated.MutationResolver implementation.
 func (r *Resolver) Mutation() generated.MutationResolver { return &mutationResolver{r} }
 
 // Query returns generated.QueryResolver implementation.
 func (r *Resolver) Query() generated.QueryResolver { return &queryResolver{r} }
 
+// Subscription returns generated.SubscriptionResolver implementation.
+func (r *Resolver) Subscription() generated.SubscriptionResolver { return &subscriptionResolver{r} }
+
 type mutationResolver struct{ *Resolver }
 type queryResolver struct{ *Resolver }
+type subscriptionResolver struct{ *Resolver }
 
 // !!! WARNING !!!
 // The code below was going to be deleted when updating resolvers. It has been copied here so you have
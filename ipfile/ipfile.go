@@ -0,0 +1,259 @@
+package ipfile
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"path/filepath"
+	"strings"
+)
+
+// Formats of ip files
+const (
+	FormatText   = "text"
+	FormatCSV    = "csv"
+	FormatNDJSON = "ndjson"
+)
+
+// ErrNoIPs is returned by Read for a file without any ip
+var ErrNoIPs = errors.New("no ips given")
+
+// ipColumns are the csv header and ndjson field names taken as the ip, in
+// order of preference
+var ipColumns = []string{"ip", "ip_address", "ipaddress", "address", "addr"}
+
+// Detect function returns the format of a file from its name or, failing
+// that, its content type. It returns "" if neither tells, for Scan to sniff.
+func Detect(filename, contentType string) string {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".csv":
+		return FormatCSV
+	case ".ndjson", ".jsonl":
+		return FormatNDJSON
+	case ".txt", ".list":
+		return FormatText
+	}
+	contentType = strings.ToLower(contentType)
+	switch {
+	case strings.HasPrefix(contentType, "text/csv"):
+		return FormatCSV
+	case strings.Contains(contentType, "ndjson"), strings.Contains(contentType, "jsonlines"):
+		return FormatNDJSON
+	}
+	return ""
+}
+
+// Scan function calls fn with every ip in r, in the order of the file,
+// without holding more than a line of it in memory. An empty format is
+// sniffed from the first line: `{` or `"` is ndjson, a comma csv and
+// anything else text.
+//
+// text files have one ip per line, blank lines and # comments are skipped.
+// csv files take the ip from the header column named ip, ip_address,
+// ipaddress, address or addr or, without such a header, from the first
+// column holding an IPv4 address.
+// ndjson lines are objects with one of those fields, or bare strings.
+func Scan(r io.Reader, format string, fn func(ip string) error) error {
+	br := bufio.NewReader(r)
+	if format == "" {
+		var err error
+		if format, err = sniff(br); err != nil {
+			return err
+		}
+	}
+	switch format {
+	case FormatText:
+		return scanText(br, fn)
+	case FormatCSV:
+		return scanCSV(br, fn)
+	case FormatNDJSON:
+		return scanNDJSON(br, fn)
+	}
+	return fmt.Errorf("unknown format %s, use text, csv or ndjson", format)
+}
+
+// Read function returns the ips in r, see Scan, with duplicates removed
+func Read(r io.Reader, format string) ([]string, error) {
+	var ips []string
+	seen := map[string]bool{}
+	err := Scan(r, format, func(ip string) error {
+		if !seen[ip] {
+			seen[ip] = true
+			ips = append(ips, ip)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(ips) == 0 {
+		return nil, ErrNoIPs
+	}
+	return ips, nil
+}
+
+// sniff guesses the format from the first line that isn't blank or a comment
+func sniff(br *bufio.Reader) (string, error) {
+	for n := 64; ; n *= 2 {
+		b, err := br.Peek(n)
+		lines := bytes.Split(b, []byte("\n"))
+		// the last line may be cut off, unless it is the end of the file
+		complete := len(lines) - 1
+		if err != nil {
+			complete = len(lines)
+		}
+		for _, line := range lines[:complete] {
+			line = bytes.TrimSpace(line)
+			if len(line) == 0 || line[0] == '#' {
+				continue
+			}
+			switch {
+			case line[0] == '{' || line[0] == '"':
+				return FormatNDJSON, nil
+			case bytes.IndexByte(line, ',') >= 0:
+				return FormatCSV, nil
+			}
+			return FormatText, nil
+		}
+		switch err {
+		case nil:
+		case io.EOF, bufio.ErrBufferFull:
+			// all blank, or longer than the reader's buffer
+			return FormatText, nil
+		default:
+			return "", err
+		}
+	}
+}
+
+func scanText(br *bufio.Reader, fn func(ip string) error) error {
+	scanner := bufio.NewScanner(br)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.Index(text, "#"); i >= 0 {
+			text = text[:i]
+		}
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		if err := emit(line, text, fn); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+func scanCSV(br *bufio.Reader, fn func(ip string) error) error {
+	cr := csv.NewReader(br)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	cr.ReuseRecord = true
+
+	column := -1
+	for line := 1; ; line++ {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if column < 0 {
+			if line == 1 {
+				if column = headerColumn(record); column >= 0 {
+					continue
+				}
+			}
+			// without a known header the ips are in the first column that
+			// has one, any row before that is a header
+			if column = ipColumn(record); column < 0 {
+				if line == 1 {
+					continue
+				}
+				return fmt.Errorf("line %d: no IPv4 address", line)
+			}
+		}
+		if column >= len(record) || strings.TrimSpace(record[column]) == "" {
+			continue
+		}
+		if err = emit(line, strings.TrimSpace(record[column]), fn); err != nil {
+			return err
+		}
+	}
+}
+
+// headerColumn returns the index of the ip column of a csv header, or -1
+func headerColumn(header []string) int {
+	for _, name := range ipColumns {
+		for i, h := range header {
+			if strings.EqualFold(strings.TrimSpace(h), name) {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// ipColumn returns the index of the first field of record that is an IPv4
+// address, or -1
+func ipColumn(record []string) int {
+	for i, field := range record {
+		if isIPv4(strings.TrimSpace(field)) {
+			return i
+		}
+	}
+	return -1
+}
+
+func scanNDJSON(br *bufio.Reader, fn func(ip string) error) error {
+	scanner := bufio.NewScanner(br)
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+		var ip string
+		if text[0] == '"' {
+			if err := json.Unmarshal(text, &ip); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+		} else {
+			var object map[string]interface{}
+			if err := json.Unmarshal(text, &object); err != nil {
+				return fmt.Errorf("line %d: %s", line, err)
+			}
+			for _, name := range ipColumns {
+				if v, ok := object[name].(string); ok {
+					ip = v
+					break
+				}
+			}
+			if ip == "" {
+				return fmt.Errorf("line %d: no ip field", line)
+			}
+		}
+		if err := emit(line, strings.TrimSpace(ip), fn); err != nil {
+			return err
+		}
+	}
+	return scanner.Err()
+}
+
+// emit passes ip to fn if it is an IPv4 address
+func emit(line int, ip string, fn func(ip string) error) error {
+	if !isIPv4(ip) {
+		return fmt.Errorf("line %d: %s is not an IPv4 address", line, ip)
+	}
+	return fn(ip)
+}
+
+func isIPv4(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && addr.To4() != nil
+}
@@ -0,0 +1,71 @@
+package ipfile
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIPFile(t *testing.T) {
+	t.Run("detect", func(t *testing.T) {
+		assert.Equal(t, FormatCSV, Detect("ips.CSV", ""))
+		assert.Equal(t, FormatNDJSON, Detect("ips.jsonl", "application/octet-stream"))
+		assert.Equal(t, FormatText, Detect("ips.txt", "text/csv"))
+		assert.Equal(t, FormatCSV, Detect("upload", "text/csv; charset=utf-8"))
+		assert.Equal(t, FormatNDJSON, Detect("upload", "application/x-ndjson"))
+		assert.Equal(t, "", Detect("upload", "application/octet-stream"))
+	})
+
+	tests := []struct {
+		name    string
+		format  string
+		content string
+		ips     []string
+	}{
+		{"text", FormatText, "# suspects\n127.0.0.2\n\n 127.0.0.3 # maybe\n127.0.0.2\n", []string{"127.0.0.2", "127.0.0.3"}},
+		{"csv_header", FormatCSV, "first_seen,IP_Address\n2020-12-01,127.0.0.2\n2020-12-02, 127.0.0.3\n2020-12-03,\n", []string{"127.0.0.2", "127.0.0.3"}},
+		{"csv_unknown_header", FormatCSV, "host,addr4\nmx1,127.0.0.2\n", []string{"127.0.0.2"}},
+		{"csv_no_header", FormatCSV, "127.0.0.2,spam\n127.0.0.3,\"exploit, botnet\"\n", []string{"127.0.0.2", "127.0.0.3"}},
+		{"ndjson", FormatNDJSON, "{\"ip\": \"127.0.0.2\", \"source\": \"mx1\"}\n\n\"127.0.0.3\"\n{\"ip_address\": \"127.0.0.4\"}\n", []string{"127.0.0.2", "127.0.0.3", "127.0.0.4"}},
+		{"sniff_text", "", "\n# suspects\n127.0.0.2\n", []string{"127.0.0.2"}},
+		{"sniff_csv", "", "ip,source\n127.0.0.2,mx1\n", []string{"127.0.0.2"}},
+		{"sniff_ndjson", "", "{\"ip\": \"127.0.0.2\"}\n", []string{"127.0.0.2"}},
+		{"sniff_long_comment", "", "# " + strings.Repeat("x", 10000) + "\n127.0.0.2\n", []string{"127.0.0.2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ips, err := Read(strings.NewReader(test.content), test.format)
+			require.Equal(t, nil, err)
+			assert.Equal(t, test.ips, ips)
+		})
+	}
+
+	t.Run("errors", func(t *testing.T) {
+		_, err := Read(strings.NewReader("127.0.0.2\n::1\n"), FormatText)
+		assert.EqualError(t, err, "line 2: ::1 is not an IPv4 address")
+		_, err = Read(strings.NewReader("host,seen\nmx1,today\n"), FormatCSV)
+		assert.EqualError(t, err, "line 2: no IPv4 address")
+		_, err = Read(strings.NewReader("{\"host\": \"mx1\"}\n"), FormatNDJSON)
+		assert.EqualError(t, err, "line 1: no ip field")
+		_, err = Read(strings.NewReader("{\"ip\": \n"), FormatNDJSON)
+		assert.NotEqual(t, nil, err)
+		_, err = Read(strings.NewReader("# nothing here\n"), "")
+		assert.Equal(t, ErrNoIPs, err)
+		_, err = Read(strings.NewReader("127.0.0.2\n"), "yaml")
+		assert.EqualError(t, err, "unknown format yaml, use text, csv or ndjson")
+	})
+
+	t.Run("scan_stops_on_error", func(t *testing.T) {
+		stop := errors.New("stop")
+		var seen []string
+		err := Scan(strings.NewReader("127.0.0.2\n127.0.0.3\n"), FormatText, func(ip string) error {
+			seen = append(seen, ip)
+			return stop
+		})
+		assert.Equal(t, stop, err)
+		assert.Equal(t, []string{"127.0.0.2"}, seen)
+	})
+}
@@ -0,0 +1,327 @@
+package maillog
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"log"
+	"net"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+)
+
+const (
+	// batchSize is the most ips queued as one job
+	batchSize = 500
+	// flushInterval is how often Run queues the ips gathered since the last
+	// batch, and retries a batch the queue had no room for
+	flushInterval = 5 * time.Second
+	// maxPending caps the ips waiting for room in the queue; new ones are
+	// dropped beyond it
+	maxPending = 100000
+)
+
+// pollInterval is how often Follow looks for new lines, rotation and
+// truncation once it has read to the end of a file
+var pollInterval = time.Second
+
+// extractors find the client ip in the postfix and exim lines logged when a
+// client connects or is rejected
+var extractors = []*regexp.Regexp{
+	// postfix/smtpd[123]: connect from mail.example.com[192.0.2.1]
+	// postfix/smtpd[123]: NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 ...
+	regexp.MustCompile(`/smtpd\[\d+\]: (?:connect from|\w+: reject: \w+ from) [^\s\[]*\[([0-9.]+)\]`),
+	// postfix/postscreen[123]: CONNECT from [192.0.2.1]:51234 to [198.51.100.1]:25
+	regexp.MustCompile(`/postscreen\[\d+\]: CONNECT from \[([0-9.]+)\]`),
+	// SMTP connection from mail.example.com [192.0.2.1]:51234 I=[198.51.100.1]:25 ...
+	regexp.MustCompile(`\bSMTP connection from (?:\S+ )?(?:\([^)]*\) )?\[([0-9.]+)\]`),
+	// H=mail.example.com (helo) [192.0.2.1]:51234 F=<a@example.com> rejected RCPT ...
+	regexp.MustCompile(`\bH=(?:[^\s(\[]+ )?(?:\([^)]*\) )?\[([0-9.]+)\].*\brejected\b`),
+	// rejected EHLO from [192.0.2.1]: syntactically invalid argument(s): ...
+	regexp.MustCompile(`\brejected (?:EHLO|HELO) from (?:\S+ )?\[([0-9.]+)\]`),
+}
+
+// privateNets are never worth a blocklist lookup
+var privateNets = []*net.IPNet{
+	mustParseCIDR("10.0.0.0/8"),
+	mustParseCIDR("172.16.0.0/12"),
+	mustParseCIDR("192.168.0.0/16"),
+	mustParseCIDR("100.64.0.0/10"),
+}
+
+func mustParseCIDR(cidr string) *net.IPNet {
+	_, n, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Extract function returns the client ip of a postfix or exim connect or
+// reject line. Lines without one, and loopback, private or link local
+// clients, return false.
+func Extract(line string) (string, bool) {
+	for _, re := range extractors {
+		m := re.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		ip := net.ParseIP(m[1]).To4()
+		if ip == nil || !IsPublic(ip) {
+			return "", false
+		}
+		return ip.String(), true
+	}
+	return "", false
+}
+
+// IsPublic function reports whether ip is worth a blocklist lookup, i.e. isn't
+// loopback, private, link local or multicast
+func IsPublic(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsUnspecified() || ip.IsLinkLocalUnicast() || ip.IsMulticast() {
+		return false
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return false
+		}
+	}
+	return true
+}
+
+// Ingester queues the client ips found in mail logs, each at most once per
+// window, in batches
+type Ingester struct {
+	enqueue func(ips []string) (string, error)
+	window  time.Duration
+
+	mu      sync.Mutex
+	seen    map[string]time.Time
+	pending []string
+	queued  int
+
+	// flushMu keeps two flushes from queuing the same batch
+	flushMu sync.Mutex
+}
+
+// NewIngester function returns an ingester queuing ips with enqueue, e.g.
+// Consumer.QueueJob, skipping ips already queued within window
+func NewIngester(enqueue func(ips []string) (string, error), window time.Duration) *Ingester {
+	return &Ingester{
+		enqueue: enqueue,
+		window:  window,
+		seen:    map[string]time.Time{},
+	}
+}
+
+// Line method queues the client ip of line, if it has one not seen within
+// the window. It reports whether the ip was new.
+func (in *Ingester) Line(line string) bool {
+	ip, ok := Extract(line)
+	if !ok {
+		return false
+	}
+	return in.Add(ip)
+}
+
+// Add method queues ip unless it was seen within the window. A full batch is
+// queued straight away, anything less by Run or Flush.
+func (in *Ingester) Add(ip string) bool {
+	now := time.Now()
+	in.mu.Lock()
+	if last, ok := in.seen[ip]; ok && now.Sub(last) < in.window {
+		in.mu.Unlock()
+		return false
+	}
+	if len(in.pending) >= maxPending {
+		in.mu.Unlock()
+		log.Printf("mail log ingest is %d ips behind, dropping %s\n", maxPending, ip)
+		return false
+	}
+	in.seen[ip] = now
+	in.pending = append(in.pending, ip)
+	full := len(in.pending) >= batchSize
+	in.mu.Unlock()
+
+	if full {
+		in.Flush()
+	}
+	return true
+}
+
+// Flush method queues the pending ips, in jobs of at most batchSize. Ips the
+// queue has no room for stay pending for the next flush.
+func (in *Ingester) Flush() error {
+	in.flushMu.Lock()
+	defer in.flushMu.Unlock()
+	for {
+		in.mu.Lock()
+		n := len(in.pending)
+		if n > batchSize {
+			n = batchSize
+		}
+		batch := in.pending[:n:n]
+		in.mu.Unlock()
+		if n == 0 {
+			return nil
+		}
+
+		id, err := in.enqueue(batch)
+		if err != nil {
+			log.Printf("queuing %d ips from mail logs failed, retrying later: %s\n", n, err)
+			return err
+		}
+		log.Printf("queued %d ips from mail logs as job %s\n", n, id)
+
+		in.mu.Lock()
+		in.pending = in.pending[n:]
+		in.queued += n
+		in.mu.Unlock()
+	}
+}
+
+// Queued method returns how many ips were queued so far
+func (in *Ingester) Queued() int {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.queued
+}
+
+// Run method flushes the pending ips every flushInterval, and forgets ips
+// seen longer than the window ago, until ctx is done
+func (in *Ingester) Run(ctx context.Context) {
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			in.Flush()
+			return
+		case <-ticker.C:
+			in.Flush()
+			in.forget(time.Now().Add(-in.window))
+		}
+	}
+}
+
+// forget drops the ips last seen before t
+func (in *Ingester) forget(t time.Time) {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	for ip, last := range in.seen {
+		if last.Before(t) {
+			delete(in.seen, ip)
+		}
+	}
+}
+
+// Ingest method ingests the mail log at path, see Follow, or stdin, see
+// Read, if path is -
+func (in *Ingester) Ingest(ctx context.Context, path string, fromStart bool) error {
+	if path == "-" {
+		return in.Read(ctx, os.Stdin)
+	}
+	return in.Follow(ctx, path, fromStart)
+}
+
+// Read method ingests every line of r, e.g. stdin, until its end or ctx is
+// done
+func (in *Ingester) Read(ctx context.Context, r io.Reader) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if ctx.Err() != nil {
+			return nil
+		}
+		in.Line(scanner.Text())
+	}
+	return scanner.Err()
+}
+
+// Follow method ingests the lines appended to the file at path until ctx is
+// done, like `tail -F`: it starts at the end of the file, or its start if
+// fromStart, reopens the file when it is rotated and starts over when it is
+// truncated.
+func (in *Ingester) Follow(ctx context.Context, path string, fromStart bool) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { f.Close() }()
+	if !fromStart {
+		if _, err = f.Seek(0, io.SeekEnd); err != nil {
+			return err
+		}
+	}
+
+	br := bufio.NewReader(f)
+	var partial string
+	for {
+		if partial, err = in.readLines(br, partial); err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(pollInterval):
+		}
+
+		current, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(path)
+		if err != nil {
+			// rotated away and not created again yet
+			continue
+		}
+		if !os.SameFile(current, latest) {
+			rotated, err := os.Open(path)
+			if err != nil {
+				continue
+			}
+			// finish what was written before the rotation
+			if partial, err = in.readLines(br, partial); err != nil {
+				return err
+			}
+			if partial != "" {
+				in.Line(partial)
+				partial = ""
+			}
+			f.Close()
+			f = rotated
+			br.Reset(f)
+			continue
+		}
+		offset, err := f.Seek(0, io.SeekCurrent)
+		if err != nil {
+			return err
+		}
+		if latest.Size() < offset-int64(br.Buffered()) {
+			if _, err = f.Seek(0, io.SeekStart); err != nil {
+				return err
+			}
+			br.Reset(f)
+			partial = ""
+		}
+	}
+}
+
+// readLines ingests the complete lines left in br and returns the unfinished
+// last one, prefixed by partial
+func (in *Ingester) readLines(br *bufio.Reader, partial string) (string, error) {
+	for {
+		line, err := br.ReadString('\n')
+		partial += line
+		if err == io.EOF {
+			return partial, nil
+		}
+		if err != nil {
+			return partial, err
+		}
+		in.Line(partial)
+		partial = ""
+	}
+}
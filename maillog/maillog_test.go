@@ -0,0 +1,197 @@
+package maillog
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queue records the jobs an ingester queues
+type queue struct {
+	mu   sync.Mutex
+	jobs [][]string
+	err  error
+}
+
+func (q *queue) enqueue(ips []string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.err != nil {
+		return "", q.err
+	}
+	q.jobs = append(q.jobs, append([]string{}, ips...))
+	return fmt.Sprintf("job-%d", len(q.jobs)), nil
+}
+
+func (q *queue) ips() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var ips []string
+	for _, j := range q.jobs {
+		ips = append(ips, j...)
+	}
+	return ips
+}
+
+func TestExtract(t *testing.T) {
+	tests := []struct {
+		name string
+		line string
+		ip   string
+	}{
+		{"postfix_connect", "Dec  1 10:00:00 mx1 postfix/smtpd[1234]: connect from mail.example.com[192.0.2.1]", "192.0.2.1"},
+		{"postfix_connect_unknown", "Dec  1 10:00:00 mx1 postfix/submission/smtpd[1234]: connect from unknown[192.0.2.2]", "192.0.2.2"},
+		{"postfix_noqueue_reject", "Dec  1 10:00:01 mx1 postfix/smtpd[1234]: NOQUEUE: reject: RCPT from unknown[192.0.2.3]: 554 5.7.1 Service unavailable; Client host [192.0.2.3] blocked using zen.spamhaus.org; from=<a@example.com> to=<b@example.org> proto=ESMTP helo=<x>", "192.0.2.3"},
+		{"postfix_queued_reject", "Dec  1 10:00:01 mx1 postfix/smtpd[1234]: 4Cm3Xk1Z2Vz9vC: reject: RCPT from unknown[192.0.2.4]: 450 4.7.1 <b@example.org>: Recipient address rejected", "192.0.2.4"},
+		{"postscreen_connect", "Dec  1 10:00:00 mx1 postfix/postscreen[99]: CONNECT from [192.0.2.5]:51234 to [198.51.100.1]:25", "192.0.2.5"},
+		{"exim_connect", "2020-12-01 10:00:00 SMTP connection from mail.example.com [192.0.2.6]:51234 I=[198.51.100.1]:25 (TCP/IP connection count = 1)", "192.0.2.6"},
+		{"exim_connect_bare", "2020-12-01 10:00:00 SMTP connection from [192.0.2.7]:51234 (TCP/IP connection count = 2)", "192.0.2.7"},
+		{"exim_reject_rcpt", "2020-12-01 10:00:01 H=mail.example.com (helo.example.com) [192.0.2.8]:51234 F=<a@example.com> rejected RCPT <b@example.org>: relay not permitted", "192.0.2.8"},
+		{"exim_reject_helo_literal", "2020-12-01 10:00:01 H=([192.0.2.9]) [192.0.2.9]:51234 rejected connection in \"connect\" ACL", "192.0.2.9"},
+		{"exim_rejected_ehlo", "2020-12-01 10:00:01 rejected EHLO from [192.0.2.10]: syntactically invalid argument(s): _", "192.0.2.10"},
+		{"postfix_local_client", "Dec  1 10:00:00 mx1 postfix/smtpd[1234]: connect from localhost[127.0.0.1]", ""},
+		{"postfix_private_client", "Dec  1 10:00:00 mx1 postfix/smtpd[1234]: connect from relay[10.1.2.3]", ""},
+		{"postfix_ipv6_client", "Dec  1 10:00:00 mx1 postfix/smtpd[1234]: connect from unknown[2001:db8::1]", ""},
+		{"postfix_disconnect", "Dec  1 10:00:02 mx1 postfix/smtpd[1234]: disconnect from unknown[192.0.2.3] ehlo=1 mail=1 rcpt=0/1 quit=1 commands=3/4", ""},
+		{"exim_delivery", "2020-12-01 10:00:03 1kk0Xz-0001 <= a@example.com H=mail.example.com [192.0.2.8]:51234 P=esmtps S=1234", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ip, ok := Extract(test.line)
+			assert.Equal(t, test.ip != "", ok)
+			assert.Equal(t, test.ip, ip)
+		})
+	}
+}
+
+func TestIngester(t *testing.T) {
+	t.Run("dedupe_within_window", func(t *testing.T) {
+		q := &queue{}
+		in := NewIngester(q.enqueue, time.Hour)
+		assert.Equal(t, true, in.Line("postfix/smtpd[1]: connect from unknown[192.0.2.1]"))
+		assert.Equal(t, false, in.Line("postfix/smtpd[1]: NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 blocked"))
+		assert.Equal(t, false, in.Line("postfix/smtpd[1]: disconnect from unknown[192.0.2.1]"))
+		assert.Equal(t, true, in.Add("192.0.2.2"))
+		require.Equal(t, nil, in.Flush())
+		assert.Equal(t, [][]string{{"192.0.2.1", "192.0.2.2"}}, q.jobs)
+		assert.Equal(t, 2, in.Queued())
+
+		// seen longer than the window ago
+		in.forget(time.Now().Add(time.Minute))
+		assert.Equal(t, true, in.Add("192.0.2.1"))
+
+		in = NewIngester(q.enqueue, 0)
+		assert.Equal(t, true, in.Add("192.0.2.1"))
+		assert.Equal(t, true, in.Add("192.0.2.1"))
+	})
+
+	t.Run("full_batches_queue_straight_away", func(t *testing.T) {
+		q := &queue{}
+		in := NewIngester(q.enqueue, time.Hour)
+		for i := 0; i < batchSize+1; i++ {
+			in.Add(fmt.Sprintf("192.0.%d.%d", i/256, i%256))
+		}
+		require.Equal(t, 1, len(q.jobs))
+		assert.Equal(t, batchSize, len(q.jobs[0]))
+		require.Equal(t, nil, in.Flush())
+		assert.Equal(t, 2, len(q.jobs))
+		assert.Equal(t, []string{"192.0.1.244"}, q.jobs[1])
+	})
+
+	t.Run("full_queue_keeps_ips_pending", func(t *testing.T) {
+		q := &queue{err: errors.New("queue is full")}
+		in := NewIngester(q.enqueue, time.Hour)
+		in.Add("192.0.2.1")
+		assert.Equal(t, q.err, in.Flush())
+
+		q.err = nil
+		in.Add("192.0.2.2")
+		require.Equal(t, nil, in.Flush())
+		assert.Equal(t, [][]string{{"192.0.2.1", "192.0.2.2"}}, q.jobs)
+	})
+
+	t.Run("read", func(t *testing.T) {
+		q := &queue{}
+		in := NewIngester(q.enqueue, time.Hour)
+		log := strings.Join([]string{
+			"Dec  1 10:00:00 mx1 postfix/smtpd[1]: connect from unknown[192.0.2.1]",
+			"Dec  1 10:00:00 mx1 postfix/smtpd[1]: lost connection after CONNECT from unknown[192.0.2.1]",
+			"Dec  1 10:00:01 mx1 postfix/postscreen[2]: CONNECT from [192.0.2.2]:1234 to [198.51.100.1]:25",
+		}, "\n")
+		require.Equal(t, nil, in.Read(context.Background(), strings.NewReader(log)))
+		require.Equal(t, nil, in.Flush())
+		assert.Equal(t, []string{"192.0.2.1", "192.0.2.2"}, q.ips())
+	})
+
+	t.Run("follow_rotation_and_truncation", func(t *testing.T) {
+		pollInterval = 10 * time.Millisecond
+		defer func() { pollInterval = time.Second }()
+
+		dir, err := ioutil.TempDir("", "maillog")
+		require.Equal(t, nil, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "mail.log")
+		appendLine := func(line string) {
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			require.Equal(t, nil, err)
+			f.WriteString(line)
+			f.Close()
+		}
+		connect := func(ip string) string {
+			return "postfix/smtpd[1]: connect from unknown[" + ip + "]\n"
+		}
+		waitFor := func(q *queue, in *Ingester, ips ...string) {
+			deadline := time.Now().Add(2 * time.Second)
+			for time.Now().Before(deadline) {
+				in.Flush()
+				if len(q.ips()) >= len(ips) {
+					break
+				}
+				time.Sleep(5 * time.Millisecond)
+			}
+			assert.Equal(t, ips, q.ips())
+		}
+
+		// lines from before Follow started are skipped
+		appendLine(connect("192.0.2.1"))
+
+		q := &queue{}
+		in := NewIngester(q.enqueue, time.Hour)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- in.Follow(ctx, path, false) }()
+		time.Sleep(30 * time.Millisecond)
+
+		// a line written in two parts is read once it is complete
+		appendLine("postfix/smtpd[1]: connect from unknown[192.0.2.2")
+		time.Sleep(30 * time.Millisecond)
+		appendLine("]\n")
+		waitFor(q, in, "192.0.2.2")
+
+		// lines written just before the rotation are still read
+		appendLine(connect("192.0.2.3"))
+		require.Equal(t, nil, os.Rename(path, path+".1"))
+		appendLine(connect("192.0.2.4"))
+		waitFor(q, in, "192.0.2.2", "192.0.2.3", "192.0.2.4")
+
+		require.Equal(t, nil, os.Truncate(path, 0))
+		time.Sleep(30 * time.Millisecond)
+		appendLine(connect("192.0.2.5"))
+		waitFor(q, in, "192.0.2.2", "192.0.2.3", "192.0.2.4", "192.0.2.5")
+
+		cancel()
+		assert.Equal(t, nil, <-done)
+
+		assert.NotEqual(t, nil, in.Follow(context.Background(), filepath.Join(dir, "missing.log"), true))
+	})
+}
@@ -2,9 +2,11 @@ package middleware
 
 import (
 	"context"
+	"errors"
 	"net/http"
 	"strings"
 
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/alexanderkarlis/sw-dnsbl/auth"
 )
 
@@ -41,8 +43,7 @@ func Middleware() func(http.Handler) http.Handler {
 				return
 			}
 
-			ctx := context.WithValue(r.Context(), contextTokenKey, tokenString)
-			r = r.WithContext(ctx)
+			r = r.WithContext(WithToken(r.Context(), tokenString))
 
 			next.ServeHTTP(w, r)
 		})
@@ -54,3 +55,37 @@ func GetTokenFromContext(ctx context.Context) string {
 	tokenString, _ := ctx.Value(contextTokenKey).(string)
 	return tokenString
 }
+
+// WebsocketInit is the gqlgen websocket InitFunc. Browsers can't set headers on
+// a websocket upgrade, so subscriptions send the bearer token as
+// `Authorization` in the connection_init payload instead.
+func WebsocketInit(ctx context.Context, initPayload transport.InitPayload) (context.Context, error) {
+	tokenString := strings.Replace(initPayload.Authorization(), "Bearer ", "", 1)
+	if tokenString == "" {
+		return ctx, errors.New("missing auth token")
+	}
+
+	_, err := auth.ValidateToken(tokenString)
+	if err != nil {
+		return ctx, errors.New("not an authorized token")
+	}
+	return WithToken(ctx, tokenString), nil
+}
+
+// WithToken func returns a copy of ctx carrying a validated token
+func WithToken(ctx context.Context, tokenString string) context.Context {
+	return context.WithValue(ctx, contextTokenKey, tokenString)
+}
+
+// RequireAuth wraps handlers outside of graphql that need a validated token,
+// it must run after Middleware has put the token on the request context
+func RequireAuth(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if GetTokenFromContext(r.Context()) == "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte("Missing Authorization Header"))
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
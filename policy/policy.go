@@ -0,0 +1,145 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+)
+
+// idleTimeout is how long postfix may keep a connection open between requests
+const idleTimeout = 5 * time.Minute
+
+// Postfix policy actions, see http://www.postfix.org/access.5.html
+const (
+	ActionReject = "REJECT"
+	ActionDefer  = "DEFER"
+	ActionDunno  = "DUNNO"
+)
+
+// Server speaks the postfix policy delegation protocol
+// (http://www.postfix.org/SMTPD_POLICY_README.html). Each request's
+// client_address is checked like the checkIP query, and the score of the lists
+// listing it decides between REJECT, DEFER and DUNNO.
+type Server struct {
+	consumer    *dnsbl.Consumer
+	weights     map[string]int
+	rejectScore int
+	deferScore  int
+	timeout     time.Duration
+}
+
+// NewServer function returns a policy server using the configured
+// POLICY_REJECT_SCORE, POLICY_DEFER_SCORE and LIST_WEIGHTS
+func NewServer(consumer *dnsbl.Consumer, c *config.APIConfig) *Server {
+	return &Server{
+		consumer:    consumer,
+		weights:     c.ListWeights,
+		rejectScore: c.PolicyRejectScore,
+		deferScore:  c.PolicyDeferScore,
+		timeout:     dnsbl.DefaultCheckTimeout,
+	}
+}
+
+// ListenAndServe function listens on the tcp addr and serves policy requests
+// until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("serving postfix policy requests on %s\n", addr)
+	return s.Serve(ctx, l)
+}
+
+// Serve function accepts connections on l until ctx is done
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serveConn answers the requests postfix sends on a connection, one
+// `name=value` attribute per line and an empty line ending each request
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+
+	r := bufio.NewReader(conn)
+	attrs := map[string]string{}
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		line = strings.TrimRight(line, "\r\n")
+		if line != "" {
+			if i := strings.Index(line, "="); i > 0 {
+				attrs[line[:i]] = line[i+1:]
+			}
+			continue
+		}
+		if len(attrs) == 0 {
+			continue
+		}
+
+		if _, err = fmt.Fprintf(conn, "action=%s\n\n", s.Action(ctx, attrs)); err != nil {
+			return
+		}
+		attrs = map[string]string{}
+	}
+}
+
+// Action function returns the reply to a single policy request. Anything that
+// can't be checked, like IPv6 clients or lookup failures, is DUNNO so mail
+// keeps flowing when the service can't give a verdict.
+func (s *Server) Action(ctx context.Context, attrs map[string]string) string {
+	ip := attrs["client_address"]
+	if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+		return ActionDunno
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.timeout)
+	defer cancel()
+	results, err := s.consumer.CheckIP(ctx, ip, nil)
+	if err != nil {
+		log.Printf("policy check of %s failed: %s\n", ip, err)
+		return ActionDunno
+	}
+
+	var lists []string
+	for _, r := range results {
+		if r != nil && r.Listed {
+			lists = append(lists, r.Blocklist)
+		}
+	}
+	score := dnsbl.Score(results, s.weights)
+	reason := fmt.Sprintf("client [%s] blocked using %s", ip, strings.Join(lists, ", "))
+
+	switch {
+	case s.rejectScore > 0 && score >= s.rejectScore:
+		return ActionReject + " " + reason
+	case s.deferScore > 0 && score >= s.deferScore:
+		return ActionDefer + " " + reason
+	}
+	return ActionDunno
+}
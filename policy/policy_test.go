@@ -0,0 +1,106 @@
+package policy
+
+import (
+	"bufio"
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestPolicyServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "policy")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	conf := &config.APIConfig{
+		DbPath:            filepath.Join(dir, "swdnsbl.db"),
+		PersistDb:         true,
+		WorkerPoolsize:    10,
+		CacheTTL:          3600,
+		QueuePolicy:       config.QueuePolicyReject,
+		DNSBlockList:      []string{"zen.spamhaus.org", "bl.spamcop.net"},
+		ListWeights:       map[string]int{"zen.spamhaus.org": 2},
+		PolicyRejectScore: 3,
+		PolicyDeferScore:  2,
+	}
+	db, err := database.NewDb(conf)
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	// every ip is stored for both lists so no live lookups happen
+	now := int(time.Now().Unix())
+	listed := map[string][]string{
+		"127.0.0.4":  {"zen.spamhaus.org", "bl.spamcop.net"},
+		"127.0.0.10": {"zen.spamhaus.org"},
+		"127.0.0.3":  {"bl.spamcop.net"},
+		"127.0.0.1":  nil,
+	}
+	for ip, lists := range listed {
+		for _, list := range conf.DNSBlockList {
+			r := &model.ListResult{IPAddress: ip, Blocklist: list, ResponseCode: "NXDOMAIN", CheckedAt: now}
+			for _, l := range lists {
+				if l == list {
+					r.Listed = true
+					r.ResponseCode = "127.0.0.2"
+				}
+			}
+			require.Equal(t, nil, db.UpsertListResult(r))
+		}
+	}
+
+	server := NewServer(dnsbl.NewConsumer(db, conf), conf)
+
+	t.Run("actions", func(t *testing.T) {
+		ctx := context.Background()
+		assert.Equal(t, "REJECT client [127.0.0.4] blocked using zen.spamhaus.org, bl.spamcop.net",
+			server.Action(ctx, map[string]string{"client_address": "127.0.0.4"}))
+		assert.Equal(t, "DEFER client [127.0.0.10] blocked using zen.spamhaus.org",
+			server.Action(ctx, map[string]string{"client_address": "127.0.0.10"}))
+		assert.Equal(t, ActionDunno, server.Action(ctx, map[string]string{"client_address": "127.0.0.3"}))
+		assert.Equal(t, ActionDunno, server.Action(ctx, map[string]string{"client_address": "127.0.0.1"}))
+		assert.Equal(t, ActionDunno, server.Action(ctx, map[string]string{"client_address": "::1"}))
+		assert.Equal(t, ActionDunno, server.Action(ctx, map[string]string{}))
+	})
+
+	t.Run("protocol", func(t *testing.T) {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Equal(t, nil, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go server.Serve(ctx, l)
+
+		conn, err := net.Dial("tcp", l.Addr().String())
+		require.Equal(t, nil, err)
+		defer conn.Close()
+		r := bufio.NewReader(conn)
+
+		// postfix reuses a connection for several requests
+		for ip, want := range map[string]string{
+			"127.0.0.4": "action=REJECT client [127.0.0.4] blocked using zen.spamhaus.org, bl.spamcop.net",
+			"127.0.0.1": "action=DUNNO",
+		} {
+			_, err = conn.Write([]byte("request=smtpd_access_policy\nprotocol_state=RCPT\nclient_address=" + ip + "\n\n"))
+			require.Equal(t, nil, err)
+
+			line, err := r.ReadString('\n')
+			require.Equal(t, nil, err)
+			assert.Equal(t, want, strings.TrimSpace(line))
+			line, err = r.ReadString('\n')
+			require.Equal(t, nil, err)
+			assert.Equal(t, "\n", line)
+		}
+	})
+}
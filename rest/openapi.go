@@ -0,0 +1,140 @@
+package rest
+
+import "net/http"
+
+// openAPIDocument describes the /v1 endpoints, keep it in step with rest.go
+const openAPIDocument = `{
+  "openapi": "3.0.3",
+  "info": {
+    "title": "sw-dnsbl",
+    "description": "REST/JSON API for looking up and queueing DNS blocklist checks. Get a bearer token from the GraphQL createToken mutation.",
+    "version": "1.0.0"
+  },
+  "servers": [{"url": "/v1"}],
+  "security": [{"bearerAuth": []}],
+  "paths": {
+    "/ips/{ip}": {
+      "get": {
+        "summary": "Stored details and per list results of an IP address",
+        "operationId": "getIP",
+        "parameters": [
+          {"name": "ip", "in": "path", "required": true, "schema": {"type": "string", "format": "ipv4"}}
+        ],
+        "responses": {
+          "200": {"description": "The IP address has been checked", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/IPDetails"}}}},
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    },
+    "/jobs": {
+      "post": {
+        "summary": "Queue IP addresses to be checked against the blocklists",
+        "operationId": "createJob",
+        "requestBody": {
+          "required": true,
+          "content": {"application/json": {"schema": {"$ref": "#/components/schemas/JobRequest"}}}
+        },
+        "responses": {
+          "202": {
+            "description": "The job was queued",
+            "headers": {"Location": {"schema": {"type": "string"}, "description": "URL of the job"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}
+          },
+          "400": {"$ref": "#/components/responses/Error"},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "503": {
+            "description": "The queue is full, code is QUEUE_FULL",
+            "headers": {"Retry-After": {"schema": {"type": "integer"}, "description": "Seconds until there is likely room"}},
+            "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}
+          }
+        }
+      }
+    },
+    "/jobs/{id}": {
+      "get": {
+        "summary": "Progress of a queued job",
+        "operationId": "getJob",
+        "parameters": [
+          {"name": "id", "in": "path", "required": true, "schema": {"type": "string"}}
+        ],
+        "responses": {
+          "200": {"description": "The job", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Job"}}}},
+          "401": {"$ref": "#/components/responses/Unauthorized"},
+          "404": {"$ref": "#/components/responses/Error"}
+        }
+      }
+    }
+  },
+  "components": {
+    "securitySchemes": {
+      "bearerAuth": {"type": "http", "scheme": "bearer", "bearerFormat": "JWT"}
+    },
+    "responses": {
+      "Error": {"description": "The request failed", "content": {"application/json": {"schema": {"$ref": "#/components/schemas/Error"}}}},
+      "Unauthorized": {"description": "Missing or invalid bearer token", "content": {"text/plain": {"schema": {"type": "string"}}}}
+    },
+    "schemas": {
+      "IPDetails": {
+        "type": "object",
+        "properties": {
+          "uuid": {"type": "string"},
+          "ip_address": {"type": "string"},
+          "response_code": {"type": "string", "description": "NXDOMAIN, or the A record of the last list checked"},
+          "created_at": {"type": "integer", "description": "Unix time"},
+          "updated_at": {"type": "integer", "description": "Unix time"},
+          "error": {"type": "string", "nullable": true, "description": "Why the last lookup failed, null if it succeeded"},
+          "results": {"type": "array", "items": {"$ref": "#/components/schemas/ListResult"}}
+        }
+      },
+      "ListResult": {
+        "type": "object",
+        "properties": {
+          "ip_address": {"type": "string"},
+          "blocklist": {"type": "string"},
+          "listed": {"type": "boolean"},
+          "response_code": {"type": "string"},
+          "reason": {"type": "string", "nullable": true},
+          "category": {"type": "string", "enum": ["spam", "exploit", "proxy", "policy", "local", "other", ""]},
+          "error": {"type": "string", "nullable": true},
+          "cached": {"type": "boolean"},
+          "checked_at": {"type": "integer", "description": "Unix time"}
+        }
+      },
+      "JobRequest": {
+        "type": "object",
+        "required": ["ips"],
+        "properties": {
+          "ips": {"type": "array", "minItems": 1, "items": {"type": "string", "format": "ipv4"}}
+        }
+      },
+      "Job": {
+        "type": "object",
+        "properties": {
+          "id": {"type": "string"},
+          "state": {"type": "string", "enum": ["queued", "spilled", "running", "done"]},
+          "ips": {"type": "array", "items": {"type": "string"}},
+          "checked": {"type": "integer", "description": "IP addresses checked so far"},
+          "created_at": {"type": "integer", "description": "Unix time"},
+          "finished_at": {"type": "integer", "description": "Unix time, set once done"}
+        }
+      },
+      "Error": {
+        "type": "object",
+        "properties": {
+          "error": {"type": "string"},
+          "code": {"type": "string"},
+          "retry_after": {"type": "integer"}
+        }
+      }
+    }
+  }
+}
+`
+
+// OpenAPI function serves the OpenAPI document of the /v1 endpoints
+func OpenAPI(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Write([]byte(openAPIDocument))
+}
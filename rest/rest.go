@@ -0,0 +1,145 @@
+package rest
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+)
+
+// API serves the REST/JSON endpoints under /v1, backed by the same database
+// and consumer as the GraphQL resolvers
+type API struct {
+	Database database.Store
+	Consumer *dnsbl.Consumer
+}
+
+// ipDetails is the body of GET /v1/ips/{ip}, the stored record plus the
+// result of each list
+type ipDetails struct {
+	*model.Record
+	Results []*model.ListResult `json:"results"`
+}
+
+// jobRequest is the body of POST /v1/jobs
+type jobRequest struct {
+	IPs []string `json:"ips"`
+}
+
+// apiError is the body of every error response
+type apiError struct {
+	Error      string `json:"error"`
+	Code       string `json:"code,omitempty"`
+	RetryAfter int    `json:"retry_after,omitempty"`
+}
+
+// Register function adds the /v1 routes to router. Everything but the OpenAPI
+// document needs a bearer token, so router must already use
+// middleware.Middleware.
+func (a *API) Register(router *mux.Router) {
+	v1 := router.PathPrefix("/v1").Subrouter()
+	v1.HandleFunc("/openapi.json", OpenAPI).Methods(http.MethodGet)
+	v1.Handle("/ips/{ip}", middleware.RequireAuth(http.HandlerFunc(a.getIP))).Methods(http.MethodGet)
+	v1.Handle("/jobs", middleware.RequireAuth(http.HandlerFunc(a.createJob))).Methods(http.MethodPost)
+	v1.Handle("/jobs/{id}", middleware.RequireAuth(http.HandlerFunc(a.getJob))).Methods(http.MethodGet)
+}
+
+// getIP serves GET /v1/ips/{ip}, the REST version of getIPDetails
+func (a *API) getIP(w http.ResponseWriter, r *http.Request) {
+	ip := mux.Vars(r)["ip"]
+	if !isIPv4(ip) {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("%s is not an IPv4 address", ip)})
+		return
+	}
+
+	record, err := a.Database.QueryRecord(ip)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("rest query of %s failed: %s\n", ip, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "could not read ip details"})
+		return
+	}
+	results, err := a.Database.QueryListResults(ip)
+	if err != nil {
+		log.Printf("rest query of %s failed: %s\n", ip, err)
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: "could not read ip details"})
+		return
+	}
+	if record == nil && len(results) == 0 {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("%s has not been checked", ip)})
+		return
+	}
+	writeJSON(w, http.StatusOK, ipDetails{Record: record, Results: results})
+}
+
+// createJob serves POST /v1/jobs, the REST version of enqueueJob
+func (a *API) createJob(w http.ResponseWriter, r *http.Request) {
+	var req jobRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "body must be a json object with an `ips` array"})
+		return
+	}
+	if len(req.IPs) == 0 {
+		writeJSON(w, http.StatusBadRequest, apiError{Error: "no ips given"})
+		return
+	}
+	for _, ip := range req.IPs {
+		if !isIPv4(ip) {
+			writeJSON(w, http.StatusBadRequest, apiError{Error: fmt.Sprintf("%s is not an IPv4 address", ip)})
+			return
+		}
+	}
+
+	id, err := a.Consumer.QueueJob(req.IPs)
+	if err == dnsbl.ErrQueueFull {
+		retryAfter := int(a.Consumer.RetryAfter().Seconds())
+		w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+		writeJSON(w, http.StatusServiceUnavailable, apiError{Error: err.Error(), Code: "QUEUE_FULL", RetryAfter: retryAfter})
+		return
+	}
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, apiError{Error: fmt.Sprintf("could not queue job: %s", err)})
+		return
+	}
+
+	status, ok := a.Consumer.Job(id)
+	if !ok {
+		status = &dnsbl.JobStatus{ID: id, State: dnsbl.JobQueued, IPs: req.IPs}
+	}
+	w.Header().Set("Location", "/v1/jobs/"+id)
+	writeJSON(w, http.StatusAccepted, status)
+}
+
+// getJob serves GET /v1/jobs/{id}
+func (a *API) getJob(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	status, ok := a.Consumer.Job(id)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{Error: fmt.Sprintf("job %s not found", id)})
+		return
+	}
+	writeJSON(w, http.StatusOK, status)
+}
+
+// writeJSON writes v as the json body of a status response
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Println("writing rest response failed!", err)
+	}
+}
+
+func isIPv4(ip string) bool {
+	addr := net.ParseIP(ip)
+	return addr != nil && addr.To4() != nil
+}
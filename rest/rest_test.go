@@ -0,0 +1,126 @@
+package rest
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/auth"
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+)
+
+func TestRestAPI(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rest")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	// no blocklists, so jobs finish without any lookups
+	conf := &config.APIConfig{
+		DbPath:         filepath.Join(dir, "swdnsbl.db"),
+		PersistDb:      true,
+		WorkerPoolsize: 10,
+		QueuePolicy:    config.QueuePolicyReject,
+	}
+	db, err := database.NewDb(conf)
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	now := int(time.Now().Unix())
+	require.Equal(t, nil, db.UpsertRecord(&model.Record{UUID: "uuid", IPAddress: "127.0.0.2", ResponseCode: "127.0.0.2", CreatedAt: now, UpdatedAt: now}))
+	require.Equal(t, nil, db.UpsertListResult(&model.ListResult{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", Category: dnsbl.CategorySpam, CheckedAt: now}))
+
+	router := mux.NewRouter()
+	router.Use(middleware.Middleware())
+	api := &API{Database: db, Consumer: dnsbl.NewConsumer(db, conf)}
+	api.Register(router)
+
+	token, err := auth.CreateJWT("secureworks", "supersecret", 5)
+	require.Equal(t, nil, err)
+
+	do := func(method, path, body string, authorized bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if authorized {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("no_auth", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnauthorized, do("GET", "/v1/ips/127.0.0.2", "", false).Code)
+		assert.Equal(t, http.StatusUnauthorized, do("POST", "/v1/jobs", `{"ips": ["127.0.0.2"]}`, false).Code)
+		assert.Equal(t, http.StatusUnauthorized, do("GET", "/v1/jobs/nope", "", false).Code)
+	})
+
+	t.Run("get_ip", func(t *testing.T) {
+		rec := do("GET", "/v1/ips/127.0.0.2", "", true)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var resp struct {
+			IPAddress    string `json:"ip_address"`
+			ResponseCode string `json:"response_code"`
+			Results      []model.ListResult
+		}
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &resp))
+		assert.Equal(t, "127.0.0.2", resp.IPAddress)
+		assert.Equal(t, "127.0.0.2", resp.ResponseCode)
+		require.Equal(t, 1, len(resp.Results))
+		assert.Equal(t, dnsbl.CategorySpam, resp.Results[0].Category)
+
+		assert.Equal(t, http.StatusNotFound, do("GET", "/v1/ips/127.0.0.80", "", true).Code)
+		assert.Equal(t, http.StatusBadRequest, do("GET", "/v1/ips/nope", "", true).Code)
+	})
+
+	t.Run("create_and_get_job", func(t *testing.T) {
+		rec := do("POST", "/v1/jobs", `{"ips": ["127.0.0.2", "127.0.0.3"]}`, true)
+		require.Equal(t, http.StatusAccepted, rec.Code)
+		var job dnsbl.JobStatus
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &job))
+		assert.NotEqual(t, "", job.ID)
+		assert.Equal(t, "/v1/jobs/"+job.ID, rec.Header().Get("Location"))
+
+		require.Eventually(t, func() bool {
+			rec = do("GET", "/v1/jobs/"+job.ID, "", true)
+			json.Unmarshal(rec.Body.Bytes(), &job)
+			return rec.Code == http.StatusOK && job.State == dnsbl.JobDone
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Equal(t, 2, job.Checked)
+		assert.Equal(t, []string{"127.0.0.2", "127.0.0.3"}, job.IPs)
+
+		assert.Equal(t, http.StatusNotFound, do("GET", "/v1/jobs/nope", "", true).Code)
+	})
+
+	t.Run("create_job_bad_request", func(t *testing.T) {
+		assert.Equal(t, http.StatusBadRequest, do("POST", "/v1/jobs", `not json`, true).Code)
+		assert.Equal(t, http.StatusBadRequest, do("POST", "/v1/jobs", `{"ips": []}`, true).Code)
+		assert.Equal(t, http.StatusBadRequest, do("POST", "/v1/jobs", `{"ips": ["nope"]}`, true).Code)
+	})
+
+	t.Run("openapi_document", func(t *testing.T) {
+		rec := do("GET", "/v1/openapi.json", "", false)
+		require.Equal(t, http.StatusOK, rec.Code)
+		var doc struct {
+			OpenAPI string                 `json:"openapi"`
+			Paths   map[string]interface{} `json:"paths"`
+		}
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &doc))
+		assert.Equal(t, "3.0.3", doc.OpenAPI)
+		for _, path := range []string{"/ips/{ip}", "/jobs", "/jobs/{id}"} {
+			assert.Contains(t, doc.Paths, path)
+		}
+	})
+}
@@ -0,0 +1,132 @@
+package retention
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+const day = 24 * time.Hour
+
+// metrics are the totals of every pruner in the process, served with the
+// other expvars on /metrics
+var metrics = expvar.NewMap("retention")
+
+// Pruner keeps the database from growing forever: it deletes the clean
+// records not rechecked within RECORD_RETENTION_DAYS, rolls the lookups
+// older than HISTORY_RETENTION_DAYS up into daily summaries and drops the ips
+// of the summaries older than DAILY_IPS_RETENTION_DAYS
+type Pruner struct {
+	db           database.Store
+	recordDays   int
+	historyDays  int
+	dailyIPsDays int
+	interval     time.Duration
+
+	// running keeps runs from overlapping, mu guards status
+	running sync.Mutex
+	mu      sync.Mutex
+	status  model.PruneStatus
+}
+
+// NewPruner function returns a pruner of db with the retention settings of c
+func NewPruner(db database.Store, c *config.APIConfig) *Pruner {
+	return &Pruner{
+		db:           db,
+		recordDays:   c.RecordRetentionDays,
+		historyDays:  c.HistoryRetentionDays,
+		dailyIPsDays: c.DailyIPsRetentionDays,
+		interval:     time.Duration(c.PruneInterval) * time.Second,
+		status: model.PruneStatus{
+			RecordRetentionDays:   c.RecordRetentionDays,
+			HistoryRetentionDays:  c.HistoryRetentionDays,
+			DailyIpsRetentionDays: c.DailyIPsRetentionDays,
+			IntervalSeconds:       c.PruneInterval,
+		},
+	}
+}
+
+// Run method prunes every PRUNE_INTERVAL until ctx is done. It returns
+// straight away if the interval is 0, leaving pruning to Prune.
+func (p *Pruner) Run(ctx context.Context) {
+	if p.interval <= 0 {
+		return
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			p.Prune()
+		}
+	}
+}
+
+// Prune method runs the pruner once, waiting for a run already going to
+// finish first, and returns what it removed. A retention of 0 days skips
+// that part.
+func (p *Pruner) Prune() (*model.PruneResult, error) {
+	p.running.Lock()
+	defer p.running.Unlock()
+
+	start := time.Now()
+	result := &model.PruneResult{StartedAt: int(start.Unix())}
+
+	var err error
+	if p.recordDays > 0 {
+		before := start.Add(-time.Duration(p.recordDays) * day)
+		result.RecordsRemoved, err = p.db.PruneRecords(int(before.Unix()))
+	}
+	if err == nil && p.historyDays > 0 {
+		before := start.Add(-time.Duration(p.historyDays) * day)
+		result.HistoryCompacted, err = p.db.CompactHistory(int(before.Unix()))
+	}
+	if err == nil && p.dailyIPsDays > 0 {
+		before := start.Add(-time.Duration(p.dailyIPsDays) * day)
+		result.DailyIpsRemoved, err = p.db.PruneDailyIPs(int(before.Unix()))
+	}
+	result.DurationMs = int(time.Since(start) / time.Millisecond)
+
+	metrics.Add("runs", 1)
+	metrics.Add("records_removed", int64(result.RecordsRemoved))
+	metrics.Add("history_compacted", int64(result.HistoryCompacted))
+	metrics.Add("daily_ips_removed", int64(result.DailyIpsRemoved))
+	if err != nil {
+		metrics.Add("failures", 1)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.status.Runs++
+	// a failed run may still have removed some records
+	p.status.RecordsRemoved += result.RecordsRemoved
+	p.status.HistoryCompacted += result.HistoryCompacted
+	p.status.DailyIpsRemoved += result.DailyIpsRemoved
+	if err != nil {
+		log.Println("pruning failed!", err)
+		msg := err.Error()
+		p.status.LastError = &msg
+		return nil, err
+	}
+	log.Printf("pruned %d records, compacted %d lookups and removed %d daily ips in %dms\n", result.RecordsRemoved, result.HistoryCompacted, result.DailyIpsRemoved, result.DurationMs)
+	p.status.LastError = nil
+	p.status.LastRun = result
+	return result, nil
+}
+
+// Status method returns the retention settings and what the runs so far
+// removed
+func (p *Pruner) Status() *model.PruneStatus {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	status := p.status
+	return &status
+}
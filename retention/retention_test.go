@@ -0,0 +1,112 @@
+package retention
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestPruner(t *testing.T) {
+	db := database.NewMemory()
+	defer db.Close()
+
+	now := int(time.Now().Unix())
+	old := now - 100*24*60*60
+	for _, r := range []*model.Record{
+		{IPAddress: "127.0.0.1", UUID: "uuid-1", ResponseCode: "NXDOMAIN", CreatedAt: old, UpdatedAt: old},
+		{IPAddress: "127.0.0.2", UUID: "uuid-2", ResponseCode: "127.0.0.2", CreatedAt: old, UpdatedAt: old},
+		{IPAddress: "127.0.0.3", UUID: "uuid-3", ResponseCode: "NXDOMAIN", CreatedAt: old, UpdatedAt: now},
+	} {
+		require.Equal(t, nil, db.UpsertRecord(r))
+	}
+	for _, r := range []*model.ListResult{
+		{IPAddress: "127.0.0.1", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN", CheckedAt: old},
+		{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", CheckedAt: old},
+		{IPAddress: "127.0.0.3", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN", CheckedAt: now},
+	} {
+		require.Equal(t, nil, db.UpsertListResult(r))
+	}
+
+	t.Run("retention_disabled", func(t *testing.T) {
+		p := NewPruner(db, &config.APIConfig{})
+		result, err := p.Prune()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, result.RecordsRemoved)
+		assert.Equal(t, 0, result.HistoryCompacted)
+
+		// without an interval there is no background pruning
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		p.Run(ctx)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		p := NewPruner(db, &config.APIConfig{RecordRetentionDays: 90, HistoryRetentionDays: 30, DailyIPsRetentionDays: 60, PruneInterval: 3600})
+		result, err := p.Prune()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, result.RecordsRemoved)
+		assert.Equal(t, 2, result.HistoryCompacted)
+		assert.Equal(t, 2, result.DailyIpsRemoved)
+
+		_, err = db.QueryRecord("127.0.0.1")
+		assert.NotEqual(t, nil, err)
+		for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+			_, err = db.QueryRecord(ip)
+			assert.Equal(t, nil, err, ip)
+		}
+		history, err := db.QueryHistory("127.0.0.3")
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, len(history))
+		summaries, err := db.QueryDailySummaries(0, 0)
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, len(summaries))
+		// the old day keeps its counts, but no longer its ips
+		stats, err := db.QueryStats(database.StatsQuery{To: old})
+		require.Equal(t, nil, err)
+		assert.Equal(t, []*database.Stats{{Lookups: 2, Listed: 1}}, stats)
+
+		result, err = p.Prune()
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, result.RecordsRemoved)
+
+		status := p.Status()
+		assert.Equal(t, 2, status.Runs)
+		assert.Equal(t, 1, status.RecordsRemoved)
+		assert.Equal(t, 2, status.HistoryCompacted)
+		assert.Equal(t, 2, status.DailyIpsRemoved)
+		assert.Equal(t, result, status.LastRun)
+		assert.Equal(t, (*string)(nil), status.LastError)
+		assert.Equal(t, 90, status.RecordRetentionDays)
+		assert.Equal(t, 30, status.HistoryRetentionDays)
+		assert.Equal(t, 60, status.DailyIpsRetentionDays)
+		assert.Equal(t, 3600, status.IntervalSeconds)
+
+		// the metrics count the runs of every pruner
+		assert.Equal(t, "3", metrics.Get("runs").String())
+		assert.Equal(t, "1", metrics.Get("records_removed").String())
+		assert.Equal(t, "2", metrics.Get("history_compacted").String())
+		assert.Equal(t, "2", metrics.Get("daily_ips_removed").String())
+	})
+
+	t.Run("prune_error", func(t *testing.T) {
+		closed := database.NewMemory()
+		closed.Close()
+
+		p := NewPruner(closed, &config.APIConfig{RecordRetentionDays: 90})
+		_, err := p.Prune()
+		assert.NotEqual(t, nil, err)
+		status := p.Status()
+		assert.Equal(t, 1, status.Runs)
+		require.NotEqual(t, (*string)(nil), status.LastError)
+		assert.Equal(t, err.Error(), *status.LastError)
+		assert.Equal(t, (*model.PruneResult)(nil), status.LastRun)
+		assert.Equal(t, "1", metrics.Get("failures").String())
+	})
+}
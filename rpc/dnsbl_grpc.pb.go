@@ -0,0 +1,247 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+
+package rpc
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+const _ = grpc.SupportPackageIsVersion7
+
+// DNSBLClient is the client API for DNSBL service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type DNSBLClient interface {
+	// Check checks a single IP address right away, like the checkIP query.
+	Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error)
+	// CheckBulk checks many IP addresses and streams each result as soon as it
+	// is ready, so not in request order.
+	CheckBulk(ctx context.Context, in *CheckBulkRequest, opts ...grpc.CallOption) (DNSBL_CheckBulkClient, error)
+	// Enqueue queues IP addresses to be checked in the background, like the
+	// enqueueJob mutation. A full queue is RESOURCE_EXHAUSTED with a
+	// `retry-after` header in seconds.
+	Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error)
+	// GetJob returns the progress of an enqueued job.
+	GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error)
+}
+
+type dNSBLClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewDNSBLClient(cc grpc.ClientConnInterface) DNSBLClient {
+	return &dNSBLClient{cc}
+}
+
+func (c *dNSBLClient) Check(ctx context.Context, in *CheckRequest, opts ...grpc.CallOption) (*CheckResponse, error) {
+	out := new(CheckResponse)
+	err := c.cc.Invoke(ctx, "/swdnsbl.v1.DNSBL/Check", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dNSBLClient) CheckBulk(ctx context.Context, in *CheckBulkRequest, opts ...grpc.CallOption) (DNSBL_CheckBulkClient, error) {
+	stream, err := c.cc.NewStream(ctx, &_DNSBL_serviceDesc.Streams[0], "/swdnsbl.v1.DNSBL/CheckBulk", opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &dNSBLCheckBulkClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type DNSBL_CheckBulkClient interface {
+	Recv() (*CheckResponse, error)
+	grpc.ClientStream
+}
+
+type dNSBLCheckBulkClient struct {
+	grpc.ClientStream
+}
+
+func (x *dNSBLCheckBulkClient) Recv() (*CheckResponse, error) {
+	m := new(CheckResponse)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (c *dNSBLClient) Enqueue(ctx context.Context, in *EnqueueRequest, opts ...grpc.CallOption) (*EnqueueResponse, error) {
+	out := new(EnqueueResponse)
+	err := c.cc.Invoke(ctx, "/swdnsbl.v1.DNSBL/Enqueue", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *dNSBLClient) GetJob(ctx context.Context, in *GetJobRequest, opts ...grpc.CallOption) (*Job, error) {
+	out := new(Job)
+	err := c.cc.Invoke(ctx, "/swdnsbl.v1.DNSBL/GetJob", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DNSBLServer is the server API for DNSBL service.
+// All implementations must embed UnimplementedDNSBLServer
+// for forward compatibility
+type DNSBLServer interface {
+	// Check checks a single IP address right away, like the checkIP query.
+	Check(context.Context, *CheckRequest) (*CheckResponse, error)
+	// CheckBulk checks many IP addresses and streams each result as soon as it
+	// is ready, so not in request order.
+	CheckBulk(*CheckBulkRequest, DNSBL_CheckBulkServer) error
+	// Enqueue queues IP addresses to be checked in the background, like the
+	// enqueueJob mutation. A full queue is RESOURCE_EXHAUSTED with a
+	// `retry-after` header in seconds.
+	Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error)
+	// GetJob returns the progress of an enqueued job.
+	GetJob(context.Context, *GetJobRequest) (*Job, error)
+	mustEmbedUnimplementedDNSBLServer()
+}
+
+// UnimplementedDNSBLServer must be embedded to have forward compatible implementations.
+type UnimplementedDNSBLServer struct {
+}
+
+func (UnimplementedDNSBLServer) Check(context.Context, *CheckRequest) (*CheckResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Check not implemented")
+}
+func (UnimplementedDNSBLServer) CheckBulk(*CheckBulkRequest, DNSBL_CheckBulkServer) error {
+	return status.Errorf(codes.Unimplemented, "method CheckBulk not implemented")
+}
+func (UnimplementedDNSBLServer) Enqueue(context.Context, *EnqueueRequest) (*EnqueueResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Enqueue not implemented")
+}
+func (UnimplementedDNSBLServer) GetJob(context.Context, *GetJobRequest) (*Job, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetJob not implemented")
+}
+func (UnimplementedDNSBLServer) mustEmbedUnimplementedDNSBLServer() {}
+
+// UnsafeDNSBLServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to DNSBLServer will
+// result in compilation errors.
+type UnsafeDNSBLServer interface {
+	mustEmbedUnimplementedDNSBLServer()
+}
+
+func RegisterDNSBLServer(s grpc.ServiceRegistrar, srv DNSBLServer) {
+	s.RegisterService(&_DNSBL_serviceDesc, srv)
+}
+
+func _DNSBL_Check_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(CheckRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DNSBLServer).Check(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/swdnsbl.v1.DNSBL/Check",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DNSBLServer).Check(ctx, req.(*CheckRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DNSBL_CheckBulk_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(CheckBulkRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(DNSBLServer).CheckBulk(m, &dNSBLCheckBulkServer{stream})
+}
+
+type DNSBL_CheckBulkServer interface {
+	Send(*CheckResponse) error
+	grpc.ServerStream
+}
+
+type dNSBLCheckBulkServer struct {
+	grpc.ServerStream
+}
+
+func (x *dNSBLCheckBulkServer) Send(m *CheckResponse) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+func _DNSBL_Enqueue_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(EnqueueRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DNSBLServer).Enqueue(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/swdnsbl.v1.DNSBL/Enqueue",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DNSBLServer).Enqueue(ctx, req.(*EnqueueRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _DNSBL_GetJob_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetJobRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(DNSBLServer).GetJob(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/swdnsbl.v1.DNSBL/GetJob",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(DNSBLServer).GetJob(ctx, req.(*GetJobRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+var _DNSBL_serviceDesc = grpc.ServiceDesc{
+	ServiceName: "swdnsbl.v1.DNSBL",
+	HandlerType: (*DNSBLServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "Check",
+			Handler:    _DNSBL_Check_Handler,
+		},
+		{
+			MethodName: "Enqueue",
+			Handler:    _DNSBL_Enqueue_Handler,
+		},
+		{
+			MethodName: "GetJob",
+			Handler:    _DNSBL_GetJob_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "CheckBulk",
+			Handler:       _DNSBL_CheckBulk_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "rpc/dnsbl.proto",
+}
@@ -0,0 +1,266 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"github.com/alexanderkarlis/sw-dnsbl/auth"
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+)
+
+// bulkConcurrency is how many ips of a CheckBulk call are checked at once
+const bulkConcurrency = 16
+
+// Server implements the DNSBL gRPC service with the same database and consumer
+// as the GraphQL resolvers
+type Server struct {
+	UnimplementedDNSBLServer
+
+	Database database.Store
+	Consumer *dnsbl.Consumer
+	Weights  map[string]int
+}
+
+// NewServer function returns the DNSBL service
+func NewServer(db database.Store, consumer *dnsbl.Consumer, c *config.APIConfig) *Server {
+	return &Server{
+		Database: db,
+		Consumer: consumer,
+		Weights:  c.ListWeights,
+	}
+}
+
+// NewGRPCServer function returns a grpc server with s registered behind the
+// JWT auth interceptors
+func NewGRPCServer(s *Server) *grpc.Server {
+	srv := grpc.NewServer(
+		grpc.UnaryInterceptor(UnaryAuth),
+		grpc.StreamInterceptor(StreamAuth),
+	)
+	RegisterDNSBLServer(srv, s)
+	return srv
+}
+
+// ListenAndServe function serves s on the tcp addr until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	srv := NewGRPCServer(s)
+	go func() {
+		<-ctx.Done()
+		srv.GracefulStop()
+	}()
+	log.Printf("serving grpc on %s\n", addr)
+	return srv.Serve(l)
+}
+
+// Check checks a single ip right away
+func (s *Server) Check(ctx context.Context, req *CheckRequest) (*CheckResponse, error) {
+	timeout, err := checkTimeout(req.TimeoutMs)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := s.check(ctx, req.Ip, req.Lists, timeout)
+	if err != nil {
+		return nil, checkError(err)
+	}
+	return resp, nil
+}
+
+// checkError turns a failed check into a status clients can act on: a bad ip
+// isn't worth retrying, a deadline or an internal failure may be
+func checkError(err error) error {
+	switch {
+	case errors.Is(err, dnsbl.ErrInvalidIP):
+		return status.Error(codes.InvalidArgument, err.Error())
+	case errors.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	}
+	return status.Error(codes.Internal, err.Error())
+}
+
+// CheckBulk checks every ip of the request and streams the results as they
+// finish. An ip that can't be checked comes back with its error set.
+func (s *Server) CheckBulk(req *CheckBulkRequest, stream DNSBL_CheckBulkServer) error {
+	timeout, err := checkTimeout(req.TimeoutMs)
+	if err != nil {
+		return err
+	}
+
+	ctx := stream.Context()
+	results := make(chan *CheckResponse)
+	sem := make(chan struct{}, bulkConcurrency)
+	var wg sync.WaitGroup
+	go func() {
+		defer close(results)
+		for _, ip := range req.Ips {
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				wg.Wait()
+				return
+			}
+			wg.Add(1)
+			go func(ip string) {
+				defer wg.Done()
+				defer func() { <-sem }()
+				// the error is on the response too
+				resp, _ := s.check(ctx, ip, req.Lists, timeout)
+				select {
+				case results <- resp:
+				case <-ctx.Done():
+				}
+			}(ip)
+		}
+		wg.Wait()
+	}()
+
+	for resp := range results {
+		if err := stream.Send(resp); err != nil {
+			return err
+		}
+	}
+	return ctx.Err()
+}
+
+// Enqueue queues ips to be checked by the consumer's worker
+func (s *Server) Enqueue(ctx context.Context, req *EnqueueRequest) (*EnqueueResponse, error) {
+	if len(req.Ips) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "no ips given")
+	}
+	for _, ip := range req.Ips {
+		if addr := net.ParseIP(ip); addr == nil || addr.To4() == nil {
+			return nil, status.Errorf(codes.InvalidArgument, "%s is not an IPv4 address", ip)
+		}
+	}
+
+	id, err := s.Consumer.QueueJob(req.Ips)
+	if err == dnsbl.ErrQueueFull {
+		retryAfter := int(s.Consumer.RetryAfter().Seconds())
+		grpc.SetHeader(ctx, metadata.Pairs("retry-after", strconv.Itoa(retryAfter)))
+		return nil, status.Error(codes.ResourceExhausted, err.Error())
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "could not queue job: %s", err)
+	}
+	return &EnqueueResponse{JobId: id}, nil
+}
+
+// GetJob returns the status of an enqueued job
+func (s *Server) GetJob(ctx context.Context, req *GetJobRequest) (*Job, error) {
+	j, ok := s.Consumer.Job(req.Id)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "job %s not found", req.Id)
+	}
+	return &Job{
+		Id:         j.ID,
+		State:      j.State,
+		Ips:        j.IPs,
+		Checked:    int32(j.Checked),
+		CreatedAt:  int64(j.CreatedAt),
+		FinishedAt: int64(j.FinishedAt),
+	}, nil
+}
+
+// check runs Consumer.CheckIP for ip within timeout
+func (s *Server) check(ctx context.Context, ip string, lists []string, timeout time.Duration) (*CheckResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	resp := &CheckResponse{Ip: ip}
+	results, err := s.Consumer.CheckIP(ctx, ip, lists)
+	if err != nil {
+		resp.Error = err.Error()
+		return resp, err
+	}
+	for _, r := range results {
+		resp.Listed = resp.Listed || r.Listed
+		resp.Results = append(resp.Results, listResult(r))
+	}
+	resp.Score = int32(dnsbl.Score(results, s.Weights))
+	return resp, nil
+}
+
+// checkTimeout returns the deadline for a check of timeoutMs, 0 meaning the
+// default
+func checkTimeout(timeoutMs int32) (time.Duration, error) {
+	if timeoutMs < 0 {
+		return 0, status.Error(codes.InvalidArgument, "timeout_ms must be positive")
+	}
+	if timeoutMs == 0 {
+		return dnsbl.DefaultCheckTimeout, nil
+	}
+	return time.Duration(timeoutMs) * time.Millisecond, nil
+}
+
+// listResult converts a graphql list result to its protobuf message
+func listResult(r *model.ListResult) *ListResult {
+	out := &ListResult{
+		IpAddress:    r.IPAddress,
+		Blocklist:    r.Blocklist,
+		Listed:       r.Listed,
+		ResponseCode: r.ResponseCode,
+		Category:     r.Category,
+		Cached:       r.Cached,
+		CheckedAt:    int64(r.CheckedAt),
+	}
+	if r.Reason != nil {
+		out.Reason = *r.Reason
+	}
+	if r.Error != nil {
+		out.Error = *r.Error
+	}
+	return out
+}
+
+// UnaryAuth is the unary interceptor checking the bearer token in the
+// `authorization` metadata
+func UnaryAuth(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	ctx, err := authorize(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return handler(ctx, req)
+}
+
+// StreamAuth is the stream interceptor checking the bearer token in the
+// `authorization` metadata
+func StreamAuth(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	if _, err := authorize(ss.Context()); err != nil {
+		return err
+	}
+	return handler(srv, ss)
+}
+
+// authorize validates the token of an incoming call and returns ctx carrying
+// it, like middleware.Middleware does for http
+func authorize(ctx context.Context) (context.Context, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get("authorization")
+	if len(values) == 0 || values[0] == "" {
+		return ctx, status.Error(codes.Unauthenticated, "missing auth token")
+	}
+
+	tokenString := strings.Replace(values[0], "Bearer ", "", 1)
+	if _, err := auth.ValidateToken(tokenString); err != nil {
+		return ctx, status.Error(codes.Unauthenticated, "not an authorized token")
+	}
+	return middleware.WithToken(ctx, tokenString), nil
+}
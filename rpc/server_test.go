@@ -0,0 +1,181 @@
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/alexanderkarlis/sw-dnsbl/auth"
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/database"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
+)
+
+func TestGRPCServer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rpc")
+	require.Equal(t, nil, err)
+	defer os.RemoveAll(dir)
+
+	conf := &config.APIConfig{
+		DbPath:         filepath.Join(dir, "swdnsbl.db"),
+		PersistDb:      true,
+		WorkerPoolsize: 10,
+		CacheTTL:       3600,
+		QueuePolicy:    config.QueuePolicyReject,
+		DNSBlockList:   []string{"zen.spamhaus.org"},
+		ListWeights:    map[string]int{"zen.spamhaus.org": 3},
+	}
+	db, err := database.NewDb(conf)
+	require.Equal(t, nil, err)
+	defer db.Close()
+
+	// results are stored so checks are answered without live lookups
+	now := int(time.Now().Unix())
+	reason := "listed for testing"
+	for _, r := range []*model.ListResult{
+		{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", Reason: &reason, Category: dnsbl.CategorySpam, CheckedAt: now},
+		{IPAddress: "127.0.0.1", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN", CheckedAt: now},
+		{IPAddress: "127.0.0.3", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.3", CheckedAt: now},
+	} {
+		require.Equal(t, nil, db.UpsertListResult(r))
+	}
+
+	// a consumer without lists for the enqueue tests, so jobs finish at once
+	l := bufconn.Listen(1 << 20)
+	srv := NewGRPCServer(NewServer(db, dnsbl.NewConsumer(db, &config.APIConfig{
+		WorkerPoolsize: 10,
+		QueuePolicy:    config.QueuePolicyReject,
+	}), conf))
+	go srv.Serve(l)
+	defer srv.Stop()
+
+	checkSrv := NewServer(db, dnsbl.NewConsumer(db, conf), conf)
+	checkL := bufconn.Listen(1 << 20)
+	checkGRPC := NewGRPCServer(checkSrv)
+	go checkGRPC.Serve(checkL)
+	defer checkGRPC.Stop()
+
+	dial := func(l *bufconn.Listener) DNSBLClient {
+		conn, err := grpc.Dial("bufnet",
+			grpc.WithInsecure(),
+			grpc.WithContextDialer(func(ctx context.Context, s string) (net.Conn, error) {
+				return l.Dial()
+			}),
+		)
+		require.Equal(t, nil, err)
+		t.Cleanup(func() { conn.Close() })
+		return NewDNSBLClient(conn)
+	}
+	jobClient := dial(l)
+	checkClient := dial(checkL)
+
+	token, err := auth.CreateJWT("secureworks", "supersecret", 5)
+	require.Equal(t, nil, err)
+	ctx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer "+token)
+
+	t.Run("no_auth", func(t *testing.T) {
+		_, err := checkClient.Check(context.Background(), &CheckRequest{Ip: "127.0.0.2"})
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		badCtx := metadata.AppendToOutgoingContext(context.Background(), "authorization", "Bearer nope")
+		stream, err := checkClient.CheckBulk(badCtx, &CheckBulkRequest{Ips: []string{"127.0.0.2"}})
+		require.Equal(t, nil, err)
+		_, err = stream.Recv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("check", func(t *testing.T) {
+		resp, err := checkClient.Check(ctx, &CheckRequest{Ip: "127.0.0.2"})
+		require.Equal(t, nil, err)
+		assert.Equal(t, true, resp.Listed)
+		assert.Equal(t, int32(3), resp.Score)
+		require.Equal(t, 1, len(resp.Results))
+		assert.Equal(t, "127.0.0.2", resp.Results[0].ResponseCode)
+		assert.Equal(t, reason, resp.Results[0].Reason)
+		assert.Equal(t, dnsbl.CategorySpam, resp.Results[0].Category)
+		assert.Equal(t, true, resp.Results[0].Cached)
+
+		_, err = checkClient.Check(ctx, &CheckRequest{Ip: "nope"})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = checkClient.Check(ctx, &CheckRequest{Ip: "127.0.0.2", TimeoutMs: -1})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("check_error_codes", func(t *testing.T) {
+		for err, code := range map[error]codes.Code{
+			fmt.Errorf("nope is %w", dnsbl.ErrInvalidIP):       codes.InvalidArgument,
+			fmt.Errorf("lookup: %w", context.DeadlineExceeded): codes.DeadlineExceeded,
+			database.ErrClosed: codes.Internal,
+			errors.New("read udp 127.0.0.1:53: connection refused"): codes.Internal,
+		} {
+			assert.Equal(t, code, status.Code(checkError(err)), err.Error())
+		}
+
+		// a store that fails is the server's problem, not the request's
+		closed := database.NewMemory()
+		closed.Close()
+		s := NewServer(closed, dnsbl.NewConsumer(closed, &config.APIConfig{WorkerPoolsize: 1, QueuePolicy: config.QueuePolicyReject}), conf)
+		_, err := s.Check(context.Background(), &CheckRequest{Ip: "127.0.0.2"})
+		assert.Equal(t, codes.Internal, status.Code(err))
+	})
+
+	t.Run("check_bulk", func(t *testing.T) {
+		stream, err := checkClient.CheckBulk(ctx, &CheckBulkRequest{Ips: []string{"127.0.0.1", "127.0.0.2", "127.0.0.3", "nope"}})
+		require.Equal(t, nil, err)
+
+		var responses []*CheckResponse
+		for {
+			resp, err := stream.Recv()
+			if err == io.EOF {
+				break
+			}
+			require.Equal(t, nil, err)
+			responses = append(responses, resp)
+		}
+		require.Equal(t, 4, len(responses))
+		sort.Slice(responses, func(i, j int) bool { return responses[i].Ip < responses[j].Ip })
+		assert.Equal(t, false, responses[0].Listed)
+		assert.Equal(t, true, responses[1].Listed)
+		assert.Equal(t, true, responses[2].Listed)
+		assert.Equal(t, "nope", responses[3].Ip)
+		assert.NotEqual(t, "", responses[3].Error)
+	})
+
+	t.Run("enqueue_and_get_job", func(t *testing.T) {
+		resp, err := jobClient.Enqueue(ctx, &EnqueueRequest{Ips: []string{"127.0.0.2", "127.0.0.3"}})
+		require.Equal(t, nil, err)
+		assert.NotEqual(t, "", resp.JobId)
+
+		var job *Job
+		require.Eventually(t, func() bool {
+			job, err = jobClient.GetJob(ctx, &GetJobRequest{Id: resp.JobId})
+			return err == nil && job.State == dnsbl.JobDone
+		}, 5*time.Second, 50*time.Millisecond)
+		assert.Equal(t, int32(2), job.Checked)
+		assert.Equal(t, []string{"127.0.0.2", "127.0.0.3"}, job.Ips)
+
+		_, err = jobClient.GetJob(ctx, &GetJobRequest{Id: "nope"})
+		assert.Equal(t, codes.NotFound, status.Code(err))
+		_, err = jobClient.Enqueue(ctx, &EnqueueRequest{})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+		_, err = jobClient.Enqueue(ctx, &EnqueueRequest{Ips: []string{"127.0.0.2", "::1"}})
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+}
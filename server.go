@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"expvar"
 	"fmt"
 	"log"
 	"net/http"
@@ -10,18 +11,38 @@ import (
 	"time"
 
 	"github.com/99designs/gqlgen/graphql/handler"
+	"github.com/99designs/gqlgen/graphql/handler/extension"
+	"github.com/99designs/gqlgen/graphql/handler/lru"
+	"github.com/99designs/gqlgen/graphql/handler/transport"
 	"github.com/99designs/gqlgen/graphql/playground"
+	"github.com/alexanderkarlis/sw-dnsbl/cli"
 	"github.com/alexanderkarlis/sw-dnsbl/config"
 	"github.com/alexanderkarlis/sw-dnsbl/database"
 	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsserver"
+	"github.com/alexanderkarlis/sw-dnsbl/export"
 	"github.com/alexanderkarlis/sw-dnsbl/graph"
 	"github.com/alexanderkarlis/sw-dnsbl/graph/generated"
+	"github.com/alexanderkarlis/sw-dnsbl/maillog"
 	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+	"github.com/alexanderkarlis/sw-dnsbl/policy"
+	"github.com/alexanderkarlis/sw-dnsbl/rest"
+	"github.com/alexanderkarlis/sw-dnsbl/retention"
+	"github.com/alexanderkarlis/sw-dnsbl/rpc"
+	"github.com/alexanderkarlis/sw-dnsbl/syslog"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
 )
 
 const defaultPort = "8080"
 
+// uploads, e.g. for enqueueFile, may be large; anything past the first
+// uploadMemory bytes is spooled to a temp file instead of held in memory
+const (
+	maxUploadSize = 256 << 20
+	uploadMemory  = 1 << 20
+)
+
 func enableCors(w *http.ResponseWriter) {
 	(*w).Header().Set("Access-Control-Allow-Origin", "*")
 	(*w).Header().Set("Access-Control-Allow-Methods", "*")
@@ -42,6 +63,45 @@ func Ready(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, "{\"status\":\"ok\"}")
 }
 
+// newGraphQLServer is handler.NewDefaultServer, except the websocket transport
+// authenticates subscriptions from the connection_init payload
+func newGraphQLServer(resolver *graph.Resolver) *handler.Server {
+	srv := handler.New(
+		generated.NewExecutableSchema(
+			generated.Config{
+				Resolvers: resolver,
+			},
+		),
+	)
+
+	srv.AddTransport(transport.Websocket{
+		KeepAlivePingInterval: 10 * time.Second,
+		InitFunc:              middleware.WebsocketInit,
+		Upgrader: websocket.Upgrader{
+			// same as the Access-Control-Allow-Origin of the other endpoints
+			CheckOrigin: func(r *http.Request) bool {
+				return true
+			},
+		},
+	})
+	srv.AddTransport(transport.Options{})
+	srv.AddTransport(transport.GET{})
+	srv.AddTransport(transport.POST{})
+	srv.AddTransport(transport.MultipartForm{
+		MaxUploadSize: maxUploadSize,
+		MaxMemory:     uploadMemory,
+	})
+
+	srv.SetQueryCache(lru.New(1000))
+
+	srv.Use(extension.Introspection{})
+	srv.Use(extension.AutomaticPersistedQuery{
+		Cache: lru.New(100),
+	})
+
+	return srv
+}
+
 func serve(ctx context.Context) (err error) {
 	config := config.GetConfig()
 
@@ -51,7 +111,7 @@ func serve(ctx context.Context) (err error) {
 	}
 
 	// new db
-	db, err := database.NewDb(config)
+	db, err := database.NewStore(config)
 	if err != nil {
 		log.Fatalln(err)
 	}
@@ -61,29 +121,40 @@ func serve(ctx context.Context) (err error) {
 	if err != nil {
 		log.Fatalln(err)
 	}
+	pruner := retention.NewPruner(db, config)
+	go pruner.Run(ctx)
+
 	resolver := graph.Resolver{
-		Database: db,
-		Consumer: consumer,
+		Database:   db,
+		Consumer:   consumer,
+		Pruner:     pruner,
+		BackupDir:  config.BackupDir,
+		AdminUsers: config.AdminUsers,
 	}
 
 	// new router and auth layer
 	router := mux.NewRouter()
 
-	srv := handler.NewDefaultServer(
-		generated.NewExecutableSchema(
-			generated.Config{
-				Resolvers: &resolver,
-			},
-		),
-	)
+	srv := newGraphQLServer(&resolver)
 
 	router.Use(middleware.Middleware())
 	router.Handle("/", playground.Handler("GraphQL playground", "/graphql"))
 	router.Handle("/graphql", srv)
+	router.Handle("/export/{format}", middleware.RequireAuth(export.Handler(db, config)))
+	router.Handle("/export/records/{format}", middleware.RequireAuth(export.RecordsHandler(db)))
+	router.Handle("/export/firewall/{format}", middleware.RequireAuth(export.FirewallHandler(db, config)))
+
+	api := rest.API{
+		Database: db,
+		Consumer: consumer,
+	}
+	api.Register(router)
 
 	// helm charts had these in the config??
 	router.HandleFunc("/alive", Alive)
 	router.HandleFunc("/ready", Ready)
+	// counters, e.g. of what the pruner removed, as expvar json
+	router.Handle("/metrics", middleware.RequireAuth(expvar.Handler()))
 
 	go func() {
 		if err = http.ListenAndServe(":"+port, router); err != nil && err != http.ErrServerClosed {
@@ -91,6 +162,54 @@ func serve(ctx context.Context) (err error) {
 		}
 	}()
 
+	if config.DNSServerPort != "" {
+		dnsServer := dnsserver.NewServer(db, config)
+		go func() {
+			if err := dnsServer.ListenAndServe(ctx, ":"+config.DNSServerPort); err != nil {
+				log.Fatalf("dns listen:%+s\n", err)
+			}
+		}()
+	}
+
+	if config.PolicyServerPort != "" {
+		policyServer := policy.NewServer(consumer, config)
+		go func() {
+			if err := policyServer.ListenAndServe(ctx, ":"+config.PolicyServerPort); err != nil {
+				log.Fatalf("policy listen:%+s\n", err)
+			}
+		}()
+	}
+
+	if config.GRPCPort != "" {
+		grpcServer := rpc.NewServer(db, consumer, config)
+		go func() {
+			if err := grpcServer.ListenAndServe(ctx, ":"+config.GRPCPort); err != nil {
+				log.Fatalf("grpc listen:%+s\n", err)
+			}
+		}()
+	}
+
+	if len(config.MailLogFiles) > 0 {
+		ingester := maillog.NewIngester(consumer.QueueJob, time.Duration(config.MailLogWindow)*time.Second)
+		go ingester.Run(ctx)
+		for _, path := range config.MailLogFiles {
+			go func(path string) {
+				if err := ingester.Ingest(ctx, path, false); err != nil {
+					log.Printf("mail log %s: %s\n", path, err)
+				}
+			}(path)
+		}
+	}
+
+	if config.SyslogPort != "" {
+		syslogServer := syslog.NewServer(consumer, config)
+		go func() {
+			if err := syslogServer.ListenAndServe(ctx, ":"+config.SyslogPort); err != nil {
+				log.Fatalf("syslog listen:%+s\n", err)
+			}
+		}()
+	}
+
 	log.Printf("connect to http://localhost:%s/ for GraphQL playground", port)
 	<-ctx.Done()
 
@@ -121,6 +240,14 @@ func main() {
 
 	log.SetOutput(f)
 
+	if ran, err := cli.Run(os.Args[1:], os.Stdout); ran {
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s failed: %s\n", os.Args[1], err)
+			os.Exit(1)
+		}
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
 
 	go func() {
@@ -1,21 +1,29 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"expvar"
+	"io/ioutil"
 	"log"
+	"mime/multipart"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/99designs/gqlgen/client"
-	"github.com/99designs/gqlgen/graphql/handler"
 	"github.com/alexanderkarlis/sw-dnsbl/config"
 	"github.com/alexanderkarlis/sw-dnsbl/database"
 	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/export"
 	"github.com/alexanderkarlis/sw-dnsbl/graph"
-	"github.com/alexanderkarlis/sw-dnsbl/graph/generated"
 	"github.com/alexanderkarlis/sw-dnsbl/graph/model"
 	"github.com/alexanderkarlis/sw-dnsbl/middleware"
+	"github.com/alexanderkarlis/sw-dnsbl/retention"
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -30,7 +38,13 @@ type enqueue struct {
 }
 
 type getipdetails struct {
-	GetIPDetails model.Record
+	GetIPDetails struct {
+		UUID         string
+		CreatedAt    string `json:"created_at"`
+		UpdatedAt    string `json:"updated_at"`
+		ResponseCode string `json:"response_code"`
+		IPAddress    string `json:"ip_address"`
+	}
 }
 
 type gqlError struct {
@@ -51,6 +65,9 @@ func isIPInResponseList(ip string, ips []string) bool {
 
 func TestSWDNSBLServer(t *testing.T) {
 	// t.Skip()
+	// the whole server runs on the memory store, never touching disk
+	defer os.Setenv("DB_DRIVER", os.Getenv("DB_DRIVER"))
+	os.Setenv("DB_DRIVER", config.DbDriverMemory)
 	config := config.GetConfig()
 
 	port := "8080"
@@ -59,7 +76,7 @@ func TestSWDNSBLServer(t *testing.T) {
 	}
 
 	// new db
-	db, err := database.NewDb(config)
+	db, err := database.NewStore(config)
 
 	// new consumer
 	consumer := dnsbl.NewConsumer(db, config)
@@ -67,8 +84,10 @@ func TestSWDNSBLServer(t *testing.T) {
 		log.Fatalln(err)
 	}
 	resolver := graph.Resolver{
-		Database: db,
-		Consumer: consumer,
+		Database:   db,
+		Consumer:   consumer,
+		Pruner:     retention.NewPruner(db, config),
+		AdminUsers: config.AdminUsers,
 	}
 
 	// new router and auth layer
@@ -76,18 +95,14 @@ func TestSWDNSBLServer(t *testing.T) {
 
 	router.Use(middleware.Middleware())
 
-	srv := handler.NewDefaultServer(
-		generated.NewExecutableSchema(
-			generated.Config{
-				Resolvers: &resolver,
-			},
-		),
-	)
+	srv := newGraphQLServer(&resolver)
 
 	// gqp client
 	c := client.New(router)
 
 	router.Handle("/", srv)
+	router.Handle("/export/{format}", middleware.RequireAuth(export.Handler(db, config)))
+	router.Handle("/metrics", middleware.RequireAuth(expvar.Handler()))
 
 	go func() {
 		if err = http.ListenAndServe(":"+port, router); err != nil && err != http.ErrServerClosed {
@@ -239,6 +254,8 @@ func TestSWDNSBLServer(t *testing.T) {
 		`
 		c.Post(getDetailsQuery, &ipdetails, authHeader)
 		assert.Equal(t, "NXDOMAIN", ipdetails.GetIPDetails.ResponseCode)
+		_, err := time.Parse(time.RFC3339, ipdetails.GetIPDetails.UpdatedAt)
+		assert.Equal(t, nil, err)
 	})
 
 	t.Run("query_ip_success_127.0.0.2", func(t *testing.T) {
@@ -356,6 +373,374 @@ func TestSWDNSBLServer(t *testing.T) {
 		assert.Equal(t, "127.0.0.10", ipdetails.GetIPDetails.ResponseCode)
 	})
 
+	t.Run("check_ip_no_auth", func(t *testing.T) {
+		var resp struct {
+			CheckIP []model.ListResult
+		}
+		checkIPQuery := `
+		query {
+			checkIP(
+			  ip: "127.0.0.2"
+			  timeoutMs: 500
+			),
+			{
+			  blocklist
+			  listed
+			  response_code
+			}
+		  }
+		`
+		err := c.Post(checkIPQuery, &resp)
+		assert.EqualError(t, err, `[{"message":"missing auth token","path":["checkIP"]}]`)
+	})
+
+	t.Run("subscribe_no_auth", func(t *testing.T) {
+		var resp struct {
+			RecordUpdated model.RecordUpdate
+		}
+		sub := c.Websocket(`subscription { recordUpdated { job_id } }`)
+		defer sub.Close()
+		err := sub.Next(&resp)
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("subscribe_job_updates", func(t *testing.T) {
+		var resp struct {
+			RecordUpdated struct {
+				JobID  string `json:"job_id"`
+				Record struct {
+					IPAddress string `json:"ip_address"`
+				}
+			}
+		}
+		var jobResp struct {
+			EnqueueJob string
+		}
+
+		sub := c.WebsocketWithPayload(
+			`subscription { recordUpdated(ips: ["127.0.0.5"]) { job_id record { ip_address } } }`,
+			map[string]interface{}{"Authorization": auth.CreateToken.BearerToken},
+		)
+		defer sub.Close()
+
+		err := c.Post(`mutation { enqueueJob(ips: ["127.0.0.5"]) }`, &jobResp, authHeader)
+		require.Equal(t, nil, err)
+
+		err = sub.Next(&resp)
+		require.Equal(t, nil, err)
+		assert.Equal(t, jobResp.EnqueueJob, resp.RecordUpdated.JobID)
+		assert.Equal(t, "127.0.0.5", resp.RecordUpdated.Record.IPAddress)
+	})
+
+	t.Run("queue_status", func(t *testing.T) {
+		var resp struct {
+			QueueStatus model.QueueStatus
+		}
+		queueStatusQuery := `
+		query {
+			queueStatus {
+				depth
+				capacity
+				spilled
+				policy
+				retry_after_seconds
+			}
+		}
+		`
+		err := c.Post(queueStatusQuery, &resp, authHeader)
+		require.Equal(t, nil, err)
+		assert.Equal(t, config.WorkerPoolsize, resp.QueueStatus.Capacity)
+		assert.Equal(t, config.QueuePolicy, resp.QueueStatus.Policy)
+	})
+
+	t.Run("records", func(t *testing.T) {
+		var resp struct {
+			Records struct {
+				Edges []struct {
+					Cursor string
+					Node   struct {
+						IPAddress string `json:"ip_address"`
+					}
+				}
+				PageInfo struct {
+					HasNextPage bool    `json:"has_next_page"`
+					EndCursor   *string `json:"end_cursor"`
+				} `json:"page_info"`
+			}
+		}
+		recordsQuery := `
+		query($after: String) {
+			records(filter: {cidr: "127.0.0.0/24"}, first: 1, after: $after) {
+				edges { cursor node { ip_address } }
+				page_info { has_next_page end_cursor }
+			}
+		}
+		`
+		err := c.Post(recordsQuery, &resp)
+		assert.EqualError(t, err, `[{"message":"missing auth token","path":["records"]}]`)
+
+		err = c.Post(recordsQuery, &resp, authHeader)
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(resp.Records.Edges))
+		assert.Equal(t, true, resp.Records.PageInfo.HasNextPage)
+		require.NotEqual(t, (*string)(nil), resp.Records.PageInfo.EndCursor)
+		first := resp.Records.Edges[0].Node.IPAddress
+
+		err = c.Post(recordsQuery, &resp, authHeader, client.Var("after", *resp.Records.PageInfo.EndCursor))
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(resp.Records.Edges))
+		assert.NotEqual(t, first, resp.Records.Edges[0].Node.IPAddress)
+
+		err = c.Post(`query { records(first: 0) { page_info { has_next_page } } }`, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"first must be between 1 and 500","path":["records"]}]`)
+	})
+
+	t.Run("prune", func(t *testing.T) {
+		var resp struct {
+			Prune       model.PruneResult
+			PruneStatus model.PruneStatus
+		}
+		pruneMutation := `
+		mutation {
+			prune {
+				records_removed
+				history_compacted
+			}
+		}
+		`
+		err := c.Post(pruneMutation, &resp)
+		assert.EqualError(t, err, `[{"message":"missing auth token","path":["prune"]}]`)
+
+		// a valid token isn't enough, it has to be an admin's
+		resolver.AdminUsers = []string{"ops"}
+		err = c.Post(pruneMutation, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"not an admin token","path":["prune"]}]`)
+		resolver.AdminUsers = config.AdminUsers
+
+		// everything stored was just checked, so there is nothing to prune
+		err = c.Post(pruneMutation, &resp, authHeader)
+		require.Equal(t, nil, err)
+		assert.Equal(t, 0, resp.Prune.RecordsRemoved)
+		assert.Equal(t, 0, resp.Prune.HistoryCompacted)
+
+		err = c.Post(`query { pruneStatus { runs history_retention_days } }`, &resp, authHeader)
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, resp.PruneStatus.Runs)
+		assert.Equal(t, config.HistoryRetentionDays, resp.PruneStatus.HistoryRetentionDays)
+	})
+
+	t.Run("backup", func(t *testing.T) {
+		var resp struct {
+			Backup model.Backup
+		}
+		backupMutation := `mutation { backup(gzip: true) { path bytes compressed schema_version } }`
+		err := c.Post(backupMutation, &resp)
+		assert.EqualError(t, err, `[{"message":"missing auth token","path":["backup"]}]`)
+
+		resolver.AdminUsers = []string{"ops"}
+		err = c.Post(backupMutation, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"not an admin token","path":["backup"]}]`)
+		resolver.AdminUsers = config.AdminUsers
+
+		// the memory store has nothing to snapshot
+		err = c.Post(backupMutation, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"this database can't be backed up","path":["backup"]}]`)
+
+		dir, err := ioutil.TempDir("", "backup")
+		require.Equal(t, nil, err)
+		defer os.RemoveAll(dir)
+		sqliteConfig := *config
+		sqliteConfig.DbDriver = ""
+		sqliteConfig.DbPath = filepath.Join(dir, "swdnsbl.db")
+		sqliteConfig.PersistDb = true
+		sqlite, err := database.NewDb(&sqliteConfig)
+		require.Equal(t, nil, err)
+		defer sqlite.Close()
+
+		backupRouter := mux.NewRouter()
+		backupRouter.Use(middleware.Middleware())
+		backupRouter.Handle("/", newGraphQLServer(&graph.Resolver{Database: sqlite, BackupDir: filepath.Join(dir, "backups"), AdminUsers: config.AdminUsers}))
+		bc := client.New(backupRouter)
+
+		err = bc.Post(backupMutation, &resp, authHeader)
+		require.Equal(t, nil, err)
+		assert.Equal(t, filepath.Join(dir, "backups"), filepath.Dir(resp.Backup.Path))
+		assert.Equal(t, true, strings.HasSuffix(resp.Backup.Path, ".db.gz"))
+		assert.Equal(t, true, resp.Backup.Compressed)
+		assert.Equal(t, database.LatestSchemaVersion(), resp.Backup.SchemaVersion)
+		fi, err := os.Stat(resp.Backup.Path)
+		require.Equal(t, nil, err)
+		assert.Equal(t, int(fi.Size()), resp.Backup.Bytes)
+
+		// snapshots are never overwritten
+		err = bc.Post(`mutation { backup(name: "named.db") { path } }`, &resp, authHeader)
+		require.Equal(t, nil, err)
+		err = bc.Post(`mutation { backup(name: "named.db") { path } }`, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"named.db already exists in BACKUP_DIR","path":["backup"]}]`)
+
+		err = bc.Post(`mutation { backup(name: "../escape.db") { path } }`, &resp, authHeader)
+		assert.EqualError(t, err, `[{"message":"name must be a file name, written to BACKUP_DIR","path":["backup"]}]`)
+	})
+
+	t.Run("stats", func(t *testing.T) {
+		type bucket struct {
+			Blocklist    *string
+			ResponseCode *string `json:"response_code"`
+			Category     *string
+			Day          *string
+			Lookups      int
+			Listed       int
+			Errors       int
+			UniqueIps    int `json:"unique_ips"`
+			ListedIps    int `json:"listed_ips"`
+		}
+		var resp struct {
+			Stats []bucket
+		}
+		statsQuery := `
+		query($groupBy: [StatsGroup!]) {
+			stats(from: "2020-11-05T00:00:00Z", groupBy: $groupBy) {
+				blocklist response_code category day lookups listed errors unique_ips listed_ips
+			}
+		}
+		`
+		err := c.Post(statsQuery, &resp)
+		assert.EqualError(t, err, `[{"message":"missing auth token","path":["stats"]}]`)
+
+		// a store of its own, as the lookups of the other tests depend on DNS
+		db := database.NewMemory()
+		defer db.Close()
+		timeout := "i/o timeout"
+		for _, r := range []*model.ListResult{
+			{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", Category: "spam", CheckedAt: 1604534400},
+			{IPAddress: "127.0.0.2", Blocklist: "zen.spamhaus.org", Listed: true, ResponseCode: "127.0.0.2", Category: "spam", CheckedAt: 1604581445},
+			{IPAddress: "127.0.0.3", Blocklist: "zen.spamhaus.org", Error: &timeout, CheckedAt: 1604581446},
+			// before from
+			{IPAddress: "127.0.0.4", Blocklist: "zen.spamhaus.org", ResponseCode: "NXDOMAIN", CheckedAt: 1604534399},
+		} {
+			require.Equal(t, nil, db.UpsertListResult(r))
+		}
+		statsRouter := mux.NewRouter()
+		statsRouter.Use(middleware.Middleware())
+		statsRouter.Handle("/", newGraphQLServer(&graph.Resolver{Database: db}))
+		sc := client.New(statsRouter)
+
+		err = sc.Post(statsQuery, &resp, authHeader)
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(resp.Stats))
+		assert.Equal(t, bucket{Lookups: 3, Listed: 2, Errors: 1, UniqueIps: 2, ListedIps: 1}, resp.Stats[0])
+
+		blocklist, day := "zen.spamhaus.org", "2020-11-05T00:00:00Z"
+		err = sc.Post(statsQuery, &resp, authHeader, client.Var("groupBy", []string{"DAY", "BLOCKLIST"}))
+		require.Equal(t, nil, err)
+		require.Equal(t, 1, len(resp.Stats))
+		assert.Equal(t, bucket{Blocklist: &blocklist, Day: &day, Lookups: 3, Listed: 2, Errors: 1, UniqueIps: 2, ListedIps: 1}, resp.Stats[0])
+
+		err = sc.Post(statsQuery, &resp, authHeader, client.Var("groupBy", []string{"IP_ADDRESS"}))
+		assert.NotEqual(t, nil, err)
+	})
+
+	t.Run("enqueue_file", func(t *testing.T) {
+		upload := func(filename, content, token string) *httptest.ResponseRecorder {
+			var body bytes.Buffer
+			w := multipart.NewWriter(&body)
+			w.WriteField("operations", `{"query": "mutation($file: Upload!) { enqueueFile(file: $file) }", "variables": {"file": null}}`)
+			w.WriteField("map", `{"0": ["variables.file"]}`)
+			part, err := w.CreateFormFile("0", filename)
+			require.Equal(t, nil, err)
+			part.Write([]byte(content))
+			require.Equal(t, nil, w.Close())
+
+			req := httptest.NewRequest("POST", "/", &body)
+			req.Header.Set("Content-Type", w.FormDataContentType())
+			if token != "" {
+				req.Header.Set("Authorization", token)
+			}
+			rec := httptest.NewRecorder()
+			router.ServeHTTP(rec, req)
+			return rec
+		}
+		var resp struct {
+			Data struct {
+				EnqueueFile string
+			}
+			Errors []struct {
+				Message string
+			}
+		}
+
+		rec := upload("ips.csv", "first_seen,ip\n2020-12-01,127.0.0.6\n2020-12-02,127.0.0.7\n2020-12-03,127.0.0.6\n", auth.CreateToken.BearerToken)
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Equal(t, 0, len(resp.Errors))
+		job, ok := consumer.Job(resp.Data.EnqueueFile)
+		require.Equal(t, true, ok)
+		assert.Equal(t, []string{"127.0.0.6", "127.0.0.7"}, job.IPs)
+
+		resp.Errors = nil
+		rec = upload("ips.ndjson", "{\"ip\": \"127.0.0.6\"}\n{\"ip\": \"not an ip\"}\n", auth.CreateToken.BearerToken)
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Equal(t, 1, len(resp.Errors))
+		assert.Equal(t, "ips.ndjson: line 2: not an ip is not an IPv4 address", resp.Errors[0].Message)
+
+		resp.Errors = nil
+		rec = upload("ips.txt", "127.0.0.6\n", "")
+		require.Equal(t, nil, json.Unmarshal(rec.Body.Bytes(), &resp))
+		require.Equal(t, 1, len(resp.Errors))
+		assert.Equal(t, "missing auth token", resp.Errors[0].Message)
+	})
+
+	t.Run("export_no_auth", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/export/rbldnsd", nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	})
+
+	t.Run("metrics_no_auth", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+		assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+		req := httptest.NewRequest("GET", "/metrics", nil)
+		req.Header.Set("Authorization", auth.CreateToken.BearerToken)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), `"retention"`)
+	})
+
+	t.Run("export_zones", func(t *testing.T) {
+		require.Equal(t, nil, db.UpsertListResult(&model.ListResult{
+			IPAddress:    "127.0.0.4",
+			Blocklist:    "zen.spamhaus.org",
+			Listed:       true,
+			ResponseCode: "127.0.0.4",
+			Category:     dnsbl.CategoryExploit,
+			CheckedAt:    int(time.Now().Unix()),
+		}))
+
+		req := httptest.NewRequest("GET", "/export/rbldnsd?category=exploit&ttl=60&zone=bl.example.com", nil)
+		req.Header.Set("Authorization", auth.CreateToken.BearerToken)
+		rec := httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, true, strings.HasPrefix(rec.Body.String(), "$SOA 60 bl.example.com. "))
+		assert.Contains(t, rec.Body.String(), "\n127.0.0.4 :127.0.0.4:listed on zen.spamhaus.org (127.0.0.4)\n")
+
+		req = httptest.NewRequest("GET", "/export/rpz?list=zen.spamhaus.org", nil)
+		req.Header.Set("Authorization", auth.CreateToken.BearerToken)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+		assert.Contains(t, rec.Body.String(), "\n32.4.0.0.127.rpz-ip CNAME . ; zen.spamhaus.org\n")
+
+		req = httptest.NewRequest("GET", "/export/hosts", nil)
+		req.Header.Set("Authorization", auth.CreateToken.BearerToken)
+		rec = httptest.NewRecorder()
+		router.ServeHTTP(rec, req)
+		assert.Equal(t, http.StatusNotFound, rec.Code)
+	})
+
 	t.Run("query_ip_empty", func(t *testing.T) {
 		getDetailsQuery := `
 		query {
@@ -0,0 +1,207 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/config"
+	"github.com/alexanderkarlis/sw-dnsbl/dnsbl"
+	"github.com/alexanderkarlis/sw-dnsbl/maillog"
+)
+
+// maxMessageSize is the longest message accepted, over UDP or TCP
+const maxMessageSize = 64 << 10
+
+// Server receives syslog messages over UDP and TCP and queues the ips its
+// extractors find in them, each at most once per SYSLOG_WINDOW
+type Server struct {
+	extractors []*Extractor
+	// ingesters batch and dedupe the ips of the extractor at the same index
+	ingesters []*maillog.Ingester
+}
+
+// NewServer function returns a syslog server queuing ips on consumer with the
+// configured SYSLOG_EXTRACTORS and SYSLOG_WINDOW
+func NewServer(consumer *dnsbl.Consumer, c *config.APIConfig) *Server {
+	return newServer(consumer.QueueJobFrom, LoadExtractors(c.SyslogExtractors), time.Duration(c.SyslogWindow)*time.Second)
+}
+
+func newServer(enqueue func(source string, ips []string) (string, error), extractors []*Extractor, window time.Duration) *Server {
+	s := &Server{extractors: extractors}
+	for _, e := range extractors {
+		source := e.Source()
+		s.ingesters = append(s.ingesters, maillog.NewIngester(func(ips []string) (string, error) {
+			return enqueue(source, ips)
+		}, window))
+	}
+	return s
+}
+
+// ListenAndServe function receives syslog messages on the udp and tcp addr
+// until ctx is done
+func (s *Server) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	log.Printf("receiving syslog messages on udp and tcp %s\n", addr)
+
+	// either failing stops the other, closing its listener
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for _, in := range s.ingesters {
+		go in.Run(ctx)
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- s.ServeUDP(ctx, pc) }()
+	go func() { errs <- s.ServeTCP(ctx, l) }()
+	err = <-errs
+	cancel()
+	if other := <-errs; err == nil {
+		err = other
+	}
+	return err
+}
+
+// ServeUDP function handles the datagrams received on pc, one message each,
+// until ctx is done
+func (s *Server) ServeUDP(ctx context.Context, pc net.PacketConn) error {
+	go func() {
+		<-ctx.Done()
+		pc.Close()
+	}()
+
+	buf := make([]byte, maxMessageSize)
+	for {
+		n, _, err := pc.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		s.Handle(buf[:n])
+	}
+}
+
+// ServeTCP function accepts connections on l until ctx is done
+func (s *Server) ServeTCP(ctx context.Context, l net.Listener) error {
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		go s.serveConn(ctx, conn)
+	}
+}
+
+// serveConn handles the messages sent on a connection, framed either by
+// octet counting or by newlines (RFC6587); senders may mix both
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	var once sync.Once
+	closeConn := func() { once.Do(func() { conn.Close() }) }
+	defer closeConn()
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeConn()
+		case <-done:
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, maxMessageSize)
+	for {
+		msg, err := readFrame(r)
+		if err != nil {
+			if err != io.EOF && ctx.Err() == nil {
+				log.Printf("syslog connection from %s: %s\n", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		s.Handle(msg)
+	}
+}
+
+// readFrame reads the next message from r, either `LEN SP MSG` or a line
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	if n, ok := octetCount(r); ok {
+		if n > maxMessageSize {
+			return nil, fmt.Errorf("message longer than %d bytes", maxMessageSize)
+		}
+		r.Discard(len(strconv.Itoa(n)) + 1)
+		msg := make([]byte, n)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return nil, err
+		}
+		return msg, nil
+	}
+
+	line, err := r.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return nil, fmt.Errorf("message longer than %d bytes", maxMessageSize)
+	}
+	if err == io.EOF && len(line) > 0 {
+		return line, nil
+	}
+	return line, err
+}
+
+// octetCount returns the length of the octet counted frame at the start of r,
+// false if the next frame is a line. It peeks a byte at a time so it never
+// waits for more than the sender has to send.
+func octetCount(r *bufio.Reader) (int, bool) {
+	digits := len(strconv.Itoa(maxMessageSize))
+	for i := 0; i <= digits; i++ {
+		head, err := r.Peek(i + 1)
+		if err != nil {
+			return 0, false
+		}
+		switch c := head[i]; {
+		case c == ' ' && i > 0:
+			n, err := strconv.Atoi(string(head[:i]))
+			return n, err == nil
+		case c < '0' || c > '9' || (i == 0 && c == '0'):
+			return 0, false
+		}
+	}
+	return 0, false
+}
+
+// Handle method parses a single syslog message and queues the ip found by
+// the first extractor matching it. It reports whether one matched.
+func (s *Server) Handle(data []byte) bool {
+	m, err := Parse(data)
+	if err != nil {
+		return false
+	}
+	line := m.Line()
+	for i, e := range s.extractors {
+		if ip, ok := e.Extract(line); ok {
+			s.ingesters[i].Add(ip)
+			return true
+		}
+	}
+	return false
+}
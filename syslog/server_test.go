@@ -0,0 +1,140 @@
+package syslog
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// queue records the ips queued per source
+type queue struct {
+	mu  sync.Mutex
+	ips map[string][]string
+}
+
+func (q *queue) enqueue(source string, ips []string) (string, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.ips[source] = append(q.ips[source], ips...)
+	return "job", nil
+}
+
+func (q *queue) get() map[string][]string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	got := map[string][]string{}
+	for source, ips := range q.ips {
+		got[source] = append([]string{}, ips...)
+		sort.Strings(got[source])
+	}
+	return got
+}
+
+func newReader(s string) *bufio.Reader {
+	return bufio.NewReaderSize(strings.NewReader(s), maxMessageSize)
+}
+
+// flush queues the ips every extractor of s has pending
+func flush(s *Server) {
+	for _, in := range s.ingesters {
+		in.Flush()
+	}
+}
+
+func TestServer(t *testing.T) {
+	newTestServer := func() (*Server, *queue) {
+		q := &queue{ips: map[string][]string{}}
+		extractors := LoadExtractors([]string{DefaultExtractor, `fw=SRC=([0-9.]+)`})
+		return newServer(q.enqueue, extractors, time.Hour), q
+	}
+
+	t.Run("handle", func(t *testing.T) {
+		s, q := newTestServer()
+		assert.Equal(t, true, s.Handle([]byte("<22>Dec  1 10:00:00 mx1 postfix/smtpd[1]: connect from unknown[192.0.2.1]")))
+		assert.Equal(t, true, s.Handle([]byte("<22>1 2020-12-01T10:00:00Z mx1 postfix/smtpd 1 - - NOQUEUE: reject: RCPT from unknown[192.0.2.1]: 554 blocked")))
+		assert.Equal(t, true, s.Handle([]byte("<4>Dec  1 10:00:00 fw1 kernel: IN=eth0 SRC=192.0.2.9 DST=198.51.100.1")))
+		assert.Equal(t, false, s.Handle([]byte("<4>Dec  1 10:00:00 fw1 kernel: IN=eth0 SRC=10.0.0.9 DST=198.51.100.1")))
+		assert.Equal(t, false, s.Handle([]byte("<4>Dec  1 10:00:00 fw1 sshd[7]: session opened")))
+		assert.Equal(t, false, s.Handle([]byte("<999>garbage")))
+		flush(s)
+		assert.Equal(t, map[string][]string{
+			"syslog/mail": {"192.0.2.1"},
+			"syslog/fw":   {"192.0.2.9"},
+		}, q.get())
+	})
+
+	t.Run("udp_and_tcp", func(t *testing.T) {
+		s, q := newTestServer()
+		ctx, cancel := context.WithCancel(context.Background())
+
+		pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+		require.Equal(t, nil, err)
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		require.Equal(t, nil, err)
+		done := make(chan error, 2)
+		go func() { done <- s.ServeUDP(ctx, pc) }()
+		go func() { done <- s.ServeTCP(ctx, l) }()
+
+		udp, err := net.Dial("udp", pc.LocalAddr().String())
+		require.Equal(t, nil, err)
+		defer udp.Close()
+		_, err = udp.Write([]byte("<22>Dec  1 10:00:00 mx1 postfix/smtpd[1]: connect from unknown[192.0.2.1]"))
+		require.Equal(t, nil, err)
+
+		tcp, err := net.Dial("tcp", l.Addr().String())
+		require.Equal(t, nil, err)
+		defer tcp.Close()
+		framed := "<22>1 - mx1 postfix/smtpd 1 - - connect from unknown[192.0.2.2]"
+		// octet counted (with a newline inside the message) and newline
+		// framed messages on the same connection
+		counted := "<4>1 - fw1 kernel - - - dropped\nSRC=192.0.2.3 DST=198.51.100.1"
+		fmt.Fprintf(tcp, "%d %s", len(framed), framed)
+		fmt.Fprintf(tcp, "%d %s", len(counted), counted)
+		fmt.Fprint(tcp, "<4>Dec  1 10:00:00 fw1 kernel: SRC=192.0.2.4 DST=198.51.100.1\n")
+		fmt.Fprint(tcp, "<22>Dec  1 10:00:00 mx1 postfix/smtpd[1]: connect from unknown[192.0.2.5]\r\n")
+
+		want := map[string][]string{
+			"syslog/mail": {"192.0.2.1", "192.0.2.2", "192.0.2.5"},
+			"syslog/fw":   {"192.0.2.3", "192.0.2.4"},
+		}
+		deadline := time.Now().Add(2 * time.Second)
+		for time.Now().Before(deadline) {
+			flush(s)
+			got := q.get()
+			if len(got["syslog/mail"])+len(got["syslog/fw"]) >= 5 {
+				break
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+		assert.Equal(t, want, q.get())
+
+		cancel()
+		assert.Equal(t, nil, <-done)
+		assert.Equal(t, nil, <-done)
+	})
+
+	t.Run("read_frame", func(t *testing.T) {
+		_, err := readFrame(newReader("99999 <13>too long"))
+		assert.NotEqual(t, nil, err)
+
+		msg, err := readFrame(newReader("2020-12-01 10:00:00 a line starting with digits\n"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, "2020-12-01 10:00:00 a line starting with digits\n", string(msg))
+
+		msg, err = readFrame(newReader("last line without a newline"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, "last line without a newline", string(msg))
+
+		_, err = readFrame(newReader(strings.Repeat("x", maxMessageSize+1)))
+		assert.NotEqual(t, nil, err)
+	})
+}
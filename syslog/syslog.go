@@ -0,0 +1,277 @@
+package syslog
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/alexanderkarlis/sw-dnsbl/maillog"
+)
+
+// DefaultExtractor is the built in extractor, finding the clients of postfix
+// and exim like the mail log ingest does. It is used when SYSLOG_EXTRACTORS is
+// not set, and can be listed there by name alongside regex extractors.
+const DefaultExtractor = "mail"
+
+// ErrEmptyMessage is returned by Parse for a message with no content at all
+var ErrEmptyMessage = errors.New("empty syslog message")
+
+// Message is a syslog message in either the RFC5424 or the older RFC3164
+// (BSD) format
+type Message struct {
+	Facility, Severity int
+	Timestamp          time.Time
+	Hostname, AppName  string
+	ProcID, MsgID      string
+	Content            string
+}
+
+// rfc3164Tag is the `app[pid]: ` prefix of the content of a BSD message
+var rfc3164Tag = regexp.MustCompile(`^([^\s\[\]:]+)(?:\[([^\]\s]*)\])?: ?`)
+
+// Parse function parses a single syslog message, telling RFC5424 and RFC3164
+// apart by the version after the priority. Like rsyslog it is lenient with
+// BSD messages: a missing priority defaults to user.notice and content that
+// doesn't start with a timestamp and hostname is kept as it is.
+func Parse(data []byte) (*Message, error) {
+	s := strings.TrimRight(string(data), "\r\n\x00")
+	if strings.TrimSpace(s) == "" {
+		return nil, ErrEmptyMessage
+	}
+
+	m := &Message{Facility: 1, Severity: 5}
+	if strings.HasPrefix(s, "<") {
+		end := strings.IndexByte(s, '>')
+		if end < 2 || end > 4 {
+			return nil, fmt.Errorf("bad priority in %q", truncate(s))
+		}
+		pri, err := strconv.Atoi(s[1:end])
+		if err != nil || pri > 191 {
+			return nil, fmt.Errorf("bad priority in %q", truncate(s))
+		}
+		m.Facility, m.Severity = pri/8, pri%8
+		s = s[end+1:]
+	}
+
+	if strings.HasPrefix(s, "1 ") {
+		return m, m.parse5424(s[2:])
+	}
+	m.parse3164(s)
+	return m, nil
+}
+
+// parse5424 parses the header, structured data and message following the
+// version of an RFC5424 message
+func (m *Message) parse5424(s string) error {
+	fields := make([]string, 5)
+	for i := range fields {
+		end := strings.IndexByte(s, ' ')
+		if end < 0 {
+			return fmt.Errorf("truncated RFC5424 header %q", truncate(s))
+		}
+		if fields[i] = s[:end]; fields[i] == "-" {
+			fields[i] = ""
+		}
+		s = s[end+1:]
+	}
+	if fields[0] != "" {
+		t, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return fmt.Errorf("bad RFC5424 timestamp %q", fields[0])
+		}
+		m.Timestamp = t
+	}
+	m.Hostname, m.AppName, m.ProcID, m.MsgID = fields[1], fields[2], fields[3], fields[4]
+
+	s, err := skipStructuredData(s)
+	if err != nil {
+		return err
+	}
+	m.Content = strings.TrimPrefix(strings.TrimPrefix(s, " "), "\ufeff")
+	return nil
+}
+
+// skipStructuredData returns what follows the structured data at the start
+// of s, which is either `-` or one or more `[id name="value"...]` elements
+func skipStructuredData(s string) (string, error) {
+	if strings.HasPrefix(s, "-") {
+		return s[1:], nil
+	}
+	for strings.HasPrefix(s, "[") {
+		quoted := false
+		end := -1
+		for i := 1; i < len(s) && end < 0; i++ {
+			switch {
+			case quoted && s[i] == '\\':
+				i++
+			case s[i] == '"':
+				quoted = !quoted
+			case !quoted && s[i] == ']':
+				end = i
+			}
+		}
+		if end < 0 {
+			return "", fmt.Errorf("unterminated RFC5424 structured data %q", truncate(s))
+		}
+		s = s[end+1:]
+	}
+	if s != "" && s[0] != ' ' {
+		return "", fmt.Errorf("bad RFC5424 structured data %q", truncate(s))
+	}
+	return s, nil
+}
+
+// parse3164 parses the `Mmm dd hh:mm:ss host app[pid]: msg` that follows the
+// priority of a BSD message. Senders forwarding with an RFC3339 timestamp
+// instead are understood too.
+func (m *Message) parse3164(s string) {
+	rest, ok := m.parse3164Timestamp(s)
+	if ok {
+		if end := strings.IndexByte(rest, ' '); end > 0 {
+			m.Hostname = rest[:end]
+			s = rest[end+1:]
+		}
+	}
+
+	if tag := rfc3164Tag.FindStringSubmatch(s); tag != nil {
+		m.AppName, m.ProcID = tag[1], tag[2]
+		s = s[len(tag[0]):]
+	}
+	m.Content = s
+}
+
+// parse3164Timestamp parses the timestamp at the start of s, returning what
+// follows it. BSD timestamps have no year, so the one that puts the time
+// closest to now is picked.
+func (m *Message) parse3164Timestamp(s string) (string, bool) {
+	if end := strings.IndexByte(s, ' '); end > 0 {
+		if t, err := time.Parse(time.RFC3339Nano, s[:end]); err == nil {
+			m.Timestamp = t
+			return s[end+1:], true
+		}
+	}
+	if len(s) < len(time.Stamp)+1 || s[len(time.Stamp)] != ' ' {
+		return s, false
+	}
+	t, err := time.ParseInLocation(time.Stamp, s[:len(time.Stamp)], time.Local)
+	if err != nil {
+		return s, false
+	}
+	now := time.Now()
+	t = t.AddDate(now.Year(), 0, 0)
+	if t.Sub(now) > 30*24*time.Hour {
+		t = t.AddDate(-1, 0, 0)
+	}
+	m.Timestamp = t
+	return s[len(time.Stamp)+1:], true
+}
+
+// Line method returns the message as a syslog file would log it after the
+// hostname, e.g. `postfix/smtpd[123]: connect from ...`, which is what
+// extractors are matched against
+func (m *Message) Line() string {
+	switch {
+	case m.AppName == "":
+		return m.Content
+	case m.ProcID == "":
+		return m.AppName + ": " + m.Content
+	}
+	return m.AppName + "[" + m.ProcID + "]: " + m.Content
+}
+
+func truncate(s string) string {
+	if len(s) > 64 {
+		return s[:64] + "..."
+	}
+	return s
+}
+
+// Extractor finds the ip to queue in a syslog message. The jobs it queues
+// are tagged with its name.
+type Extractor struct {
+	Name    string
+	extract func(line string) (string, bool)
+}
+
+// Source method returns the tag of the jobs queued by the extractor
+func (e *Extractor) Source() string {
+	return "syslog/" + e.Name
+}
+
+// Extract method returns the public IPv4 address the extractor finds in line
+func (e *Extractor) Extract(line string) (string, bool) {
+	return e.extract(line)
+}
+
+// ParseExtractor function parses a SYSLOG_EXTRACTORS entry, either
+// `name=regex` or the name of the built in DefaultExtractor. The ip is the
+// regex's `ip` named group, else its first group, else the whole match.
+func ParseExtractor(spec string) (*Extractor, error) {
+	spec = strings.TrimSpace(spec)
+	if spec == DefaultExtractor {
+		return &Extractor{Name: DefaultExtractor, extract: maillog.Extract}, nil
+	}
+
+	parts := strings.SplitN(spec, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("syslog extractor `%s` is not name=regex", spec)
+	}
+	re, err := regexp.Compile(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("syslog extractor %s: %s", parts[0], err)
+	}
+
+	group := 0
+	if re.NumSubexp() > 0 {
+		group = 1
+	}
+	for i, name := range re.SubexpNames() {
+		if name == "ip" {
+			group = i
+		}
+	}
+	return &Extractor{
+		Name: parts[0],
+		extract: func(line string) (string, bool) {
+			m := re.FindStringSubmatch(line)
+			if m == nil {
+				return "", false
+			}
+			ip := net.ParseIP(strings.TrimSpace(m[group])).To4()
+			if ip == nil || !maillog.IsPublic(ip) {
+				return "", false
+			}
+			return ip.String(), true
+		},
+	}, nil
+}
+
+// LoadExtractors function parses the SYSLOG_EXTRACTORS entries, logging and
+// skipping the ones that don't parse. Without any entries the
+// DefaultExtractor is used.
+func LoadExtractors(specs []string) []*Extractor {
+	var extractors []*Extractor
+	configured := false
+	for _, spec := range specs {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		configured = true
+		e, err := ParseExtractor(spec)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		extractors = append(extractors, e)
+	}
+	if !configured {
+		e, _ := ParseExtractor(DefaultExtractor)
+		extractors = append(extractors, e)
+	}
+	return extractors
+}
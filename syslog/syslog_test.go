@@ -0,0 +1,137 @@
+package syslog
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParse(t *testing.T) {
+	t.Run("rfc5424", func(t *testing.T) {
+		m, err := Parse([]byte(`<22>1 2020-12-01T10:00:00.123Z mx1.example.com postfix/smtpd 1234 - [meta sequenceId="1" note="a \"quoted\] value"][origin ip="198.51.100.1"] ` + "\ufeff" + "connect from unknown[192.0.2.1]\n"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 2, m.Facility)
+		assert.Equal(t, 6, m.Severity)
+		assert.Equal(t, time.Date(2020, 12, 1, 10, 0, 0, 123000000, time.UTC), m.Timestamp.UTC())
+		assert.Equal(t, "mx1.example.com", m.Hostname)
+		assert.Equal(t, "postfix/smtpd", m.AppName)
+		assert.Equal(t, "1234", m.ProcID)
+		assert.Equal(t, "", m.MsgID)
+		assert.Equal(t, "connect from unknown[192.0.2.1]", m.Content)
+		assert.Equal(t, "postfix/smtpd[1234]: connect from unknown[192.0.2.1]", m.Line())
+	})
+
+	t.Run("rfc5424_nil_values", func(t *testing.T) {
+		m, err := Parse([]byte("<165>1 - - - - ID47 -"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 20, m.Facility)
+		assert.Equal(t, true, m.Timestamp.IsZero())
+		assert.Equal(t, "ID47", m.MsgID)
+		assert.Equal(t, "", m.Line())
+	})
+
+	t.Run("rfc3164", func(t *testing.T) {
+		m, err := Parse([]byte("<34>Dec  1 10:00:00 mx1 postfix/postscreen[99]: CONNECT from [192.0.2.5]:51234 to [198.51.100.1]:25"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 4, m.Facility)
+		assert.Equal(t, 2, m.Severity)
+		assert.Equal(t, time.December, m.Timestamp.Month())
+		assert.Equal(t, 10, m.Timestamp.Hour())
+		assert.Equal(t, "mx1", m.Hostname)
+		assert.Equal(t, "postfix/postscreen", m.AppName)
+		assert.Equal(t, "99", m.ProcID)
+		assert.Equal(t, "postfix/postscreen[99]: CONNECT from [192.0.2.5]:51234 to [198.51.100.1]:25", m.Line())
+	})
+
+	t.Run("rfc3164_rfc3339_timestamp", func(t *testing.T) {
+		m, err := Parse([]byte("<13>2020-12-01T10:00:00+01:00 fw1 kernel: IN=eth0 SRC=192.0.2.9 DST=198.51.100.1"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, time.Date(2020, 12, 1, 9, 0, 0, 0, time.UTC), m.Timestamp.UTC())
+		assert.Equal(t, "fw1", m.Hostname)
+		assert.Equal(t, "kernel", m.AppName)
+		assert.Equal(t, "kernel: IN=eth0 SRC=192.0.2.9 DST=198.51.100.1", m.Line())
+	})
+
+	t.Run("rfc3164_lenient", func(t *testing.T) {
+		// no priority, timestamp or hostname
+		m, err := Parse([]byte("exim[12]: rejected EHLO from [192.0.2.10]: syntactically invalid"))
+		require.Equal(t, nil, err)
+		assert.Equal(t, 1, m.Facility)
+		assert.Equal(t, 5, m.Severity)
+		assert.Equal(t, "", m.Hostname)
+		assert.Equal(t, "exim", m.AppName)
+		assert.Equal(t, "rejected EHLO from [192.0.2.10]: syntactically invalid", m.Content)
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		for _, data := range []string{
+			"",
+			"\r\n",
+			"<>hello",
+			"<192>1 - - - - - -",
+			"<13 hello",
+			"<13>1 2020-12-01T10:00:00Z host",
+			"<13>1 yesterday host app - - - hi",
+			"<13>1 - host app - - [meta x=\"1\" hi",
+		} {
+			_, err := Parse([]byte(data))
+			assert.NotEqual(t, nil, err, data)
+		}
+	})
+}
+
+func TestExtractor(t *testing.T) {
+	t.Run("regex", func(t *testing.T) {
+		e, err := ParseExtractor(`iptables=SRC=(\d+\.\d+\.\d+\.\d+)`)
+		require.Equal(t, nil, err)
+		assert.Equal(t, "syslog/iptables", e.Source())
+
+		ip, ok := e.Extract("kernel: IN=eth0 SRC=192.0.2.9 DST=198.51.100.1 PROTO=TCP")
+		assert.Equal(t, true, ok)
+		assert.Equal(t, "192.0.2.9", ip)
+		_, ok = e.Extract("kernel: IN=eth0 SRC=10.0.0.1 DST=198.51.100.1 PROTO=TCP")
+		assert.Equal(t, false, ok)
+		_, ok = e.Extract("kernel: IN=eth0 DST=198.51.100.1 PROTO=TCP")
+		assert.Equal(t, false, ok)
+	})
+
+	t.Run("named_group_and_whole_match", func(t *testing.T) {
+		e, err := ParseExtractor(`asa=(Deny|Drop) \w+ src \w+:(?P<ip>[0-9.]+)`)
+		require.Equal(t, nil, err)
+		ip, ok := e.Extract("%ASA-4-106023: Deny tcp src outside:192.0.2.20/4444 dst inside:10.0.0.1/25")
+		assert.Equal(t, true, ok)
+		assert.Equal(t, "192.0.2.20", ip)
+
+		e, err = ParseExtractor(`any=\d+\.\d+\.\d+\.\d+`)
+		require.Equal(t, nil, err)
+		ip, _ = e.Extract("blocked 192.0.2.21 again")
+		assert.Equal(t, "192.0.2.21", ip)
+	})
+
+	t.Run("mail", func(t *testing.T) {
+		e, err := ParseExtractor(DefaultExtractor)
+		require.Equal(t, nil, err)
+		assert.Equal(t, "syslog/mail", e.Source())
+		ip, ok := e.Extract("postfix/smtpd[1]: connect from unknown[192.0.2.1]")
+		assert.Equal(t, true, ok)
+		assert.Equal(t, "192.0.2.1", ip)
+	})
+
+	t.Run("load", func(t *testing.T) {
+		_, err := ParseExtractor("nameless")
+		assert.NotEqual(t, nil, err)
+		_, err = ParseExtractor("broken=(")
+		assert.NotEqual(t, nil, err)
+
+		extractors := LoadExtractors([]string{"fw=SRC=([0-9.]+)", "broken=(", " mail"})
+		require.Equal(t, 2, len(extractors))
+		assert.Equal(t, "fw", extractors[0].Name)
+		assert.Equal(t, "mail", extractors[1].Name)
+
+		extractors = LoadExtractors(nil)
+		require.Equal(t, 1, len(extractors))
+		assert.Equal(t, DefaultExtractor, extractors[0].Name)
+	})
+}